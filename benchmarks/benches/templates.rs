@@ -1,6 +1,10 @@
-use criterion::{black_box, criterion_group, criterion_main, Criterion};
+use criterion::{black_box, criterion_group, criterion_main, Criterion, Throughput};
 use minijinja::machinery::parse;
-use minijinja::{context, Environment, State};
+use minijinja::value::Value;
+use minijinja::{context, Environment, HtmlEscape, Source, State};
+
+/// The number of templates in the inheritance chain of the inheritance benchmark.
+const INHERITANCE_DEPTH: usize = 10;
 
 fn do_parse() {
     parse(
@@ -48,6 +52,121 @@ fn create_real_env() -> Environment<'static> {
     env
 }
 
+fn create_workload_env() -> Environment<'static> {
+    let mut env = Environment::new();
+    let mut source = Source::new();
+    source
+        .add_template("loops.html", include_str!("../inputs/loops.html"))
+        .unwrap();
+    source
+        .add_template("filters.html", include_str!("../inputs/filters.html"))
+        .unwrap();
+    source
+        .add_template(
+            "large_context.html",
+            include_str!("../inputs/large_context.html"),
+        )
+        .unwrap();
+
+    // a chain of templates where every level extends the one before and
+    // calls up to the parent block.
+    source
+        .add_template(
+            "level_0.html",
+            "<div>{% block content %}base{% endblock %}</div>{% block footer %}footer{% endblock %}",
+        )
+        .unwrap();
+    for level in 1..INHERITANCE_DEPTH {
+        source
+            .add_template(
+                format!("level_{}.html", level),
+                format!(
+                    "{{% extends \"level_{}.html\" %}}\
+                     {{% block content %}}[{}]{{{{ super() }}}}{{% endblock %}}",
+                    level - 1,
+                    level
+                ),
+            )
+            .unwrap();
+    }
+    env.set_source(source);
+    env
+}
+
+fn loops_context() -> Value {
+    let rows = (0..100)
+        .map(|row| (0..20).map(|col| row * 20 + col).collect::<Vec<_>>())
+        .collect::<Vec<_>>();
+    context!(rows)
+}
+
+fn filters_context() -> Value {
+    let users = (0..200)
+        .map(|idx| {
+            context! {
+                name => format!("user-{}-name", 200 - idx),
+                email => format!("User{}@Example.COM", idx),
+                active => idx % 3 != 0,
+                tags => (0..idx % 4).map(|tag| format!("tag{}", tag)).collect::<Vec<_>>(),
+                bio => "Lorem ipsum dolor sit amet, consectetur adipiscing elit <b>sed</b> do eiusmod",
+            }
+        })
+        .collect::<Vec<_>>();
+    context!(users)
+}
+
+fn large_context() -> Value {
+    let data = (0..1000)
+        .map(|idx| (format!("key_{}", idx), idx))
+        .collect::<std::collections::BTreeMap<_, _>>();
+    let keys = (0..1000)
+        .step_by(10)
+        .map(|idx| format!("key_{}", idx))
+        .collect::<Vec<_>>();
+    context!(data, keys)
+}
+
+/// Benchmarks rendering a template with a context.
+///
+/// The throughput is reported in bytes of output which makes the numbers
+/// comparable across the workloads.
+fn bench_render(c: &mut Criterion, env: &Environment, name: &str, ctx: Value) {
+    let tmpl = env.get_template(name).unwrap();
+    let output_len = tmpl.render(&ctx).unwrap().len();
+    let mut group = c.benchmark_group("workloads");
+    group.throughput(Throughput::Bytes(output_len as u64));
+    group.bench_function(format!("render {}", name), |b| {
+        b.iter(|| tmpl.render(black_box(&ctx)).unwrap())
+    });
+    group.finish();
+}
+
+pub fn workload_benchmark(c: &mut Criterion) {
+    let env = create_workload_env();
+    bench_render(c, &env, "loops.html", loops_context());
+    bench_render(c, &env, "filters.html", filters_context());
+    bench_render(c, &env, "large_context.html", large_context());
+    bench_render(
+        c,
+        &env,
+        &format!("level_{}.html", INHERITANCE_DEPTH - 1),
+        context!(depth => INHERITANCE_DEPTH),
+    );
+}
+
+pub fn escape_benchmark(c: &mut Criterion) {
+    let clean = "The quick brown fox jumps over the lazy dog, again and again. ".repeat(8);
+    let dirty = "<a href=\"/x\">Tom & Jerry's</a> and some text between tags. ".repeat(8);
+    let mut group = c.benchmark_group("escape");
+    for (name, input) in [("clean", &clean), ("dirty", &dirty)].iter() {
+        group.throughput(Throughput::Bytes(input.len() as u64));
+        group.bench_function(*name, |b| {
+            b.iter(|| HtmlEscape(black_box(input)).to_string())
+        });
+    }
+    group.finish();
+}
+
 pub fn criterion_benchmark(c: &mut Criterion) {
     c.bench_function("parse all_elements", |b| b.iter(|| do_parse()));
     c.bench_function("parse+compile all_elements", |b| {
@@ -59,5 +178,10 @@ pub fn criterion_benchmark(c: &mut Criterion) {
     });
 }
 
-criterion_group!(benches, criterion_benchmark);
+criterion_group!(
+    benches,
+    criterion_benchmark,
+    workload_benchmark,
+    escape_benchmark
+);
 criterion_main!(benches);
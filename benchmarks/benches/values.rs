@@ -0,0 +1,43 @@
+use criterion::{black_box, criterion_group, criterion_main, Criterion};
+use minijinja::value::Value;
+use minijinja::{context, Environment};
+use serde::Serialize;
+
+#[derive(Serialize)]
+struct Row {
+    id: usize,
+    name: String,
+    email: String,
+    active: bool,
+}
+
+fn make_rows(count: usize) -> Vec<Row> {
+    (0..count)
+        .map(|id| Row {
+            id,
+            name: format!("User {}", id),
+            email: format!("user{}@example.com", id),
+            active: id % 3 != 0,
+        })
+        .collect()
+}
+
+pub fn criterion_benchmark(c: &mut Criterion) {
+    let rows = make_rows(1000);
+    c.bench_function("convert 1000 struct rows", |b| {
+        b.iter(|| Value::from_serializable(black_box(&rows)))
+    });
+    c.bench_function("render 1000 struct rows", |b| {
+        let mut env = Environment::new();
+        env.add_template(
+            "rows.html",
+            "{% for row in rows %}{% if row.active %}{{ row.id }}: {{ row.name }} <{{ row.email }}>\n{% endif %}{% endfor %}",
+        )
+        .unwrap();
+        let tmpl = env.get_template("rows.html").unwrap();
+        b.iter(|| tmpl.render(context!(rows => &rows)).unwrap());
+    });
+}
+
+criterion_group!(benches, criterion_benchmark);
+criterion_main!(benches);
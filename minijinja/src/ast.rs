@@ -4,7 +4,7 @@ use std::ops::Deref;
 use std::fmt;
 
 use crate::tokens::Span;
-use crate::value::Value;
+use crate::value::{Value, ValueKind};
 
 /// Container for nodes with location info.
 ///
@@ -53,6 +53,8 @@ pub enum Stmt<'a> {
     Template(Spanned<Template<'a>>),
     EmitExpr(Spanned<EmitExpr<'a>>),
     EmitRaw(Spanned<EmitRaw<'a>>),
+    #[cfg(feature = "unstable_machinery")]
+    Comment(Spanned<Comment<'a>>),
     ForLoop(Spanned<ForLoop<'a>>),
     IfCond(Spanned<IfCond<'a>>),
     WithBlock(Spanned<WithBlock<'a>>),
@@ -62,6 +64,9 @@ pub enum Stmt<'a> {
     Include(Spanned<Include<'a>>),
     AutoEscape(Spanned<AutoEscape<'a>>),
     FilterBlock(Spanned<FilterBlock<'a>>),
+    Component(Spanned<Component<'a>>),
+    Props(Spanned<Props<'a>>),
+    CustomTag(Spanned<CustomTag<'a>>),
 }
 
 #[cfg(feature = "internal_debug")]
@@ -71,6 +76,8 @@ impl<'a> fmt::Debug for Stmt<'a> {
             Stmt::Template(s) => fmt::Debug::fmt(s, f),
             Stmt::EmitExpr(s) => fmt::Debug::fmt(s, f),
             Stmt::EmitRaw(s) => fmt::Debug::fmt(s, f),
+            #[cfg(feature = "unstable_machinery")]
+            Stmt::Comment(s) => fmt::Debug::fmt(s, f),
             Stmt::ForLoop(s) => fmt::Debug::fmt(s, f),
             Stmt::IfCond(s) => fmt::Debug::fmt(s, f),
             Stmt::WithBlock(s) => fmt::Debug::fmt(s, f),
@@ -80,6 +87,9 @@ impl<'a> fmt::Debug for Stmt<'a> {
             Stmt::Include(s) => fmt::Debug::fmt(s, f),
             Stmt::AutoEscape(s) => fmt::Debug::fmt(s, f),
             Stmt::FilterBlock(s) => fmt::Debug::fmt(s, f),
+            Stmt::Component(s) => fmt::Debug::fmt(s, f),
+            Stmt::Props(s) => fmt::Debug::fmt(s, f),
+            Stmt::CustomTag(s) => fmt::Debug::fmt(s, f),
         }
     }
 }
@@ -96,9 +106,11 @@ pub enum Expr<'a> {
     Test(Spanned<Test<'a>>),
     GetAttr(Spanned<GetAttr<'a>>),
     GetItem(Spanned<GetItem<'a>>),
+    Slice(Spanned<Slice<'a>>),
     Call(Spanned<Call<'a>>),
     List(Spanned<List<'a>>),
     Map(Spanned<Map<'a>>),
+    Splat(Spanned<Splat<'a>>),
 }
 
 #[cfg(feature = "internal_debug")]
@@ -114,9 +126,11 @@ impl<'a> fmt::Debug for Expr<'a> {
             Expr::Test(s) => fmt::Debug::fmt(s, f),
             Expr::GetAttr(s) => fmt::Debug::fmt(s, f),
             Expr::GetItem(s) => fmt::Debug::fmt(s, f),
+            Expr::Slice(s) => fmt::Debug::fmt(s, f),
             Expr::Call(s) => fmt::Debug::fmt(s, f),
             Expr::List(s) => fmt::Debug::fmt(s, f),
             Expr::Map(s) => fmt::Debug::fmt(s, f),
+            Expr::Splat(s) => fmt::Debug::fmt(s, f),
         }
     }
 }
@@ -194,6 +208,37 @@ pub struct FilterBlock<'a> {
     pub body: Vec<Stmt<'a>>,
 }
 
+/// Renders a component template with props and slots.
+#[cfg_attr(feature = "internal_debug", derive(Debug))]
+pub struct Component<'a> {
+    pub name: Expr<'a>,
+    pub props: Vec<(&'a str, Expr<'a>)>,
+    pub slots: Vec<(&'a str, Vec<Stmt<'a>>)>,
+    pub body: Vec<Stmt<'a>>,
+}
+
+/// Invokes a custom tag registered on the environment.
+#[cfg_attr(feature = "internal_debug", derive(Debug))]
+pub struct CustomTag<'a> {
+    pub name: &'a str,
+    pub args: Vec<Expr<'a>>,
+    pub body: Option<Vec<Stmt<'a>>>,
+}
+
+/// Declares the props a component accepts.
+#[cfg_attr(feature = "internal_debug", derive(Debug))]
+pub struct Props<'a> {
+    pub props: Vec<Prop<'a>>,
+}
+
+/// A single prop declaration.
+#[cfg_attr(feature = "internal_debug", derive(Debug))]
+pub struct Prop<'a> {
+    pub name: &'a str,
+    pub kind: Option<ValueKind>,
+    pub default: Option<Expr<'a>>,
+}
+
 /// Outputs the expression.
 #[cfg_attr(feature = "internal_debug", derive(Debug))]
 pub struct EmitExpr<'a> {
@@ -206,6 +251,17 @@ pub struct EmitRaw<'a> {
     pub raw: &'a str,
 }
 
+/// A comment.
+///
+/// Comments are only retained by
+/// [`parse_with_comments`](crate::machinery::parse_with_comments), `raw` is
+/// the text between the comment markers.
+#[cfg(feature = "unstable_machinery")]
+#[cfg_attr(feature = "internal_debug", derive(Debug))]
+pub struct Comment<'a> {
+    pub raw: &'a str,
+}
+
 /// Looks up a variable.
 #[cfg_attr(feature = "internal_debug", derive(Debug))]
 pub struct Var<'a> {
@@ -300,6 +356,15 @@ pub struct GetItem<'a> {
     pub subscript_expr: Expr<'a>,
 }
 
+/// A slice expression.
+#[cfg_attr(feature = "internal_debug", derive(Debug))]
+pub struct Slice<'a> {
+    pub expr: Expr<'a>,
+    pub start: Option<Expr<'a>>,
+    pub stop: Option<Expr<'a>>,
+    pub step: Option<Expr<'a>>,
+}
+
 /// Calls something.
 #[cfg_attr(feature = "internal_debug", derive(Debug))]
 pub struct Call<'a> {
@@ -320,6 +385,17 @@ pub struct Map<'a> {
     pub values: Vec<Expr<'a>>,
 }
 
+/// Unpacks a value into the arguments of a call.
+///
+/// This is only valid in argument lists.  `*expr` passes the items of a
+/// sequence as positional arguments, `**expr` the items of a map as
+/// keyword arguments.
+#[cfg_attr(feature = "internal_debug", derive(Debug))]
+pub struct Splat<'a> {
+    pub expr: Expr<'a>,
+    pub kwargs: bool,
+}
+
 /// Defines the specific type of call.
 #[cfg_attr(feature = "internal_debug", derive(Debug))]
 pub enum CallType<'ast, 'source> {
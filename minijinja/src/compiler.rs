@@ -1,13 +1,102 @@
 use std::collections::BTreeMap;
 
 use crate::ast;
-use crate::error::Error;
+use crate::error::{Error, ErrorKind};
 use crate::instructions::{
-    Instruction, Instructions, LOOP_FLAG_RECURSIVE, LOOP_FLAG_WITH_LOOP_VAR,
+    Instruction, Instructions, LOOP_FLAG_PAIRS, LOOP_FLAG_RECURSIVE, LOOP_FLAG_WITH_LOOP_VAR,
 };
 use crate::tokens::Span;
 use crate::utils::matches;
-use crate::value::Value;
+use crate::value::{self, Value};
+
+/// Controls which optimizations the compiler performs.
+///
+/// Optimizations never change what a template renders.  They can however
+/// make the compiled instructions harder to correlate with the template
+/// source which is why they can be turned off.
+#[derive(Debug, Copy, Clone, PartialEq, Eq)]
+pub enum OptimizationLevel {
+    /// Compile templates as they are written.
+    None,
+    /// Fold constant expressions (eg: `{{ 60 * 60 * 24 }}`) and merge
+    /// adjacent template data.  This is the default.
+    Basic,
+}
+
+impl Default for OptimizationLevel {
+    fn default() -> OptimizationLevel {
+        OptimizationLevel::Basic
+    }
+}
+
+/// Evaluates an expression at compile time if it only depends on constants.
+///
+/// Expressions that would fail to evaluate are not folded so that the error
+/// is reported when the template is rendered.
+fn const_eval(expr: &ast::Expr<'_>) -> Option<Value> {
+    match expr {
+        ast::Expr::Const(c) => Some(c.value.clone()),
+        ast::Expr::UnaryOp(c) => {
+            let v = const_eval(&c.expr)?;
+            match c.op {
+                ast::UnaryOpKind::Not => Some(Value::from(!v.is_true())),
+                ast::UnaryOpKind::Neg => value::neg(&v).ok(),
+            }
+        }
+        ast::Expr::BinOp(c) => {
+            let a = const_eval(&c.left)?;
+            let b = const_eval(&c.right)?;
+            match c.op {
+                ast::BinOpKind::Eq => Some(Value::from(a == b)),
+                ast::BinOpKind::Ne => Some(Value::from(a != b)),
+                // unordered comparisons fail in strict mode which is only
+                // known at runtime.
+                ast::BinOpKind::Lt
+                | ast::BinOpKind::Lte
+                | ast::BinOpKind::Gt
+                | ast::BinOpKind::Gte
+                    if a.partial_cmp(&b).is_none() =>
+                {
+                    None
+                }
+                ast::BinOpKind::Lt => Some(Value::from(a < b)),
+                ast::BinOpKind::Lte => Some(Value::from(a <= b)),
+                ast::BinOpKind::Gt => Some(Value::from(a > b)),
+                ast::BinOpKind::Gte => Some(Value::from(a >= b)),
+                ast::BinOpKind::ScAnd => Some(if a.is_true() { b } else { a }),
+                ast::BinOpKind::ScOr => Some(if a.is_true() { a } else { b }),
+                ast::BinOpKind::Add => value::add(&a, &b).ok(),
+                ast::BinOpKind::Sub => value::sub(&a, &b).ok(),
+                ast::BinOpKind::Mul => value::mul(&a, &b).ok(),
+                ast::BinOpKind::Div => value::div(&a, &b).ok(),
+                // integer division by zero and overflowing powers panic in
+                // the engine so they are left for the runtime to report.
+                ast::BinOpKind::FloorDiv | ast::BinOpKind::Rem if !b.is_true() => None,
+                ast::BinOpKind::FloorDiv => value::int_div(&a, &b).ok(),
+                ast::BinOpKind::Rem => value::rem(&a, &b).ok(),
+                ast::BinOpKind::Pow => None,
+                ast::BinOpKind::Concat => Some(value::string_concat(a, &b)),
+                ast::BinOpKind::In => value::contains(&b, &a).ok(),
+            }
+        }
+        ast::Expr::IfExpr(i) => {
+            if const_eval(&i.test_expr)?.is_true() {
+                const_eval(&i.true_expr)
+            } else if let Some(ref false_expr) = i.false_expr {
+                const_eval(false_expr)
+            } else {
+                Some(Value::UNDEFINED)
+            }
+        }
+        ast::Expr::List(l) => l
+            .items
+            .iter()
+            .map(const_eval)
+            .collect::<Option<Vec<_>>>()
+            .map(Value::from),
+        _ => None,
+    }
+}
 
 /// Represents an open block of code that does not yet have updated
 /// jump targets.
@@ -25,6 +114,10 @@ pub struct Compiler<'source> {
     blocks: BTreeMap<&'source str, Instructions<'source>>,
     pending_block: Vec<PendingBlock>,
     current_line: usize,
+    optimization_level: OptimizationLevel,
+    // the most recent jump target.  Instructions must not be merged into
+    // an earlier one if they are jumped to.
+    last_jump_target: usize,
 }
 
 impl<'source> Compiler<'source> {
@@ -35,9 +128,22 @@ impl<'source> Compiler<'source> {
             blocks: BTreeMap::new(),
             pending_block: Vec::new(),
             current_line: 0,
+            optimization_level: OptimizationLevel::default(),
+            last_jump_target: 0,
         }
     }
 
+    /// Sets the optimization level.
+    ///
+    /// Defaults to [`OptimizationLevel::Basic`].
+    pub fn set_optimization_level(&mut self, level: OptimizationLevel) {
+        self.optimization_level = level;
+    }
+
+    fn optimize(&self) -> bool {
+        self.optimization_level != OptimizationLevel::None
+    }
+
     /// Sets the current location's line.
     pub fn set_line(&mut self, lineno: usize) {
         self.current_line = lineno;
@@ -60,8 +166,17 @@ impl<'source> Compiler<'source> {
     }
 
     /// Starts a for loop
+    #[cfg(feature = "unstable_machinery")]
     pub fn start_for_loop(&mut self, with_loop_var: bool, recursive: bool) {
+        self.start_loop(with_loop_var, recursive, false);
+    }
+
+    /// Starts a for loop that optionally unpacks into two targets.
+    fn start_loop(&mut self, with_loop_var: bool, recursive: bool, pairs: bool) {
         let mut flags = 0;
+        if pairs {
+            flags |= LOOP_FLAG_PAIRS;
+        }
         if with_loop_var {
             flags |= LOOP_FLAG_WITH_LOOP_VAR;
         }
@@ -79,6 +194,7 @@ impl<'source> Compiler<'source> {
             Some(PendingBlock::Loop(iter_instr)) => {
                 self.add(Instruction::Jump(iter_instr));
                 let loop_end = self.next_instruction();
+                self.last_jump_target = loop_end;
                 if push_did_iterate {
                     self.add(Instruction::Lookup("loop"));
                     self.add(Instruction::GetAttr("index0"));
@@ -137,6 +253,7 @@ impl<'source> Compiler<'source> {
     /// Ends a short circuited bool block.
     pub fn end_sc_bool(&mut self) {
         let end = self.next_instruction();
+        self.last_jump_target = end;
         if let Some(PendingBlock::ScBool(instructions)) = self.pending_block.pop() {
             for instr in instructions {
                 match self.instructions.get_mut(instr) {
@@ -151,6 +268,7 @@ impl<'source> Compiler<'source> {
     }
 
     fn end_condition(&mut self, jump_instr: usize) {
+        self.last_jump_target = jump_instr;
         match self.pending_block.pop() {
             Some(PendingBlock::Branch(instr)) => match self.instructions.get_mut(instr) {
                 Some(Instruction::JumpIfFalse(ref mut target))
@@ -182,7 +300,10 @@ impl<'source> Compiler<'source> {
                             self.add(Instruction::FastSuper);
                             return Ok(());
                         }
-                        if var.id == "loop" && call.args.len() == 1 {
+                        if var.id == "loop"
+                            && call.args.len() == 1
+                            && !matches!(call.args[0], ast::Expr::Splat(_))
+                        {
                             self.compile_expr(&call.args[0])?;
                             self.add(Instruction::FastRecurse);
                             return Ok(());
@@ -195,10 +316,18 @@ impl<'source> Compiler<'source> {
             }
             ast::Stmt::EmitRaw(raw) => {
                 self.set_location_from_span(raw.span());
-                self.add(Instruction::EmitRaw(raw.raw));
+                if !self.optimize() {
+                    self.add(Instruction::EmitRaw(raw.raw));
+                } else if !raw.raw.is_empty() && !self.merge_raw(raw.raw) {
+                    self.add(Instruction::EmitRaw(raw.raw));
+                }
             }
+            #[cfg(feature = "unstable_machinery")]
+            ast::Stmt::Comment(_) => {}
             ast::Stmt::ForLoop(for_loop) => {
                 self.set_location_from_span(for_loop.span());
+                let pairs = matches!(for_loop.target, ast::Expr::List(ref list)
+                    if list.items.len() == 2 && matches!(list.items[1], ast::Expr::Var(_)));
 
                 if let Some(ref filter_expr) = for_loop.filter_expr {
                     // filter expressions work like a nested for loop without
@@ -206,7 +335,7 @@ impl<'source> Compiler<'source> {
                     // just outside of the loop.
                     self.add(Instruction::BuildList(0));
                     self.compile_expr(&for_loop.iter)?;
-                    self.start_for_loop(false, false);
+                    self.start_loop(false, false, pairs);
                     self.add(Instruction::DupTop);
                     self.compile_assignment(&for_loop.target)?;
                     self.compile_expr(filter_expr)?;
@@ -220,7 +349,7 @@ impl<'source> Compiler<'source> {
                     self.compile_expr(&for_loop.iter)?;
                 }
 
-                self.start_for_loop(true, for_loop.recursive);
+                self.start_loop(true, for_loop.recursive, pairs);
                 self.compile_assignment(&for_loop.target)?;
                 for node in &for_loop.body {
                     self.compile_stmt(node)?;
@@ -271,6 +400,7 @@ impl<'source> Compiler<'source> {
                 let mut sub_compiler =
                     Compiler::new(self.instructions.name(), self.instructions.source());
                 sub_compiler.set_line(self.current_line);
+                sub_compiler.set_optimization_level(self.optimization_level);
                 for node in &block.body {
                     sub_compiler.compile_stmt(node)?;
                 }
@@ -309,6 +439,68 @@ impl<'source> Compiler<'source> {
                 self.compile_expr(&filter_block.filter)?;
                 self.add(Instruction::Emit);
             }
+            ast::Stmt::Component(component) => {
+                self.set_location_from_span(component.span());
+                self.compile_expr(&component.name)?;
+                for (name, expr) in &component.props {
+                    self.add(Instruction::LoadConst(Value::from(*name)));
+                    self.compile_expr(expr)?;
+                }
+                self.add(Instruction::LoadConst(Value::from("slots")));
+                let default_slot = ("default", &component.body);
+                for (name, body) in component
+                    .slots
+                    .iter()
+                    .map(|(name, body)| (*name, body))
+                    .chain(Some(default_slot))
+                {
+                    self.add(Instruction::LoadConst(Value::from(name)));
+                    self.add(Instruction::BeginCapture);
+                    for node in body {
+                        self.compile_stmt(node)?;
+                    }
+                    self.add(Instruction::EndCapture);
+                }
+                self.add(Instruction::BuildMap(component.slots.len() + 1));
+                self.add(Instruction::BuildMap(component.props.len() + 1));
+                self.add(Instruction::RenderComponent);
+            }
+            ast::Stmt::CustomTag(tag) => {
+                self.set_location_from_span(tag.span());
+                for arg in &tag.args {
+                    self.compile_expr(arg)?;
+                }
+                self.add(Instruction::BuildList(tag.args.len()));
+                let enter_instr = self.add(Instruction::EnterTag(tag.name, !0));
+                if let Some(ref body) = tag.body {
+                    self.add(Instruction::BeginCapture);
+                    for node in body {
+                        self.compile_stmt(node)?;
+                    }
+                    self.add(Instruction::EndCapture);
+                }
+                self.add(Instruction::ExitTag(tag.name, tag.body.is_some()));
+                let tag_end = self.next_instruction();
+                self.last_jump_target = tag_end;
+                if let Some(Instruction::EnterTag(_, ref mut target)) =
+                    self.instructions.get_mut(enter_instr)
+                {
+                    *target = tag_end;
+                }
+            }
+            ast::Stmt::Props(props) => {
+                self.set_location_from_span(props.span());
+                for prop in &props.props {
+                    if let Some(ref default) = prop.default {
+                        self.compile_expr(default)?;
+                    }
+                    self.add(Instruction::DeclareProp(
+                        prop.name,
+                        prop.kind,
+                        prop.default.is_some(),
+                    ));
+                }
+            }
         }
         Ok(())
     }
@@ -322,18 +514,98 @@ impl<'source> Compiler<'source> {
             }
             ast::Expr::List(list) => {
                 self.set_location_from_span(list.span());
-                self.add(Instruction::UnpackList(list.items.len()));
+                match list
+                    .items
+                    .iter()
+                    .position(|x| matches!(x, ast::Expr::Splat(_)))
+                {
+                    Some(star) => self.add(Instruction::UnpackListStarred(
+                        star,
+                        list.items.len() - star - 1,
+                    )),
+                    None => self.add(Instruction::UnpackList(list.items.len())),
+                };
                 for expr in &list.items {
                     self.compile_assignment(expr)?;
                 }
             }
+            ast::Expr::Splat(splat) => {
+                self.compile_assignment(&splat.expr)?;
+            }
+            ast::Expr::GetAttr(attr) => {
+                self.set_location_from_span(attr.span());
+                self.compile_expr(&attr.expr)?;
+                self.add(Instruction::SetAttr(attr.name));
+            }
             _ => panic!("bad assignment target"),
         }
         Ok(())
     }
 
+    /// Merges raw template data into the previous instruction.
+    ///
+    /// This is only possible if the previous instruction emits the template
+    /// data right in front of this one in the source and it's not the target
+    /// of a jump.  Returns `false` if the data could not be merged.
+    fn merge_raw(&mut self, raw: &'source str) -> bool {
+        let idx = self.next_instruction();
+        if idx == 0 || self.last_jump_target == idx {
+            return false;
+        }
+        let source = self.instructions.source();
+        let source_start = source.as_ptr() as usize;
+        let offset_of = |s: &str| {
+            let start = s.as_ptr() as usize;
+            if start >= source_start && start + s.len() <= source_start + source.len() {
+                Some(start - source_start)
+            } else {
+                None
+            }
+        };
+        if let Some(Instruction::EmitRaw(prev)) = self.instructions.get(idx - 1) {
+            if let (Some(prev_start), Some(start)) = (offset_of(prev), offset_of(raw)) {
+                if prev_start + prev.len() == start {
+                    let merged = &source[prev_start..start + raw.len()];
+                    *self.instructions.get_mut(idx - 1).unwrap() = Instruction::EmitRaw(merged);
+                    return true;
+                }
+            }
+        }
+        false
+    }
+
+    /// Compiles an expression that is checked for being defined.
+    ///
+    /// Attributes and items of undefined values are undefined here instead
+    /// of failing so that `foo.bar is defined` and `foo.bar|default(42)`
+    /// work if `foo` is undefined.
+    /// The subscript expressions are compiled normally.
+    fn compile_probe_expr(&mut self, expr: &ast::Expr<'source>) -> Result<(), Error> {
+        match expr {
+            ast::Expr::GetAttr(g) => {
+                self.set_location_from_span(g.span());
+                self.compile_probe_expr(&g.expr)?;
+                self.add(Instruction::ProbeAttr(g.name));
+            }
+            ast::Expr::GetItem(g) => {
+                self.set_location_from_span(g.span());
+                self.compile_probe_expr(&g.expr)?;
+                self.compile_expr(&g.subscript_expr)?;
+                self.add(Instruction::ProbeItem);
+            }
+            _ => self.compile_expr(expr)?,
+        }
+        Ok(())
+    }
+
     /// Compiles an expression.
     pub fn compile_expr(&mut self, expr: &ast::Expr<'source>) -> Result<(), Error> {
+        if self.optimize() && !matches!(expr, ast::Expr::Const(_)) {
+            if let Some(value) = const_eval(expr) {
+                self.add(Instruction::LoadConst(value));
+                return Ok(());
+            }
+        }
         match expr {
             ast::Expr::Var(v) => {
                 self.set_location_from_span(v.span());
@@ -398,21 +670,23 @@ impl<'source> Compiler<'source> {
             ast::Expr::Filter(f) => {
                 self.set_location_from_span(f.span());
                 if let Some(ref expr) = f.expr {
-                    self.compile_expr(expr)?;
-                }
-                for arg in &f.args {
-                    self.compile_expr(arg)?;
+                    if matches!(f.name, "default" | "d") {
+                        self.compile_probe_expr(expr)?;
+                    } else {
+                        self.compile_expr(expr)?;
+                    }
                 }
-                self.add(Instruction::BuildList(f.args.len()));
+                self.compile_call_args(&f.args)?;
                 self.add(Instruction::ApplyFilter(f.name));
             }
             ast::Expr::Test(f) => {
                 self.set_location_from_span(f.span());
-                self.compile_expr(&f.expr)?;
-                for arg in &f.args {
-                    self.compile_expr(arg)?;
+                if matches!(f.name, "defined" | "undefined") {
+                    self.compile_probe_expr(&f.expr)?;
+                } else {
+                    self.compile_expr(&f.expr)?;
                 }
-                self.add(Instruction::BuildList(f.args.len()));
+                self.compile_call_args(&f.args)?;
                 self.add(Instruction::PerformTest(f.name));
             }
             ast::Expr::GetAttr(g) => {
@@ -426,14 +700,23 @@ impl<'source> Compiler<'source> {
                 self.compile_expr(&g.subscript_expr)?;
                 self.add(Instruction::GetItem);
             }
+            ast::Expr::Slice(s) => {
+                self.set_location_from_span(s.span());
+                self.compile_expr(&s.expr)?;
+                for part in [&s.start, &s.stop, &s.step].iter() {
+                    if let Some(part) = part {
+                        self.compile_expr(part)?;
+                    } else {
+                        self.add(Instruction::LoadConst(Value::from(())));
+                    }
+                }
+                self.add(Instruction::Slice);
+            }
             ast::Expr::Call(c) => {
                 self.set_location_from_span(c.span());
                 match c.identify_call() {
                     ast::CallType::Function(name) => {
-                        for arg in &c.args {
-                            self.compile_expr(arg)?;
-                        }
-                        self.add(Instruction::BuildList(c.args.len()));
+                        self.compile_call_args(&c.args)?;
                         self.add(Instruction::CallFunction(name));
                     }
                     ast::CallType::Block(name) => {
@@ -443,14 +726,12 @@ impl<'source> Compiler<'source> {
                     }
                     ast::CallType::Method(expr, name) => {
                         self.compile_expr(expr)?;
-                        for arg in &c.args {
-                            self.compile_expr(arg)?;
-                        }
-                        self.add(Instruction::BuildList(c.args.len()));
+                        self.compile_call_args(&c.args)?;
                         self.add(Instruction::CallMethod(name));
                     }
                     ast::CallType::Object(expr) => {
                         self.compile_expr(expr)?;
+                        self.compile_call_args(&c.args)?;
                         self.add(Instruction::CallObject);
                     }
                 }
@@ -471,6 +752,53 @@ impl<'source> Compiler<'source> {
                 }
                 self.add(Instruction::BuildMap(m.keys.len()));
             }
+            ast::Expr::Splat(s) => {
+                let mut err = Error::new(
+                    ErrorKind::SyntaxError,
+                    "argument splats are only allowed in calls",
+                );
+                err.set_location(self.instructions.name(), s.span().start_line);
+                return Err(err);
+            }
+        }
+        Ok(())
+    }
+
+    /// Compiles the arguments of a call into a list.
+    ///
+    /// Without splats the arguments are built into a list directly.  With
+    /// splats the list is extended at runtime and all keyword arguments are
+    /// merged into the trailing map.
+    fn compile_call_args(&mut self, args: &[ast::Expr<'source>]) -> Result<(), Error> {
+        if !args.iter().any(|arg| matches!(arg, ast::Expr::Splat(_))) {
+            for arg in args {
+                self.compile_expr(arg)?;
+            }
+            self.add(Instruction::BuildList(args.len()));
+            return Ok(());
+        }
+
+        self.add(Instruction::BuildList(0));
+        let mut kwargs_chunks = 0;
+        for arg in args {
+            match arg {
+                ast::Expr::Splat(splat) => {
+                    self.compile_expr(&splat.expr)?;
+                    self.set_location_from_span(splat.span());
+                    if splat.kwargs {
+                        kwargs_chunks += 1;
+                    } else {
+                        self.add(Instruction::ListExtend);
+                    }
+                }
+                arg => {
+                    self.compile_expr(arg)?;
+                    self.add(Instruction::ListAppend);
+                }
+            }
+        }
+        if kwargs_chunks > 0 {
+            self.add(Instruction::MergeKwargs(kwargs_chunks));
         }
         Ok(())
     }
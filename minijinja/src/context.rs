@@ -19,6 +19,23 @@
 ///
 /// The return value is a [`Value`](crate::value::Value).
 ///
+/// Other contexts (or any other map) can be spread into the context with
+/// `..base` after the keys.  Keys given explicitly take precedence over
+/// spread ones, and earlier spreads take precedence over later ones.  This
+/// is the same as passing the spread values in reverse order and then the
+/// explicit keys to [`merge_maps`](crate::value::merge_maps):
+///
+/// ```rust
+/// # use minijinja::context;
+/// let defaults = context! { title => "Untitled", lang => "en" };
+/// let ctx = context! { title => "Hello", ..defaults };
+/// assert_eq!(ctx.get_attr("title").unwrap().as_str(), Some("Hello"));
+/// assert_eq!(ctx.get_attr("lang").unwrap().as_str(), Some("en"));
+/// ```
+///
+/// Values in the context take precedence over the globals of the
+/// environment.
+///
 /// Note that [`context!`] can also be used recursively if you need to
 /// create nested objects:
 ///
@@ -34,6 +51,25 @@
 /// ```
 #[macro_export]
 macro_rules! context {
+    (
+        $(.. $base:expr),+ $(,)?
+    ) => {{
+        let mut maps = vec![$($crate::value::Value::from_serializable(&$base)),+];
+        maps.reverse();
+        $crate::value::merge_maps(maps)
+    }};
+    (
+        $($key:ident $(=> $value:expr)?,)+ $(.. $base:expr),+ $(,)?
+    ) => {{
+        let mut ctx = std::collections::BTreeMap::<&str, $crate::value::Value>::new();
+        $(
+            $crate::__pair!(ctx, $key $(, $value)?);
+        )*
+        let mut maps = vec![$($crate::value::Value::from_serializable(&$base)),+];
+        maps.reverse();
+        maps.push($crate::value::Value::from(ctx));
+        $crate::value::merge_maps(maps)
+    }};
     (
         $($key:ident $(=> $value:expr)?),* $(,)?
     ) => {{
@@ -67,3 +103,20 @@ fn test_macro() {
     assert_eq!(ctx.get_attr("var1").unwrap(), Value::from(23));
     assert_eq!(ctx.get_attr("var2").unwrap(), Value::from(42));
 }
+
+#[test]
+#[deny(unused_mut)]
+fn test_macro_spread() {
+    use crate::value::Value;
+    let base = context!(a => 1, b => 1, c => 1);
+    let other = context!(b => 2, c => 2);
+    let ctx = context!(c => 3, ..other, ..base);
+    assert_eq!(ctx.get_attr("a").unwrap(), Value::from(1));
+    assert_eq!(ctx.get_attr("b").unwrap(), Value::from(2));
+    assert_eq!(ctx.get_attr("c").unwrap(), Value::from(3));
+    let ctx = context!(..base,);
+    assert_eq!(ctx.get_attr("c").unwrap(), Value::from(1));
+    let ctx = context!(..other, ..base);
+    assert_eq!(ctx.get_attr("a").unwrap(), Value::from(1));
+    assert_eq!(ctx.get_attr("b").unwrap(), Value::from(2));
+}
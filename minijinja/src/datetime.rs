@@ -0,0 +1,755 @@
+//! Implements the datetime and duration objects.
+//!
+//! There is no timezone database so only UTC and fixed offsets are
+//! supported.  Calendar conversions use the proleptic Gregorian calendar.
+
+use std::cmp::Ordering;
+use std::convert::TryFrom;
+use std::fmt::{self, Write};
+use std::time::{SystemTime, UNIX_EPOCH};
+
+use crate::error::{Error, ErrorKind};
+use crate::value::{as_f64, Object, Value, ValueRepr};
+use crate::vm::State;
+
+const WEEKDAYS: [&str; 7] = [
+    "Monday",
+    "Tuesday",
+    "Wednesday",
+    "Thursday",
+    "Friday",
+    "Saturday",
+    "Sunday",
+];
+const MONTHS: [&str; 12] = [
+    "January",
+    "February",
+    "March",
+    "April",
+    "May",
+    "June",
+    "July",
+    "August",
+    "September",
+    "October",
+    "November",
+    "December",
+];
+
+const NANOS_PER_SEC: i128 = 1_000_000_000;
+
+// datetimes store seconds as i64, leave room for the UTC offset which is
+// added to the seconds for calendar calculations
+const MAX_SECS: i64 = i64::MAX - 86_400;
+const MAX_NANOS: i128 = MAX_SECS as i128 * NANOS_PER_SEC;
+
+/// A point in time with a fixed UTC offset.
+///
+/// Datetimes are returned by the `now()` global function and can also be
+/// passed to templates with [`Value::from_object`].  In templates they
+/// expose `year`, `month`, `day`, `hour`, `minute`, `second`,
+/// `microsecond`, `weekday` (`0` is Monday), `timestamp` and `offset` (in
+/// seconds) as attributes and have `strftime(format)`, `isoformat()` and
+/// `astimezone(tz)` methods.
+///
+/// Two datetimes compare by the instant they represent regardless of their
+/// offset.  They can also be compared with strings in RFC 3339 format.
+/// Subtracting two datetimes yields a [`Duration`], adding or subtracting a
+/// duration or a number of seconds yields a new datetime.
+///
+/// ```
+/// # use minijinja::{Environment, value::{DateTime, Value}};
+/// let mut env = Environment::new();
+/// env.add_template("t.txt", "{{ dt.strftime('%Y-%m-%d %H:%M') }}").unwrap();
+/// let dt = DateTime::from_timestamp(1_000_000_000, 0).with_offset(3600).unwrap();
+/// let rv = env.get_template("t.txt").unwrap()
+///     .render(minijinja::context!(dt => Value::from_object(dt))).unwrap();
+/// assert_eq!(rv, "2001-09-09 02:46");
+/// ```
+#[derive(Clone, Copy, PartialEq, Eq, Hash)]
+pub struct DateTime {
+    secs: i64,
+    nanos: u32,
+    offset: i32,
+}
+
+/// The broken down local representation of a datetime.
+struct Fields {
+    year: i64,
+    month: u32,
+    day: u32,
+    hour: u32,
+    minute: u32,
+    second: u32,
+    weekday: u32,
+    yearday: u32,
+}
+
+impl DateTime {
+    /// Creates a UTC datetime from a unix timestamp.
+    pub fn from_timestamp(secs: i64, nanos: u32) -> DateTime {
+        DateTime {
+            secs: secs + (nanos / 1_000_000_000) as i64,
+            nanos: nanos % 1_000_000_000,
+            offset: 0,
+        }
+    }
+
+    /// Returns the current time in UTC.
+    pub fn now() -> DateTime {
+        match SystemTime::now().duration_since(UNIX_EPOCH) {
+            Ok(d) => DateTime::from_timestamp(d.as_secs() as i64, d.subsec_nanos()),
+            Err(err) => {
+                let d = err.duration();
+                let (secs, nanos) = (d.as_secs() as i64, d.subsec_nanos());
+                if nanos == 0 {
+                    DateTime::from_timestamp(-secs, 0)
+                } else {
+                    DateTime::from_timestamp(-secs - 1, 1_000_000_000 - nanos)
+                }
+            }
+        }
+    }
+
+    /// Returns the same instant with another UTC offset in seconds.
+    ///
+    /// Offsets must be less than a day.
+    pub fn with_offset(self, offset: i32) -> Option<DateTime> {
+        if offset.abs() >= 86400 {
+            None
+        } else {
+            Some(DateTime { offset, ..self })
+        }
+    }
+
+    /// Returns the same instant in the given timezone.
+    ///
+    /// Accepted are `UTC`, `Z` and fixed offsets such as `+02:00` or
+    /// `-0530`.
+    pub fn with_timezone(self, tz: &str) -> Result<DateTime, Error> {
+        parse_offset(tz)
+            .and_then(|offset| self.with_offset(offset))
+            .ok_or_else(|| {
+                Error::new(
+                    ErrorKind::InvalidArguments,
+                    format!("unknown timezone {:?}", tz),
+                )
+            })
+    }
+
+    /// Parses a datetime in RFC 3339 format.
+    ///
+    /// A space can be used instead of the `T` separator, the time and the
+    /// fractional seconds are optional and so is the offset in which case
+    /// UTC is assumed.
+    pub fn parse(s: &str) -> Option<DateTime> {
+        let b = s.as_bytes();
+        let num = |start: usize, len: usize| -> Option<u32> {
+            let part = b.get(start..start + len)?;
+            if !part.iter().all(|c| c.is_ascii_digit()) {
+                return None;
+            }
+            part.iter()
+                .try_fold(0u32, |acc, c| Some(acc * 10 + (c - b'0') as u32))
+        };
+        if b.len() < 10 || b[4] != b'-' || b[7] != b'-' {
+            return None;
+        }
+        let year = num(0, 4)? as i64;
+        let month = num(5, 2)?;
+        let day = num(8, 2)?;
+        if month < 1 || month > 12 || day < 1 || day > days_in_month(year, month) {
+            return None;
+        }
+        let mut secs = days_from_civil(year, month, day) * 86400;
+        let mut nanos = 0;
+        let mut rest = &s[10..];
+        if !rest.is_empty() {
+            if !rest.starts_with('T') && !rest.starts_with('t') && !rest.starts_with(' ') {
+                return None;
+            }
+            let b = rest.as_bytes();
+            if b.len() < 9 || b[3] != b':' || b[6] != b':' {
+                return None;
+            }
+            let hour = num(11, 2)?;
+            let minute = num(14, 2)?;
+            let second = num(17, 2)?;
+            if hour > 23 || minute > 59 || second > 59 {
+                return None;
+            }
+            secs += (hour * 3600 + minute * 60 + second) as i64;
+            rest = &rest[9..];
+            if rest.starts_with('.') {
+                let digits = rest[1..].bytes().take_while(|c| c.is_ascii_digit()).count();
+                if digits == 0 {
+                    return None;
+                }
+                for (idx, c) in rest[1..=digits].bytes().take(9).enumerate() {
+                    nanos += (c - b'0') as u32 * 10u32.pow(8 - idx as u32);
+                }
+                rest = &rest[digits + 1..];
+            }
+        }
+        let offset = if rest.is_empty() {
+            0
+        } else {
+            parse_offset(rest)?
+        };
+        DateTime::from_timestamp(secs - offset as i64, nanos).with_offset(offset)
+    }
+
+    /// Returns the unix timestamp in seconds.
+    pub fn timestamp(&self) -> i64 {
+        self.secs
+    }
+
+    /// Returns the nanoseconds since the last full second.
+    pub fn subsec_nanos(&self) -> u32 {
+        self.nanos
+    }
+
+    /// Returns the UTC offset in seconds.
+    pub fn offset(&self) -> i32 {
+        self.offset
+    }
+
+    /// Returns the datetime moved by a duration.
+    pub(crate) fn checked_add(&self, duration: Duration) -> Option<DateTime> {
+        let nanos =
+            (self.secs as i128 * NANOS_PER_SEC + self.nanos as i128).checked_add(duration.nanos)?;
+        if nanos.abs() > MAX_NANOS {
+            return None;
+        }
+        DateTime::from_timestamp(
+            i64::try_from(nanos.div_euclid(NANOS_PER_SEC)).ok()?,
+            nanos.rem_euclid(NANOS_PER_SEC) as u32,
+        )
+        .with_offset(self.offset)
+    }
+
+    /// Returns the duration that passed since another datetime.
+    pub(crate) fn since(&self, other: &DateTime) -> Duration {
+        Duration {
+            nanos: (self.secs as i128 - other.secs as i128) * NANOS_PER_SEC
+                + (self.nanos as i128 - other.nanos as i128),
+        }
+    }
+
+    fn fields(&self) -> Fields {
+        let local = self.secs + self.offset as i64;
+        let days = local.div_euclid(86400);
+        let secs = local.rem_euclid(86400) as u32;
+        let (year, month, day) = civil_from_days(days);
+        Fields {
+            year,
+            month,
+            day,
+            hour: secs / 3600,
+            minute: secs / 60 % 60,
+            second: secs % 60,
+            weekday: (days + 3).rem_euclid(7) as u32,
+            yearday: (days - days_from_civil(year, 1, 1)) as u32 + 1,
+        }
+    }
+
+    /// Formats the datetime with `strftime` style directives.
+    ///
+    /// Supported are `%Y`, `%y`, `%m`, `%d`, `%e`, `%H`, `%I`, `%M`, `%S`,
+    /// `%f`, `%p`, `%a`, `%A`, `%b`, `%B`, `%j`, `%w`, `%z`, `%Z`, `%F`,
+    /// `%T`, `%s` and `%%`.
+    pub fn format(&self, fmt: &str) -> Result<String, Error> {
+        let f = self.fields();
+        let mut rv = String::with_capacity(fmt.len() + 16);
+        let mut chars = fmt.chars();
+        while let Some(c) = chars.next() {
+            if c != '%' {
+                rv.push(c);
+                continue;
+            }
+            match chars.next() {
+                Some('Y') => write!(rv, "{:04}", f.year),
+                Some('y') => write!(rv, "{:02}", f.year.rem_euclid(100)),
+                Some('m') => write!(rv, "{:02}", f.month),
+                Some('d') => write!(rv, "{:02}", f.day),
+                Some('e') => write!(rv, "{:2}", f.day),
+                Some('H') => write!(rv, "{:02}", f.hour),
+                Some('I') => write!(rv, "{:02}", (f.hour + 11) % 12 + 1),
+                Some('M') => write!(rv, "{:02}", f.minute),
+                Some('S') => write!(rv, "{:02}", f.second),
+                Some('f') => write!(rv, "{:06}", self.nanos / 1000),
+                Some('p') => rv.write_str(if f.hour < 12 { "AM" } else { "PM" }),
+                Some('a') => rv.write_str(&WEEKDAYS[f.weekday as usize][..3]),
+                Some('A') => rv.write_str(WEEKDAYS[f.weekday as usize]),
+                Some('b') => rv.write_str(&MONTHS[f.month as usize - 1][..3]),
+                Some('B') => rv.write_str(MONTHS[f.month as usize - 1]),
+                Some('j') => write!(rv, "{:03}", f.yearday),
+                Some('w') => write!(rv, "{}", (f.weekday + 1) % 7),
+                Some('z') => write_offset(&mut rv, self.offset, ""),
+                Some('Z') if self.offset == 0 => rv.write_str("UTC"),
+                Some('Z') => write_offset(&mut rv, self.offset, ":"),
+                Some('F') => write!(rv, "{:04}-{:02}-{:02}", f.year, f.month, f.day),
+                Some('T') => write!(rv, "{:02}:{:02}:{:02}", f.hour, f.minute, f.second),
+                Some('s') => write!(rv, "{}", self.secs),
+                Some('%') => rv.write_str("%"),
+                other => {
+                    return Err(Error::new(
+                        ErrorKind::InvalidArguments,
+                        match other {
+                            Some(c) => format!("unsupported format directive %{}", c),
+                            None => "incomplete format directive".into(),
+                        },
+                    ))
+                }
+            }
+            .unwrap();
+        }
+        Ok(rv)
+    }
+}
+
+impl fmt::Debug for DateTime {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        write!(f, "DateTime({})", self)
+    }
+}
+
+impl fmt::Display for DateTime {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        let fields = self.fields();
+        write!(
+            f,
+            "{:04}-{:02}-{:02}T{:02}:{:02}:{:02}",
+            fields.year, fields.month, fields.day, fields.hour, fields.minute, fields.second
+        )?;
+        if self.nanos >= 1000 {
+            write!(f, ".{:06}", self.nanos / 1000)?;
+        }
+        let mut offset = String::new();
+        write_offset(&mut offset, self.offset, ":")?;
+        f.write_str(&offset)
+    }
+}
+
+impl Object for DateTime {
+    fn get_attr(&self, name: &str) -> Option<Value> {
+        let f = self.fields();
+        Some(match name {
+            "year" => Value::from(f.year),
+            "month" => Value::from(f.month),
+            "day" => Value::from(f.day),
+            "hour" => Value::from(f.hour),
+            "minute" => Value::from(f.minute),
+            "second" => Value::from(f.second),
+            "microsecond" => Value::from(self.nanos / 1000),
+            "weekday" => Value::from(f.weekday),
+            "timestamp" => Value::from(self.secs),
+            "offset" => Value::from(self.offset),
+            _ => return None,
+        })
+    }
+
+    fn attributes(&self) -> &[&str] {
+        &[
+            "year",
+            "month",
+            "day",
+            "hour",
+            "minute",
+            "second",
+            "microsecond",
+            "weekday",
+            "timestamp",
+            "offset",
+        ][..]
+    }
+
+    fn call_method(&self, _state: &State, name: &str, args: Vec<Value>) -> Result<Value, Error> {
+        let arg = match (name, &args[..]) {
+            ("isoformat", []) => return Ok(Value::from(self.to_string())),
+            ("strftime", [arg]) | ("astimezone", [arg]) => arg.as_str().ok_or_else(|| {
+                Error::new(
+                    ErrorKind::InvalidArguments,
+                    format!("{} expects a string argument", name),
+                )
+            })?,
+            ("isoformat", _) | ("strftime", _) | ("astimezone", _) => {
+                return Err(Error::new(
+                    ErrorKind::InvalidArguments,
+                    format!("wrong number of arguments for {}", name),
+                ))
+            }
+            _ => {
+                return Err(Error::new(
+                    ErrorKind::ImpossibleOperation,
+                    format!("datetime has no method named {}", name),
+                ))
+            }
+        };
+        if name == "strftime" {
+            self.format(arg).map(Value::from)
+        } else {
+            self.with_timezone(arg).map(Value::from_object)
+        }
+    }
+
+    fn eq_value(&self, other: &Value) -> Option<bool> {
+        self.cmp_value(other).map(|x| x == Ordering::Equal)
+    }
+
+    fn cmp_value(&self, other: &Value) -> Option<Ordering> {
+        let other = as_datetime(other)?;
+        Some((self.secs, self.nanos).cmp(&(other.secs, other.nanos)))
+    }
+}
+
+/// Interprets a value as datetime.
+///
+/// Datetime objects and strings in RFC 3339 format are accepted.
+pub(crate) fn as_datetime(value: &Value) -> Option<DateTime> {
+    match value.0 {
+        ValueRepr::String(ref s) | ValueRepr::SafeString(ref s) => DateTime::parse(s),
+        _ => value.downcast_object_ref::<DateTime>().copied(),
+    }
+}
+
+/// A signed span of time.
+///
+/// Durations are the result of subtracting two [`DateTime`]s and can be
+/// created from [`std::time::Duration`] with [`Value::from`].  They render
+/// in a human readable form (eg: `2 days 3 hours`) and expose `days`,
+/// `seconds` and `microseconds` (normalized like Python's `timedelta`) as
+/// well as `total_seconds` as attributes.
+///
+/// Durations compare with other durations and with numbers which are
+/// interpreted as seconds.  They can be added to and subtracted from
+/// datetimes and other durations and multiplied by numbers.
+///
+/// ```
+/// # use minijinja::{Environment, value::Value};
+/// let mut env = Environment::new();
+/// env.add_template("t.txt", "up for {{ uptime }}").unwrap();
+/// let uptime = std::time::Duration::from_secs(93_784);
+/// let rv = env.get_template("t.txt").unwrap()
+///     .render(minijinja::context!(uptime => Value::from(uptime))).unwrap();
+/// assert_eq!(rv, "up for 1 day 2 hours 3 minutes 4 seconds");
+/// ```
+#[derive(Clone, Copy, PartialEq, Eq, PartialOrd, Ord, Hash)]
+pub struct Duration {
+    nanos: i128,
+}
+
+const UNITS: [(&str, i128); 5] = [
+    ("day", 86_400 * NANOS_PER_SEC),
+    ("hour", 3600 * NANOS_PER_SEC),
+    ("minute", 60 * NANOS_PER_SEC),
+    ("second", NANOS_PER_SEC),
+    ("millisecond", 1_000_000),
+];
+
+impl Duration {
+    /// Creates a duration from (possibly fractional or negative) seconds.
+    pub fn from_secs_f64(secs: f64) -> Option<Duration> {
+        let nanos = secs * 1e9;
+        if nanos.is_finite() && nanos.abs() <= MAX_NANOS as f64 {
+            Some(Duration {
+                nanos: nanos.round() as i128,
+            })
+        } else {
+            None
+        }
+    }
+
+    /// Returns the duration in seconds.
+    pub fn as_secs_f64(&self) -> f64 {
+        self.nanos as f64 / 1e9
+    }
+
+    /// Returns the duration in nanoseconds.
+    pub fn as_nanos(&self) -> i128 {
+        self.nanos
+    }
+
+    /// Formats the duration with at most `precision` units.
+    ///
+    /// The smallest unit is a millisecond, shorter durations are shown as
+    /// `0 seconds`.  Negative durations are prefixed with a minus sign.
+    pub fn humanize(&self, precision: usize) -> String {
+        let mut rv = String::new();
+        if self.nanos < 0 {
+            rv.push('-');
+        }
+        let mut rest = self.nanos.abs();
+        let mut parts = 0;
+        for &(name, size) in UNITS.iter() {
+            let count = rest / size;
+            if count == 0 {
+                continue;
+            }
+            if parts == precision {
+                break;
+            }
+            rest -= count * size;
+            if parts > 0 {
+                rv.push(' ');
+            }
+            write!(
+                rv,
+                "{} {}{}",
+                count,
+                name,
+                if count == 1 { "" } else { "s" }
+            )
+            .unwrap();
+            parts += 1;
+        }
+        if parts == 0 {
+            rv.clear();
+            rv.push_str("0 seconds");
+        }
+        rv
+    }
+
+    fn checked_add(&self, other: Duration) -> Option<Duration> {
+        Some(Duration {
+            nanos: self.nanos.checked_add(other.nanos)?,
+        })
+        .filter(|d| d.nanos.abs() <= MAX_NANOS)
+    }
+
+    fn checked_mul(&self, factor: &Value) -> Option<Duration> {
+        let nanos = match i128::try_from(factor.clone()) {
+            Ok(factor) => self.nanos.checked_mul(factor)?,
+            Err(_) => (self.nanos as f64 * as_f64(factor)?).round() as i128,
+        };
+        Some(Duration { nanos }).filter(|d| d.nanos.abs() <= MAX_NANOS)
+    }
+
+    fn neg(&self) -> Duration {
+        Duration { nanos: -self.nanos }
+    }
+}
+
+impl From<std::time::Duration> for Duration {
+    fn from(value: std::time::Duration) -> Duration {
+        Duration {
+            nanos: value.as_nanos() as i128,
+        }
+    }
+}
+
+impl From<std::time::Duration> for Value {
+    fn from(value: std::time::Duration) -> Value {
+        Value::from_object(Duration::from(value))
+    }
+}
+
+impl fmt::Debug for Duration {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        write!(f, "Duration({})", self)
+    }
+}
+
+impl fmt::Display for Duration {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        f.write_str(&self.humanize(UNITS.len()))
+    }
+}
+
+impl Object for Duration {
+    fn get_attr(&self, name: &str) -> Option<Value> {
+        let day = UNITS[0].1;
+        Some(match name {
+            "days" => Value::from(self.nanos.div_euclid(day)),
+            "seconds" => Value::from(self.nanos.rem_euclid(day) / NANOS_PER_SEC),
+            "microseconds" => Value::from(self.nanos.rem_euclid(NANOS_PER_SEC) / 1000),
+            "total_seconds" => Value::from(self.as_secs_f64()),
+            _ => return None,
+        })
+    }
+
+    fn attributes(&self) -> &[&str] {
+        &["days", "seconds", "microseconds", "total_seconds"][..]
+    }
+
+    fn eq_value(&self, other: &Value) -> Option<bool> {
+        self.cmp_value(other).map(|x| x == Ordering::Equal)
+    }
+
+    fn cmp_value(&self, other: &Value) -> Option<Ordering> {
+        match as_duration(other)? {
+            Some(other) => Some(self.cmp(&other)),
+            None => self.as_secs_f64().partial_cmp(&as_f64(other)?),
+        }
+    }
+}
+
+/// Interprets a value as duration.
+///
+/// Returns `Some(None)` for numbers which are then treated as seconds.
+fn as_duration(value: &Value) -> Option<Option<Duration>> {
+    match value.downcast_object_ref::<Duration>() {
+        Some(d) => Some(Some(*d)),
+        None => as_f64(value).map(|_| None),
+    }
+}
+
+/// Converts a duration or number of seconds into a duration.
+pub(crate) fn to_duration(value: &Value) -> Option<Duration> {
+    match value.downcast_object_ref::<Duration>() {
+        Some(d) => Some(*d),
+        None => Duration::from_secs_f64(as_f64(value)?),
+    }
+}
+
+/// Implements `+`, `-` and `*` for datetimes and durations.
+///
+/// Returns `None` if neither side is a datetime or duration object.
+pub(crate) fn arithmetic(op: &str, lhs: &Value, rhs: &Value) -> Option<Result<Value, Error>> {
+    let lhs_dt = lhs.downcast_object_ref::<DateTime>();
+    let rhs_dt = rhs.downcast_object_ref::<DateTime>();
+    let lhs_d = lhs.downcast_object_ref::<Duration>();
+    let rhs_d = rhs.downcast_object_ref::<Duration>();
+    if lhs_dt.is_none() && rhs_dt.is_none() && lhs_d.is_none() && rhs_d.is_none() {
+        return None;
+    }
+    let rv = match (op, lhs_dt, rhs_dt) {
+        ("-", Some(dt), _) if to_duration(rhs).is_none() => {
+            as_datetime(rhs).map(|other| Value::from_object(dt.since(&other)))
+        }
+        ("-", None, Some(dt)) => as_datetime(lhs).map(|other| Value::from_object(other.since(dt))),
+        ("-", Some(dt), None) => to_duration(rhs)
+            .and_then(|d| dt.checked_add(d.neg()))
+            .map(Value::from_object),
+        ("+", Some(dt), None) => to_duration(rhs)
+            .and_then(|d| dt.checked_add(d))
+            .map(Value::from_object),
+        ("+", None, Some(dt)) => to_duration(lhs)
+            .and_then(|d| dt.checked_add(d))
+            .map(Value::from_object),
+        (_, Some(_), _) | (_, _, Some(_)) => None,
+        ("+", None, None) | ("-", None, None) => match (to_duration(lhs), to_duration(rhs)) {
+            (Some(a), Some(b)) => a
+                .checked_add(if op == "-" { b.neg() } else { b })
+                .map(Value::from_object),
+            _ => None,
+        },
+        ("*", None, None) => match (lhs_d, rhs_d) {
+            (Some(d), None) => d.checked_mul(rhs),
+            (None, Some(d)) => d.checked_mul(lhs),
+            _ => None,
+        }
+        .map(Value::from_object),
+        _ => None,
+    };
+    Some(rv.ok_or_else(|| {
+        Error::new(
+            ErrorKind::ImpossibleOperation,
+            format!(
+                "tried to use {} operator on unsupported types {} and {}",
+                op,
+                lhs.kind(),
+                rhs.kind()
+            ),
+        )
+    }))
+}
+
+fn parse_offset(tz: &str) -> Option<i32> {
+    if tz.eq_ignore_ascii_case("utc") || tz.eq_ignore_ascii_case("z") {
+        return Some(0);
+    }
+    let sign = match tz.as_bytes().first()? {
+        b'+' => 1,
+        b'-' => -1,
+        _ => return None,
+    };
+    let digits = tz[1..].replacen(':', "", 1);
+    if digits.len() != 4 || !digits.bytes().all(|c| c.is_ascii_digit()) {
+        return None;
+    }
+    let hours: i32 = digits[..2].parse().ok()?;
+    let minutes: i32 = digits[2..].parse().ok()?;
+    if hours > 23 || minutes > 59 {
+        return None;
+    }
+    Some(sign * (hours * 3600 + minutes * 60))
+}
+
+fn write_offset<W: Write>(w: &mut W, offset: i32, sep: &str) -> fmt::Result {
+    let sign = if offset < 0 { '-' } else { '+' };
+    let offset = offset.abs() / 60;
+    write!(w, "{}{:02}{}{:02}", sign, offset / 60, sep, offset % 60)
+}
+
+fn is_leap_year(year: i64) -> bool {
+    year % 4 == 0 && (year % 100 != 0 || year % 400 == 0)
+}
+
+fn days_in_month(year: i64, month: u32) -> u32 {
+    match month {
+        2 if is_leap_year(year) => 29,
+        2 => 28,
+        4 | 6 | 9 | 11 => 30,
+        _ => 31,
+    }
+}
+
+// the two functions below are based on Howard Hinnant's date algorithms
+
+fn days_from_civil(year: i64, month: u32, day: u32) -> i64 {
+    let year = if month <= 2 { year - 1 } else { year };
+    let era = year.div_euclid(400);
+    let yoe = year.rem_euclid(400);
+    let mp = (month as i64 + 9) % 12;
+    let doy = (153 * mp + 2) / 5 + day as i64 - 1;
+    let doe = yoe * 365 + yoe / 4 - yoe / 100 + doy;
+    era * 146_097 + doe - 719_468
+}
+
+fn civil_from_days(days: i64) -> (i64, u32, u32) {
+    let days = days + 719_468;
+    let era = days.div_euclid(146_097);
+    let doe = days.rem_euclid(146_097);
+    let yoe = (doe - doe / 1460 + doe / 36524 - doe / 146_096) / 365;
+    let doy = doe - (365 * yoe + yoe / 4 - yoe / 100);
+    let mp = (5 * doy + 2) / 153;
+    let day = (doy - (153 * mp + 2) / 5 + 1) as u32;
+    let month = if mp < 10 { mp + 3 } else { mp - 9 } as u32;
+    let year = yoe + era * 400 + if month <= 2 { 1 } else { 0 };
+    (year, month, day)
+}
+
+#[test]
+fn test_civil_roundtrip() {
+    for &days in &[-719_468, -1, 0, 1, 11_016, 19_000, 2_932_896] {
+        let (y, m, d) = civil_from_days(days);
+        assert_eq!(days_from_civil(y, m, d), days);
+    }
+    assert_eq!(civil_from_days(0), (1970, 1, 1));
+    assert_eq!(civil_from_days(11_016), (2000, 2, 29));
+}
+
+#[test]
+fn test_parse_and_format() {
+    let dt = DateTime::parse("2022-03-04T05:06:07.25+01:30").unwrap();
+    assert_eq!(dt.timestamp(), 1_646_370_367 - 5400);
+    assert_eq!(dt.offset(), 5400);
+    assert_eq!(dt.to_string(), "2022-03-04T05:06:07.250000+01:30");
+    assert_eq!(
+        dt.format("%a %d %b %Y %I:%M %p %z %j").unwrap(),
+        "Fri 04 Mar 2022 05:06 AM +0130 063"
+    );
+    assert_eq!(
+        DateTime::parse("2022-03-04").unwrap().to_string(),
+        "2022-03-04T00:00:00+00:00"
+    );
+    assert_eq!(
+        DateTime::from_timestamp(-1, 0).to_string(),
+        "1969-12-31T23:59:59+00:00"
+    );
+    assert!(DateTime::parse("2022-02-30").is_none());
+    assert!(DateTime::parse("2022-03-04T25:00:00").is_none());
+    assert!(DateTime::parse("2022-03-04T05:06:07+1").is_none());
+    assert!(dt.format("%Q").is_err());
+}
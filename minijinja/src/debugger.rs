@@ -0,0 +1,157 @@
+//! Hooks for stepping through template execution.
+//!
+//! A [`Debugger`] can be registered on the environment with
+//! [`Environment::set_debugger`](crate::Environment::set_debugger).  The engine
+//! then invokes the debugger whenever execution moves to a new line of a
+//! template.  Because the callback is invoked synchronously from within the
+//! engine, a debugger can pause execution by simply blocking (for instance
+//! by waiting on a channel until an external tool signals to continue) and
+//! can abort rendering by returning an error.
+//!
+//! ```rust
+//! # use minijinja::{Environment, State, Error};
+//! # use minijinja::debugger::{Debugger, Location};
+//! struct Tracer;
+//!
+//! impl Debugger for Tracer {
+//!     fn before_line(&self, state: &State, location: &Location) -> Result<(), Error> {
+//!         eprintln!("{}:{} (block {:?})", location.name, location.line, state.current_block());
+//!         Ok(())
+//!     }
+//! }
+//!
+//! let mut env = Environment::new();
+//! env.set_debugger(Tracer);
+//! ```
+//!
+//! This requires the `debug` feature.
+use crate::error::Error;
+use crate::vm::State;
+
+/// The location the engine is about to execute.
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub struct Location<'a> {
+    /// The name of the template that is executing.
+    pub name: &'a str,
+    /// The line (1-indexed) that is about to be executed.
+    pub line: usize,
+}
+
+/// A debugger that gets notified about the progress of the engine.
+///
+/// All methods have default implementations so a debugger only needs to
+/// implement the hooks it is interested in.
+pub trait Debugger: Send + Sync {
+    /// Invoked before the first instruction of a line is executed.
+    ///
+    /// The state gives access to the current context so that the debugger can
+    /// inspect variables.  Blocking in this method pauses the engine, returning
+    /// an error aborts the rendering with that error.
+    fn before_line(&self, state: &State, location: &Location) -> Result<(), Error> {
+        let _state = state;
+        let _location = location;
+        Ok(())
+    }
+
+    /// Invoked when the engine starts executing a template.
+    fn enter_template(&self, state: &State) {
+        let _state = state;
+    }
+
+    /// Invoked when the engine finished executing a template.
+    ///
+    /// This is not invoked if the template failed with an error.
+    fn leave_template(&self, state: &State) {
+        let _state = state;
+    }
+}
+
+#[test]
+fn test_debugger_lines() {
+    use std::sync::Mutex;
+
+    use crate::Environment;
+
+    #[derive(Default)]
+    struct Recorder(Mutex<Vec<String>>);
+
+    impl Debugger for std::sync::Arc<Recorder> {
+        fn before_line(&self, state: &State, location: &Location) -> Result<(), Error> {
+            self.0.lock().unwrap().push(format!(
+                "{}:{} x={}",
+                location.name,
+                location.line,
+                state.lookup("x").map_or("-".into(), |x| x.to_string())
+            ));
+            Ok(())
+        }
+
+        fn enter_template(&self, state: &State) {
+            self.0
+                .lock()
+                .unwrap()
+                .push(format!("enter {}", state.name()));
+        }
+
+        fn leave_template(&self, state: &State) {
+            self.0
+                .lock()
+                .unwrap()
+                .push(format!("leave {}", state.name()));
+        }
+    }
+
+    let recorder = std::sync::Arc::new(Recorder::default());
+    let mut env = Environment::new();
+    env.set_debugger(recorder.clone());
+    env.add_template("inc", "{{ x }}").unwrap();
+    env.add_template(
+        "test",
+        "{% for x in [1, 2] %}\n{{ x }}\n{% endfor %}\n{% include 'inc' %}",
+    )
+    .unwrap();
+    let rv = env.get_template("test").unwrap().render(()).unwrap();
+    assert_eq!(rv, "\n1\n\n2\n\n");
+    assert_eq!(
+        &*recorder.0.lock().unwrap(),
+        &[
+            "enter test",
+            "test:1 x=-",
+            "test:2 x=1",
+            "test:1 x=1",
+            "test:2 x=2",
+            "test:1 x=2",
+            "test:2 x=2",
+            "test:3 x=-",
+            "test:4 x=-",
+            "enter inc",
+            "inc:1 x=-",
+            "leave inc",
+            "leave test",
+        ][..]
+    );
+}
+
+#[test]
+fn test_debugger_abort() {
+    use crate::{Environment, ErrorKind};
+
+    struct Abort;
+
+    impl Debugger for Abort {
+        fn before_line(&self, _state: &State, location: &Location) -> Result<(), Error> {
+            if location.line == 2 {
+                Err(Error::new(ErrorKind::InvalidOperation, "breakpoint hit"))
+            } else {
+                Ok(())
+            }
+        }
+    }
+
+    let mut env = Environment::new();
+    env.set_debugger(Abort);
+    env.add_template("test", "a\n{{ b }}").unwrap();
+    let err = env.get_template("test").unwrap().render(()).unwrap_err();
+    assert_eq!(err.kind(), ErrorKind::InvalidOperation);
+    assert_eq!(err.line(), Some(2));
+}
@@ -1,6 +1,8 @@
-use serde::de::{self, MapAccess, SeqAccess, Visitor};
-use serde::Deserialize;
+use serde::de::value::{MapAccessDeserializer, MapDeserializer, SeqDeserializer};
+use serde::de::{self, IntoDeserializer, MapAccess, SeqAccess, Visitor};
+use serde::{forward_to_deserialize_any, Deserialize};
 
+use crate::error::{Error, ErrorKind};
 use crate::key::Key;
 use crate::value::{Value, ValueMap, ValueRepr};
 
@@ -165,3 +167,158 @@ impl<'de> Visitor<'de> for KeyVisitor {
         Deserialize::deserialize(deserializer)
     }
 }
+
+impl de::Error for Error {
+    fn custom<T>(msg: T) -> Self
+    where
+        T: std::fmt::Display,
+    {
+        Error::new(ErrorKind::CannotDeserialize, msg.to_string())
+    }
+}
+
+impl<'de> IntoDeserializer<'de, Error> for Value {
+    type Deserializer = Value;
+
+    fn into_deserializer(self) -> Value {
+        self
+    }
+}
+
+/// Values can be deserialized into other types.
+///
+/// This lets functions and filters convert complex arguments (eg: an options
+/// map) into their own types in one go.  Undefined values are deserialized
+/// like `none`, dynamic objects like maps of their attributes.
+impl<'de> de::Deserializer<'de> for Value {
+    type Error = Error;
+
+    fn deserialize_any<V: Visitor<'de>>(self, visitor: V) -> Result<V::Value, Error> {
+        match self.0 {
+            ValueRepr::Undefined | ValueRepr::None => visitor.visit_unit(),
+            ValueRepr::Bool(v) => visitor.visit_bool(v),
+            ValueRepr::U64(v) => visitor.visit_u64(v),
+            ValueRepr::I64(v) => visitor.visit_i64(v),
+            ValueRepr::F64(v) => visitor.visit_f64(v),
+            ValueRepr::Char(v) => visitor.visit_char(v),
+            ValueRepr::U128(v) => visitor.visit_u128(*v),
+            ValueRepr::I128(v) => visitor.visit_i128(*v),
+            ValueRepr::String(ref v) | ValueRepr::SafeString(ref v) => visitor.visit_str(v),
+            ValueRepr::Bytes(ref v) => visitor.visit_bytes(v),
+            ValueRepr::Seq(ref v) => {
+                let mut seq = SeqDeserializer::new(v.iter().cloned());
+                let rv = visitor.visit_seq(&mut seq)?;
+                seq.end()?;
+                Ok(rv)
+            }
+            ValueRepr::Map(ref v) => {
+                let mut map = MapDeserializer::new(
+                    v.iter().map(|(k, v)| (Value::from(k.clone()), v.clone())),
+                );
+                let rv = visitor.visit_map(&mut map)?;
+                map.end()?;
+                Ok(rv)
+            }
+            ValueRepr::Dynamic(_) => {
+                let items = self
+                    .iter_as_str_map()
+                    .map(|(k, v)| (Value::from(k), v))
+                    .collect::<Vec<_>>();
+                let mut map = MapDeserializer::new(items.into_iter());
+                let rv = visitor.visit_map(&mut map)?;
+                map.end()?;
+                Ok(rv)
+            }
+        }
+    }
+
+    fn deserialize_option<V: Visitor<'de>>(self, visitor: V) -> Result<V::Value, Error> {
+        match self.0 {
+            ValueRepr::Undefined | ValueRepr::None => visitor.visit_none(),
+            _ => visitor.visit_some(self),
+        }
+    }
+
+    fn deserialize_enum<V: Visitor<'de>>(
+        self,
+        name: &'static str,
+        variants: &'static [&'static str],
+        visitor: V,
+    ) -> Result<V::Value, Error> {
+        match self.0 {
+            ValueRepr::String(ref v) | ValueRepr::SafeString(ref v) => {
+                visitor.visit_enum(v.as_str().into_deserializer())
+            }
+            ValueRepr::Map(ref v) if v.len() == 1 => {
+                let map = MapDeserializer::new(
+                    v.iter().map(|(k, v)| (Value::from(k.clone()), v.clone())),
+                );
+                visitor.visit_enum(MapAccessDeserializer::new(map))
+            }
+            _ => {
+                let _name = name;
+                let _variants = variants;
+                Err(de::Error::invalid_type(
+                    de::Unexpected::Other(&self.kind().to_string()),
+                    &"a string or a map with a single key",
+                ))
+            }
+        }
+    }
+
+    fn deserialize_newtype_struct<V: Visitor<'de>>(
+        self,
+        name: &'static str,
+        visitor: V,
+    ) -> Result<V::Value, Error> {
+        let _name = name;
+        visitor.visit_newtype_struct(self)
+    }
+
+    forward_to_deserialize_any! {
+        bool i8 i16 i32 i64 i128 u8 u16 u32 u64 u128 f32 f64 char str string
+        bytes byte_buf unit unit_struct seq tuple tuple_struct map struct
+        identifier ignored_any
+    }
+}
+
+#[test]
+fn test_deserialize_from_value() {
+    use std::collections::BTreeMap;
+
+    let value = Value::from_serializable(&serde_json::json!({
+        "width": 4,
+        "names": ["a", "b"],
+        "ratio": 0.5,
+        "nested": {"x": [1, 2]},
+        "missing": null,
+    }));
+
+    let json = serde_json::Value::deserialize(value.clone()).unwrap();
+    assert_eq!(json["width"], 4);
+    assert_eq!(json["nested"]["x"][1], 2);
+
+    let map = BTreeMap::<String, Value>::deserialize(value.clone()).unwrap();
+    assert_eq!(
+        Vec::<String>::deserialize(map["names"].clone()).unwrap(),
+        vec!["a", "b"]
+    );
+    assert_eq!(f32::deserialize(map["ratio"].clone()).unwrap(), 0.5);
+    assert_eq!(
+        Option::<u32>::deserialize(map["missing"].clone()).unwrap(),
+        None
+    );
+    assert_eq!(Option::<u32>::deserialize(Value::UNDEFINED).unwrap(), None);
+    assert_eq!(
+        <(i32, i32)>::deserialize(value.get_attr("nested").unwrap().get_attr("x").unwrap())
+            .unwrap(),
+        (1, 2)
+    );
+
+    let err = u32::deserialize(map["names"].clone()).unwrap_err();
+    assert_eq!(err.kind(), ErrorKind::CannotDeserialize);
+    assert_eq!(
+        err.to_string(),
+        "could not deserialize value: invalid type: sequence, expected u32"
+    );
+}
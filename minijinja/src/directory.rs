@@ -0,0 +1,186 @@
+//! Renders all templates of an environment into a directory.
+use std::fs;
+use std::path::{Component, Path, PathBuf};
+
+use serde::Serialize;
+
+use crate::environment::Environment;
+use crate::error::{Error, ErrorKind};
+#[cfg(feature = "threads")]
+use crate::utils::run_concurrently;
+use crate::utils::{glob_match, matches};
+use crate::value::Value;
+
+/// Options for [`Environment::render_directory`].
+#[derive(Debug, Clone)]
+pub struct RenderDirectoryOptions {
+    /// Patterns of templates that are not rendered.
+    ///
+    /// A template is skipped if any component of its name matches one of
+    /// the patterns.  `*` matches any number of characters and `?` a single
+    /// one.  The default is `_*` which skips partials such as
+    /// `_header.html` and everything in directories like `_layouts/`.
+    pub ignore: Vec<String>,
+    /// The number of threads that render templates.  The default is 4.
+    ///
+    /// This is ignored without the `threads` feature.
+    pub threads: usize,
+}
+
+impl Default for RenderDirectoryOptions {
+    fn default() -> RenderDirectoryOptions {
+        RenderDirectoryOptions {
+            ignore: vec!["_*".into()],
+            threads: 4,
+        }
+    }
+}
+
+impl RenderDirectoryOptions {
+    fn is_ignored(&self, name: &str) -> bool {
+        name.split('/').any(|component| {
+            self.ignore
+                .iter()
+                .any(|pattern| glob_match(pattern, component))
+        })
+    }
+}
+
+fn output_path(out_dir: &Path, name: &str) -> Option<PathBuf> {
+    let relative = Path::new(name);
+    if relative
+        .components()
+        .all(|x| matches!(x, Component::Normal(_)))
+    {
+        Some(out_dir.join(relative))
+    } else {
+        None
+    }
+}
+
+fn write_output(path: &Path, output: &[u8]) -> Result<(), Error> {
+    let rv = match path.parent() {
+        Some(parent) => fs::create_dir_all(parent),
+        None => Ok(()),
+    };
+    rv.and_then(|_| fs::write(path, output)).map_err(|err| {
+        Error::new(
+            ErrorKind::InvalidOperation,
+            format!("could not write {}", path.display()),
+        )
+        .with_source(err)
+    })
+}
+
+impl<'source> Environment<'source> {
+    /// Renders every template of the environment into a directory.
+    ///
+    /// Templates are written to a file with the name of the template below
+    /// `out_dir`, intermediate directories are created as necessary.  The
+    /// context for each template is created by `ctx_for` which is invoked
+    /// with the name of the template.  Partials and layouts are skipped by
+    /// the ignore patterns of the options.  With the `threads` feature the
+    /// templates are rendered on a pool of threads and the calling thread
+    /// takes part in the work, otherwise they are rendered one after another
+    /// on the calling thread.
+    ///
+    /// Only templates that are known to the environment are rendered, see
+    /// [`template_names`](Environment::template_names).  Templates a loader
+    /// would only load on demand are skipped unless the source has a
+    /// [template lister](crate::source::Source::set_template_lister).
+    ///
+    /// On success the names of the rendered templates are returned in sorted
+    /// order.  Rendering continues if a template fails, afterwards an error
+    /// that lists all failed templates is returned.  The first failure is
+    /// attached as its source.
+    ///
+    /// ```no_run
+    /// # use minijinja::{context, Environment, RenderDirectoryOptions};
+    /// # let env = Environment::new();
+    /// env.render_directory("_site", &RenderDirectoryOptions::default(), |name| {
+    ///     context!(page => name)
+    /// }).unwrap();
+    /// ```
+    pub fn render_directory<P, F, S>(
+        &self,
+        out_dir: P,
+        options: &RenderDirectoryOptions,
+        ctx_for: F,
+    ) -> Result<Vec<String>, Error>
+    where
+        P: AsRef<Path>,
+        F: Fn(&str) -> S + Sync,
+        S: Serialize,
+    {
+        let ctx_for = |name: &str| Value::from_serializable(&ctx_for(name));
+        self._render_directory(out_dir.as_ref(), options, &ctx_for)
+    }
+
+    fn _render_directory(
+        &self,
+        out_dir: &Path,
+        options: &RenderDirectoryOptions,
+        ctx_for: &(dyn Fn(&str) -> Value + Sync),
+    ) -> Result<Vec<String>, Error> {
+        let names = self
+            .template_names()?
+            .into_iter()
+            .filter(|name| !options.is_ignored(name))
+            .collect::<Vec<_>>();
+        let render_one = |name: &str| -> Result<(), Error> {
+            let path = output_path(out_dir, name).ok_or_else(|| {
+                Error::new(
+                    ErrorKind::InvalidOperation,
+                    "template name cannot be used as output path",
+                )
+            })?;
+            let output = self.get_template(name)?.render_to_bytes(ctx_for(name))?;
+            write_output(&path, &output)
+        };
+        #[cfg(feature = "threads")]
+        let results = run_concurrently(names.len(), options.threads, |idx| render_one(&names[idx]));
+        #[cfg(not(feature = "threads"))]
+        let results = names
+            .iter()
+            .map(|name| render_one(name))
+            .collect::<Vec<_>>();
+
+        let mut rendered = Vec::with_capacity(results.len());
+        let mut failed = Vec::new();
+        for (name, result) in names.iter().zip(results) {
+            match result {
+                Ok(()) => rendered.push(name.clone()),
+                Err(err) => failed.push((name, err)),
+            }
+        }
+        if failed.is_empty() {
+            return Ok(rendered);
+        }
+        let mut detail = format!(
+            "failed to render {} of {} templates",
+            failed.len(),
+            names.len()
+        );
+        for (name, err) in failed.iter() {
+            detail.push_str(&format!("\n  {}: {}", name, err));
+        }
+        let first = failed.into_iter().next().unwrap().1;
+        Err(Error::new(ErrorKind::InvalidOperation, detail).with_source(first))
+    }
+}
+
+#[test]
+fn test_output_path() {
+    let out = Path::new("out");
+    assert_eq!(output_path(out, "a/b.html"), Some(out.join("a/b.html")));
+    assert_eq!(output_path(out, "../b.html"), None);
+    assert_eq!(output_path(out, "/etc/passwd"), None);
+}
+
+#[test]
+fn test_is_ignored() {
+    let options = RenderDirectoryOptions::default();
+    assert!(options.is_ignored("_header.html"));
+    assert!(options.is_ignored("_layouts/base.html"));
+    assert!(!options.is_ignored("blog/index.html"));
+}
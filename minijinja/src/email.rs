@@ -0,0 +1,185 @@
+//! Helpers for rendering emails.
+//!
+//! A common use of templates is rendering transactional emails.  An email
+//! consists of a subject, a plain text body and an HTML body which all need
+//! the same context but different escaping rules.  Rather than keeping three
+//! templates per email, [`render_email`] renders an email from the
+//! conventional `subject`, `text_body` and `html_body` blocks of a single
+//! template:
+//!
+//! ```jinja
+//! {% block subject %}Welcome {{ user }}!{% endblock %}
+//!
+//! {% block text_body %}
+//! Hello {{ user }}, thanks for signing up.
+//! {% endblock %}
+//!
+//! {% block html_body %}
+//! <p>Hello <strong>{{ user }}</strong>, thanks for signing up.</p>
+//! {% endblock %}
+//! ```
+//!
+//! The subject and text body are rendered without auto escaping and the HTML
+//! body is rendered with HTML escaping no matter what the auto escape
+//! settings for the template name are.  Every block is rendered on its own
+//! as if it was the only thing in the template, so variables set outside of
+//! a block are not visible in it.  Blocks are resolved like with
+//! [`Template::render_block`]: an email template can extend a layout and
+//! only override some of the blocks.
+//!
+//! ```rust
+//! # use minijinja::{context, Environment};
+//! # let mut env = Environment::new();
+//! # env.add_template("welcome.txt", "\
+//! #     {% block subject %}Welcome {{ user }}!{% endblock %}\
+//! #     {% block text_body %}Hello {{ user }}!{% endblock %}\
+//! #     {% block html_body %}<p>Hello {{ user }}!</p>{% endblock %}").unwrap();
+//! use minijinja::email::render_email;
+//!
+//! let tmpl = env.get_template("welcome.txt").unwrap();
+//! let email = render_email(&tmpl, context!(user => "<John>")).unwrap();
+//! assert_eq!(email.subject, "Welcome <John>!");
+//! assert_eq!(email.text_body.as_deref(), Some("Hello <John>!"));
+//! assert_eq!(email.html_body.as_deref(), Some("<p>Hello &lt;John&gt;!</p>"));
+//! ```
+use serde::Serialize;
+
+use crate::environment::{RenderOptions, Template};
+use crate::error::{Error, ErrorKind};
+use crate::output::Output;
+use crate::utils::AutoEscape;
+use crate::value::Value;
+
+/// A rendered email.
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct Email {
+    /// The subject with surrounding whitespace removed and inner whitespace
+    /// (including newlines) collapsed into single spaces.
+    pub subject: String,
+    /// The plain text body if the template has a `text_body` block.
+    pub text_body: Option<String>,
+    /// The HTML body if the template has an `html_body` block.
+    pub html_body: Option<String>,
+}
+
+/// Renders an email from the `subject`, `text_body` and `html_body` blocks.
+///
+/// The `subject` block is required and at least one of the two body blocks
+/// has to exist.  See the [module level documentation](self) for more
+/// information.
+pub fn render_email<S: Serialize>(tmpl: &Template<'_>, ctx: S) -> Result<Email, Error> {
+    let root = Value::from_serializable(&ctx);
+    tmpl.with_render_hooks(|| _render_email(tmpl, root))
+}
+
+fn _render_email(tmpl: &Template<'_>, root: Value) -> Result<Email, Error> {
+    let subject = match tmpl._render_block(
+        "subject",
+        root.clone(),
+        AutoEscape::None,
+        &RenderOptions::default(),
+    )? {
+        Some(subject) => subject.into_string(),
+        None => {
+            return Err(Error::new(
+                ErrorKind::InvalidOperation,
+                format!("template {} has no subject block", tmpl.name()),
+            ))
+        }
+    };
+    let text_body = tmpl
+        ._render_block(
+            "text_body",
+            root.clone(),
+            AutoEscape::None,
+            &RenderOptions::default(),
+        )?
+        .map(Output::into_string);
+    let html_body = tmpl
+        ._render_block(
+            "html_body",
+            root,
+            AutoEscape::Html,
+            &RenderOptions::default(),
+        )?
+        .map(Output::into_string);
+    if text_body.is_none() && html_body.is_none() {
+        return Err(Error::new(
+            ErrorKind::InvalidOperation,
+            format!(
+                "template {} has neither a text_body nor an html_body block",
+                tmpl.name()
+            ),
+        ));
+    }
+    Ok(Email {
+        subject: subject.split_whitespace().collect::<Vec<_>>().join(" "),
+        text_body: text_body.map(|x| x.trim().to_string()),
+        html_body: html_body.map(|x| x.trim().to_string()),
+    })
+}
+
+#[test]
+fn test_render_email() {
+    use crate::Environment;
+
+    let mut env = Environment::new();
+    env.add_template(
+        "welcome.html",
+        "{% set greeting = 'Hi' %}\
+         {% block subject %}\n  Welcome\n  {{ user }} & co\n{% endblock %}\
+         {% block html_body %}\n<p>{{ greeting }} {{ user }}</p>\n{% endblock %}",
+    )
+    .unwrap();
+    let tmpl = env.get_template("welcome.html").unwrap();
+    let email = render_email(&tmpl, crate::context!(user => "<John>")).unwrap();
+    assert_eq!(
+        email,
+        Email {
+            subject: "Welcome <John> & co".into(),
+            text_body: None,
+            html_body: Some("<p> &lt;John&gt;</p>".into()),
+        }
+    );
+
+    env.add_template(
+        "layout.html",
+        "{% block subject %}News{% endblock %}\
+         {% block html_body %}<main>{% block content %}{% endblock %}</main>{% endblock %}",
+    )
+    .unwrap();
+    env.add_template(
+        "news.html",
+        "{% extends 'layout.html' %}\
+         {% block subject %}{{ super() }} for {{ user }}{% endblock %}\
+         {% block content %}<p>Hi {{ user }}</p>{% endblock %}",
+    )
+    .unwrap();
+    let tmpl = env.get_template("news.html").unwrap();
+    let email = render_email(&tmpl, crate::context!(user => "<John>")).unwrap();
+    assert_eq!(
+        email,
+        Email {
+            subject: "News for <John>".into(),
+            text_body: None,
+            html_body: Some("<main><p>Hi &lt;John&gt;</p></main>".into()),
+        }
+    );
+
+    env.add_template("nosubject.txt", "{% block text_body %}{% endblock %}")
+        .unwrap();
+    let tmpl = env.get_template("nosubject.txt").unwrap();
+    let err = render_email(&tmpl, ()).unwrap_err();
+    assert_eq!(
+        err.to_string(),
+        "invalid operation: template nosubject.txt has no subject block"
+    );
+
+    env.add_template("nobody.txt", "{% block subject %}{% endblock %}")
+        .unwrap();
+    let tmpl = env.get_template("nobody.txt").unwrap();
+    assert_eq!(
+        render_email(&tmpl, ()).unwrap_err().to_string(),
+        "invalid operation: template nobody.txt has neither a text_body nor an html_body block"
+    );
+}
@@ -1,17 +1,35 @@
-use std::collections::BTreeMap;
+use std::collections::{BTreeMap, BTreeSet};
 use std::fmt;
+use std::sync::atomic::{AtomicBool, AtomicUsize, Ordering};
+use std::sync::{Arc, Mutex};
 
 use serde::Serialize;
 
-use crate::compiler::Compiler;
-use crate::error::Error;
-use crate::instructions::Instructions;
-use crate::parser::{parse, parse_expr};
-use crate::utils::{AutoEscape, BTreeMapKeysDebug, HtmlEscape};
-use crate::value::{ArgType, FunctionArgs, RcType, Value};
-use crate::vm::Vm;
+use crate::ast;
+use crate::compiler::{Compiler, OptimizationLevel};
+use crate::error::{Error, ErrorKind};
+use crate::extensions::Extension;
+use crate::format::format_template_with_tags;
+use crate::instructions::{Instruction, Instructions};
+use crate::meta::{analyze, BlockDependencies};
+use crate::output::Output;
+use crate::parser::{
+    parse_expr_with_max_depth, parse_with_line_offset, parse_with_recovery, DEFAULT_MAX_EXPR_DEPTH,
+};
+use crate::pprint::ReprLimits;
+use crate::syntax::Syntax;
+use crate::tags::Tag;
+use crate::utils::{
+    fill_random, find_html_escape, format_float, join_template_name, matches, AutoEscape,
+    BTreeMapKeysDebug, FloatFormat, HtmlEscape, HtmlEscapeKeepEntities, UndefinedBehavior,
+};
+use crate::value::{self, ArgType, FunctionArgs, RcType, Value, ValueKind, ValueRepr};
+use crate::vm::{State, Vm};
 use crate::{filters, functions, tests};
 
+/// The default for [`Environment::set_max_include_depth`].
+const DEFAULT_MAX_INCLUDE_DEPTH: usize = 20;
+
 /// Represents a handle to a template.
 ///
 /// Templates are stored in the [`Environment`] as bytecode instructions.  With the
@@ -44,6 +62,13 @@ impl<'env> fmt::Debug for Template<'env> {
 pub(crate) struct CompiledTemplate<'source> {
     instructions: Instructions<'source>,
     blocks: BTreeMap<&'source str, Instructions<'source>>,
+    block_dependencies: BTreeMap<String, BlockDependencies>,
+    undeclared_paths: BTreeSet<String>,
+    // the template named by a constant top level `{% extends %}`.
+    parent: Option<String>,
+    metadata: Value,
+    // the size of the last output, used to size the buffer of the next render.
+    output_size_hint: RcType<AtomicUsize>,
 }
 
 impl<'env> fmt::Debug for CompiledTemplate<'env> {
@@ -83,25 +108,204 @@ impl<'source> CompiledTemplate<'source> {
     pub(crate) fn from_name_and_source(
         name: &'source str,
         source: &'source str,
+        syntax: &Syntax,
+        custom_tags: &dyn Fn(&str) -> Option<bool>,
+        optimization_level: OptimizationLevel,
+        max_expression_depth: usize,
+        front_matter_parser: Option<&FrontMatterParser>,
     ) -> Result<CompiledTemplate<'source>, Error> {
-        attach_basic_debug_info(Self::_from_name_and_source_impl(name, source), source)
+        attach_basic_debug_info(
+            Self::_from_name_and_source_impl(
+                name,
+                source,
+                syntax,
+                custom_tags,
+                optimization_level,
+                max_expression_depth,
+                front_matter_parser,
+            ),
+            source,
+        )
     }
 
     fn _from_name_and_source_impl(
         name: &'source str,
         source: &'source str,
+        syntax: &Syntax,
+        custom_tags: &dyn Fn(&str) -> Option<bool>,
+        optimization_level: OptimizationLevel,
+        max_expression_depth: usize,
+        front_matter_parser: Option<&FrontMatterParser>,
     ) -> Result<CompiledTemplate<'source>, Error> {
-        let ast = parse(source, name)?;
+        let mut metadata = Value::UNDEFINED;
+        let mut body = source;
+        let mut line_offset = 0;
+        if let Some(parser) = front_matter_parser {
+            if let Some(front_matter) = split_front_matter(source) {
+                metadata =
+                    parser(front_matter.fence, front_matter.content).map_err(|mut err| {
+                        if err.line().is_none() {
+                            err.set_location(name, 1);
+                        }
+                        err
+                    })?;
+                body = front_matter.body;
+                line_offset = front_matter.lines;
+            }
+        }
+        let ast = parse_with_line_offset(
+            body,
+            name,
+            syntax,
+            custom_tags,
+            line_offset,
+            max_expression_depth,
+        )?;
         let mut compiler = Compiler::new(name, source);
+        compiler.set_optimization_level(optimization_level);
         compiler.compile_stmt(&ast)?;
         let (instructions, blocks) = compiler.finish();
+        let analysis = analyze(&ast);
         Ok(CompiledTemplate {
             blocks,
+            block_dependencies: analysis.blocks,
+            undeclared_paths: analysis.paths,
+            parent: find_parent(&ast),
             instructions,
+            metadata,
+            output_size_hint: RcType::new(AtomicUsize::new(0)),
         })
     }
 }
 
+/// Returns the name of the template extended with a constant name.
+fn find_parent(ast: &ast::Stmt<'_>) -> Option<String> {
+    if let ast::Stmt::Template(stmt) = ast {
+        for child in &stmt.children {
+            if let ast::Stmt::Extends(stmt) = child {
+                if let ast::Expr::Const(val) = &stmt.name {
+                    return val.value.as_str().map(|x| x.to_string());
+                }
+            }
+        }
+    }
+    None
+}
+
+/// A front matter block at the start of a template.
+struct FrontMatter<'source> {
+    fence: &'source str,
+    content: &'source str,
+    body: &'source str,
+    lines: usize,
+}
+
+/// Splits a `---` or `+++` delimited front matter block off a template.
+fn split_front_matter(source: &str) -> Option<FrontMatter<'_>> {
+    let fence = if source.starts_with("---") {
+        "---"
+    } else if source.starts_with("+++") {
+        "+++"
+    } else {
+        return None;
+    };
+    let mut lines = source.split('\n');
+    if lines.next()?.trim_end_matches('\r') != fence {
+        return None;
+    }
+    let content_start = source.find('\n')? + 1;
+    let mut offset = content_start;
+    let mut line_count = 1;
+    for line in lines {
+        line_count += 1;
+        if line.trim_end_matches('\r') == fence {
+            let body_start = (offset + line.len() + 1).min(source.len());
+            return Some(FrontMatter {
+                fence,
+                content: &source[content_start..offset],
+                body: &source[body_start..],
+                lines: line_count,
+            });
+        }
+        offset += line.len() + 1;
+    }
+    None
+}
+
+/// Options for a single render.
+///
+/// Options that are `None` fall back to the configuration of the environment
+/// and template.  See [`Template::render_with_options`].
+#[derive(Debug, Clone, Default)]
+pub struct RenderOptions {
+    /// Overrides how undefined values are handled.
+    pub undefined_behavior: Option<UndefinedBehavior>,
+    /// Overrides the initial auto escaping of the template.
+    pub auto_escape: Option<AutoEscape>,
+    /// Limits the number of instructions the engine executes.
+    ///
+    /// Once the fuel is used up rendering fails with an error of kind
+    /// [`InvalidOperation`](crate::ErrorKind::InvalidOperation).  This can be
+    /// used to protect against untrusted templates that would loop for a long
+    /// time.  The fuel is shared with included templates.
+    pub fuel: Option<u64>,
+    /// Overrides the memory budget of the environment.
+    ///
+    /// See [`Environment::set_memory_budget`].
+    pub memory_budget: Option<usize>,
+    /// Cancels the render once the flag is set.
+    ///
+    /// The flag is checked before every instruction and once it is set
+    /// rendering fails with an error of kind
+    /// [`InvalidOperation`](crate::ErrorKind::InvalidOperation).  This can be
+    /// used to stop a render from another thread, for instance when the
+    /// request it was for went away.
+    pub cancel: Option<Arc<AtomicBool>>,
+}
+
+/// Counts how often filters, tests, functions and templates were used.
+///
+/// This is returned by [`Environment::usage_stats`] once usage tracking was
+/// enabled with [`Environment::set_usage_tracking`].  Only names that were
+/// used show up in the maps.
+#[derive(Debug, Clone, Default, PartialEq, Eq)]
+pub struct UsageStats {
+    /// How often each filter was applied.
+    pub filters: BTreeMap<String, u64>,
+    /// How often each test was performed.
+    pub tests: BTreeMap<String, u64>,
+    /// How often each function was called by name.
+    pub functions: BTreeMap<String, u64>,
+    /// How often each template was rendered, included, imported or extended.
+    pub templates: BTreeMap<String, u64>,
+}
+
+/// A template with a static context bound to it.
+///
+/// This is created by [`Template::prepare`].
+#[derive(Debug, Clone)]
+pub struct PreparedTemplate<'env> {
+    template: Template<'env>,
+    base: Value,
+}
+
+impl<'env> PreparedTemplate<'env> {
+    /// Returns the template that was prepared.
+    pub fn template(&self) -> &Template<'env> {
+        &self.template
+    }
+
+    /// Renders the template with the dynamic part of the context.
+    ///
+    /// Variables in the given context take precedence over the static context
+    /// the template was prepared with.
+    pub fn render<S: Serialize>(&self, ctx: S) -> Result<String, Error> {
+        self.template
+            ._render_with_base(Some(self.base.clone()), Value::from_serializable(&ctx))
+            .map(Output::into_string)
+    }
+}
+
 impl<'env> Template<'env> {
     /// Returns the name of the template.
     pub fn name(&self) -> &str {
@@ -113,6 +317,15 @@ impl<'env> Template<'env> {
         self.compiled.instructions.source()
     }
 
+    /// Returns the metadata from the front matter of the template.
+    ///
+    /// This is undefined unless a parser was registered with
+    /// [`Environment::set_front_matter_parser`] and the template has front
+    /// matter.
+    pub fn metadata(&self) -> &Value {
+        &self.compiled.metadata
+    }
+
     /// Renders the template into a string.
     ///
     /// The provided value is used as the initial context for the template.  It
@@ -126,19 +339,538 @@ impl<'env> Template<'env> {
     }
 
     fn _render(&self, root: Value) -> Result<String, Error> {
-        let mut output = String::new();
-        let vm = Vm::new(self.env);
+        self._render_to_output(root).map(Output::into_string)
+    }
+
+    /// Renders the template into bytes.
+    ///
+    /// This works like [`render`](Self::render) but the output is not
+    /// required to be valid UTF-8.  Byte values (see
+    /// [`Value::from_bytes`](crate::value::Value::from_bytes)) are emitted
+    /// verbatim which makes this useful to generate files in encodings other
+    /// than UTF-8.  With [`render`](Self::render) invalid sequences would be
+    /// replaced.
+    pub fn render_to_bytes<S: Serialize>(&self, ctx: S) -> Result<Vec<u8>, Error> {
+        self._render_to_output(Value::from_serializable(&ctx))
+            .map(Output::into_bytes)
+    }
+
+    /// Renders the template into a [`Write`](std::io::Write).
+    ///
+    /// This works like [`render_to_bytes`](Self::render_to_bytes) but writes
+    /// the output into the given writer once rendering succeeded.
+    pub fn render_to_write<S: Serialize, W: std::io::Write>(
+        &self,
+        ctx: S,
+        mut w: W,
+    ) -> Result<(), Error> {
+        let output = self._render_to_output(Value::from_serializable(&ctx))?;
+        w.write_all(output.as_bytes()).map_err(|err| {
+            Error::new(ErrorKind::InvalidOperation, "failed to write output").with_source(err)
+        })
+    }
+
+    /// Renders the template into a string with options for this render.
+    ///
+    /// The options override the configuration of the environment for this
+    /// call only, which makes it possible to render individual templates
+    /// more strictly (or with a limit on the work done) without changing an
+    /// environment that is shared.
+    ///
+    /// ```
+    /// # use minijinja::{Environment, RenderOptions, UndefinedBehavior};
+    /// # let mut env = Environment::new();
+    /// # env.add_template("hello.txt", "Hello {{ name }}!").unwrap();
+    /// let tmpl = env.get_template("hello.txt").unwrap();
+    /// let options = RenderOptions {
+    ///     undefined_behavior: Some(UndefinedBehavior::Strict),
+    ///     ..Default::default()
+    /// };
+    /// assert!(tmpl.render_with_options((), &options).is_err());
+    /// assert_eq!(tmpl.render(()).unwrap(), "Hello !");
+    /// ```
+    pub fn render_with_options<S: Serialize>(
+        &self,
+        ctx: S,
+        options: &RenderOptions,
+    ) -> Result<String, Error> {
+        self._render_impl(None, Value::from_serializable(&ctx), options, None)
+            .map(Output::into_string)
+    }
+
+    /// Renders the template and returns the variables it exports.
+    ///
+    /// The exports are the variables that are set at the top level of the
+    /// template (or of a template it extends) with `{% set %}`.  They are
+    /// returned as a map together with the output which makes it possible
+    /// to compute metadata such as a page title in the template alongside
+    /// the body in a single render.
+    ///
+    /// ```
+    /// # use minijinja::{context, Environment};
+    /// # let mut env = Environment::new();
+    /// # env.add_template("post.html", "{% set title = name|upper %}<h1>{{ title }}</h1>").unwrap();
+    /// let tmpl = env.get_template("post.html").unwrap();
+    /// let (output, exports) = tmpl.render_with_exports(context!(name => "hello")).unwrap();
+    /// assert_eq!(output, "<h1>HELLO</h1>");
+    /// assert_eq!(exports.get_attr("title").unwrap().as_str(), Some("HELLO"));
+    /// ```
+    pub fn render_with_exports<S: Serialize>(&self, ctx: S) -> Result<(String, Value), Error> {
+        let mut exports = Value::UNDEFINED;
+        let output = self._render_impl(
+            None,
+            Value::from_serializable(&ctx),
+            &RenderOptions::default(),
+            Some(&mut exports),
+        )?;
+        Ok((output.into_string(), exports))
+    }
+
+    /// Evaluates an expression in the context of the template.
+    ///
+    /// The template is rendered with the given context first, then the
+    /// expression is evaluated with the context, the variables the template
+    /// exports and the globals in scope.  This is useful to compute values
+    /// such as an email subject with the helpers a template defines.
+    ///
+    /// ```
+    /// # use minijinja::{context, Environment};
+    /// # let mut env = Environment::new();
+    /// # env.add_template("mail.txt", "{% set greeting = 'Hello ' ~ name %}{{ greeting }}!").unwrap();
+    /// let tmpl = env.get_template("mail.txt").unwrap();
+    /// let rv = tmpl.eval_expr(context!(name => "Jane"), "greeting|upper").unwrap();
+    /// assert_eq!(rv.as_str(), Some("HELLO JANE"));
+    /// ```
+    pub fn eval_expr<S: Serialize>(&self, ctx: S, expr: &str) -> Result<Value, Error> {
+        self._eval_expr(Value::from_serializable(&ctx), expr)
+    }
+
+    fn _eval_expr(&self, root: Value, expr: &str) -> Result<Value, Error> {
+        let mut exports = Value::UNDEFINED;
+        self._render_impl(
+            None,
+            root.clone(),
+            &RenderOptions::default(),
+            Some(&mut exports),
+        )?;
+        let ast = parse_expr_with_max_depth(expr, self.env.max_expression_depth())?;
+        let mut compiler = Compiler::new("<expression>", expr);
+        compiler.set_optimization_level(self.env.optimization_level());
+        compiler.compile_expr(&ast)?;
+        let (instructions, _) = compiler.finish();
+        let blocks = BTreeMap::new();
+        Ok(Vm::new(self.env)
+            .eval(
+                &instructions,
+                value::merge_maps(vec![root, exports]),
+                &blocks,
+                AutoEscape::None,
+                &mut Output::new(),
+            )?
+            .unwrap_or_default())
+    }
+
+    fn _render_to_output(&self, root: Value) -> Result<Output, Error> {
+        self._render_with_base(None, root)
+    }
+
+    fn _render_with_base(&self, base: Option<Value>, root: Value) -> Result<Output, Error> {
+        self._render_impl(base, root, &RenderOptions::default(), None)
+    }
+
+    fn _render_impl(
+        &self,
+        base: Option<Value>,
+        root: Value,
+        options: &RenderOptions,
+        exports: Option<&mut Value>,
+    ) -> Result<Output, Error> {
+        self.env.record_usage(|x| &mut x.templates, self.name());
+        if let Some(ref prefetch) = self.env.prefetch_callback {
+            prefetch(self.name(), &self.compiled.undeclared_paths)?;
+        }
+        self.with_render_hooks(|| self._render_vm(base, root, options, exports))
+    }
+
+    /// Invokes `f` between the render hooks of the extensions.
+    ///
+    /// Every way of rendering a template goes through this once, no matter
+    /// how many blocks it renders.
+    pub(crate) fn with_render_hooks<R, F: FnOnce() -> Result<R, Error>>(
+        &self,
+        f: F,
+    ) -> Result<R, Error> {
+        let extensions = &self.env.extensions;
+        let mut rv = Ok(());
+        let mut entered = 0;
+        for extension in extensions {
+            rv = extension.before_render(self);
+            if rv.is_err() {
+                break;
+            }
+            entered += 1;
+        }
+        let rv = rv.and_then(|_| f());
+        for extension in extensions[..entered].iter().rev() {
+            extension.after_render(self, rv.as_ref().err());
+        }
+        rv
+    }
+
+    fn _render_vm(
+        &self,
+        base: Option<Value>,
+        root: Value,
+        options: &RenderOptions,
+        exports: Option<&mut Value>,
+    ) -> Result<Output, Error> {
+        let size_hint = &self.compiled.output_size_hint;
+        let mut output = Output::with_capacity(size_hint.load(Ordering::Relaxed));
+        let mut vm = Vm::new(self.env);
+        if let Some(behavior) = options.undefined_behavior {
+            vm.set_undefined_behavior(behavior);
+        }
+        vm.set_fuel(options.fuel);
+        vm.set_cancel(options.cancel.clone());
+        vm.set_memory_budget(options.memory_budget.or(self.env.memory_budget));
         let blocks = &self.compiled.blocks;
-        vm.eval(
+        vm.eval_root(
             &self.compiled.instructions,
+            self.with_metadata_defaults(base),
             root,
             blocks,
-            self.initial_auto_escape,
+            options.auto_escape.unwrap_or(self.initial_auto_escape),
             &mut output,
+            exports,
         )?;
+        size_hint.store(output.as_bytes().len(), Ordering::Relaxed);
         Ok(output)
     }
 
+    /// Puts the metadata of the template below the base context.
+    fn with_metadata_defaults(&self, base: Option<Value>) -> Option<Value> {
+        let metadata = &self.compiled.metadata;
+        if metadata.kind() != ValueKind::Map {
+            return base;
+        }
+        match base {
+            Some(base) if base.kind() == ValueKind::Map => Some(Value::from(
+                metadata
+                    .iter_as_str_map()
+                    .chain(base.iter_as_str_map())
+                    .collect::<BTreeMap<_, _>>(),
+            )),
+            Some(base) => Some(base),
+            None => Some(metadata.clone()),
+        }
+    }
+
+    /// Renders a list of blocks concurrently.
+    ///
+    /// Each block is rendered on its own thread with its own state as if it
+    /// was the only thing in the template, so blocks cannot see variables set
+    /// by other parts of the template.  This is useful for templates that are
+    /// composed of independent and expensive blocks (such as the panels of a
+    /// dashboard).  The rendered blocks are returned in the order of `names`.
+    ///
+    /// All blocks are rendered to completion even if one of them fails.  In
+    /// that case the error of the first failing block in `names` is returned.
+    ///
+    /// ```
+    /// # use minijinja::{context, Environment};
+    /// # let mut env = Environment::new();
+    /// # env.add_template("dash.html", "{% block a %}A{{ x }}{% endblock %}{% block b %}B{{ x }}{% endblock %}").unwrap();
+    /// let tmpl = env.get_template("dash.html").unwrap();
+    /// let blocks = tmpl.render_blocks_concurrently(context!(x => 1), &["b", "a"]).unwrap();
+    /// assert_eq!(blocks.concat(), "B1A1");
+    /// ```
+    ///
+    /// This requires the `threads` feature.
+    #[cfg(feature = "threads")]
+    #[cfg_attr(docsrs, doc(cfg(feature = "threads")))]
+    pub fn render_blocks_concurrently<S: Serialize>(
+        &self,
+        ctx: S,
+        names: &[&str],
+    ) -> Result<Vec<String>, Error> {
+        self._render_blocks_concurrently(
+            Value::from_serializable(&ctx),
+            names,
+            &RenderOptions::default(),
+        )
+    }
+
+    /// Renders a list of blocks concurrently with options for this render.
+    ///
+    /// This works like
+    /// [`render_blocks_concurrently`](Self::render_blocks_concurrently) but
+    /// the options apply to every block.  Setting the
+    /// [`cancel`](RenderOptions::cancel) flag stops all blocks that are still
+    /// rendering.
+    ///
+    /// ```
+    /// # use std::sync::Arc;
+    /// # use std::sync::atomic::AtomicBool;
+    /// # use minijinja::{context, Environment, ErrorKind, RenderOptions};
+    /// # let mut env = Environment::new();
+    /// # env.add_template("dash.html", "{% block a %}A{% endblock %}").unwrap();
+    /// let tmpl = env.get_template("dash.html").unwrap();
+    /// let options = RenderOptions {
+    ///     cancel: Some(Arc::new(AtomicBool::new(true))),
+    ///     ..Default::default()
+    /// };
+    /// let err = tmpl.render_blocks_concurrently_with_options((), &["a"], &options).unwrap_err();
+    /// assert_eq!(err.kind(), ErrorKind::InvalidOperation);
+    /// ```
+    ///
+    /// This requires the `threads` feature.
+    #[cfg(feature = "threads")]
+    #[cfg_attr(docsrs, doc(cfg(feature = "threads")))]
+    pub fn render_blocks_concurrently_with_options<S: Serialize>(
+        &self,
+        ctx: S,
+        names: &[&str],
+        options: &RenderOptions,
+    ) -> Result<Vec<String>, Error> {
+        self._render_blocks_concurrently(Value::from_serializable(&ctx), names, options)
+    }
+
+    #[cfg(feature = "threads")]
+    fn _render_blocks_concurrently(
+        &self,
+        root: Value,
+        names: &[&str],
+        options: &RenderOptions,
+    ) -> Result<Vec<String>, Error> {
+        let auto_escape = options.auto_escape.unwrap_or(self.initial_auto_escape);
+        self.with_render_hooks(|| {
+            crate::utils::run_concurrently(names.len(), names.len(), |idx| {
+                self._render_block(names[idx], root.clone(), auto_escape, options)?
+                    .map(Output::into_string)
+                    .ok_or_else(|| {
+                        Error::new(
+                            ErrorKind::InvalidOperation,
+                            format!("block {} does not exist", names[idx]),
+                        )
+                    })
+            })
+            .into_iter()
+            .collect()
+        })
+    }
+
+    /// Renders a single block of the template.
+    ///
+    /// Only the instructions of the block are executed, the rest of the
+    /// template (including a template it extends) is not evaluated.  The
+    /// block is rendered as if it was the only thing in the template, so it
+    /// cannot see variables set outside of it.  This is useful to render
+    /// fragments of a page, for instance in response to HTMX requests.
+    ///
+    /// Blocks that the template does not override are taken from the
+    /// template it extends and `super()` works like in a full render.  This
+    /// only follows `{% extends %}` tags with a constant template name.  If
+    /// no template in the chain has a block with that name an error of kind
+    /// [`InvalidOperation`](crate::ErrorKind::InvalidOperation) is returned.
+    ///
+    /// ```
+    /// # use minijinja::{context, Environment};
+    /// # let mut env = Environment::new();
+    /// # env.add_template("page.html", "<ul>{% block items %}{% for x in items %}<li>{{ x }}{% endfor %}{% endblock %}</ul>").unwrap();
+    /// let tmpl = env.get_template("page.html").unwrap();
+    /// let rv = tmpl.render_block("items", context!(items => [1, 2])).unwrap();
+    /// assert_eq!(rv, "<li>1<li>2");
+    /// ```
+    pub fn render_block<S: Serialize>(&self, name: &str, ctx: S) -> Result<String, Error> {
+        let root = Value::from_serializable(&ctx);
+        self.with_render_hooks(|| {
+            self._render_block(
+                name,
+                root,
+                self.initial_auto_escape,
+                &RenderOptions::default(),
+            )?
+            .map(Output::into_string)
+            .ok_or_else(|| {
+                Error::new(
+                    ErrorKind::InvalidOperation,
+                    format!("block {} does not exist", name),
+                )
+            })
+        })
+    }
+
+    /// Renders a single block in isolation with the given auto escaping.
+    ///
+    /// Returns `None` if the template does not have a block with that name.
+    pub(crate) fn _render_block(
+        &self,
+        name: &str,
+        root: Value,
+        auto_escape: AutoEscape,
+        options: &RenderOptions,
+    ) -> Result<Option<Output>, Error> {
+        let mut output = Output::new();
+        let mut vm = Vm::new(self.env);
+        if let Some(behavior) = options.undefined_behavior {
+            vm.set_undefined_behavior(behavior);
+        }
+        vm.set_fuel(options.fuel);
+        vm.set_cancel(options.cancel.clone());
+        vm.set_memory_budget(options.memory_budget.or(self.env.memory_budget));
+        if vm.eval_block(
+            *self,
+            name,
+            self.with_metadata_defaults(None),
+            root,
+            auto_escape,
+            &mut output,
+        )? {
+            Ok(Some(output))
+        } else {
+            Ok(None)
+        }
+    }
+
+    /// Returns the dependencies of the blocks of the template.
+    ///
+    /// The dependencies are determined statically when the template is
+    /// compiled and list the variables, filters and templates each block
+    /// uses.  This can for instance be used to derive cache keys for blocks.
+    /// Blocks nested in other blocks are listed on their own, their
+    /// dependencies are also part of the dependencies of the outer block.
+    ///
+    /// ```
+    /// # use minijinja::Environment;
+    /// # let mut env = Environment::new();
+    /// # env.add_template("page.html", "{% block title %}{{ title|upper }}{% endblock %}").unwrap();
+    /// let tmpl = env.get_template("page.html").unwrap();
+    /// let deps = &tmpl.block_dependencies()["title"];
+    /// assert!(deps.variables().contains("title"));
+    /// assert!(deps.filters().contains("upper"));
+    /// assert!(deps.includes().is_empty());
+    /// ```
+    pub fn block_dependencies(&self) -> &BTreeMap<String, BlockDependencies> {
+        &self.compiled.block_dependencies
+    }
+
+    /// Returns the attribute paths the template looks up from the context.
+    ///
+    /// The paths are determined statically when the template is compiled.
+    /// Attribute lookups and subscripts with constant keys are joined with
+    /// a dot so that `user.profile["name"]` is reported as
+    /// `user.profile.name`.  Lookups with a dynamic key are cut off before
+    /// that key.  Variables declared by the template such as loop variables
+    /// are not followed, for `{% for u in users %}{{ u.name }}{% endfor %}`
+    /// only `users` is reported.  Included templates are not considered.
+    ///
+    /// ```
+    /// # use minijinja::Environment;
+    /// # let mut env = Environment::new();
+    /// # env.add_template("hello.txt", "Hello {{ user.name }} from {{ site.title }}!").unwrap();
+    /// let tmpl = env.get_template("hello.txt").unwrap();
+    /// let paths = tmpl.undeclared_paths().iter().map(|x| x.as_str()).collect::<Vec<_>>();
+    /// assert_eq!(paths, vec!["site.title", "user.name"]);
+    /// ```
+    pub fn undeclared_paths(&self) -> &BTreeSet<String> {
+        &self.compiled.undeclared_paths
+    }
+
+    /// Re-renders the blocks that are affected by a change of the context.
+    ///
+    /// The variables each block references are determined when the template
+    /// is compiled (see [`block_dependencies`](Self::block_dependencies)).
+    /// This compares these variables between `old_ctx` and
+    /// `new_ctx` and renders only the blocks where one of them changed with
+    /// the new context.  Blocks that include other templates or refer to
+    /// `self` or `super` are always rendered as their output can depend on
+    /// more than their variables.  The rendered blocks are returned by name.
+    ///
+    /// Like with [`render_blocks_concurrently`](Self::render_blocks_concurrently)
+    /// each block is rendered in isolation.
+    ///
+    /// ```
+    /// # use minijinja::{context, Environment};
+    /// # let mut env = Environment::new();
+    /// # env.add_template("page.html", "{% block title %}{{ title }}{% endblock %}{% block body %}{{ body }}{% endblock %}").unwrap();
+    /// let tmpl = env.get_template("page.html").unwrap();
+    /// let changed = tmpl.render_changed_blocks(
+    ///     context!(title => "A", body => "old"),
+    ///     context!(title => "A", body => "new"),
+    /// ).unwrap();
+    /// assert_eq!(changed.len(), 1);
+    /// assert_eq!(changed["body"], "new");
+    /// ```
+    pub fn render_changed_blocks<S: Serialize, T: Serialize>(
+        &self,
+        old_ctx: S,
+        new_ctx: T,
+    ) -> Result<BTreeMap<String, String>, Error> {
+        self._render_changed_blocks(
+            Value::from_serializable(&old_ctx),
+            Value::from_serializable(&new_ctx),
+        )
+    }
+
+    fn _render_changed_blocks(
+        &self,
+        old_root: Value,
+        new_root: Value,
+    ) -> Result<BTreeMap<String, String>, Error> {
+        self.with_render_hooks(|| self._render_changed_blocks_impl(old_root, new_root))
+    }
+
+    fn _render_changed_blocks_impl(
+        &self,
+        old_root: Value,
+        new_root: Value,
+    ) -> Result<BTreeMap<String, String>, Error> {
+        let mut rv = BTreeMap::new();
+        for (name, deps) in self.compiled.block_dependencies.iter() {
+            let changed = deps.is_dynamic()
+                || deps.variables().iter().any(|var| {
+                    old_root.get_attr(var).unwrap_or_default()
+                        != new_root.get_attr(var).unwrap_or_default()
+                });
+            if !changed {
+                continue;
+            }
+            if let Some(output) = self._render_block(
+                name,
+                new_root.clone(),
+                self.initial_auto_escape,
+                &RenderOptions::default(),
+            )? {
+                rv.insert(name.clone(), output.into_string());
+            }
+        }
+        Ok(rv)
+    }
+
+    /// Prepares the template for rendering with a partially static context.
+    ///
+    /// Templates that are rendered very often with largely the same context
+    /// can split that context into a static part that is given here and a
+    /// dynamic part that is given to [`PreparedTemplate::render`].  The static
+    /// part is converted into a value only once rather than on every render.
+    ///
+    /// ```
+    /// # use minijinja::{context, Environment};
+    /// # let mut env = Environment::new();
+    /// # env.add_template("row.txt", "{{ site }}: {{ name }}").unwrap();
+    /// let tmpl = env.get_template("row.txt").unwrap();
+    /// let prepared = tmpl.prepare(context!(site => "Example"));
+    /// for name in &["a", "b"] {
+    ///     println!("{}", prepared.render(context!(name)).unwrap());
+    /// }
+    /// ```
+    pub fn prepare<S: Serialize>(&self, ctx: S) -> PreparedTemplate<'env> {
+        PreparedTemplate {
+            template: *self,
+            base: Value::from_serializable(&ctx),
+        }
+    }
+
     /// Returns the root instructions.
     pub(crate) fn instructions(&self) -> &'env Instructions<'env> {
         &self.compiled.instructions
@@ -149,6 +881,13 @@ impl<'env> Template<'env> {
         &self.compiled.blocks
     }
 
+    /// Returns the name of the template this template extends.
+    ///
+    /// This is only known if the template is extended with a constant name.
+    pub(crate) fn parent(&self) -> Option<&'env str> {
+        self.compiled.parent.as_deref()
+    }
+
     /// Returns the initial auto escape setting.
     pub(crate) fn initial_auto_escape(&self) -> AutoEscape {
         self.initial_auto_escape
@@ -199,9 +938,30 @@ pub struct Environment<'source> {
     filters: RcType<BTreeMap<&'source str, filters::BoxedFilter>>,
     tests: RcType<BTreeMap<&'source str, tests::BoxedTest>>,
     pub(crate) globals: RcType<BTreeMap<&'source str, Value>>,
+    scoped_globals: RcType<BTreeMap<&'source str, RcType<ScopedGlobal>>>,
     default_auto_escape: RcType<dyn Fn(&str) -> AutoEscape + Sync + Send>,
+    formatter: RcType<Formatter>,
+    markdown_renderer: Option<RcType<MarkdownRenderer>>,
+    random_source: Option<RcType<RandomSource>>,
+    front_matter_parser: Option<RcType<FrontMatterParser>>,
+    undefined_behavior: UndefinedBehavior,
+    float_format: FloatFormat,
+    keep_html_entities: bool,
+    strict_attribute_lookup: bool,
+    extensions: Vec<RcType<dyn Extension>>,
+    tags: RcType<BTreeMap<&'source str, RcType<dyn Tag>>>,
+    syntax: Syntax,
+    optimization_level: OptimizationLevel,
+    max_include_depth: usize,
+    max_expression_depth: usize,
+    memory_budget: Option<usize>,
+    repr_limits: ReprLimits,
+    prefetch_callback: Option<RcType<PrefetchCallback>>,
+    usage: Option<RcType<Mutex<UsageStats>>>,
     #[cfg(feature = "debug")]
     debug: bool,
+    #[cfg(feature = "debug")]
+    debugger: Option<RcType<dyn crate::debugger::Debugger>>,
 }
 
 impl<'source> Default for Environment<'source> {
@@ -221,6 +981,13 @@ impl<'source> fmt::Debug for Environment<'source> {
     }
 }
 
+type Formatter = dyn Fn(&mut Output, &State, &Value) -> Result<(), Error> + Sync + Send;
+type MarkdownRenderer = dyn Fn(&str) -> Result<String, Error> + Sync + Send;
+type RandomSource = dyn Fn(&mut [u8]) + Sync + Send;
+type ScopedGlobal = dyn Fn() -> Value + Sync + Send;
+type PrefetchCallback = dyn Fn(&str, &BTreeSet<String>) -> Result<(), Error> + Sync + Send;
+pub(crate) type FrontMatterParser = dyn Fn(&str, &str) -> Result<Value, Error> + Sync + Send;
+
 fn default_auto_escape(name: &str) -> AutoEscape {
     match name.rsplit('.').next() {
         Some("html") | Some("htm") | Some("xml") => AutoEscape::Html,
@@ -276,7 +1043,7 @@ impl<'env, 'source> Expression<'env, 'source> {
     }
 
     fn _eval(&self, root: Value) -> Result<Value, Error> {
-        let mut output = String::new();
+        let mut output = Output::new();
         let vm = Vm::new(self.env);
         let blocks = BTreeMap::new();
         Ok(vm
@@ -303,25 +1070,80 @@ impl<'source> Environment<'source> {
             filters: RcType::new(filters::get_builtin_filters()),
             tests: RcType::new(tests::get_builtin_tests()),
             globals: RcType::new(functions::get_globals()),
+            scoped_globals: RcType::default(),
             default_auto_escape: RcType::new(default_auto_escape),
+            formatter: RcType::new(escape_formatter),
+            markdown_renderer: None,
+            random_source: None,
+            front_matter_parser: None,
+            undefined_behavior: UndefinedBehavior::default(),
+            float_format: FloatFormat::default(),
+            keep_html_entities: false,
+            strict_attribute_lookup: false,
+            extensions: Vec::new(),
+            tags: RcType::default(),
+            syntax: Syntax::default(),
+            optimization_level: OptimizationLevel::default(),
+            max_include_depth: DEFAULT_MAX_INCLUDE_DEPTH,
+            max_expression_depth: DEFAULT_MAX_EXPR_DEPTH,
+            memory_budget: None,
+            repr_limits: ReprLimits::default(),
+            prefetch_callback: None,
+            usage: None,
             #[cfg(feature = "debug")]
             debug: false,
+            #[cfg(feature = "debug")]
+            debugger: None,
         }
     }
 
     /// Creates a completely empty environment.
     ///
     /// This environment has no filters, no templates and no default logic for
-    /// auto escaping configured.
+    /// auto escaping configured.  This is useful to hand-pick the filters,
+    /// tests and functions that templates can use.  The built-in ones are
+    /// exported from [`filters`](crate::filters), [`tests`](crate::tests) and
+    /// [`functions`](crate::functions) and can be registered individually:
+    ///
+    /// ```
+    /// # use minijinja::{Environment, filters, tests};
+    /// let mut env = Environment::empty();
+    /// env.add_filter("upper", filters::upper);
+    /// env.add_test("odd", tests::is_odd);
+    /// ```
+    ///
+    /// To also leave out the code of the built-ins, disable the `builtins`
+    /// feature (see the [crate level documentation](crate#optional-features)).
     pub fn empty() -> Environment<'source> {
         Environment {
             templates: Source::Borrowed(Default::default()),
             filters: RcType::default(),
             tests: RcType::default(),
             globals: RcType::default(),
+            scoped_globals: RcType::default(),
             default_auto_escape: RcType::new(no_auto_escape),
+            formatter: RcType::new(escape_formatter),
+            markdown_renderer: None,
+            random_source: None,
+            front_matter_parser: None,
+            undefined_behavior: UndefinedBehavior::default(),
+            float_format: FloatFormat::default(),
+            keep_html_entities: false,
+            strict_attribute_lookup: false,
+            extensions: Vec::new(),
+            tags: RcType::default(),
+            syntax: Syntax::default(),
+            optimization_level: OptimizationLevel::default(),
+            max_include_depth: DEFAULT_MAX_INCLUDE_DEPTH,
+            max_expression_depth: DEFAULT_MAX_EXPR_DEPTH,
+            memory_budget: None,
+            repr_limits: ReprLimits::default(),
+            prefetch_callback: None,
+            usage: None,
             #[cfg(feature = "debug")]
             debug: false,
+            #[cfg(feature = "debug")]
+            debugger: None,
         }
     }
 
@@ -339,6 +1161,536 @@ impl<'source> Environment<'source> {
         self.default_auto_escape = RcType::new(f);
     }
 
+    /// Sets a different formatter function.
+    ///
+    /// The formatter is invoked to write the result of expressions (`{{ ...
+    /// }}`) and custom tags into the output.  It's responsible for applying
+    /// the auto escaping which is available via
+    /// [`State::auto_escape`].  The default formatter is
+    /// [`escape_formatter`](crate::escape_formatter) which a custom
+    /// formatter can fall back to.  As the formatter can fail it can for
+    /// instance be used to reject values that should never be rendered.
+    ///
+    /// ```
+    /// # use minijinja::{escape_formatter, Environment, Error, ErrorKind};
+    /// let mut env = Environment::new();
+    /// env.set_formatter(|out, state, value| {
+    ///     if value.is_none() {
+    ///         return Err(Error::new(ErrorKind::InvalidOperation, "cannot render none"));
+    ///     }
+    ///     escape_formatter(out, state, value)
+    /// });
+    /// env.add_template("hello.html", "Hello {{ name }}!").unwrap();
+    /// let tmpl = env.get_template("hello.html").unwrap();
+    /// assert_eq!(tmpl.render(minijinja::context!(name => "<b>")).unwrap(), "Hello &lt;b&gt;!");
+    /// assert!(tmpl.render(minijinja::context!(name => ())).is_err());
+    /// ```
+    pub fn set_formatter<F>(&mut self, f: F)
+    where
+        F: Fn(&mut Output, &State, &Value) -> Result<(), Error> + Sync + Send + 'static,
+    {
+        self.formatter = RcType::new(f);
+    }
+
+    /// Sets the function that renders markdown for the `markdown` filter.
+    ///
+    /// MiniJinja does not come with a markdown implementation.  Instead an
+    /// application registers the renderer of its choice here which is then
+    /// used by the [`markdown`](crate::filters::markdown) filter.  The HTML
+    /// returned by the renderer is marked as safe so it is not escaped again
+    /// by auto escaping.  This means that the renderer is responsible for
+    /// escaping or sanitizing raw HTML in the markdown source if that source
+    /// is not trusted.
+    ///
+    /// ```
+    /// # use minijinja::Environment;
+    /// let mut env = Environment::new();
+    /// env.set_markdown_renderer(|source| {
+    ///     // use a real markdown library here
+    ///     Ok(format!("<p>{}</p>", minijinja::HtmlEscape(source.trim())))
+    /// });
+    /// env.add_template("post.html", "{{ body|markdown }}").unwrap();
+    /// let tmpl = env.get_template("post.html").unwrap();
+    /// assert_eq!(tmpl.render(minijinja::context!(body => "a < b")).unwrap(), "<p>a &lt; b</p>");
+    /// ```
+    pub fn set_markdown_renderer<F>(&mut self, f: F)
+    where
+        F: Fn(&str) -> Result<String, Error> + Sync + Send + 'static,
+    {
+        self.markdown_renderer = Some(RcType::new(f));
+    }
+
+    /// Renders markdown with the configured markdown renderer.
+    pub(crate) fn render_markdown(&self, source: &str) -> Result<String, Error> {
+        match self.markdown_renderer {
+            Some(ref renderer) => renderer(source),
+            None => Err(Error::new(
+                ErrorKind::InvalidOperation,
+                "no markdown renderer configured",
+            )),
+        }
+    }
+
+    /// Sets the source of randomness for `uuid4()` and `random_token()`.
+    ///
+    /// The function is invoked with a buffer that it has to fill with random
+    /// bytes.  The default source derives bytes from the random keys of the
+    /// standard library's hash maps which is fine for identifiers but not
+    /// cryptographically secure.  `uuid4()` falls back to it but
+    /// `random_token()` requires a source to be configured, which should be
+    /// backed by a cryptographically secure random number generator if the
+    /// tokens are used as secrets.  A deterministic source is also useful in
+    /// tests.
+    ///
+    /// ```
+    /// # use minijinja::Environment;
+    /// let mut env = Environment::new();
+    /// env.set_random_source(|buf| buf.iter_mut().for_each(|b| *b = 0));
+    /// env.add_template("id.txt", "{{ uuid4() }}").unwrap();
+    /// let tmpl = env.get_template("id.txt").unwrap();
+    /// assert_eq!(tmpl.render(()).unwrap(), "00000000-0000-4000-8000-000000000000");
+    /// ```
+    pub fn set_random_source<F>(&mut self, f: F)
+    where
+        F: Fn(&mut [u8]) + Sync + Send + 'static,
+    {
+        self.random_source = Some(RcType::new(f));
+    }
+
+    /// Fills the buffer with bytes from the configured random source.
+    #[cfg_attr(not(feature = "builtins"), allow(dead_code))]
+    pub(crate) fn fill_random(&self, buf: &mut [u8]) {
+        match self.random_source {
+            Some(ref source) => source(buf),
+            None => fill_random(buf),
+        }
+    }
+
+    /// Fills the buffer with bytes from the configured random source.
+    ///
+    /// Unlike [`fill_random`](Self::fill_random) this fails instead of
+    /// falling back to the insecure default source.
+    #[cfg_attr(not(feature = "builtins"), allow(dead_code))]
+    pub(crate) fn fill_configured_random(&self, buf: &mut [u8]) -> Result<(), Error> {
+        match self.random_source {
+            Some(ref source) => {
+                source(buf);
+                Ok(())
+            }
+            None => Err(Error::new(
+                ErrorKind::InvalidOperation,
+                "no random source configured, see Environment::set_random_source",
+            )),
+        }
+    }
+
+    /// Sets a parser for front matter at the start of templates.
+    ///
+    /// If a parser is set, templates that start with a line consisting of
+    /// `---` or `+++` have everything up to the next line with the same
+    /// fence cut off.  The parser is invoked with the fence and the text in
+    /// between (commonly YAML for `---` and TOML for `+++`) and returns the
+    /// metadata of the template which is available via
+    /// [`Template::metadata`].  If the metadata is a map its items are
+    /// also the default values of the context when the template is
+    /// rendered.  Errors in the template report the line numbers in the
+    /// original file.
+    ///
+    /// Only templates added after the parser was set are affected.
+    ///
+    /// ```
+    /// # use minijinja::{Environment, value::Value};
+    /// let mut env = Environment::new();
+    /// env.set_front_matter_parser(|_fence, content| {
+    ///     Ok(Value::from_serializable(&content
+    ///         .lines()
+    ///         .filter_map(|line| {
+    ///             let mut parts = line.splitn(2, ": ");
+    ///             Some((parts.next()?, parts.next()?))
+    ///         })
+    ///         .collect::<std::collections::BTreeMap<_, _>>()))
+    /// });
+    /// env.add_template("post.html", "---\ntitle: Hello\n---\n<h1>{{ title }}</h1>").unwrap();
+    /// let tmpl = env.get_template("post.html").unwrap();
+    /// assert_eq!(tmpl.metadata().get_attr("title").unwrap().as_str(), Some("Hello"));
+    /// assert_eq!(tmpl.render(()).unwrap(), "<h1>Hello</h1>");
+    /// ```
+    pub fn set_front_matter_parser<F>(&mut self, f: F)
+    where
+        F: Fn(&str, &str) -> Result<Value, Error> + Sync + Send + 'static,
+    {
+        let parser: RcType<FrontMatterParser> = RcType::new(f);
+        #[cfg(feature = "source")]
+        {
+            if let Source::Owned(ref mut source) = self.templates {
+                RcType::make_mut(source).set_front_matter_parser_rc(parser.clone());
+            }
+        }
+        self.front_matter_parser = Some(parser);
+    }
+
+    /// Sets a callback that is invoked before a template is rendered.
+    ///
+    /// The callback is invoked with the name of the template and the
+    /// attribute paths the template looks up from the context (see
+    /// [`Template::undeclared_paths`]).  As the paths are determined when
+    /// the template is compiled this lets the host fetch exactly the data a
+    /// template needs in one go before rendering starts.  If the callback
+    /// fails the render fails with that error.
+    ///
+    /// ```
+    /// # use minijinja::Environment;
+    /// let mut env = Environment::new();
+    /// env.set_prefetch_callback(|name, paths| {
+    ///     println!("{} needs {:?}", name, paths);
+    ///     Ok(())
+    /// });
+    /// ```
+    pub fn set_prefetch_callback<F>(&mut self, f: F)
+    where
+        F: Fn(&str, &BTreeSet<String>) -> Result<(), Error> + Sync + Send + 'static,
+    {
+        self.prefetch_callback = Some(RcType::new(f));
+    }
+
+    /// Removes a previously set prefetch callback.
+    pub fn clear_prefetch_callback(&mut self) {
+        self.prefetch_callback = None;
+    }
+
+    /// Enables or disables counting which filters, tests, functions and
+    /// templates are used.
+    ///
+    /// This helps to find custom filters that are no longer used by any
+    /// template and templates that are rendered the most.  The counters are
+    /// shared with clones of the environment that are made after tracking
+    /// was enabled.  Disabling tracking discards the counters.  As every use
+    /// takes a lock this is off by default.
+    ///
+    /// ```
+    /// # use minijinja::Environment;
+    /// let mut env = Environment::new();
+    /// env.set_usage_tracking(true);
+    /// env.add_template("hello.txt", "{{ name|upper }}").unwrap();
+    /// let tmpl = env.get_template("hello.txt").unwrap();
+    /// tmpl.render(minijinja::context!(name => "World")).unwrap();
+    /// let stats = env.usage_stats();
+    /// assert_eq!(stats.filters["upper"], 1);
+    /// assert_eq!(stats.templates["hello.txt"], 1);
+    /// ```
+    pub fn set_usage_tracking(&mut self, enabled: bool) {
+        if !enabled {
+            self.usage = None;
+        } else if self.usage.is_none() {
+            self.usage = Some(RcType::default());
+        }
+    }
+
+    /// Returns the usage counters collected since tracking was enabled.
+    ///
+    /// If usage tracking is not enabled the returned stats are empty.
+    pub fn usage_stats(&self) -> UsageStats {
+        match self.usage {
+            Some(ref usage) => usage.lock().unwrap().clone(),
+            None => UsageStats::default(),
+        }
+    }
+
+    /// Resets all usage counters to zero.
+    pub fn reset_usage_stats(&self) {
+        if let Some(ref usage) = self.usage {
+            *usage.lock().unwrap() = UsageStats::default();
+        }
+    }
+
+    /// Increments a usage counter if usage tracking is enabled.
+    pub(crate) fn record_usage(
+        &self,
+        counters: fn(&mut UsageStats) -> &mut BTreeMap<String, u64>,
+        name: &str,
+    ) {
+        if let Some(ref usage) = self.usage {
+            let mut stats = usage.lock().unwrap();
+            let counters = counters(&mut stats);
+            match counters.get_mut(name) {
+                Some(count) => *count += 1,
+                None => {
+                    counters.insert(name.to_string(), 1);
+                }
+            }
+        }
+    }
+
+    /// Changes how undefined values are handled.
+    ///
+    /// The default is [`UndefinedBehavior::Lenient`].  The behavior can also
+    /// be changed for individual renders with
+    /// [`Template::render_with_options`].
+    pub fn set_undefined_behavior(&mut self, behavior: UndefinedBehavior) {
+        self.undefined_behavior = behavior;
+    }
+
+    /// Returns how undefined values are handled.
+    pub fn undefined_behavior(&self) -> UndefinedBehavior {
+        self.undefined_behavior
+    }
+
+    /// Changes how floats are written to the output.
+    ///
+    /// The default is [`FloatFormat::Default`] which matches how MiniJinja
+    /// has always written floats.  [`FloatFormat::Python`] matches the
+    /// output of Jinja2 which is useful if the same templates are rendered
+    /// with both.  This only affects printing floats with the default
+    /// [formatter](Self::set_formatter), converting a float into a string
+    /// (eg: with `~`) uses the default format.
+    ///
+    /// ```
+    /// # use minijinja::{Environment, FloatFormat};
+    /// let mut env = Environment::new();
+    /// env.set_float_format(FloatFormat::Python);
+    /// env.add_template("x", "{{ 10.0 ** 20 }} {{ 1.0 }}").unwrap();
+    /// assert_eq!(env.get_template("x").unwrap().render(()).unwrap(), "1e+20 1.0");
+    /// ```
+    pub fn set_float_format(&mut self, format: FloatFormat) {
+        self.float_format = format;
+    }
+
+    /// Returns how floats are written to the output.
+    pub fn float_format(&self) -> FloatFormat {
+        self.float_format
+    }
+
+    /// Enables or disables strict attribute lookups.
+    ///
+    /// By default attribute and item lookups follow the Jinja2 protocol:
+    /// `obj.name` falls back to looking up the item `"name"` on objects that
+    /// do not have such an attribute and `obj["name"]` falls back to the
+    /// attribute.  With strict lookups enabled objects are only asked for
+    /// attributes with `obj.name` and only for items with `obj["name"]`.
+    /// Maps and sequences are not affected.
+    ///
+    /// ```
+    /// # use minijinja::{Environment, context};
+    /// # use minijinja::value::{Object, Value};
+    /// # use std::fmt;
+    /// #[derive(Debug)]
+    /// struct Headers;
+    ///
+    /// impl fmt::Display for Headers {
+    ///     fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+    ///         write!(f, "headers")
+    ///     }
+    /// }
+    ///
+    /// impl Object for Headers {
+    ///     fn get_item(&self, key: &Value) -> Option<Value> {
+    ///         match key.as_str()? {
+    ///             "host" => Some(Value::from("example.com")),
+    ///             _ => None,
+    ///         }
+    ///     }
+    /// }
+    ///
+    /// let mut env = Environment::new();
+    /// env.add_template("t", "[{{ headers.host }}|{{ headers['host'] }}]").unwrap();
+    /// let ctx = context!(headers => Value::from_object(Headers));
+    /// let rv = env.get_template("t").unwrap().render(&ctx).unwrap();
+    /// assert_eq!(rv, "[example.com|example.com]");
+    ///
+    /// env.set_strict_attribute_lookup(true);
+    /// let rv = env.get_template("t").unwrap().render(&ctx).unwrap();
+    /// assert_eq!(rv, "[|example.com]");
+    /// ```
+    pub fn set_strict_attribute_lookup(&mut self, yes: bool) {
+        self.strict_attribute_lookup = yes;
+    }
+
+    /// Returns `true` if strict attribute lookups are enabled.
+    pub fn strict_attribute_lookup(&self) -> bool {
+        self.strict_attribute_lookup
+    }
+
+    /// Enables or disables the preservation of HTML entities when escaping.
+    ///
+    /// When enabled, HTML auto escaping and the `escape` filter leave
+    /// character references that are already in a string (eg: `&amp;` or
+    /// `&#39;`) alone.  This is useful if values come pre-escaped from an
+    /// upstream system and would otherwise end up double escaped.  All other
+    /// characters are escaped like before.  The `forceescape` filter always
+    /// escapes everything.  This is disabled by default.
+    ///
+    /// ```
+    /// # use minijinja::{Environment, context};
+    /// let mut env = Environment::new();
+    /// env.set_keep_html_entities(true);
+    /// env.add_template("hello.html", "{{ name }}").unwrap();
+    /// let tmpl = env.get_template("hello.html").unwrap();
+    /// let rv = tmpl.render(context!(name => "Tom &amp; <Jerry>")).unwrap();
+    /// assert_eq!(rv, "Tom &amp; &lt;Jerry&gt;");
+    /// ```
+    pub fn set_keep_html_entities(&mut self, yes: bool) {
+        self.keep_html_entities = yes;
+    }
+
+    /// Returns `true` if HTML entities are preserved when escaping.
+    pub fn keep_html_entities(&self) -> bool {
+        self.keep_html_entities
+    }
+
+    /// HTML escapes a string according to the escaping settings.
+    pub(crate) fn write_html_escaped<W: fmt::Write>(&self, w: &mut W, s: &str) -> fmt::Result {
+        if find_html_escape(s.as_bytes()).is_none() {
+            w.write_str(s)
+        } else if self.keep_html_entities {
+            write!(w, "{}", HtmlEscapeKeepEntities(s))
+        } else {
+            write!(w, "{}", HtmlEscape(s))
+        }
+    }
+
+    /// Sets the syntax for templates added to the environment.
+    ///
+    /// This changes the delimiters used by templates that are loaded with
+    /// [`add_template`](Self::add_template) afterwards.  Templates that were
+    /// already loaded keep the syntax they were compiled with.  The syntax is
+    /// validated first and an error of kind
+    /// [`InvalidSyntax`](crate::ErrorKind::InvalidSyntax) is returned if it's
+    /// not usable.  For more information see [`Syntax`].
+    ///
+    /// Templates held by a [`Source`](crate::source::Source) use the syntax
+    /// configured on the source instead.
+    pub fn set_syntax(&mut self, syntax: Syntax) -> Result<(), Error> {
+        syntax.validate()?;
+        self.syntax = syntax;
+        Ok(())
+    }
+
+    /// Returns the syntax for templates added to the environment.
+    pub fn syntax(&self) -> &Syntax {
+        &self.syntax
+    }
+
+    /// Sets the optimization level for templates and expressions.
+    ///
+    /// This affects templates that are loaded with
+    /// [`add_template`](Self::add_template) and expressions compiled with
+    /// [`compile_expression`](Self::compile_expression) afterwards.  The
+    /// default is [`OptimizationLevel::Basic`].  Templates held by a
+    /// [`Source`](crate::source::Source) use the level configured on the
+    /// source instead.
+    pub fn set_optimization_level(&mut self, level: OptimizationLevel) {
+        self.optimization_level = level;
+    }
+
+    /// Returns the optimization level.
+    pub fn optimization_level(&self) -> OptimizationLevel {
+        self.optimization_level
+    }
+
+    /// Sets the maximum number of nested includes.
+    ///
+    /// This limit applies to `{% include %}`, `{% component %}` and
+    /// [`State::render_template`](crate::State::render_template).  Templates
+    /// can include themselves recursively (for instance to render trees)
+    /// so an include cycle is only detected once this limit is hit.  The
+    /// default is 20.
+    pub fn set_max_include_depth(&mut self, depth: usize) {
+        self.max_include_depth = depth;
+    }
+
+    /// Returns the maximum number of nested includes.
+    pub fn max_include_depth(&self) -> usize {
+        self.max_include_depth
+    }
+
+    /// Sets the maximum nesting depth of expressions.
+    ///
+    /// The parser and compiler are recursive so deeply nested expressions
+    /// are rejected with a syntax error to not overflow the stack.  This
+    /// affects templates that are loaded with
+    /// [`add_template`](Self::add_template) and expressions compiled with
+    /// [`compile_expression`](Self::compile_expression) afterwards.  The
+    /// default is 30.  Raising the limit makes it more likely for templates
+    /// to overflow the stack, particularly on threads with small stacks.
+    /// Templates held by a
+    /// [`Source`](crate::source::Source) use the limit configured on the
+    /// source instead.
+    pub fn set_max_expression_depth(&mut self, depth: usize) {
+        self.max_expression_depth = depth;
+    }
+
+    /// Returns the maximum nesting depth of expressions.
+    pub fn max_expression_depth(&self) -> usize {
+        self.max_expression_depth
+    }
+
+    /// Limits the memory a single render may allocate.
+    ///
+    /// The engine keeps an approximate tally of the bytes of the values that
+    /// are created during a render (strings built by filters, functions and
+    /// concatenation, lists and maps that are materialized) and the output
+    /// that is written.  Once the tally exceeds the budget rendering fails
+    /// with an error of kind
+    /// [`MemoryBudgetExceeded`](crate::ErrorKind::MemoryBudgetExceeded).
+    /// Memory is never given back to the budget, so it is a limit on the
+    /// total work rather than the peak usage.
+    ///
+    /// String concatenation with `~`, list and map literals as well as the
+    /// `range` function and the `join` and `indent` filters check the budget
+    /// before they allocate.  Other values returned by filters, functions
+    /// and methods are accounted for after they were created, so a single
+    /// call can allocate more than the remaining budget before the render
+    /// fails.  This complements the fuel in
+    /// [`RenderOptions`] and protects against templates like
+    /// `{{ range(10000000)|join }}`.  The default is no limit.
+    ///
+    /// ```
+    /// # use minijinja::{Environment, ErrorKind};
+    /// let mut env = Environment::new();
+    /// env.set_memory_budget(Some(1024));
+    /// env.add_template("big.txt", "{{ range(100000)|join }}").unwrap();
+    /// let err = env.get_template("big.txt").unwrap().render(()).unwrap_err();
+    /// assert_eq!(err.kind(), ErrorKind::MemoryBudgetExceeded);
+    /// ```
+    pub fn set_memory_budget(&mut self, bytes: Option<usize>) {
+        self.memory_budget = bytes;
+    }
+
+    /// Returns the memory budget of a render.
+    pub fn memory_budget(&self) -> Option<usize> {
+        self.memory_budget
+    }
+
+    /// Limits the size of the debug output of values.
+    ///
+    /// The limits apply to the `pprint` filter, the `debug` function and
+    /// the referenced variables that are shown with errors in debug mode.
+    /// The `pprint` filter can still override them with its keyword
+    /// arguments.  By default the output is not limited.
+    ///
+    /// ```
+    /// # use minijinja::{Environment, ReprLimits};
+    /// let mut env = Environment::new();
+    /// env.set_repr_limits(ReprLimits {
+    ///     max_items: Some(2),
+    ///     max_string_len: Some(5),
+    ///     ..ReprLimits::default()
+    /// });
+    /// let expr = env.compile_expression("['a long string', 2, 3]|pprint").unwrap();
+    /// assert_eq!(
+    ///     expr.eval(()).unwrap().as_str(),
+    ///     Some("[\n    \"a lon\"... (8 more),\n    2,\n    ... (1 more)\n]")
+    /// );
+    /// ```
+    pub fn set_repr_limits(&mut self, limits: ReprLimits) {
+        self.repr_limits = limits;
+    }
+
+    /// Returns the limits for the debug output of values.
+    pub fn repr_limits(&self) -> ReprLimits {
+        self.repr_limits
+    }
+
     /// Enable or disable the debug mode.
     ///
     /// When the debug mode is enabled the engine will dump out some of the
@@ -363,6 +1715,83 @@ impl<'source> Environment<'source> {
         self.debug
     }
 
+    /// Adds an extension to the environment.
+    ///
+    /// This invokes [`Extension::register`] so that the extension can add
+    /// its filters, tests and globals and installs its render hooks.  If an
+    /// extension with the same name was added before, its hooks are replaced.
+    /// For more information see [`extensions`](crate::extensions).
+    pub fn add_extension<E: Extension + 'static>(&mut self, extension: E) {
+        extension.register(self);
+        let extension: RcType<dyn Extension> = RcType::new(extension);
+        match self
+            .extensions
+            .iter_mut()
+            .find(|x| x.name() == extension.name())
+        {
+            Some(existing) => *existing = extension,
+            None => self.extensions.push(extension),
+        }
+    }
+
+    /// Registers a custom statement tag.
+    ///
+    /// Tags are resolved when templates are parsed, so the tag has to be
+    /// registered before the templates using it are added.  When a
+    /// [`Source`](crate::source::Source) is used, the tags have to be
+    /// registered before it is set.  Built-in statements cannot be
+    /// overridden.  For more information see [`tags`](crate::tags).
+    pub fn add_tag<T: Tag + 'static>(&mut self, name: &'source str, tag: T) {
+        #[cfg(feature = "source")]
+        {
+            if let Source::Owned(ref mut src) = self.templates {
+                RcType::make_mut(src).add_custom_tag(name, tag.has_body());
+            }
+        }
+        RcType::make_mut(&mut self.tags).insert(name, RcType::new(tag));
+    }
+
+    /// Looks up a custom tag.
+    pub(crate) fn get_tag(&self, name: &str) -> Result<&dyn Tag, Error> {
+        self.tags.get(name).map(|x| &**x).ok_or_else(|| {
+            Error::new(
+                ErrorKind::InvalidOperation,
+                format!("tag {} is not registered", name),
+            )
+        })
+    }
+
+    /// Returns `true` if an extension with the given name was added.
+    pub fn has_extension(&self, name: &str) -> bool {
+        self.extensions.iter().any(|x| x.name() == name)
+    }
+
+    /// Installs a debugger that is notified as templates execute.
+    ///
+    /// The debugger is invoked before each new line of a template is executed
+    /// and can inspect the [`State`](crate::State) at that point, pause the
+    /// engine by blocking or abort rendering by returning an error.  For more
+    /// information see [`debugger`](crate::debugger).
+    ///
+    /// This requires the `debug` feature.
+    #[cfg(feature = "debug")]
+    #[cfg_attr(docsrs, doc(cfg(feature = "debug")))]
+    pub fn set_debugger<D: crate::debugger::Debugger + 'static>(&mut self, debugger: D) {
+        self.debugger = Some(RcType::new(debugger));
+    }
+
+    /// Removes a previously installed debugger.
+    #[cfg(feature = "debug")]
+    #[cfg_attr(docsrs, doc(cfg(feature = "debug")))]
+    pub fn clear_debugger(&mut self) {
+        self.debugger = None;
+    }
+
+    #[cfg(feature = "debug")]
+    pub(crate) fn debugger(&self) -> Option<&dyn crate::debugger::Debugger> {
+        self.debugger.as_deref()
+    }
+
     /// Sets the template source for the environment.
     ///
     /// This helps when working with dynamically loaded templates.  The
@@ -377,7 +1806,13 @@ impl<'source> Environment<'source> {
     /// For more information see [`Source`](crate::source::Source).
     #[cfg(feature = "source")]
     #[cfg_attr(docsrs, doc(cfg(feature = "source")))]
-    pub fn set_source(&mut self, source: crate::source::Source) {
+    pub fn set_source(&mut self, mut source: crate::source::Source) {
+        for (name, tag) in self.tags.iter() {
+            source.add_custom_tag(name, tag.has_body());
+        }
+        if let Some(ref parser) = self.front_matter_parser {
+            source.set_front_matter_parser_rc(parser.clone());
+        }
         self.templates = Source::Owned(RcType::new(source));
     }
 
@@ -402,9 +1837,18 @@ impl<'source> Environment<'source> {
     /// any form of sensible dynamic template loading.  To address this
     /// restriction use [`set_source`](Self::set_source).
     pub fn add_template(&mut self, name: &'source str, source: &'source str) -> Result<(), Error> {
+        let tags = &self.tags;
         match self.templates {
             Source::Borrowed(ref mut map) => {
-                let compiled_template = CompiledTemplate::from_name_and_source(name, source)?;
+                let compiled_template = CompiledTemplate::from_name_and_source(
+                    name,
+                    source,
+                    &self.syntax,
+                    &|name| tags.get(name).map(|x| x.has_body()),
+                    self.optimization_level,
+                    self.max_expression_depth,
+                    self.front_matter_parser.as_deref(),
+                )?;
                 RcType::make_mut(map).insert(name, RcType::new(compiled_template));
                 Ok(())
             }
@@ -413,6 +1857,41 @@ impl<'source> Environment<'source> {
         }
     }
 
+    /// Loads a template from a string with a custom syntax.
+    ///
+    /// This works like [`add_template`](Self::add_template) but the template
+    /// is compiled with the given syntax instead of the one configured on the
+    /// environment.  This allows mixing templates with different delimiters
+    /// in one environment.  The syntax is validated first.
+    pub fn add_template_with_syntax(
+        &mut self,
+        name: &'source str,
+        source: &'source str,
+        syntax: Syntax,
+    ) -> Result<(), Error> {
+        syntax.validate()?;
+        let tags = &self.tags;
+        match self.templates {
+            Source::Borrowed(ref mut map) => {
+                let compiled_template = CompiledTemplate::from_name_and_source(
+                    name,
+                    source,
+                    &syntax,
+                    &|name| tags.get(name).map(|x| x.has_body()),
+                    self.optimization_level,
+                    self.max_expression_depth,
+                    self.front_matter_parser.as_deref(),
+                )?;
+                RcType::make_mut(map).insert(name, RcType::new(compiled_template));
+                Ok(())
+            }
+            #[cfg(feature = "source")]
+            Source::Owned(ref mut src) => {
+                RcType::make_mut(src).add_template_with_syntax(name, source, syntax)
+            }
+        }
+    }
+
     /// Removes a template by name.
     pub fn remove_template(&mut self, name: &str) {
         match self.templates {
@@ -426,6 +1905,24 @@ impl<'source> Environment<'source> {
         }
     }
 
+    /// Returns the sorted names of the templates known to the environment.
+    ///
+    /// These are the templates that were added to the environment.  For a
+    /// [`Source`](crate::Source) with a loader these are the templates that
+    /// were already loaded and the ones reported by its
+    /// [template lister](crate::Source::set_template_lister).  Errors from
+    /// the lister are returned.
+    pub fn template_names(&self) -> Result<Vec<String>, Error> {
+        let mut rv = match &self.templates {
+            Source::Borrowed(ref map) => map.keys().map(|x| x.to_string()).collect::<Vec<_>>(),
+            #[cfg(feature = "source")]
+            Source::Owned(source) => source.template_names()?,
+        };
+        rv.sort();
+        rv.dedup();
+        Ok(rv)
+    }
+
     /// Fetches a template by name.
     ///
     /// This requires that the template has been loaded with
@@ -447,6 +1944,217 @@ impl<'source> Environment<'source> {
         })
     }
 
+    /// Renders a single block of a template.
+    ///
+    /// This is a shortcut for fetching the template with
+    /// [`get_template`](Self::get_template) and rendering the block with
+    /// [`Template::render_block`].
+    ///
+    /// ```
+    /// # use minijinja::{context, Environment};
+    /// # let mut env = Environment::new();
+    /// # env.add_template("page.html", "{% block title %}Hello {{ name }}{% endblock %}!").unwrap();
+    /// let rv = env.render_block("page.html", "title", context!(name => "World")).unwrap();
+    /// assert_eq!(rv, "Hello World");
+    /// ```
+    pub fn render_block<S: Serialize>(
+        &self,
+        name: &str,
+        block: &str,
+        ctx: S,
+    ) -> Result<String, Error> {
+        self.get_template(name)?.render_block(block, ctx)
+    }
+
+    /// Creates a state outside of a render.
+    ///
+    /// Filters, tests and functions receive a [`State`] from the engine.  A
+    /// state created by this method makes it possible to invoke them directly
+    /// which is useful for unit testing them without rendering a template.
+    /// Lookups go to the given context and the globals of the environment.
+    /// Auto escaping is disabled unless changed with
+    /// [`State::with_auto_escape`].
+    ///
+    /// ```
+    /// # use minijinja::{context, Environment, Error, State};
+    /// fn greet(state: &State, name: String) -> Result<String, Error> {
+    ///     let greeting = state.lookup("greeting");
+    ///     Ok(format!("{} {}", greeting.as_ref().and_then(|x| x.as_str()).unwrap_or("Hi"), name))
+    /// }
+    ///
+    /// let env = Environment::new();
+    /// let state = env.new_state(context!(greeting => "Hello"));
+    /// assert_eq!(greet(&state, "World".into()).unwrap(), "Hello World");
+    /// ```
+    pub fn new_state<S: Serialize>(&self, ctx: S) -> State<'_, '_> {
+        State::new_detached(self, Value::from_serializable(&ctx))
+    }
+
+    /// Validates a template without rendering it.
+    ///
+    /// The template is compiled and checked for uses of filters and tests
+    /// that are not registered with the environment.  Templates that are
+    /// included or extended by a constant name are checked as well, a missing
+    /// template is reported unless it was included with `ignore missing`.
+    /// Templates referenced by variables cannot be resolved statically and
+    /// are not checked.
+    ///
+    /// All issues are returned at once, an empty vector means the template
+    /// passed.  This makes it possible to check a whole directory of
+    /// templates before deploying them.
+    ///
+    /// ```
+    /// # use minijinja::Environment;
+    /// # let mut env = Environment::new();
+    /// env.add_template("page.html", "{{ x|nope }}{% include 'missing.html' %}").unwrap();
+    /// let errors = env.check_template("page.html");
+    /// assert_eq!(errors.len(), 2);
+    /// assert_eq!(errors[0].to_string(), "unknown filter: filter nope is unknown (in page.html:1)");
+    /// ```
+    pub fn check_template(&self, name: &str) -> Vec<Error> {
+        let mut errors = Vec::new();
+        let mut seen = BTreeSet::new();
+        match self.get_template(name) {
+            Ok(tmpl) => self._check_template(tmpl, &mut seen, &mut errors),
+            Err(err) => errors.push(err),
+        }
+        errors
+    }
+
+    fn _check_template(
+        &self,
+        tmpl: Template<'_>,
+        seen: &mut BTreeSet<String>,
+        errors: &mut Vec<Error>,
+    ) {
+        let name = tmpl.name();
+        if !seen.insert(name.to_string()) {
+            return;
+        }
+
+        let mut references = Vec::new();
+        let all_instructions = std::iter::once(tmpl.instructions()).chain(tmpl.blocks().values());
+        for instructions in all_instructions {
+            let mut prev = None;
+            for idx in 0..instructions.len() {
+                let instr = instructions.get(idx).unwrap();
+                let line = instructions.get_line(idx).unwrap_or(0);
+                let err = match *instr {
+                    Instruction::ApplyFilter(filter) if self.get_filter(filter).is_none() => {
+                        Some(Error::new(
+                            ErrorKind::UnknownFilter,
+                            format!("filter {} is unknown", filter),
+                        ))
+                    }
+                    Instruction::PerformTest(test) if self.get_test(test).is_none() => Some(
+                        Error::new(ErrorKind::UnknownTest, format!("test {} is unknown", test)),
+                    ),
+                    Instruction::Include(_) | Instruction::LoadBlocks => {
+                        let ignore_missing = matches!(*instr, Instruction::Include(true));
+                        if let Some(&Instruction::LoadConst(ref value)) = prev {
+                            if let Some(target) = value.as_str() {
+                                references.push((target, ignore_missing, line));
+                            }
+                        }
+                        None
+                    }
+                    _ => None,
+                };
+                if let Some(mut err) = err {
+                    err.set_location(name, line);
+                    errors.push(err);
+                }
+                prev = Some(instr);
+            }
+        }
+
+        for (target, ignore_missing, line) in references {
+            let rv = join_template_name(name, target).and_then(|x| self.get_template(&x));
+            match rv {
+                Ok(referenced) => self._check_template(referenced, seen, errors),
+                Err(ref err) if ignore_missing && err.kind() == ErrorKind::TemplateNotFound => {}
+                Err(mut err) => {
+                    if err.line().is_none() {
+                        err.set_location(name, line);
+                    }
+                    errors.push(err);
+                }
+            }
+        }
+    }
+
+    /// Checks the syntax of a template source and reports all syntax errors.
+    ///
+    /// Unlike [`add_template`](Self::add_template) which stops at the first
+    /// error the parser recovers by skipping to the end of the offending tag
+    /// and keeps going.  This way all syntax errors of a template can be
+    /// fixed at once.  Each error carries the [`span`](Error::span) of the
+    /// token where it was detected.  Note that an error in the opening tag
+    /// of a block can cause follow-up errors for its closing tag.
+    ///
+    /// The syntax, custom tags and front matter parser of the environment
+    /// are used.  The template is not compiled or added to the environment.
+    ///
+    /// ```
+    /// # use minijinja::Environment;
+    /// let env = Environment::new();
+    /// let errors = env.check_syntax("page.html", "{{ 1 + }}\n{{ user. }}\n{{ x }}");
+    /// assert_eq!(errors.len(), 2);
+    /// assert_eq!(errors[0].line(), Some(1));
+    /// assert_eq!(errors[1].line(), Some(2));
+    /// ```
+    pub fn check_syntax(&self, name: &str, source: &str) -> Vec<Error> {
+        let mut errors = Vec::new();
+        let mut body = source;
+        let mut line_offset = 0;
+        if let Some(parser) = self.front_matter_parser.as_deref() {
+            if let Some(front_matter) = split_front_matter(source) {
+                if let Err(mut err) = parser(front_matter.fence, front_matter.content) {
+                    if err.line().is_none() {
+                        err.set_location(name, 1);
+                    }
+                    errors.push(err);
+                }
+                body = front_matter.body;
+                line_offset = front_matter.lines;
+            }
+        }
+        let tags = &self.tags;
+        let (_, syntax_errors) = parse_with_recovery(
+            body,
+            name,
+            &self.syntax,
+            &|name| tags.get(name).map(|x| x.has_body()),
+            line_offset,
+            self.max_expression_depth,
+        );
+        errors.extend(syntax_errors);
+        errors
+    }
+
+    /// Formats a template source.
+    ///
+    /// This works like [`format_template`](crate::format_template) but uses
+    /// the syntax and custom tags of the environment.  If a front matter
+    /// parser is configured the front matter is retained as is.
+    pub fn format_template(&self, source: &str) -> Result<String, Error> {
+        let mut body = source;
+        if self.front_matter_parser.is_some() {
+            if let Some(front_matter) = split_front_matter(source) {
+                body = front_matter.body;
+            }
+        }
+        let tags = &self.tags;
+        let formatted = format_template_with_tags(body, &self.syntax, &|name| {
+            tags.get(name).map(|x| x.has_body())
+        })?;
+        Ok(format!(
+            "{}{}",
+            &source[..source.len() - body.len()],
+            formatted
+        ))
+    }
+
     /// Compiles an expression.
     ///
     /// This lets one compile an expression in the template language and
@@ -458,8 +2166,9 @@ impl<'source> Environment<'source> {
     }
 
     fn _compile_expression(&self, expr: &'source str) -> Result<Expression<'_, 'source>, Error> {
-        let ast = parse_expr(expr)?;
+        let ast = parse_expr_with_max_depth(expr, self.max_expression_depth)?;
         let mut compiler = Compiler::new("<expression>", expr);
+        compiler.set_optimization_level(self.optimization_level);
         compiler.compile_expr(&ast)?;
         let (instructions, _) = compiler.finish();
         Ok(Expression {
@@ -518,12 +2227,48 @@ impl<'source> Environment<'source> {
 
     /// Adds a global variable.
     pub fn add_global(&mut self, name: &'source str, value: Value) {
+        if self.scoped_globals.contains_key(name) {
+            RcType::make_mut(&mut self.scoped_globals).remove(name);
+        }
         RcType::make_mut(&mut self.globals).insert(name, value);
     }
 
+    /// Adds a global variable that is created for every render.
+    ///
+    /// Unlike with [`add_global`](Self::add_global) the environment only
+    /// holds on to the function that creates the value.  It's invoked the
+    /// first time a render looks up the global and the value is dropped once
+    /// the render finishes.  This means that objects holding on to large
+    /// resources are not kept alive by a long lived environment and are not
+    /// created for renders that do not use them.  Included and extended
+    /// templates share the value with the template that includes them.
+    ///
+    /// ```
+    /// # use minijinja::Environment;
+    /// # use minijinja::value::Value;
+    /// # let mut env = Environment::new();
+    /// env.add_scoped_global("rows", || Value::from(vec![1, 2, 3]));
+    /// ```
+    pub fn add_scoped_global<F, V>(&mut self, name: &'source str, f: F)
+    where
+        F: Fn() -> V + Sync + Send + 'static,
+        V: Into<Value>,
+    {
+        if self.globals.contains_key(name) {
+            RcType::make_mut(&mut self.globals).remove(name);
+        }
+        RcType::make_mut(&mut self.scoped_globals).insert(name, RcType::new(move || f().into()));
+    }
+
     /// Removes a global function or variable by name.
+    ///
+    /// This also removes globals added with
+    /// [`add_scoped_global`](Self::add_scoped_global).
     pub fn remove_global(&mut self, name: &str) {
         RcType::make_mut(&mut self.globals).remove(name);
+        if self.scoped_globals.contains_key(name) {
+            RcType::make_mut(&mut self.scoped_globals).remove(name);
+        }
     }
 
     /// Looks up a function.
@@ -531,6 +2276,11 @@ impl<'source> Environment<'source> {
         self.globals.get(name).cloned()
     }
 
+    /// Looks up the function that creates a scoped global.
+    pub(crate) fn get_scoped_global(&self, name: &str) -> Option<&ScopedGlobal> {
+        self.scoped_globals.get(name).map(|x| &**x)
+    }
+
     /// Looks up a filter.
     pub(crate) fn get_filter(&self, name: &str) -> Option<&filters::BoxedFilter> {
         self.filters.get(name)
@@ -541,34 +2291,83 @@ impl<'source> Environment<'source> {
         self.tests.get(name)
     }
 
-    /// Finalizes a value.
-    pub(crate) fn finalize(
+    /// Formats a value into the output with the formatter.
+    pub(crate) fn format(
         &self,
         value: &Value,
-        autoescape: AutoEscape,
-        out: &mut String,
+        state: &State,
+        out: &mut Output,
     ) -> Result<(), Error> {
-        use std::fmt::Write;
+        (self.formatter)(out, state, value)
+    }
+}
+
+/// The default formatter of the environment.
+///
+/// This writes the value into the output and applies the auto escaping of
+/// the [`State`].  Safe strings are written unchanged and bytes are written
+/// verbatim.  With `AutoEscape::Js` values are written as JSON.  Custom
+/// formatters (see [`Environment::set_formatter`]) can invoke this to fall
+/// back to the default behavior.
+pub fn escape_formatter(out: &mut Output, state: &State, value: &Value) -> Result<(), Error> {
+    use std::fmt::Write;
 
-        // safe values do not get escaped
-        if value.is_safe() {
-            write!(out, "{}", value).unwrap();
+    // safe values do not get escaped
+    if value.is_safe() {
+        write!(out, "{}", value).unwrap();
+        return Ok(());
+    }
+
+    // values are written as JavaScript literals
+    #[cfg(feature = "json")]
+    {
+        if let AutoEscape::Js = state.auto_escape() {
+            let json = serde_json::to_string(value).map_err(|err| {
+                Error::new(ErrorKind::ImpossibleOperation, "cannot serialize to JSON")
+                    .with_source(err)
+            })?;
+            write!(out, "{}", crate::utils::ScriptSafeJson(&json)).unwrap();
             return Ok(());
         }
+    }
+
+    // bytes are written as they are
+    if let Some(bytes) = value.as_bytes() {
+        match state.auto_escape() {
+            AutoEscape::Html => out.write_html_escaped_bytes(bytes),
+            _ => out.write_bytes(bytes),
+        }
+        return Ok(());
+    }
 
-        // TODO: this should become pluggable
-        match autoescape {
-            AutoEscape::None => write!(out, "{}", value).unwrap(),
-            AutoEscape::Html => {
-                if let Some(s) = value.as_str() {
-                    write!(out, "{}", HtmlEscape(s)).unwrap()
-                } else {
-                    write!(out, "{}", HtmlEscape(&value.to_string())).unwrap()
+    // floats never need escaping but the environment picks the format
+    if let ValueRepr::F64(val) = value.0 {
+        out.write_str(&format_float(val, state.env().float_format()))
+            .unwrap();
+        return Ok(());
+    }
+
+    match state.auto_escape() {
+        AutoEscape::Html => {
+            if let Some(s) = value.as_str() {
+                state.env().write_html_escaped(out, s).unwrap()
+            } else {
+                match value.kind() {
+                    // these never contain characters that need escaping
+                    ValueKind::Undefined
+                    | ValueKind::None
+                    | ValueKind::Bool
+                    | ValueKind::Number => write!(out, "{}", value).unwrap(),
+                    _ => state
+                        .env()
+                        .write_html_escaped(out, &value.to_string())
+                        .unwrap(),
                 }
             }
         }
-        Ok(())
+        _ => write!(out, "{}", value).unwrap(),
     }
+    Ok(())
 }
 
 #[test]
@@ -607,6 +2406,25 @@ fn test_expression_lifetimes() {
     }
 }
 
+#[test]
+fn test_empty() {
+    let mut env = Environment::empty();
+    env.add_template("upper", "{{ 'a'|upper }}").unwrap();
+    env.add_template("range", "{{ range(3) }}").unwrap();
+    env.add_template("odd", "{{ 1 is odd }}").unwrap();
+    for name in ["upper", "range", "odd"].iter() {
+        let tmpl = env.get_template(name).unwrap();
+        assert!(tmpl.render(()).is_err(), "{} should not be defined", name);
+    }
+
+    #[cfg(feature = "builtins")]
+    {
+        env.add_filter("upper", crate::filters::upper);
+        let tmpl = env.get_template("upper").unwrap();
+        assert_eq!(tmpl.render(()).unwrap(), "A");
+    }
+}
+
 #[test]
 fn test_clone() {
     let mut env = Environment::new();
@@ -627,6 +2445,37 @@ fn test_globals() {
     assert_eq!(tmpl.render(()).unwrap(), "42");
 }
 
+#[test]
+fn test_scoped_globals() {
+    use std::sync::atomic::{AtomicUsize, Ordering};
+
+    let created = Arc::new(AtomicUsize::new(0));
+    let mut env = Environment::new();
+    env.add_scoped_global("rows", {
+        let created = created.clone();
+        move || created.fetch_add(1, Ordering::Relaxed) + 3
+    });
+    env.add_template("inc", "{{ rows }}").unwrap();
+    env.add_template("test", "{{ rows }}{% include 'inc' %}{{ rows }}")
+        .unwrap();
+    env.add_template("unused", "nothing").unwrap();
+    let tmpl = env.get_template("test").unwrap();
+    assert_eq!(tmpl.render(()).unwrap(), "333");
+    assert_eq!(created.load(Ordering::Relaxed), 1);
+    assert_eq!(tmpl.render(()).unwrap(), "444");
+    assert_eq!(created.load(Ordering::Relaxed), 2);
+    let tmpl = env.get_template("unused").unwrap();
+    assert_eq!(tmpl.render(()).unwrap(), "nothing");
+    assert_eq!(created.load(Ordering::Relaxed), 2);
+
+    env.add_global("rows", Value::from(42));
+    let tmpl = env.get_template("test").unwrap();
+    assert_eq!(tmpl.render(()).unwrap(), "424242");
+    env.remove_global("rows");
+    let tmpl = env.get_template("test").unwrap();
+    assert_eq!(tmpl.render(()).unwrap(), "");
+}
+
 #[test]
 fn test_template_removal() {
     let mut env = Environment::new();
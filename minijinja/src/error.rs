@@ -1,6 +1,8 @@
 use std::borrow::Cow;
 use std::fmt;
 
+use crate::tokens::Span;
+
 /// Represents template errors.
 ///
 /// If debug mode is enabled a template error contains additional debug
@@ -28,6 +30,7 @@ pub struct Error {
     detail: Option<Cow<'static, str>>,
     name: Option<String>,
     lineno: usize,
+    span: Option<Box<Span>>,
     source: Option<Box<dyn std::error::Error + Send + Sync>>,
     #[cfg(feature = "debug")]
     pub(crate) debug_info: Option<DebugInfo>,
@@ -83,6 +86,8 @@ pub enum ErrorKind {
     BadEscape,
     UndefinedError,
     BadSerialization,
+    CannotDeserialize,
+    MemoryBudgetExceeded,
 }
 
 impl ErrorKind {
@@ -101,6 +106,8 @@ impl ErrorKind {
             ErrorKind::BadEscape => "bad string escape",
             ErrorKind::UndefinedError => "variable or attribute undefined",
             ErrorKind::BadSerialization => "could not serialize to internal format",
+            ErrorKind::CannotDeserialize => "could not deserialize value",
+            ErrorKind::MemoryBudgetExceeded => "memory budget exceeded",
         }
     }
 }
@@ -141,6 +148,7 @@ impl Error {
             detail: Some(detail.into()),
             name: None,
             lineno: 0,
+            span: None,
             source: None,
             #[cfg(feature = "debug")]
             debug_info: None,
@@ -152,6 +160,10 @@ impl Error {
         self.lineno = lineno;
     }
 
+    pub(crate) fn set_span(&mut self, span: Span) {
+        self.span = Some(Box::new(span));
+    }
+
     pub(crate) fn new_not_found(name: &str) -> Error {
         Error::new(
             ErrorKind::TemplateNotFound,
@@ -166,11 +178,73 @@ impl Error {
         self
     }
 
+    /// Finds an error of a specific type in the chain of sources.
+    ///
+    /// Errors returned by filters, tests and functions are passed through
+    /// the engine unchanged.  This makes it possible to recover an
+    /// application error that was attached with
+    /// [`with_source`](Self::with_source) from the error returned by the
+    /// render call, even if it was wrapped multiple times.
+    ///
+    /// ```
+    /// # use minijinja::{Environment, Error, ErrorKind, State};
+    /// # use std::fmt;
+    /// #[derive(Debug)]
+    /// struct NotFound(String);
+    ///
+    /// impl fmt::Display for NotFound {
+    ///     fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+    ///         write!(f, "{} not found", self.0)
+    ///     }
+    /// }
+    ///
+    /// impl std::error::Error for NotFound {}
+    ///
+    /// fn load_user(_state: &State, id: String) -> Result<String, Error> {
+    ///     Err(Error::new(ErrorKind::InvalidOperation, "could not load user")
+    ///         .with_source(NotFound(id)))
+    /// }
+    ///
+    /// let mut env = Environment::new();
+    /// env.add_function("load_user", load_user);
+    /// env.add_template("user.html", "{{ load_user('peter') }}").unwrap();
+    /// let err = env.get_template("user.html").unwrap().render(()).unwrap_err();
+    /// assert_eq!(err.find_source::<NotFound>().unwrap().0, "peter");
+    /// ```
+    pub fn find_source<E: std::error::Error + 'static>(&self) -> Option<&E> {
+        let mut source = std::error::Error::source(self);
+        while let Some(err) = source {
+            // sources of failed lazy values are shared behind a wrapper
+            #[cfg(feature = "sync")]
+            let err = match err.downcast_ref::<crate::value::LazySource>() {
+                Some(shared) => shared.inner(),
+                None => err,
+            };
+            if let Some(rv) = err.downcast_ref::<E>() {
+                return Some(rv);
+            }
+            source = err.source();
+        }
+        None
+    }
+
+    /// Removes the source from the error.
+    #[cfg(feature = "sync")]
+    pub(crate) fn take_source(&mut self) -> Option<Box<dyn std::error::Error + Send + Sync>> {
+        self.source.take()
+    }
+
     /// Returns the error kind
     pub fn kind(&self) -> ErrorKind {
         self.kind
     }
 
+    /// Returns the error detail.
+    #[cfg_attr(not(feature = "sync"), allow(dead_code))]
+    pub(crate) fn detail(&self) -> Option<&str> {
+        self.detail.as_deref()
+    }
+
     /// Returns the filename.
     pub fn name(&self) -> Option<&str> {
         self.name.as_deref()
@@ -181,6 +255,14 @@ impl Error {
         self.name.as_ref().map(|_| self.lineno)
     }
 
+    /// Returns the span in the template source the error refers to.
+    ///
+    /// This is only known for syntax errors reported by
+    /// [`Environment::check_syntax`](crate::Environment::check_syntax).
+    pub fn span(&self) -> Option<Span> {
+        self.span.as_deref().copied()
+    }
+
     /// Returns the template debug information is available.
     ///
     /// The debug info snapshot is only embedded into the error if the debug
@@ -206,6 +288,7 @@ impl From<ErrorKind> for Error {
             detail: None,
             name: None,
             lineno: 0,
+            span: None,
             source: None,
             #[cfg(feature = "debug")]
             debug_info: None,
@@ -225,6 +308,7 @@ impl serde::ser::Error for Error {
 #[cfg(feature = "debug")]
 mod debug_info {
     use super::*;
+    use crate::pprint::{PrettyPrinter, Repr, ReprLimits};
     use crate::value::Value;
 
     /// This is a snapshot of the debug information.
@@ -234,17 +318,21 @@ mod debug_info {
         pub(crate) template_source: Option<String>,
         pub(crate) context: Option<Value>,
         pub(crate) referenced_names: Option<Vec<String>>,
+        // boxed as errors are moved around a lot
+        pub(crate) repr_limits: Option<Box<ReprLimits>>,
     }
 
-    struct VarPrinter<'x>(Value, &'x [String]);
+    struct VarPrinter<'x>(Value, &'x [String], Option<&'x ReprLimits>);
 
     impl<'x> fmt::Debug for VarPrinter<'x> {
         fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
             let mut m = f.debug_struct("Referenced variables:");
+            let printer = self.2.map(|limits| PrettyPrinter::from(*limits));
             for var in self.1 {
-                match self.0.get_attr(var) {
-                    Ok(val) => m.field(var, &val),
-                    Err(_) => m.field(var, &Value::UNDEFINED),
+                let val = self.0.get_attr(var).unwrap_or(Value::UNDEFINED);
+                match printer {
+                    Some(ref printer) => m.field(var, &Repr(&val, printer)),
+                    None => m.field(var, &val),
                 };
             }
             m.finish()
@@ -301,7 +389,11 @@ mod debug_info {
         if let Some(ctx) = info.context() {
             if let Some(vars) = info.referenced_names() {
                 writeln!(f)?;
-                writeln!(f, "{:#?}", VarPrinter(ctx, vars))?;
+                writeln!(
+                    f,
+                    "{:#?}",
+                    VarPrinter(ctx, vars, info.repr_limits.as_deref())
+                )?;
             }
             write!(f, "{:-^1$}", "", 74).unwrap();
         }
@@ -0,0 +1,176 @@
+//! Support for reusable bundles of engine functionality.
+//!
+//! An [`Extension`] groups filters, tests and global functions together
+//! with hooks that are invoked as templates render.  This makes it possible
+//! to ship reusable functionality (such as internationalization helpers or
+//! asset pipelines) as a single type that is registered with
+//! [`Environment::add_extension`](crate::Environment::add_extension).
+//!
+//! ```rust
+//! # use std::sync::Arc;
+//! # use std::sync::atomic::{AtomicUsize, Ordering};
+//! # use minijinja::{Environment, Error, State, Template};
+//! use minijinja::extensions::Extension;
+//!
+//! struct Shouting {
+//!     renders: Arc<AtomicUsize>,
+//! }
+//!
+//! impl Extension for Shouting {
+//!     fn name(&self) -> &str {
+//!         "shouting"
+//!     }
+//!
+//!     fn register(&self, env: &mut Environment<'_>) {
+//!         env.add_filter("shout", |_: &State, value: String| Ok(value.to_uppercase() + "!"));
+//!     }
+//!
+//!     fn before_render(&self, _template: &Template<'_>) -> Result<(), Error> {
+//!         self.renders.fetch_add(1, Ordering::Relaxed);
+//!         Ok(())
+//!     }
+//! }
+//!
+//! let renders = Arc::new(AtomicUsize::new(0));
+//! let mut env = Environment::new();
+//! env.add_extension(Shouting { renders: renders.clone() });
+//! env.add_template("hello.txt", "{{ 'hello'|shout }}").unwrap();
+//! let tmpl = env.get_template("hello.txt").unwrap();
+//! assert_eq!(tmpl.render(()).unwrap(), "HELLO!");
+//! assert_eq!(renders.load(Ordering::Relaxed), 1);
+//! ```
+use crate::environment::{Environment, Template};
+use crate::error::Error;
+
+/// A bundle of filters, tests, globals and render hooks.
+///
+/// Only [`name`](Self::name) has to be implemented, all other methods have
+/// default implementations that do nothing.
+pub trait Extension: Send + Sync {
+    /// Returns the name of the extension.
+    ///
+    /// Adding an extension to an environment that already has an extension
+    /// with the same name replaces the hooks of the existing extension.
+    fn name(&self) -> &str;
+
+    /// Registers the filters, tests and globals of the extension.
+    ///
+    /// This is invoked once when the extension is added to an environment.
+    fn register(&self, env: &mut Environment<'_>) {
+        let _env = env;
+    }
+
+    /// Invoked before a template is rendered.
+    ///
+    /// This is invoked once per render, also when only some blocks of the
+    /// template are rendered.  Returning an error aborts the rendering with
+    /// that error.  Extensions are invoked in the order they were added.
+    fn before_render(&self, template: &Template<'_>) -> Result<(), Error> {
+        let _template = template;
+        Ok(())
+    }
+
+    /// Invoked after a template was rendered.
+    ///
+    /// If the rendering failed the error is passed.  This is invoked for all
+    /// extensions whose [`before_render`](Self::before_render) succeeded, in
+    /// reverse order, even if a later extension aborted the rendering.
+    fn after_render(&self, template: &Template<'_>, error: Option<&Error>) {
+        let _template = template;
+        let _error = error;
+    }
+}
+
+#[test]
+fn test_extension_hooks() {
+    use std::sync::{Arc, Mutex};
+
+    use crate::ErrorKind;
+
+    struct Recorder(&'static str, Arc<Mutex<Vec<String>>>);
+
+    impl Extension for Recorder {
+        fn name(&self) -> &str {
+            self.0
+        }
+
+        fn register(&self, env: &mut Environment<'_>) {
+            env.add_function("fail", |_: &crate::State| -> Result<String, Error> {
+                Err(Error::new(ErrorKind::InvalidOperation, "failed"))
+            });
+        }
+
+        fn before_render(&self, template: &Template<'_>) -> Result<(), Error> {
+            self.1
+                .lock()
+                .unwrap()
+                .push(format!("{} before {}", self.0, template.name()));
+            Ok(())
+        }
+
+        fn after_render(&self, template: &Template<'_>, error: Option<&Error>) {
+            self.1.lock().unwrap().push(format!(
+                "{} after {} ({:?})",
+                self.0,
+                template.name(),
+                error.map(|x| x.kind())
+            ));
+        }
+    }
+
+    let log = Arc::new(Mutex::new(Vec::new()));
+    let mut env = Environment::new();
+    env.add_extension(Recorder("a", log.clone()));
+    env.add_extension(Recorder("b", log.clone()));
+    env.add_template("ok.txt", "{% include 'fail.txt' ignore missing %}ok")
+        .unwrap();
+    env.add_template("bad.txt", "{{ fail() }}").unwrap();
+    env.add_template(
+        "blocks.txt",
+        "{% block subject %}{% endblock %}{% block text_body %}{% endblock %}",
+    )
+    .unwrap();
+
+    assert_eq!(
+        env.get_template("ok.txt").unwrap().render(()).unwrap(),
+        "ok"
+    );
+    assert!(env.get_template("bad.txt").unwrap().render(()).is_err());
+    assert_eq!(
+        *log.lock().unwrap(),
+        vec![
+            "a before ok.txt",
+            "b before ok.txt",
+            "b after ok.txt (None)",
+            "a after ok.txt (None)",
+            "a before bad.txt",
+            "b before bad.txt",
+            "b after bad.txt (Some(InvalidOperation))",
+            "a after bad.txt (Some(InvalidOperation))",
+        ]
+    );
+
+    // rendering blocks invokes the hooks once
+    log.lock().unwrap().clear();
+    let tmpl = env.get_template("blocks.txt").unwrap();
+    tmpl.render_block("subject", ()).unwrap();
+    tmpl.render_changed_blocks((), ()).unwrap();
+    crate::email::render_email(&tmpl, ()).unwrap();
+    assert_eq!(
+        *log.lock().unwrap(),
+        vec![
+            "a before blocks.txt",
+            "b before blocks.txt",
+            "b after blocks.txt (None)",
+            "a after blocks.txt (None)",
+            "a before blocks.txt",
+            "b before blocks.txt",
+            "b after blocks.txt (None)",
+            "a after blocks.txt (None)",
+            "a before blocks.txt",
+            "b before blocks.txt",
+            "b after blocks.txt (None)",
+            "a after blocks.txt (None)",
+        ]
+    );
+}
@@ -44,10 +44,24 @@
 //!
 //! MiniJinja will perform the necessary conversions automatically via the
 //! [`FunctionArgs`](crate::value::FunctionArgs) and [`Into`] traits.
+//!
+//! # Safe Strings
+//!
+//! Like Jinja2 with MarkupSafe the string filters that cannot introduce
+//! markup keep the safe flag of their input.  These are `upper`, `lower`,
+//! `title`, `trim`, `lstrip`, `rstrip`, `replace`, `indent` and `truncate`.
+//! Strings these filters insert into a safe string, such as the replacement
+//! of `replace`, the prefix of `indent` or the end marker of `truncate`, are
+//! escaped first unless they are safe themselves.  If `replace` is applied
+//! to a string that is not safe but is given a safe argument while auto
+//! escaping is enabled, the string is escaped and the result is safe.
+//! Likewise `join` escapes the items and the joiner and returns a safe
+//! string if any of them is safe.  All other filters that return strings
+//! return plain strings.
 use std::collections::BTreeMap;
 
 use crate::error::Error;
-use crate::utils::HtmlEscape;
+use crate::utils::{find_html_escape, HtmlEscape};
 use crate::value::{ArgType, FunctionArgs, RcType, Value};
 use crate::vm::State;
 
@@ -86,6 +100,30 @@ tuple_impls! { A B C D }
 impl BoxedFilter {
     /// Creates a new boxed filter.
     pub fn new<F, V, Rv, Args>(f: F) -> BoxedFilter
+    where
+        F: Filter<V, Rv, Args>,
+        V: ArgType,
+        Rv: Into<Value>,
+        Args: FunctionArgs,
+    {
+        BoxedFilter::new_impl(f, false)
+    }
+
+    /// Creates a boxed built-in filter that prints or iterates over its input.
+    ///
+    /// Such filters fail for undefined input unless the undefined behavior
+    /// permits printing it.
+    fn new_checked<F, V, Rv, Args>(f: F) -> BoxedFilter
+    where
+        F: Filter<V, Rv, Args>,
+        V: ArgType,
+        Rv: Into<Value>,
+        Args: FunctionArgs,
+    {
+        BoxedFilter::new_impl(f, true)
+    }
+
+    fn new_impl<F, V, Rv, Args>(f: F, check_undefined: bool) -> BoxedFilter
     where
         F: Filter<V, Rv, Args>,
         V: ArgType,
@@ -94,6 +132,9 @@ impl BoxedFilter {
     {
         BoxedFilter(RcType::new(
             move |state, value, args| -> Result<Value, Error> {
+                if check_undefined {
+                    state.check_undefined(&value, false)?;
+                }
                 f.apply_to(
                     state,
                     ArgType::from_value(Some(value))?,
@@ -112,41 +153,96 @@ impl BoxedFilter {
 
 pub(crate) fn get_builtin_filters() -> BTreeMap<&'static str, BoxedFilter> {
     let mut rv = BTreeMap::new();
-    rv.insert("safe", BoxedFilter::new(safe));
-    rv.insert("escape", BoxedFilter::new(escape));
-    rv.insert("e", BoxedFilter::new(escape));
+    rv.insert("safe", BoxedFilter::new_checked(safe));
+    rv.insert("escape", BoxedFilter::new_checked(escape));
+    rv.insert("e", BoxedFilter::new_checked(escape));
+    rv.insert("forceescape", BoxedFilter::new_checked(forceescape));
+    rv.insert("markdown", BoxedFilter::new_checked(markdown));
     #[cfg(feature = "builtins")]
     {
-        rv.insert("lower", BoxedFilter::new(lower));
-        rv.insert("upper", BoxedFilter::new(upper));
-        rv.insert("title", BoxedFilter::new(title));
-        rv.insert("replace", BoxedFilter::new(replace));
-        rv.insert("length", BoxedFilter::new(length));
-        rv.insert("count", BoxedFilter::new(length));
-        rv.insert("dictsort", BoxedFilter::new(dictsort));
-        rv.insert("items", BoxedFilter::new(items));
-        rv.insert("reverse", BoxedFilter::new(reverse));
-        rv.insert("trim", BoxedFilter::new(trim));
-        rv.insert("join", BoxedFilter::new(join));
-        rv.insert("default", BoxedFilter::new(default));
-        rv.insert("round", BoxedFilter::new(round));
-        rv.insert("abs", BoxedFilter::new(abs));
-        rv.insert("first", BoxedFilter::new(first));
-        rv.insert("last", BoxedFilter::new(last));
-        rv.insert("d", BoxedFilter::new(default));
-        rv.insert("list", BoxedFilter::new(list));
-        rv.insert("bool", BoxedFilter::new(bool));
-        rv.insert("batch", BoxedFilter::new(batch));
-        rv.insert("slice", BoxedFilter::new(slice));
+        rv.insert("lower", BoxedFilter::new_checked(lower));
+        rv.insert("upper", BoxedFilter::new_checked(upper));
+        rv.insert("title", BoxedFilter::new_checked(title));
+        rv.insert("replace", BoxedFilter::new_checked(replace));
+        rv.insert("dictsort", BoxedFilter::new_checked(dictsort));
+        rv.insert("items", BoxedFilter::new_checked(items));
+        rv.insert("reverse", BoxedFilter::new_checked(reverse));
+        rv.insert("trim", BoxedFilter::new_checked(trim));
+        rv.insert("lstrip", BoxedFilter::new_checked(lstrip));
+        rv.insert("rstrip", BoxedFilter::new_checked(rstrip));
+        rv.insert("indent", BoxedFilter::new_checked(indent));
+        rv.insert("truncate", BoxedFilter::new_checked(truncate));
+        #[cfg(feature = "unicode")]
+        {
+            rv.insert("graphemes", BoxedFilter::new_checked(graphemes));
+        }
+        rv.insert("join", BoxedFilter::new_checked(join));
+        rv.insert("round", BoxedFilter::new_checked(round));
+        rv.insert("abs", BoxedFilter::new_checked(abs));
+        rv.insert("first", BoxedFilter::new_checked(first));
+        rv.insert("last", BoxedFilter::new_checked(last));
+        rv.insert("sum", BoxedFilter::new_checked(sum));
+        #[cfg(feature = "sync")]
+        {
+            rv.insert("groupby", BoxedFilter::new_checked(groupby));
+        }
+        rv.insert("min", BoxedFilter::new_checked(min));
+        rv.insert("max", BoxedFilter::new_checked(max));
+        rv.insert("list", BoxedFilter::new_checked(list));
+        rv.insert("sort", BoxedFilter::new_checked(sort));
+        rv.insert("unique", BoxedFilter::new_checked(unique));
+        rv.insert("map", BoxedFilter::new_checked(map));
+        rv.insert("select", BoxedFilter::new_checked(select));
+        rv.insert("reject", BoxedFilter::new_checked(reject));
+        rv.insert("selectattr", BoxedFilter::new_checked(selectattr));
+        rv.insert("rejectattr", BoxedFilter::new_checked(rejectattr));
+        rv.insert("selectexpr", BoxedFilter::new_checked(selectexpr));
+        rv.insert("rejectexpr", BoxedFilter::new_checked(rejectexpr));
+        rv.insert("batch", BoxedFilter::new_checked(batch));
+        rv.insert("slice", BoxedFilter::new_checked(slice));
+        rv.insert("pprint", BoxedFilter::new_checked(pprint));
+        rv.insert("escapejs", BoxedFilter::new_checked(escapejs));
+        rv.insert("shell_quote", BoxedFilter::new_checked(shell_quote));
+        rv.insert("regex_escape", BoxedFilter::new_checked(regex_escape));
+        rv.insert("csv", BoxedFilter::new_checked(csv));
+        rv.insert("datetimeformat", BoxedFilter::new_checked(datetimeformat));
+        rv.insert("duration", BoxedFilter::new_checked(duration));
+        rv.insert("filesizeformat", BoxedFilter::new_checked(filesizeformat));
         #[cfg(feature = "json")]
         {
-            rv.insert("tojson", BoxedFilter::new(tojson));
+            rv.insert("tojson", BoxedFilter::new_checked(tojson));
         }
         #[cfg(feature = "urlencode")]
         {
-            rv.insert("urlencode", BoxedFilter::new(urlencode));
+            rv.insert("urlencode", BoxedFilter::new_checked(urlencode));
+        }
+        #[cfg(feature = "encoding")]
+        {
+            rv.insert("b64encode", BoxedFilter::new_checked(b64encode));
+            rv.insert("b64decode", BoxedFilter::new_checked(b64decode));
+            rv.insert("hex", BoxedFilter::new_checked(hex));
+            rv.insert("md5", BoxedFilter::new_checked(md5));
+            rv.insert("sha1", BoxedFilter::new_checked(sha1));
+            rv.insert("sha256", BoxedFilter::new_checked(sha256));
+        }
+        #[cfg(feature = "regex")]
+        {
+            rv.insert("regex_match", BoxedFilter::new_checked(regex_match));
+            rv.insert("regex_search", BoxedFilter::new_checked(regex_search));
+            rv.insert("regex_replace", BoxedFilter::new_checked(regex_replace));
+            rv.insert("regex_findall", BoxedFilter::new_checked(regex_findall));
         }
     }
+
+    // these deal with undefined values themselves
+    #[cfg(feature = "builtins")]
+    {
+        rv.insert("default", BoxedFilter::new(default));
+        rv.insert("d", BoxedFilter::new(default));
+        rv.insert("length", BoxedFilter::new(length));
+        rv.insert("count", BoxedFilter::new(length));
+        rv.insert("bool", BoxedFilter::new(bool));
+    }
     rv
 }
 
@@ -158,27 +254,78 @@ pub fn safe(_state: &State, v: String) -> Result<Value, Error> {
 
 /// HTML escapes a string.
 ///
+/// Values that are already marked as safe are returned unchanged.  If
+/// [`Environment::set_keep_html_entities`](crate::Environment::set_keep_html_entities)
+/// is enabled, entities already in the string are not escaped again.
+///
 /// By default this filter is also registered under the alias `e`.
-pub fn escape(_state: &State, v: Value) -> Result<Value, Error> {
+pub fn escape(state: &State, v: Value) -> Result<Value, Error> {
     // TODO: this ideally understands which type of escaping is in use
     if v.is_safe() {
         Ok(v)
+    } else if v
+        .as_str()
+        .map_or(false, |s| find_html_escape(s.as_bytes()).is_none())
+    {
+        // nothing to escape, the string can be reused as it is
+        Ok(v.into_safe_string())
     } else {
-        Ok(Value::from_safe_string(
-            HtmlEscape(&v.to_string()).to_string(),
-        ))
+        let mut rv = String::new();
+        state
+            .env()
+            .write_html_escaped(&mut rv, &v.to_string())
+            .unwrap();
+        Ok(Value::from_safe_string(rv))
     }
 }
 
+/// HTML escapes a string even if it is marked as safe.
+///
+/// Unlike [`escape`] this escapes every special character including the
+/// ones in existing entities.
+pub fn forceescape(_state: &State, v: Value) -> Result<Value, Error> {
+    Ok(Value::from_safe_string(
+        HtmlEscape(&v.to_string()).to_string(),
+    ))
+}
+
+/// Renders markdown into HTML.
+///
+/// This filter uses the renderer registered with
+/// [`Environment::set_markdown_renderer`](crate::Environment::set_markdown_renderer)
+/// and fails if no renderer was registered.  The result is marked as safe.
+///
+/// ```jinja
+/// <article>{{ post.body|markdown }}</article>
+/// ```
+pub fn markdown(state: &State, v: String) -> Result<Value, Error> {
+    state.env().render_markdown(&v).map(Value::from_safe_string)
+}
+
 #[cfg(feature = "builtins")]
 mod builtins {
     use super::*;
 
+    use crate::datetime::{as_datetime, to_duration};
     use crate::error::ErrorKind;
-    use crate::utils::matches;
-    use crate::value::{ValueKind, ValueRepr};
+    use crate::key::Key;
+    use crate::pprint::PrettyPrinter;
+    #[cfg(feature = "json")]
+    use crate::utils::ScriptSafeJson;
+    use crate::utils::{matches, natural_cmp, AutoEscape, JsEscape};
+    use crate::value::{
+        as_f64, int_as_value, ArgType, DateTime, Duration, Kwargs, ValueKind, ValueRepr,
+    };
+    use std::borrow::Cow;
+    use std::cmp::Ordering;
+    #[cfg(feature = "sync")]
+    use std::collections::HashMap;
+    use std::collections::HashSet;
+    use std::convert::TryFrom;
     use std::fmt::Write;
     use std::mem;
+    #[cfg(feature = "unicode")]
+    use unicode_segmentation::UnicodeSegmentation;
 
     /// Converts a value to uppercase.
     ///
@@ -186,8 +333,8 @@ mod builtins {
     /// <h1>{{ chapter.title|upper }}</h1>
     /// ```
     #[cfg_attr(docsrs, doc(cfg(feature = "builtins")))]
-    pub fn upper(_state: &State, v: String) -> Result<String, Error> {
-        Ok(v.to_uppercase())
+    pub fn upper(_state: &State, v: Value) -> Result<Value, Error> {
+        Ok(keep_safe(&v, v.to_string().to_uppercase()))
     }
 
     /// Converts a value to lowercase.
@@ -196,31 +343,39 @@ mod builtins {
     /// <h1>{{ chapter.title|lower }}</h1>
     /// ```
     #[cfg_attr(docsrs, doc(cfg(feature = "builtins")))]
-    pub fn lower(_state: &State, v: String) -> Result<String, Error> {
-        Ok(v.to_lowercase())
+    pub fn lower(_state: &State, v: Value) -> Result<Value, Error> {
+        Ok(keep_safe(&v, v.to_string().to_lowercase()))
     }
 
     /// Converts a value to title case.
     ///
+    /// Every word starts with an uppercase letter, all other letters are
+    /// lowercased.  Like in Jinja2 a new word starts after whitespace and
+    /// the characters `-`, `(`, `{`, `[` and `<`, so `"they're"` becomes
+    /// `"They're"`.  The optional argument replaces the set of characters
+    /// that start a new word in addition to whitespace.
+    ///
     /// ```jinja
     /// <h1>{{ chapter.title|title }}</h1>
+    /// <p>{{ "snake_case_name"|title("_") }}</p>
     /// ```
     #[cfg_attr(docsrs, doc(cfg(feature = "builtins")))]
-    pub fn title(_state: &State, v: String) -> Result<String, Error> {
+    pub fn title(_state: &State, v: Value, boundaries: Option<String>) -> Result<Value, Error> {
+        let boundaries = boundaries.as_deref().unwrap_or("-({[<");
         let mut rv = String::new();
         let mut capitalize = true;
-        for c in v.chars() {
-            if c.is_ascii_punctuation() || c.is_whitespace() {
+        for c in v.to_string().chars() {
+            if c.is_whitespace() || boundaries.contains(c) {
                 rv.push(c);
                 capitalize = true;
             } else if capitalize {
-                write!(rv, "{}", c.to_uppercase()).unwrap();
+                rv.extend(c.to_uppercase());
                 capitalize = false;
             } else {
-                write!(rv, "{}", c.to_lowercase()).unwrap();
+                rv.extend(c.to_lowercase());
             }
         }
-        Ok(rv)
+        Ok(keep_safe(&v, rv))
     }
 
     /// Does a string replace.
@@ -232,19 +387,37 @@ mod builtins {
     ///   -> Goodbye World
     /// ```
     #[cfg_attr(docsrs, doc(cfg(feature = "builtins")))]
-    pub fn replace(_state: &State, v: String, from: String, to: String) -> Result<String, Error> {
-        Ok(v.replace(&from, &to))
+    pub fn replace(state: &State, v: Value, from: Value, to: Value) -> Result<Value, Error> {
+        if v.is_safe()
+            || ((from.is_safe() || to.is_safe()) && state.auto_escape() != AutoEscape::None)
+        {
+            let v = escape_arg(state, &v);
+            Ok(Value::from_safe_string(v.replace(
+                &escape_arg(state, &from),
+                &escape_arg(state, &to),
+            )))
+        } else {
+            Ok(Value::from(
+                v.to_string().replace(&from.to_string(), &to.to_string()),
+            ))
+        }
     }
 
     /// Returns the "length" of the value
     ///
     /// By default this filter is also registered under the alias `count`.
+    /// Undefined values have a length of 0 unless the undefined behavior is
+    /// strict.
     ///
     /// ```jinja
     /// <p>Search results: {{ results|length }}
     /// ```
     #[cfg_attr(docsrs, doc(cfg(feature = "builtins")))]
-    pub fn length(_state: &State, v: Value) -> Result<Value, Error> {
+    pub fn length(state: &State, v: Value) -> Result<Value, Error> {
+        if v.is_undefined() {
+            state.check_undefined(&v, true)?;
+            return Ok(Value::from(0));
+        }
         v.len().map(Value::from).ok_or_else(|| {
             Error::new(
                 ErrorKind::ImpossibleOperation,
@@ -256,8 +429,19 @@ mod builtins {
     /// Dict sorting functionality.
     ///
     /// This filter works like `|items` but sorts the pairs by key first.
+    /// With `natural=true` string keys are sorted in natural order, that is
+    /// numbers within the keys are compared by value (`item2` before
+    /// `item10`):
+    ///
+    /// ```jinja
+    /// {% for name, file in files|dictsort(natural=true) %}
+    ///   <li>{{ name }}: {{ file.size }}</li>
+    /// {% endfor %}
+    /// ```
     #[cfg_attr(docsrs, doc(cfg(feature = "builtins")))]
-    pub fn dictsort(_state: &State, v: Value) -> Result<Value, Error> {
+    pub fn dictsort(_state: &State, v: Value, kwargs: Kwargs) -> Result<Value, Error> {
+        let natural = kwargs.get::<Option<bool>>("natural")?.unwrap_or(false);
+        kwargs.assert_all_used()?;
         let mut pairs = match v.0 {
             ValueRepr::Map(ref v) => v.iter().collect::<Vec<_>>(),
             _ => {
@@ -267,7 +451,10 @@ mod builtins {
                 ))
             }
         };
-        pairs.sort_by(|a, b| a.0.cmp(b.0));
+        pairs.sort_by(|a, b| match (natural, a.0.as_str(), b.0.as_str()) {
+            (true, Some(a), Some(b)) => natural_cmp(a, b),
+            _ => a.0.cmp(b.0),
+        });
         Ok(Value::from(
             pairs
                 .into_iter()
@@ -295,20 +482,22 @@ mod builtins {
     /// ```
     #[cfg_attr(docsrs, doc(cfg(feature = "builtins")))]
     pub fn items(_state: &State, v: Value) -> Result<Value, Error> {
-        Ok(Value::from(
-            match v.0 {
-                ValueRepr::Map(ref v) => v.iter().collect::<Vec<_>>(),
-                _ => {
-                    return Err(Error::new(
-                        ErrorKind::ImpossibleOperation,
-                        "cannot convert value into pair list",
-                    ))
-                }
+        Ok(Value::from(match v.0 {
+            ValueRepr::Map(ref v) => v
+                .iter()
+                .map(|(k, v)| vec![Value::from(k.clone()), v.clone()])
+                .collect::<Vec<_>>(),
+            ValueRepr::Dynamic(_) => v
+                .iter_as_str_map()
+                .map(|(k, v)| vec![Value::from(k), v])
+                .collect(),
+            _ => {
+                return Err(Error::new(
+                    ErrorKind::ImpossibleOperation,
+                    "cannot convert value into pair list",
+                ))
             }
-            .into_iter()
-            .map(|(k, v)| vec![Value::from(k.clone()), v.clone()])
-            .collect::<Vec<_>>(),
-        ))
+        }))
     }
 
     /// Reverses a list or string
@@ -334,54 +523,321 @@ mod builtins {
         }
     }
 
-    /// Trims a value
+    /// Trims a value.
+    ///
+    /// Like in Jinja2 the optional argument is the set of characters to
+    /// remove from both ends of the string.  If it's not provided (or
+    /// `none`) whitespace is removed.
+    ///
+    /// ```jinja
+    /// {{ "--hello--"|trim("-") }}
+    /// ```
+    #[cfg_attr(docsrs, doc(cfg(feature = "builtins")))]
+    pub fn trim(_state: &State, v: Value, chars: Option<String>) -> Result<Value, Error> {
+        let s = v.to_string();
+        let rv = match chars {
+            Some(chars) => {
+                let chars = chars.chars().collect::<Vec<_>>();
+                s.trim_matches(&chars[..])
+            }
+            None => s.trim(),
+        };
+        Ok(keep_safe(&v, rv.to_string()))
+    }
+
+    /// Removes leading characters from a value.
+    ///
+    /// This works like [`trim`] but only removes characters from the
+    /// start of the string.
+    #[cfg_attr(docsrs, doc(cfg(feature = "builtins")))]
+    pub fn lstrip(_state: &State, v: Value, chars: Option<String>) -> Result<Value, Error> {
+        let s = v.to_string();
+        let rv = match chars {
+            Some(chars) => {
+                let chars = chars.chars().collect::<Vec<_>>();
+                s.trim_start_matches(&chars[..])
+            }
+            None => s.trim_start(),
+        };
+        Ok(keep_safe(&v, rv.to_string()))
+    }
+
+    /// Removes trailing characters from a value.
+    ///
+    /// This works like [`trim`] but only removes characters from the end
+    /// of the string.
     #[cfg_attr(docsrs, doc(cfg(feature = "builtins")))]
-    pub fn trim(_state: &State, s: String, chars: Option<String>) -> Result<String, Error> {
-        match chars {
+    pub fn rstrip(_state: &State, v: Value, chars: Option<String>) -> Result<Value, Error> {
+        let s = v.to_string();
+        let rv = match chars {
             Some(chars) => {
                 let chars = chars.chars().collect::<Vec<_>>();
-                Ok(s.trim_matches(&chars[..]).to_string())
+                s.trim_end_matches(&chars[..])
             }
-            None => Ok(s.trim().to_string()),
+            None => s.trim_end(),
+        };
+        Ok(keep_safe(&v, rv.to_string()))
+    }
+
+    /// Returns the result of a string filter, marked as safe if the input was.
+    fn keep_safe(value: &Value, rv: String) -> Value {
+        if value.is_safe() {
+            Value::from_safe_string(rv)
+        } else {
+            Value::from(rv)
         }
     }
 
-    /// Joins a sequence by a character
+    /// Converts an argument into a string that can be added to a safe string.
+    ///
+    /// Unless the argument is safe itself it's HTML escaped.
+    fn escape_arg(state: &State, arg: &Value) -> String {
+        if arg.is_safe() {
+            arg.to_string()
+        } else {
+            let mut rv = String::new();
+            state
+                .env()
+                .write_html_escaped(&mut rv, &arg.to_string())
+                .unwrap();
+            rv
+        }
+    }
+
+    /// Splits keyword arguments from an optional positional argument.
+    ///
+    /// If only keyword arguments are passed the map ends up in the place of
+    /// the positional argument.
+    fn split_kwargs(arg: Option<Value>, kwargs: Kwargs) -> Result<(Option<Value>, Kwargs), Error> {
+        match arg {
+            Some(arg) if arg.kind() == ValueKind::Map => Ok((None, Kwargs::from_value(Some(arg))?)),
+            arg => Ok((arg, kwargs)),
+        }
+    }
+
+    /// Returns the byte offsets where the characters of a string start.
+    ///
+    /// With the `unicode` feature grapheme clusters are used instead of
+    /// characters.
+    fn text_unit_offsets(s: &str) -> Vec<usize> {
+        #[cfg(feature = "unicode")]
+        {
+            s.grapheme_indices(true).map(|x| x.0).collect()
+        }
+        #[cfg(not(feature = "unicode"))]
+        {
+            s.char_indices().map(|x| x.0).collect()
+        }
+    }
+
+    /// Truncates a string to a given length.
+    ///
+    /// If the string is longer than `length` it's cut off and `end` (which
+    /// defaults to `...`) is appended so that the result is `length`
+    /// characters long.  Unless `killwords` is true the cut is moved back to
+    /// the last space so that words are not split.  Strings that exceed the
+    /// length by no more than `leeway` (defaults to 5) are not truncated.
+    /// The default length is 255.  All arguments other than `length` must be
+    /// passed as keyword arguments.
+    ///
+    /// The length is counted in characters (Unicode scalar values) which
+    /// means that a cut can split characters that are composed of multiple
+    /// scalar values such as many emoji.  With the `unicode` feature the
+    /// length is counted in grapheme clusters instead and these are never
+    /// split.
+    ///
+    /// ```jinja
+    /// {{ post.body|truncate(200) }}
+    /// {{ title|truncate(20, killwords=true, end="…", leeway=0) }}
+    /// ```
     #[cfg_attr(docsrs, doc(cfg(feature = "builtins")))]
-    pub fn join(_state: &State, val: Value, joiner: Option<String>) -> Result<String, Error> {
-        if val.is_undefined() || val.is_none() {
-            return Ok(String::new());
+    pub fn truncate(
+        state: &State,
+        value: Value,
+        length: Option<Value>,
+        kwargs: Kwargs,
+    ) -> Result<Value, Error> {
+        let (length, kwargs) = split_kwargs(length, kwargs)?;
+        let length = match length {
+            Some(length) => usize::try_from(length)?,
+            None => kwargs.get::<Option<usize>>("length")?.unwrap_or(255),
+        };
+        let killwords = kwargs.get::<Option<bool>>("killwords")?.unwrap_or(false);
+        let end = kwargs
+            .get::<Option<Value>>("end")?
+            .unwrap_or_else(|| Value::from("..."));
+        let leeway = kwargs.get::<Option<usize>>("leeway")?.unwrap_or(5);
+        kwargs.assert_all_used()?;
+
+        let s = value.to_string();
+        let offsets = text_unit_offsets(&s);
+        if offsets.len() <= length.saturating_add(leeway) {
+            return Ok(keep_safe(&value, s));
+        }
+        let end = if value.is_safe() {
+            escape_arg(state, &end)
+        } else {
+            end.to_string()
+        };
+        let end_len = text_unit_offsets(&end).len();
+        if end_len > length {
+            return Err(Error::new(
+                ErrorKind::InvalidArguments,
+                "length must not be shorter than the end marker",
+            ));
         }
+        let mut rv = &s[..offsets[length - end_len]];
+        if !killwords {
+            if let Some(idx) = rv.rfind(' ') {
+                rv = &rv[..idx];
+            }
+        }
+        Ok(keep_safe(&value, format!("{}{}", rv, end)))
+    }
 
-        let joiner = joiner.as_ref().map_or("", |x| x.as_str());
+    /// Splits a string into its grapheme clusters.
+    ///
+    /// A grapheme cluster is what a user perceives as a single character
+    /// such as an emoji with a skin tone modifier or a letter with combining
+    /// accents.  Slicing a string works on Unicode scalar values and can
+    /// split such characters, slicing the list of graphemes does not.
+    ///
+    /// This filter is only available if the `unicode` feature is enabled.
+    ///
+    /// ```jinja
+    /// {{ (name|graphemes)[:1]|join }}
+    /// ```
+    #[cfg_attr(docsrs, doc(cfg(all(feature = "builtins", feature = "unicode"))))]
+    #[cfg(feature = "unicode")]
+    pub fn graphemes(_: &State, value: String) -> Result<Value, Error> {
+        Ok(Value::from(
+            value.graphemes(true).map(Value::from).collect::<Vec<_>>(),
+        ))
+    }
 
-        if let Some(s) = val.as_str() {
-            let mut rv = String::new();
-            for c in s.chars() {
-                if !rv.is_empty() {
-                    rv.push_str(joiner);
+    /// Indents the lines of a string.
+    ///
+    /// The `width` is either the number of spaces to indent with (defaults
+    /// to 4) or a string that is used as the prefix, for instance `"\t"` or
+    /// `"> "`.  Numeric widths are limited to 1024 spaces.  The first line
+    /// and blank lines are not indented unless the `first` or `blank`
+    /// keyword arguments are set to true.
+    ///
+    /// ```jinja
+    /// <pre>
+    ///   {{ code|indent(2) }}
+    /// </pre>
+    /// {{ reply|indent("> ", first=true) }}
+    /// ```
+    #[cfg_attr(docsrs, doc(cfg(feature = "builtins")))]
+    pub fn indent(
+        state: &State,
+        value: Value,
+        width: Option<Value>,
+        kwargs: Kwargs,
+    ) -> Result<Value, Error> {
+        let (width, kwargs) = split_kwargs(width, kwargs)?;
+        let width = match width {
+            Some(width) => Some(width),
+            None => kwargs.get("width")?,
+        };
+        let prefix = match width {
+            None => "    ".to_string(),
+            Some(width) if width.as_str().is_some() => {
+                if value.is_safe() {
+                    escape_arg(state, &width)
+                } else {
+                    width.to_string()
                 }
-                rv.push(c);
             }
-            Ok(rv)
-        } else if matches!(val.kind(), ValueKind::Seq) {
-            let mut rv = String::new();
-            for item in val.try_into_vec()? {
-                if !rv.is_empty() {
-                    rv.push_str(joiner);
-                }
-                if let Some(s) = item.as_str() {
-                    rv.push_str(s);
-                } else {
-                    write!(rv, "{}", item).ok();
+            Some(width) => {
+                const MAX_WIDTH: usize = 1024;
+                let width = usize::try_from(width)?;
+                if width > MAX_WIDTH {
+                    return Err(Error::new(
+                        ErrorKind::InvalidArguments,
+                        format!("indent width must be at most {}", MAX_WIDTH),
+                    ));
                 }
+                " ".repeat(width)
+            }
+        };
+        let first = kwargs.get::<Option<bool>>("first")?.unwrap_or(false);
+        let blank = kwargs.get::<Option<bool>>("blank")?.unwrap_or(false);
+        kwargs.assert_all_used()?;
+
+        let s = value.to_string();
+        state.check_memory(s.len() + prefix.len() * (s.matches('\n').count() + 1))?;
+        let mut rv = String::with_capacity(s.len());
+        for (idx, line) in s.split('\n').enumerate() {
+            if idx > 0 {
+                rv.push('\n');
             }
-            Ok(rv)
+            if (idx > 0 || first) && (blank || !line.is_empty()) {
+                rv.push_str(&prefix);
+            }
+            rv.push_str(line);
+        }
+        Ok(keep_safe(&value, rv))
+    }
+
+    /// Joins a sequence by a character
+    ///
+    /// If HTML auto escaping is enabled and the joiner or one of the items
+    /// is a safe string, the other items and the joiner are escaped and the
+    /// result is safe.
+    ///
+    /// ```jinja
+    /// {{ users|map(attribute="name")|join(", ") }}
+    /// {{ links|join("<br>"|safe) }}
+    /// ```
+    #[cfg_attr(docsrs, doc(cfg(feature = "builtins")))]
+    pub fn join(state: &State, val: Value, joiner: Option<Value>) -> Result<Value, Error> {
+        if val.is_undefined() || val.is_none() {
+            return Ok(Value::from(""));
+        }
+
+        let items = if let Some(s) = val.as_str() {
+            s.chars().map(|c| Value::from(c.to_string())).collect()
+        } else if matches!(val.kind(), ValueKind::Seq) {
+            val.try_into_vec()?
         } else {
-            Err(Error::new(
+            return Err(Error::new(
                 ErrorKind::ImpossibleOperation,
                 format!("cannot join value of type {}", val.kind()),
-            ))
+            ));
+        };
+
+        let markup = state.auto_escape() == AutoEscape::Html
+            && (joiner.as_ref().map_or(false, |x| x.is_safe())
+                || items.iter().any(|x| x.is_safe()));
+        let joiner = match joiner {
+            Some(joiner) if markup => escape_arg(state, &joiner),
+            Some(joiner) => joiner.to_string(),
+            None => String::new(),
+        };
+
+        let mut rv = String::new();
+        let mut buf = String::new();
+        for (idx, item) in items.iter().enumerate() {
+            let piece = if markup {
+                Cow::Owned(escape_arg(state, item))
+            } else if let Some(s) = item.as_str() {
+                Cow::Borrowed(s)
+            } else {
+                buf.clear();
+                write!(buf, "{}", item).ok();
+                Cow::Borrowed(buf.as_str())
+            };
+            let sep = if idx > 0 { joiner.as_str() } else { "" };
+            state.check_memory(rv.len() + sep.len() + piece.len())?;
+            rv.push_str(sep);
+            rv.push_str(&piece);
+        }
+        if markup {
+            Ok(Value::from_safe_string(rv))
+        } else {
+            Ok(Value::from(rv))
         }
     }
 
@@ -391,6 +847,13 @@ mod builtins {
     /// ```jinja
     /// <p>{{ my_variable|default("my_variable was not defined") }}</p>
     /// ```
+    ///
+    /// Attributes of undefined values can be defaulted too which also works
+    /// with strict undefined behavior:
+    ///
+    /// ```jinja
+    /// <p>{{ user.name|default("anonymous") }}</p>
+    /// ```
     #[cfg_attr(docsrs, doc(cfg(feature = "builtins")))]
     pub fn default(_: &State, value: Value, other: Option<Value>) -> Result<Value, Error> {
         Ok(if value.is_undefined() {
@@ -421,20 +884,73 @@ mod builtins {
 
     /// Round the number to a given precision.
     ///
-    /// Round the number to a given precision. The first parameter specifies the
-    /// precision (default is 0).
+    /// The first parameter specifies the precision (default is 0).  A
+    /// negative precision rounds to tens, hundreds and so on.  The `method`
+    /// keyword argument picks how to round:
+    ///
+    /// * `common`: rounds half away from zero (default)
+    /// * `half_even`: rounds half to the nearest even digit (banker's rounding)
+    /// * `ceil`: always rounds up
+    /// * `floor`: always rounds down
+    ///
+    /// Floats stay floats.  Integers stay integers and are only changed by
+    /// a negative precision.
     ///
     /// ```jinja
     /// {{ 42.55|round }}
     ///   -> 43.0
+    /// {{ 2.5|round(method="half_even") }}
+    ///   -> 2.0
+    /// {{ 1250|round(-2, method="half_even") }}
+    ///   -> 1200
     /// ```
     #[cfg_attr(docsrs, doc(cfg(feature = "builtins")))]
-    pub fn round(_: &State, value: Value, precision: Option<i32>) -> Result<Value, Error> {
+    pub fn round(
+        _: &State,
+        value: Value,
+        precision: Option<Value>,
+        kwargs: Kwargs,
+    ) -> Result<Value, Error> {
+        let (precision, kwargs) = split_kwargs(precision, kwargs)?;
+        let precision = match precision {
+            Some(precision) => i32::try_from(precision)?,
+            None => kwargs.get::<Option<i32>>("precision")?.unwrap_or(0),
+        };
+        let method = kwargs.get::<Option<String>>("method")?;
+        kwargs.assert_all_used()?;
+        let method = match method.as_deref() {
+            None | Some("common") => RoundMethod::Common,
+            Some("half_even") => RoundMethod::HalfEven,
+            Some("ceil") => RoundMethod::Ceil,
+            Some("floor") => RoundMethod::Floor,
+            Some(other) => {
+                return Err(Error::new(
+                    ErrorKind::InvalidArguments,
+                    format!("unknown rounding method '{}'", other),
+                ))
+            }
+        };
+
         match value.0 {
-            ValueRepr::I64(_) | ValueRepr::I128(_) => Ok(value),
             ValueRepr::F64(val) => {
-                let x = 10f64.powi(precision.unwrap_or(0));
-                Ok(Value::from((x * val).round() / x))
+                let x = 10f64.powi(precision);
+                Ok(Value::from(method.round_float(x * val) / x))
+            }
+            ValueRepr::I64(_) | ValueRepr::I128(_) | ValueRepr::U64(_) | ValueRepr::U128(_) => {
+                let val = i128::try_from(value.clone())?;
+                if precision >= 0 {
+                    return Ok(int_as_value(val));
+                }
+                let step = match 10i128.checked_pow(precision.wrapping_neg() as u32) {
+                    Some(step) => step,
+                    None => return Ok(Value::from(0)),
+                };
+                method
+                    .round_int(val, step)
+                    .map(int_as_value)
+                    .ok_or_else(|| {
+                        Error::new(ErrorKind::ImpossibleOperation, "rounded value overflows")
+                    })
             }
             _ => Err(Error::new(
                 ErrorKind::ImpossibleOperation,
@@ -443,9 +959,54 @@ mod builtins {
         }
     }
 
+    #[derive(Copy, Clone)]
+    enum RoundMethod {
+        Common,
+        HalfEven,
+        Ceil,
+        Floor,
+    }
+
+    impl RoundMethod {
+        fn round_float(self, val: f64) -> f64 {
+            match self {
+                RoundMethod::Common => val.round(),
+                RoundMethod::HalfEven => {
+                    let rounded = val.round();
+                    if (val - val.trunc()).abs() == 0.5 {
+                        2.0 * (val / 2.0).round()
+                    } else {
+                        rounded
+                    }
+                }
+                RoundMethod::Ceil => val.ceil(),
+                RoundMethod::Floor => val.floor(),
+            }
+        }
+
+        /// Rounds an integer to a multiple of `step`.
+        fn round_int(self, val: i128, step: i128) -> Option<i128> {
+            let (quot, rem) = (val.div_euclid(step), val.rem_euclid(step));
+            let half = rem.checked_mul(2)?.cmp(&step);
+            let up = match self {
+                RoundMethod::Common => {
+                    half == Ordering::Greater || (half == Ordering::Equal && quot >= 0)
+                }
+                RoundMethod::HalfEven => {
+                    half == Ordering::Greater
+                        || (half == Ordering::Equal && quot.rem_euclid(2) == 1)
+                }
+                RoundMethod::Ceil => rem > 0,
+                RoundMethod::Floor => false,
+            };
+            quot.checked_add(up as i128)?.checked_mul(step)
+        }
+    }
+
     /// Returns the first item from a list.
     ///
-    /// If the list is empty `undefined` is returned.
+    /// If the list is empty `undefined` is returned.  For maps the first key
+    /// is returned.
     ///
     /// ```jinja
     /// <dl>
@@ -460,6 +1021,19 @@ mod builtins {
                 Ok(s.chars().next().map_or(Value::UNDEFINED, Value::from))
             }
             ValueRepr::Seq(ref s) => Ok(s.first().cloned().unwrap_or(Value::UNDEFINED)),
+            ValueRepr::Map(ref m) => Ok(m
+                .keys()
+                .next()
+                .cloned()
+                .map_or(Value::UNDEFINED, Value::from)),
+            ValueRepr::Dynamic(ref obj) => match obj.iterate() {
+                Some(mut iter) => Ok(iter.next().unwrap_or(Value::UNDEFINED)),
+                None => Err(Error::new(
+                    ErrorKind::ImpossibleOperation,
+                    "cannot get first item from value",
+                )),
+            },
+            ValueRepr::Undefined => Ok(Value::UNDEFINED),
             _ => Err(Error::new(
                 ErrorKind::ImpossibleOperation,
                 "cannot get first item from value",
@@ -469,7 +1043,8 @@ mod builtins {
 
     /// Returns the last item from a list.
     ///
-    /// If the list is empty `undefined` is returned.
+    /// If the list is empty `undefined` is returned.  For maps the last key
+    /// is returned.
     ///
     /// ```jinja
     /// <h2>Most Recent Update</h2>
@@ -489,6 +1064,12 @@ mod builtins {
                 Ok(s.chars().rev().next().map_or(Value::UNDEFINED, Value::from))
             }
             ValueRepr::Seq(ref s) => Ok(s.last().cloned().unwrap_or(Value::UNDEFINED)),
+            ValueRepr::Map(ref m) => Ok(m
+                .keys()
+                .next_back()
+                .cloned()
+                .map_or(Value::UNDEFINED, Value::from)),
+            ValueRepr::Undefined => Ok(Value::UNDEFINED),
             _ => Err(Error::new(
                 ErrorKind::ImpossibleOperation,
                 "cannot get last item from value",
@@ -496,6 +1077,87 @@ mod builtins {
         }
     }
 
+    /// Returns the sum of a sequence of numbers.
+    ///
+    /// With `attribute` the values of that attribute (eg: `item.price`) are
+    /// summed up instead of the items.  The sum starts with the value of
+    /// `start` which defaults to `0`.
+    ///
+    /// ```jinja
+    /// Total: {{ items|sum(attribute="price") }}
+    /// ```
+    #[cfg_attr(docsrs, doc(cfg(feature = "builtins")))]
+    pub fn sum(_: &State, value: Value, kwargs: Kwargs) -> Result<Value, Error> {
+        let attribute = kwargs.get::<Option<String>>("attribute")?;
+        let mut rv = kwargs
+            .get::<Option<Value>>("start")?
+            .unwrap_or_else(|| Value::from(0));
+        kwargs.assert_all_used()?;
+        for item in value.iter() {
+            let item = match attribute {
+                Some(ref path) => get_path(&item, path)?,
+                None => item,
+            };
+            rv = crate::value::add(&rv, &item)?;
+        }
+        Ok(rv)
+    }
+
+    /// Returns the smallest item of a sequence.
+    ///
+    /// If the sequence is empty `undefined` is returned.  With `attribute`
+    /// the items are compared by that attribute (eg: `user.age`) but the
+    /// item itself is returned.  Strings are compared ignoring case unless
+    /// `case_sensitive` is enabled.
+    ///
+    /// ```jinja
+    /// Youngest: {{ (users|min(attribute="age")).name }}
+    /// ```
+    #[cfg_attr(docsrs, doc(cfg(feature = "builtins")))]
+    pub fn min(_: &State, value: Value, kwargs: Kwargs) -> Result<Value, Error> {
+        min_or_max(value, kwargs, Ordering::Less)
+    }
+
+    /// Returns the largest item of a sequence.
+    ///
+    /// This accepts the same arguments as [`min`].
+    ///
+    /// ```jinja
+    /// Most expensive: {{ (items|max(attribute="price")).name }}
+    /// ```
+    #[cfg_attr(docsrs, doc(cfg(feature = "builtins")))]
+    pub fn max(_: &State, value: Value, kwargs: Kwargs) -> Result<Value, Error> {
+        min_or_max(value, kwargs, Ordering::Greater)
+    }
+
+    fn min_or_max(value: Value, kwargs: Kwargs, want: Ordering) -> Result<Value, Error> {
+        let attribute = kwargs.get::<Option<String>>("attribute")?;
+        let case_sensitive = kwargs
+            .get::<Option<bool>>("case_sensitive")?
+            .unwrap_or(false);
+        kwargs.assert_all_used()?;
+
+        let mut rv: Option<(Value, Value)> = None;
+        for item in value.iter() {
+            let key = match attribute {
+                Some(ref path) => get_path(&item, path)?,
+                None => item.clone(),
+            };
+            let key = match key.as_str() {
+                Some(s) if !case_sensitive => Value::from(s.to_lowercase()),
+                _ => key,
+            };
+            let replace = match rv {
+                Some((ref best, _)) => key.partial_cmp(best) == Some(want),
+                None => true,
+            };
+            if replace {
+                rv = Some((key, item));
+            }
+        }
+        Ok(rv.map_or(Value::UNDEFINED, |x| x.1))
+    }
+
     /// Converts the input value into a list.
     ///
     /// If the value is already a list, then it's returned unchanged.
@@ -515,6 +1177,13 @@ mod builtins {
                     .map(|x| Value::from(x.0.clone()))
                     .collect::<Vec<_>>(),
             )),
+            ValueRepr::Dynamic(ref obj) => match obj.iterate() {
+                Some(iter) => Ok(Value::from(iter.collect::<Vec<_>>())),
+                None => Err(Error::new(
+                    ErrorKind::ImpossibleOperation,
+                    "cannot convert value to list",
+                )),
+            },
             _ => Err(Error::new(
                 ErrorKind::ImpossibleOperation,
                 "cannot convert value to list",
@@ -527,7 +1196,8 @@ mod builtins {
     /// This behaves the same as the if statement does with regards to
     /// handling of boolean values.
     #[cfg_attr(docsrs, doc(cfg(feature = "builtins")))]
-    pub fn bool(_: &State, value: Value) -> Result<bool, Error> {
+    pub fn bool(state: &State, value: Value) -> Result<bool, Error> {
+        state.check_undefined(&value, true)?;
         Ok(value.is_true())
     }
 
@@ -551,6 +1221,9 @@ mod builtins {
     ///
     /// If you pass it a second argument it’s used to fill missing values on the
     /// last iteration.
+    ///
+    /// As the size of the slices depends on the number of items a lazy
+    /// iterable is read completely.  Use `batch` to chunk streams.
     pub fn slice(
         _: &State,
         value: Value,
@@ -604,16 +1277,44 @@ mod builtins {
     ///   {% endfor %}
     /// </table>
     /// ```
+    ///
+    /// If the value is a lazy iterable (such as a stream) the batches are
+    /// produced lazily as well, so only one batch is kept in memory at a time.
     pub fn batch(
         _: &State,
         value: Value,
         count: usize,
         fill_with: Option<Value>,
     ) -> Result<Value, Error> {
-        let mut rv = Vec::new();
+        let iter = value.iter();
+
+        #[cfg(feature = "sync")]
+        {
+            if iter.known_len().is_none() {
+                let mut iter = iter;
+                if count == 0 {
+                    return Err(Error::new(
+                        ErrorKind::InvalidArguments,
+                        "cannot batch a stream into batches of zero items",
+                    ));
+                }
+                return Ok(Value::from_iterator(std::iter::from_fn(move || {
+                    let mut batch = iter.by_ref().take(count).collect::<Vec<_>>();
+                    if batch.is_empty() {
+                        return None;
+                    }
+                    if let Some(ref filler) = fill_with {
+                        batch.resize(count, filler.clone());
+                    }
+                    Some(Value::from(batch))
+                })));
+            }
+        }
+
+        let mut rv = Vec::new();
         let mut tmp = Vec::with_capacity(count);
 
-        for item in value.iter() {
+        for item in iter {
             if tmp.len() == count {
                 rv.push(Value::from(mem::replace(
                     &mut tmp,
@@ -635,11 +1336,907 @@ mod builtins {
         Ok(Value::from(rv))
     }
 
+    /// Sorts a sequence.
+    ///
+    /// The sort is stable.  It accepts the following keyword arguments:
+    ///
+    /// * `reverse`: sorts in descending order.
+    /// * `case_sensitive`: unless enabled strings are compared ignoring case.
+    /// * `attribute`: sorts by an attribute (eg: `user.name`) of the items.
+    ///   Multiple attributes can be separated by commas (eg: `"name,age"`),
+    ///   later attributes are used if the earlier ones are equal.  An
+    ///   attribute prefixed with `-` is sorted in descending order.
+    /// * `strict`: fails if two items cannot be compared (eg: a string and
+    ///   a number).  Otherwise such items are ordered by their kind: none
+    ///   and undefined come first, followed by numbers, strings, bytes,
+    ///   sequences and maps.  `NaN` is placed after all other numbers.
+    /// * `natural`: sorts strings in natural order, that is numbers within
+    ///   the strings are compared by value (`file2.txt` before `file10.txt`).
+    /// * `nulls`: either `"first"` or `"last"` to place `none` and undefined
+    ///   values before or after all other values, independent of the sort
+    ///   direction.
+    ///
+    /// ```jinja
+    /// {% for user in users|sort(attribute="name", reverse=true) %}
+    ///   <li>{{ user.name }}</li>
+    /// {% endfor %}
+    /// {% for user in users|sort(attribute="-age,name", nulls="last") %}
+    ///   <li>{{ user.name }} ({{ user.age }})</li>
+    /// {% endfor %}
+    /// {{ ["v1.10", "v1.9"]|sort(natural=true) }}
+    ///   -> ["v1.9", "v1.10"]
+    /// ```
+    #[cfg_attr(docsrs, doc(cfg(feature = "builtins")))]
+    pub fn sort(_: &State, value: Value, kwargs: Kwargs) -> Result<Value, Error> {
+        let reverse = kwargs.get::<Option<bool>>("reverse")?.unwrap_or(false);
+        let case_sensitive = kwargs
+            .get::<Option<bool>>("case_sensitive")?
+            .unwrap_or(false);
+        let attribute = kwargs.get::<Option<String>>("attribute")?;
+        let strict = kwargs.get::<Option<bool>>("strict")?.unwrap_or(false);
+        let natural = kwargs.get::<Option<bool>>("natural")?.unwrap_or(false);
+        let nulls_first = match kwargs.get::<Option<String>>("nulls")?.as_deref() {
+            None => None,
+            Some("first") => Some(true),
+            Some("last") => Some(false),
+            Some(other) => {
+                return Err(Error::new(
+                    ErrorKind::InvalidArguments,
+                    format!("nulls must be \"first\" or \"last\", got {:?}", other),
+                ))
+            }
+        };
+        kwargs.assert_all_used()?;
+
+        // the paths to sort by and if they are sorted in descending order.
+        let keys = match attribute {
+            Some(ref attribute) => attribute
+                .split(',')
+                .map(|path| {
+                    let path = path.trim();
+                    match path.strip_prefix('-') {
+                        Some(path) => (Some(path), true),
+                        None => (Some(path), false),
+                    }
+                })
+                .collect::<Vec<_>>(),
+            None => vec![(None, false)],
+        };
+
+        let mut items = Vec::new();
+        for item in value.iter() {
+            let mut values = Vec::with_capacity(keys.len());
+            for &(path, _) in keys.iter() {
+                let key = match path {
+                    Some(path) => get_path(&item, path)?,
+                    None => item.clone(),
+                };
+                values.push(match key.as_str() {
+                    Some(s) if !case_sensitive => Value::from(s.to_lowercase()),
+                    _ => key,
+                });
+            }
+            items.push((values, item));
+        }
+
+        let mut err = None;
+        let mut compare = |a: &Value, b: &Value, descending: bool| {
+            if let Some(nulls_first) = nulls_first {
+                let a_null = a.is_none() || a.is_undefined();
+                let b_null = b.is_none() || b.is_undefined();
+                if a_null || b_null {
+                    return match (a_null, b_null) {
+                        (true, true) => Ordering::Equal,
+                        (true, false) if nulls_first => Ordering::Less,
+                        (false, true) if !nulls_first => Ordering::Less,
+                        _ => Ordering::Greater,
+                    };
+                }
+            }
+            let ordering = match (natural, a.as_str(), b.as_str()) {
+                (true, Some(x), Some(y)) => Some(natural_cmp(x, y)),
+                _ => a.partial_cmp(b),
+            };
+            let ordering = match ordering {
+                Some(ordering) => ordering,
+                None => {
+                    if strict && err.is_none() {
+                        err = Some(Error::new(
+                            ErrorKind::ImpossibleOperation,
+                            format!("cannot compare {} with {}", a.kind(), b.kind()),
+                        ));
+                    }
+                    fallback_cmp(a, b)
+                }
+            };
+            if descending != reverse {
+                ordering.reverse()
+            } else {
+                ordering
+            }
+        };
+        items.sort_by(|a, b| {
+            a.0.iter()
+                .zip(b.0.iter())
+                .zip(keys.iter())
+                .map(|((a, b), &(_, descending))| compare(a, b, descending))
+                .find(|&ordering| ordering != Ordering::Equal)
+                .unwrap_or(Ordering::Equal)
+        });
+        match err {
+            Some(err) => Err(err),
+            None => Ok(Value::from(
+                items.into_iter().map(|x| x.1).collect::<Vec<_>>(),
+            )),
+        }
+    }
+
+    /// Orders values that cannot be compared with each other.
+    ///
+    /// This gives the sort filter a total order so that it is deterministic
+    /// for sequences of mixed values.
+    fn fallback_cmp(a: &Value, b: &Value) -> Ordering {
+        fn rank(value: &Value) -> u8 {
+            match value.kind() {
+                ValueKind::Undefined => 0,
+                ValueKind::None => 1,
+                ValueKind::Bool | ValueKind::Number => 2,
+                ValueKind::Char | ValueKind::String => 3,
+                ValueKind::Bytes => 4,
+                ValueKind::Seq => 5,
+                ValueKind::Map => 6,
+            }
+        }
+
+        match rank(a).cmp(&rank(b)) {
+            Ordering::Equal => {}
+            ordering => return ordering,
+        }
+        match a.kind() {
+            // numbers only fail to compare if one of them is NaN
+            ValueKind::Bool | ValueKind::Number => {
+                let is_nan = |x: &Value| as_f64(x).map_or(false, f64::is_nan);
+                is_nan(a).cmp(&is_nan(b))
+            }
+            ValueKind::Seq => {
+                let mut a = a.iter();
+                let mut b = b.iter();
+                loop {
+                    match (a.next(), b.next()) {
+                        (Some(a), Some(b)) => {
+                            match a.partial_cmp(&b).unwrap_or_else(|| fallback_cmp(&a, &b)) {
+                                Ordering::Equal => {}
+                                ordering => return ordering,
+                            }
+                        }
+                        (Some(_), None) => return Ordering::Greater,
+                        (None, Some(_)) => return Ordering::Less,
+                        (None, None) => return Ordering::Equal,
+                    }
+                }
+            }
+            _ => Ordering::Equal,
+        }
+    }
+
+    /// Groups a sequence of objects by an attribute.
+    ///
+    /// The result is a list of groups, each group has a `grouper` attribute
+    /// with the value of the attribute and a `list` attribute with the items
+    /// in that group.  A group can also be unpacked into these two values.
+    /// The attribute can be a dotted path (eg: `address.city`).  It accepts
+    /// the following keyword arguments:
+    ///
+    /// * `default`: the value used for items that do not have the attribute.
+    /// * `case_sensitive`: unless enabled strings are grouped ignoring case.
+    ///   The grouper then has the case of the first item of the group.
+    /// * `sort`: the groups are sorted by the grouper unless this is set to
+    ///   `false` in which case they are in the order in which the groups
+    ///   were first seen in the input.  Groupers that cannot be compared
+    ///   with each other are ordered like in the [`sort`] filter.
+    ///
+    /// The groups are computed eagerly since a group is only complete once
+    /// the whole input was seen, even if the groups are not sorted.
+    ///
+    /// ```jinja
+    /// <ul>{% for city, items in users|groupby("city") %}
+    ///   <li>{{ city }}: {{ items|map(attribute="name")|join(", ") }}
+    /// {% endfor %}</ul>
+    /// {% for group in entries|groupby("date", sort=false) %}
+    ///   <h2>{{ group.grouper }}</h2>
+    ///   {% for entry in group.list %}...{% endfor %}
+    /// {% endfor %}
+    /// ```
+    ///
+    /// This filter is only available if the `sync` feature is enabled.
+    #[cfg_attr(docsrs, doc(cfg(all(feature = "builtins", feature = "sync"))))]
+    #[cfg(feature = "sync")]
+    pub fn groupby(
+        _: &State,
+        value: Value,
+        attribute: String,
+        kwargs: Kwargs,
+    ) -> Result<Value, Error> {
+        let default = kwargs.get::<Option<Value>>("default")?;
+        let case_sensitive = kwargs
+            .get::<Option<bool>>("case_sensitive")?
+            .unwrap_or(false);
+        let sort = kwargs.get::<Option<bool>>("sort")?.unwrap_or(true);
+        kwargs.assert_all_used()?;
+
+        // groups are (key, grouper, items) where the key is the grouper
+        // folded to lowercase for case insensitive grouping.  Groups with
+        // keys that can be hashed are found through the index, the others
+        // (such as sequences and objects) are compared one by one.  Like in
+        // unique, objects can be equal to strings or numbers, so those are
+        // also compared with these groups.
+        let mut groups: Vec<(Value, Value, Vec<Value>)> = Vec::new();
+        let mut index = HashMap::new();
+        let mut other_groups: Vec<usize> = Vec::new();
+        for item in value.iter() {
+            let grouper = match (get_path(&item, &attribute)?, &default) {
+                (grouper, Some(default)) if grouper.is_undefined() => default.clone(),
+                (grouper, _) => grouper,
+            };
+            let key = match grouper.as_str() {
+                Some(s) if !case_sensitive => Value::from(s.to_lowercase()),
+                _ => grouper.clone(),
+            };
+            let unique_key = unique_key(&key);
+            let existing = match unique_key {
+                Some(ref unique_key) => index.get(unique_key).copied().or_else(|| {
+                    other_groups
+                        .iter()
+                        .copied()
+                        .find(|&idx| groups[idx].0 == key)
+                }),
+                None => groups.iter().position(|group| group.0 == key),
+            };
+            match existing {
+                Some(idx) => groups[idx].2.push(item),
+                None => {
+                    match unique_key {
+                        Some(unique_key) => {
+                            index.insert(unique_key, groups.len());
+                        }
+                        None => other_groups.push(groups.len()),
+                    }
+                    groups.push((key, grouper, vec![item]));
+                }
+            }
+        }
+        if sort {
+            groups.sort_by(|a, b| {
+                a.0.partial_cmp(&b.0)
+                    .unwrap_or_else(|| fallback_cmp(&a.0, &b.0))
+            });
+        }
+        Ok(Value::from(
+            groups
+                .into_iter()
+                .map(|(_, grouper, items)| {
+                    Value::from_object(Group {
+                        grouper,
+                        list: Value::from(items),
+                    })
+                })
+                .collect::<Vec<_>>(),
+        ))
+    }
+
+    /// A group returned by the `groupby` filter.
+    #[cfg(feature = "sync")]
+    #[derive(Debug)]
+    struct Group {
+        grouper: Value,
+        list: Value,
+    }
+
+    #[cfg(feature = "sync")]
+    impl std::fmt::Display for Group {
+        fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+            write!(f, "[{:?}, {:?}]", self.grouper, self.list)
+        }
+    }
+
+    #[cfg(feature = "sync")]
+    impl crate::value::Object for Group {
+        fn get_attr(&self, name: &str) -> Option<Value> {
+            match name {
+                "grouper" => Some(self.grouper.clone()),
+                "list" => Some(self.list.clone()),
+                _ => None,
+            }
+        }
+
+        fn attributes(&self) -> &[&str] {
+            &["grouper", "list"]
+        }
+
+        fn len(&self) -> Option<usize> {
+            Some(2)
+        }
+
+        fn get_index(&self, idx: usize) -> Option<Value> {
+            match idx {
+                0 => Some(self.grouper.clone()),
+                1 => Some(self.list.clone()),
+                _ => None,
+            }
+        }
+    }
+
+    /// Removes duplicate items from a sequence.
+    ///
+    /// The first occurrence of every item is retained.  Strings are compared
+    /// ignoring case unless `case_sensitive` is enabled and `attribute` can
+    /// be used to compare items by an attribute (eg: `user.email`):
+    ///
+    /// ```jinja
+    /// {{ ["foo", "bar", "Foo"]|unique }}
+    ///   -> ["foo", "bar"]
+    /// {{ users|unique(attribute="email")|map(attribute="name") }}
+    /// ```
+    ///
+    /// Dynamic objects are compared with
+    /// [`Object::eq_value`](crate::value::Object::eq_value).
+    #[cfg_attr(docsrs, doc(cfg(feature = "builtins")))]
+    pub fn unique(_: &State, value: Value, kwargs: Kwargs) -> Result<Value, Error> {
+        let case_sensitive = kwargs
+            .get::<Option<bool>>("case_sensitive")?
+            .unwrap_or(false);
+        let attribute = kwargs.get::<Option<String>>("attribute")?;
+        kwargs.assert_all_used()?;
+
+        // values that can be keys are found through the set, all others
+        // (such as sequences and objects) are compared one by one.  As
+        // objects can be equal to strings or numbers, those are also
+        // compared with the objects seen so far.
+        let mut seen_keys = HashSet::new();
+        let mut seen_other = Vec::new();
+        let mut seen = Vec::new();
+        let mut rv = Vec::new();
+        for item in value.iter() {
+            let key = match attribute {
+                Some(ref path) => get_path(&item, path)?,
+                None => item.clone(),
+            };
+            let key = match key.as_str() {
+                Some(s) if !case_sensitive => Value::from(s.to_lowercase()),
+                _ => key,
+            };
+            let is_new = match unique_key(&key) {
+                Some(unique_key) => seen_keys.insert(unique_key) && !seen_other.contains(&key),
+                None => {
+                    let is_new = !seen.contains(&key);
+                    if is_new {
+                        seen_other.push(key.clone());
+                    }
+                    is_new
+                }
+            };
+            if is_new {
+                seen.push(key);
+                rv.push(item);
+            }
+        }
+        Ok(Value::from(rv))
+    }
+
+    /// Returns a key that is equal for all values that compare equal.
+    fn unique_key(value: &Value) -> Option<Key<'static>> {
+        if let Some(s) = value.as_str() {
+            return Some(Key::String(RcType::new(s.to_string())));
+        }
+        match value.0 {
+            ValueRepr::Char(c) => Some(Key::String(RcType::new(c.to_string()))),
+            ValueRepr::Bool(b) => Some(Key::I64(b as i64)),
+            _ => match Key::from_borrowed_value(value) {
+                Ok(Key::I64(x)) => Some(Key::I64(x)),
+                _ => None,
+            },
+        }
+    }
+
+    /// Looks up a dotted attribute path such as `user.address.city`.
+    ///
+    /// Parts that are integers index into sequences.  If a part of the path
+    /// is undefined the result is undefined.
+    fn get_path(value: &Value, path: &str) -> Result<Value, Error> {
+        let mut rv = value.clone();
+        for part in path.split('.') {
+            if rv.is_undefined() {
+                break;
+            }
+            rv = match part.parse::<i64>() {
+                Ok(idx) if matches!(rv.kind(), ValueKind::Seq) => rv.get_item(&Value::from(idx))?,
+                _ => rv.get_attr(part)?,
+            };
+        }
+        Ok(rv)
+    }
+
+    fn select_or_reject(
+        state: &State,
+        value: Value,
+        attr: Option<&str>,
+        test: Option<String>,
+        arg: Option<Value>,
+        want: bool,
+    ) -> Result<Value, Error> {
+        let mut rv = Vec::new();
+        for item in value.iter() {
+            let test_value = match attr {
+                Some(path) => get_path(&item, path)?,
+                None => item.clone(),
+            };
+            let passed = match test {
+                Some(ref test) => {
+                    state.perform_test(test, test_value, arg.iter().cloned().collect())?
+                }
+                None => test_value.is_true(),
+            };
+            if passed == want {
+                rv.push(item);
+            }
+        }
+        Ok(Value::from(rv))
+    }
+
+    /// Applies a filter to a sequence of values or looks up an attribute.
+    ///
+    /// The first form applies the named filter to all items.  Up to two
+    /// arguments are passed to the filter:
+    ///
+    /// ```jinja
+    /// {{ names|map("lower")|join(", ") }}
+    /// {{ names|map("replace", "-", " ")|join(", ") }}
+    /// ```
+    ///
+    /// The second form looks up an attribute of each item.  The attribute
+    /// can be a dotted path (eg: `user.name` or `tags.0`) and a default
+    /// can be provided for items where the attribute is undefined:
+    ///
+    /// ```jinja
+    /// {{ users|map(attribute="address.city", default="n/a")|join(", ") }}
+    /// ```
+    #[cfg_attr(docsrs, doc(cfg(feature = "builtins")))]
+    pub fn map(
+        state: &State,
+        value: Value,
+        filter: Value,
+        arg1: Option<Value>,
+        arg2: Option<Value>,
+    ) -> Result<Value, Error> {
+        let mut rv = Vec::new();
+        if let Some(name) = filter.as_str() {
+            let args = arg1.into_iter().chain(arg2).collect::<Vec<_>>();
+            for item in value.iter() {
+                rv.push(state.apply_filter(name, item, args.clone())?);
+            }
+            return Ok(Value::from(rv));
+        }
+
+        let mut attribute = None;
+        let mut default = None;
+        for (key, value) in filter.iter_as_str_map() {
+            match key {
+                "attribute" => attribute = Some(value),
+                "default" => default = Some(value),
+                _ => {
+                    return Err(Error::new(
+                        ErrorKind::InvalidArguments,
+                        format!("unknown keyword argument {} for map", key),
+                    ))
+                }
+            }
+        }
+        let attribute = match attribute {
+            Some(attribute) if arg1.is_none() => attribute.to_string(),
+            _ => {
+                return Err(Error::new(
+                    ErrorKind::InvalidArguments,
+                    "map requires a filter name or an attribute",
+                ))
+            }
+        };
+        for item in value.iter() {
+            let value = get_path(&item, &attribute)?;
+            rv.push(match default {
+                Some(ref default) if value.is_undefined() => default.clone(),
+                _ => value,
+            });
+        }
+        Ok(Value::from(rv))
+    }
+
+    /// Filters a sequence by applying a test to each item.
+    ///
+    /// Only the items for which the test succeeds are retained.  The test
+    /// can be passed one argument.  Without a test the items are checked
+    /// for truthiness.
+    ///
+    /// ```jinja
+    /// {{ numbers|select("odd") }}
+    /// {{ names|select("startingwith", "a") }}
+    /// {{ [0, 1, none, "", "x"]|select }}
+    /// ```
+    #[cfg_attr(docsrs, doc(cfg(feature = "builtins")))]
+    pub fn select(
+        state: &State,
+        value: Value,
+        test: Option<String>,
+        arg: Option<Value>,
+    ) -> Result<Value, Error> {
+        select_or_reject(state, value, None, test, arg, true)
+    }
+
+    /// Filters a sequence by applying a test to each item.
+    ///
+    /// This is the inverse of [`select`] and removes the items for which
+    /// the test succeeds.
+    ///
+    /// ```jinja
+    /// {{ numbers|reject("odd") }}
+    /// ```
+    #[cfg_attr(docsrs, doc(cfg(feature = "builtins")))]
+    pub fn reject(
+        state: &State,
+        value: Value,
+        test: Option<String>,
+        arg: Option<Value>,
+    ) -> Result<Value, Error> {
+        select_or_reject(state, value, None, test, arg, false)
+    }
+
+    /// Filters a sequence by applying a test to an attribute of each item.
+    ///
+    /// The attribute can be a dotted path.  Without a test the attribute
+    /// is checked for truthiness.
+    ///
+    /// ```jinja
+    /// {% for user in users|selectattr("profile.is_active") %}
+    ///   <li>{{ user.name }}</li>
+    /// {% endfor %}
+    /// {{ users|selectattr("email", "endingwith", "@example.com") }}
+    /// ```
+    #[cfg_attr(docsrs, doc(cfg(feature = "builtins")))]
+    pub fn selectattr(
+        state: &State,
+        value: Value,
+        attr: String,
+        test: Option<String>,
+        arg: Option<Value>,
+    ) -> Result<Value, Error> {
+        select_or_reject(state, value, Some(&attr), test, arg, true)
+    }
+
+    /// Filters a sequence by applying a test to an attribute of each item.
+    ///
+    /// This is the inverse of [`selectattr`].
+    ///
+    /// ```jinja
+    /// {{ users|rejectattr("is_banned")|map(attribute="name")|join(", ") }}
+    /// ```
+    #[cfg_attr(docsrs, doc(cfg(feature = "builtins")))]
+    pub fn rejectattr(
+        state: &State,
+        value: Value,
+        attr: String,
+        test: Option<String>,
+        arg: Option<Value>,
+    ) -> Result<Value, Error> {
+        select_or_reject(state, value, Some(&attr), test, arg, false)
+    }
+
+    /// Filters a sequence by evaluating an expression for each item.
+    ///
+    /// The item is available as `item` in the expression, all other
+    /// variables are looked up in the template context.  Only the items for
+    /// which the expression is true are retained.  This avoids having to
+    /// register a custom test for complex conditions:
+    ///
+    /// ```jinja
+    /// {{ users|selectexpr("item.age >= 18 and item.name is startingwith 'a'") }}
+    /// {{ users|selectexpr("item.age >= min_age") }}
+    /// ```
+    #[cfg_attr(docsrs, doc(cfg(feature = "builtins")))]
+    pub fn selectexpr(state: &State, value: Value, expr: String) -> Result<Value, Error> {
+        select_or_reject_expr(state, value, &expr, true)
+    }
+
+    /// Filters a sequence by evaluating an expression for each item.
+    ///
+    /// This is the inverse of [`selectexpr`] and removes the items for which
+    /// the expression is true.
+    ///
+    /// ```jinja
+    /// {{ orders|rejectexpr("item.total == 0 or item.cancelled") }}
+    /// ```
+    #[cfg_attr(docsrs, doc(cfg(feature = "builtins")))]
+    pub fn rejectexpr(state: &State, value: Value, expr: String) -> Result<Value, Error> {
+        select_or_reject_expr(state, value, &expr, false)
+    }
+
+    fn select_or_reject_expr(
+        state: &State,
+        value: Value,
+        expr: &str,
+        want: bool,
+    ) -> Result<Value, Error> {
+        let items = value.iter().collect::<Vec<_>>();
+        let results = state.eval_expression_for_each(expr, "item", items.clone())?;
+        Ok(Value::from(
+            items
+                .into_iter()
+                .zip(results)
+                .filter(|(_, result)| result.is_true() == want)
+                .map(|(item, _)| item)
+                .collect::<Vec<_>>(),
+        ))
+    }
+
+    /// Pretty print a variable.
+    ///
+    /// This is useful for debugging as it better shows what's inside an
+    /// object.  The output can be limited with the `max_depth` keyword
+    /// argument (containers nested deeper are shown as `[...]` or `{...}`)
+    /// and with `max_items` which limits how many items of a sequence or map
+    /// are shown.  Strings are cut off after `max_string_len` characters.
+    /// The defaults are the limits of the environment (see
+    /// [`Environment::set_repr_limits`](crate::Environment::set_repr_limits)).
+    /// Objects that contain themselves are shown as `<cycle>`.
+    ///
+    /// ```jinja
+    /// <pre>{{ context|pprint(max_depth=3, max_items=10) }}</pre>
+    /// ```
+    #[cfg_attr(docsrs, doc(cfg(feature = "builtins")))]
+    pub fn pprint(state: &State, value: Value, kwargs: Kwargs) -> Result<String, Error> {
+        let mut printer = PrettyPrinter::from(state.env().repr_limits());
+        if let Some(max_depth) = kwargs.get("max_depth")? {
+            printer.max_depth = max_depth;
+        }
+        if let Some(max_items) = kwargs.get("max_items")? {
+            printer.max_items = max_items;
+        }
+        if let Some(max_string_len) = kwargs.get("max_string_len")? {
+            printer.max_string_len = max_string_len;
+        }
+        kwargs.assert_all_used()?;
+        Ok(printer.format(&value))
+    }
+
+    /// Formats a datetime with `strftime` style directives.
+    ///
+    /// The value can be a [`DateTime`](crate::value::DateTime) (as
+    /// returned by `now()`), a string in RFC 3339 format or a unix
+    /// timestamp.  The format defaults to `%Y-%m-%d %H:%M:%S`.  The
+    /// timezone the datetime is shown in can be changed with the `tz`
+    /// keyword argument which accepts `UTC` and fixed offsets.  See
+    /// [`DateTime::format`](crate::value::DateTime::format) for the
+    /// supported directives.
+    ///
+    /// ```jinja
+    /// {{ post.published|datetimeformat("%d %B %Y", tz="+01:00") }}
+    /// ```
+    #[cfg_attr(docsrs, doc(cfg(feature = "builtins")))]
+    pub fn datetimeformat(
+        _: &State,
+        value: Value,
+        format: Option<String>,
+        kwargs: Kwargs,
+    ) -> Result<String, Error> {
+        let mut dt = match as_f64(&value) {
+            Some(ts) => Duration::from_secs_f64(ts)
+                .and_then(|d| DateTime::from_timestamp(0, 0).checked_add(d)),
+            None => as_datetime(&value),
+        }
+        .ok_or_else(|| {
+            Error::new(
+                ErrorKind::InvalidArguments,
+                format!("cannot format value of type {} as datetime", value.kind()),
+            )
+        })?;
+        if let Some(tz) = kwargs.get::<Option<String>>("tz")? {
+            dt = dt.with_timezone(&tz)?;
+        }
+        kwargs.assert_all_used()?;
+        dt.format(format.as_deref().unwrap_or("%Y-%m-%d %H:%M:%S"))
+    }
+
+    /// Renders a duration in a human readable form.
+    ///
+    /// The value can be a [`Duration`](crate::value::Duration) or a number
+    /// of seconds.  The optional `precision` limits the number of units
+    /// that are shown, the rest is truncated.
+    ///
+    /// ```jinja
+    /// Uptime: {{ uptime_seconds|duration }}
+    /// Last seen: {{ (now() - user.last_seen)|duration(1) }} ago
+    /// ```
+    #[cfg_attr(docsrs, doc(cfg(feature = "builtins")))]
+    pub fn duration(_: &State, value: Value, precision: Option<usize>) -> Result<String, Error> {
+        let d = to_duration(&value).ok_or_else(|| {
+            Error::new(
+                ErrorKind::InvalidArguments,
+                format!("cannot format value of type {} as duration", value.kind()),
+            )
+        })?;
+        Ok(d.humanize(precision.unwrap_or(usize::MAX)))
+    }
+
+    /// Formats a size in bytes in a human readable form (eg: `13 kB`).
+    ///
+    /// Decimal prefixes (kB, MB, ...) are used unless `binary` is true in which
+    /// case binary prefixes (KiB, MiB, ...) are used.  If a bytes value is
+    /// passed its length is formatted.
+    ///
+    /// ```jinja
+    /// {{ upload.size|filesizeformat }} ({{ upload.data|filesizeformat(true) }})
+    /// ```
+    #[cfg_attr(docsrs, doc(cfg(feature = "builtins")))]
+    pub fn filesizeformat(_: &State, value: Value, binary: Option<bool>) -> Result<String, Error> {
+        let size = match value.as_bytes() {
+            Some(b) => b.len() as f64,
+            None => as_f64(&value).ok_or_else(|| {
+                Error::new(
+                    ErrorKind::InvalidArguments,
+                    format!("cannot format value of type {} as file size", value.kind()),
+                )
+            })?,
+        };
+        let (base, prefixes) = if binary.unwrap_or(false) {
+            (
+                1024.0,
+                ["KiB", "MiB", "GiB", "TiB", "PiB", "EiB", "ZiB", "YiB"],
+            )
+        } else {
+            (1000.0, ["kB", "MB", "GB", "TB", "PB", "EB", "ZB", "YB"])
+        };
+        if size == 1.0 {
+            return Ok("1 Byte".into());
+        } else if size < base {
+            return Ok(format!("{} Bytes", size as i64));
+        }
+        let mut unit = base;
+        for prefix in prefixes.iter() {
+            unit *= base;
+            if size < unit || *prefix == prefixes[prefixes.len() - 1] {
+                return Ok(format!("{:.1} {}", size * base / unit, prefix));
+            }
+        }
+        unreachable!()
+    }
+
+    /// Quotes a value for use as an argument in a POSIX shell.
+    ///
+    /// Values that only consist of characters that have no meaning to the
+    /// shell are returned unchanged, everything else is wrapped in single
+    /// quotes.  If a sequence is given, every item is quoted and the
+    /// results are joined by spaces so that a list can be passed as
+    /// multiple arguments.
+    ///
+    /// ```jinja
+    /// cp {{ source|shell_quote }} {{ [dest, "backup dir"]|shell_quote }}
+    /// ```
+    #[cfg_attr(docsrs, doc(cfg(feature = "builtins")))]
+    pub fn shell_quote(_: &State, value: Value) -> Result<String, Error> {
+        fn quote(s: &str) -> String {
+            let is_safe = |c: char| {
+                c.is_ascii_alphanumeric()
+                    || matches!(c, '_' | '@' | '%' | '+' | '=' | ':' | ',' | '.' | '/' | '-')
+            };
+            if !s.is_empty() && s.chars().all(is_safe) {
+                s.to_string()
+            } else {
+                format!("'{}'", s.replace('\'', "'\"'\"'"))
+            }
+        }
+
+        if matches!(value.kind(), ValueKind::Seq) {
+            Ok(value
+                .try_into_vec()?
+                .iter()
+                .map(|item| quote(&item.to_string()))
+                .collect::<Vec<_>>()
+                .join(" "))
+        } else {
+            Ok(quote(&value.to_string()))
+        }
+    }
+
+    /// Escapes all characters of a value that have a meaning in regular
+    /// expressions.
+    ///
+    /// ```jinja
+    /// server_name ~^{{ domain|regex_escape }}$;
+    /// ```
+    #[cfg_attr(docsrs, doc(cfg(feature = "builtins")))]
+    pub fn regex_escape(_: &State, value: String) -> Result<String, Error> {
+        let mut rv = String::with_capacity(value.len());
+        for c in value.chars() {
+            if matches!(
+                c,
+                '\\' | '.'
+                    | '+'
+                    | '*'
+                    | '?'
+                    | '('
+                    | ')'
+                    | '|'
+                    | '['
+                    | ']'
+                    | '{'
+                    | '}'
+                    | '^'
+                    | '$'
+                    | '#'
+                    | '&'
+                    | '-'
+                    | '~'
+            ) {
+                rv.push('\\');
+            }
+            rv.push(c);
+        }
+        Ok(rv)
+    }
+
+    /// Formats a value as CSV.
+    ///
+    /// A sequence is formatted as a single row, a sequence of sequences as
+    /// multiple rows separated by newlines.  Any other value is formatted
+    /// as a single field.  Fields that contain the delimiter, quotes or
+    /// newlines are quoted as described in RFC 4180.  The delimiter
+    /// defaults to a comma and can be changed with the first argument.
+    ///
+    /// ```jinja
+    /// {{ [["name", "city"], ["John", "Vienna, Austria"]]|csv }}
+    /// ```
+    #[cfg_attr(docsrs, doc(cfg(feature = "builtins")))]
+    pub fn csv(_: &State, value: Value, delimiter: Option<String>) -> Result<String, Error> {
+        let delimiter = delimiter.as_deref().unwrap_or(",");
+        let field = |value: &Value| {
+            let s = match value.0 {
+                ValueRepr::None | ValueRepr::Undefined => String::new(),
+                _ => value.to_string(),
+            };
+            if s.contains(delimiter) || s.contains(&['"', '\r', '\n'][..]) {
+                format!("\"{}\"", s.replace('"', "\"\""))
+            } else {
+                s
+            }
+        };
+        let row = |value: Value| -> Result<String, Error> {
+            Ok(value
+                .try_into_vec()?
+                .iter()
+                .map(|x| field(x))
+                .collect::<Vec<_>>()
+                .join(delimiter))
+        };
+
+        if !matches!(value.kind(), ValueKind::Seq) {
+            return Ok(field(&value));
+        }
+        let items = value.try_into_vec()?;
+        if !items.is_empty() && items.iter().all(|x| matches!(x.kind(), ValueKind::Seq)) {
+            Ok(items
+                .into_iter()
+                .map(row)
+                .collect::<Result<Vec<_>, _>>()?
+                .join("\n"))
+        } else {
+            row(Value::from(items))
+        }
+    }
+
     /// Dumps a value to JSON.
     ///
     /// This filter is only available if the `json` feature is enabled.  The resulting
     /// value is safe to use in HTML as well as it will not contain any special HTML
-    /// characters.  The optional parameter to the filter can be set to `true` to enable
+    /// characters.  The line and paragraph separators (U+2028 and U+2029) are
+    /// escaped as well as older JavaScript engines do not accept them in strings.  The optional parameter to the filter can be set to `true` to enable
     /// pretty printing.  Not that the `"` character is left unchanged as it's the
     /// JSON string delimiter.  If you want to pass JSON serialized this way into an
     /// HTTP attribute use single quoted HTML attributes:
@@ -661,19 +2258,27 @@ mod builtins {
         .map_err(|err| {
             Error::new(ErrorKind::ImpossibleOperation, "cannot serialize to JSON").with_source(err)
         })
-        .map(|s| {
-            let mut rv = String::with_capacity(s.len());
-            for c in s.chars() {
-                match c {
-                    '<' => rv.push_str("\\u003c"),
-                    '>' => rv.push_str("\\u003e"),
-                    '&' => rv.push_str("\\u0026"),
-                    '\'' => rv.push_str("\\u0027"),
-                    _ => rv.push(c),
-                }
-            }
-            Value::from_safe_string(rv)
-        })
+        .map(|s| Value::from_safe_string(ScriptSafeJson(&s).to_string()))
+    }
+
+    /// Escapes a string for use in a JavaScript string literal.
+    ///
+    /// Quotes, backslashes, control characters and characters that are
+    /// significant in HTML are replaced by `\uXXXX` escapes so the result can
+    /// be placed in quotes in inline scripts and event handler attributes.
+    /// Unlike [`tojson`] this does not add the quotes and works on the
+    /// string form of any value.
+    ///
+    /// ```jinja
+    /// <script>
+    ///   const greeting = "Hello {{ user.name|escapejs }}!";
+    /// </script>
+    /// ```
+    #[cfg_attr(docsrs, doc(cfg(feature = "builtins")))]
+    pub fn escapejs(_: &State, value: Value) -> Result<Value, Error> {
+        Ok(Value::from_safe_string(
+            JsEscape(&value.to_string()).to_string(),
+        ))
     }
 
     /// URL encodes a value.
@@ -716,6 +2321,275 @@ mod builtins {
         }
     }
 
+    /// Returns the bytes of a value for encoding and hashing.
+    #[cfg(feature = "encoding")]
+    fn value_bytes(value: &Value) -> Vec<u8> {
+        match value.0 {
+            ValueRepr::Bytes(ref b) => b.to_vec(),
+            ValueRepr::String(ref s) | ValueRepr::SafeString(ref s) => s.as_bytes().to_vec(),
+            _ => value.to_string().into_bytes(),
+        }
+    }
+
+    /// Encodes a value as base64.
+    ///
+    /// Strings are encoded as UTF-8, byte values as they are.  With
+    /// `urlsafe=true` the URL safe alphabet is used (`-` and `_` instead of
+    /// `+` and `/`).
+    ///
+    /// ```jinja
+    /// Authorization: Basic {{ (user ~ ":" ~ password)|b64encode }}
+    /// ```
+    #[cfg_attr(docsrs, doc(cfg(all(feature = "builtins", feature = "encoding"))))]
+    #[cfg(feature = "encoding")]
+    pub fn b64encode(_: &State, value: Value, kwargs: Kwargs) -> Result<String, Error> {
+        use base64::engine::general_purpose::{STANDARD, URL_SAFE};
+        use base64::Engine;
+
+        let urlsafe = kwargs.get::<Option<bool>>("urlsafe")?.unwrap_or(false);
+        kwargs.assert_all_used()?;
+        let engine = if urlsafe { &URL_SAFE } else { &STANDARD };
+        Ok(engine.encode(value_bytes(&value)))
+    }
+
+    /// Decodes a base64 encoded value.
+    ///
+    /// With `urlsafe=true` the URL safe alphabet is expected.  The padding
+    /// is optional but if it's present it has to be correct.  Invalid
+    /// characters or padding fail with an error.  If the decoded data is
+    /// valid UTF-8 a string is returned, otherwise a byte value.
+    #[cfg_attr(docsrs, doc(cfg(all(feature = "builtins", feature = "encoding"))))]
+    #[cfg(feature = "encoding")]
+    pub fn b64decode(_: &State, value: String, kwargs: Kwargs) -> Result<Value, Error> {
+        use base64::engine::general_purpose::{GeneralPurpose, GeneralPurposeConfig};
+        use base64::engine::DecodePaddingMode;
+        use base64::{alphabet, Engine};
+
+        const CONFIG: GeneralPurposeConfig =
+            GeneralPurposeConfig::new().with_decode_padding_mode(DecodePaddingMode::Indifferent);
+        const STANDARD: GeneralPurpose = GeneralPurpose::new(&alphabet::STANDARD, CONFIG);
+        const URL_SAFE: GeneralPurpose = GeneralPurpose::new(&alphabet::URL_SAFE, CONFIG);
+
+        let urlsafe = kwargs.get::<Option<bool>>("urlsafe")?.unwrap_or(false);
+        kwargs.assert_all_used()?;
+        let engine = if urlsafe { &URL_SAFE } else { &STANDARD };
+        let bytes = engine.decode(value.trim()).map_err(|err| {
+            Error::new(ErrorKind::InvalidArguments, "invalid base64 encoded value").with_source(err)
+        })?;
+        Ok(match String::from_utf8(bytes) {
+            Ok(s) => Value::from(s),
+            Err(err) => Value::from_bytes(err.into_bytes()),
+        })
+    }
+
+    /// Encodes a value as lowercase hex.
+    ///
+    /// Integers are formatted as hexadecimal numbers, strings and bytes are
+    /// encoded byte by byte.
+    ///
+    /// ```jinja
+    /// {{ 255|hex }} -> ff
+    /// {{ "hi"|hex }} -> 6869
+    /// ```
+    #[cfg_attr(docsrs, doc(cfg(all(feature = "builtins", feature = "encoding"))))]
+    #[cfg(feature = "encoding")]
+    pub fn hex(_: &State, value: Value) -> Result<String, Error> {
+        match value.0 {
+            ValueRepr::U64(n) => Ok(format!("{:x}", n)),
+            ValueRepr::U128(ref n) => Ok(format!("{:x}", **n)),
+            ValueRepr::I64(n) if n < 0 => Ok(format!("-{:x}", n.wrapping_abs() as u64)),
+            ValueRepr::I64(n) => Ok(format!("{:x}", n)),
+            ValueRepr::I128(ref n) if **n < 0 => Ok(format!("-{:x}", n.wrapping_abs() as u128)),
+            ValueRepr::I128(ref n) => Ok(format!("{:x}", **n)),
+            _ => Ok(hex_encode(&value_bytes(&value))),
+        }
+    }
+
+    /// Encodes bytes as lowercase hex.
+    #[cfg(feature = "encoding")]
+    fn hex_encode(data: &[u8]) -> String {
+        let mut rv = String::with_capacity(data.len() * 2);
+        for b in data {
+            write!(rv, "{:02x}", b).ok();
+        }
+        rv
+    }
+
+    #[cfg(feature = "encoding")]
+    fn digest<D: sha2::Digest>(value: &Value, kwargs: Kwargs) -> Result<Value, Error> {
+        let binary = kwargs.get::<Option<bool>>("binary")?.unwrap_or(false);
+        kwargs.assert_all_used()?;
+        let digest = D::digest(value_bytes(value));
+        Ok(if binary {
+            Value::from_bytes(digest.to_vec())
+        } else {
+            Value::from(hex_encode(&digest))
+        })
+    }
+
+    /// Calculates the MD5 digest of a value.
+    ///
+    /// The digest is returned as hex string, with `binary=true` as bytes.
+    /// MD5 is not secure and should only be used for cache keys or to
+    /// interface with systems that require it.
+    #[cfg_attr(docsrs, doc(cfg(all(feature = "builtins", feature = "encoding"))))]
+    #[cfg(feature = "encoding")]
+    pub fn md5(_: &State, value: Value, kwargs: Kwargs) -> Result<Value, Error> {
+        digest::<::md5::Md5>(&value, kwargs)
+    }
+
+    /// Calculates the SHA-1 digest of a value.
+    ///
+    /// The digest is returned as hex string, with `binary=true` as bytes.
+    #[cfg_attr(docsrs, doc(cfg(all(feature = "builtins", feature = "encoding"))))]
+    #[cfg(feature = "encoding")]
+    pub fn sha1(_: &State, value: Value, kwargs: Kwargs) -> Result<Value, Error> {
+        digest::<::sha1::Sha1>(&value, kwargs)
+    }
+
+    /// Calculates the SHA-256 digest of a value.
+    ///
+    /// The digest is returned as hex string, with `binary=true` as bytes
+    /// which can be combined with `b64encode` for subresource integrity:
+    ///
+    /// ```jinja
+    /// <script src="app.js" integrity="sha256-{{ script|sha256(binary=true)|b64encode }}"></script>
+    /// ```
+    #[cfg_attr(docsrs, doc(cfg(all(feature = "builtins", feature = "encoding"))))]
+    #[cfg(feature = "encoding")]
+    pub fn sha256(_: &State, value: Value, kwargs: Kwargs) -> Result<Value, Error> {
+        digest::<::sha2::Sha256>(&value, kwargs)
+    }
+
+    /// The maximum number of compiled patterns kept per thread.
+    #[cfg(feature = "regex")]
+    const REGEX_CACHE_SIZE: usize = 64;
+
+    /// Compiles a pattern, reusing previously compiled patterns.
+    #[cfg(feature = "regex")]
+    fn compile_regex(pattern: &str) -> Result<regex::Regex, Error> {
+        use std::cell::RefCell;
+        use std::collections::HashMap;
+
+        thread_local! {
+            static CACHE: RefCell<HashMap<String, regex::Regex>> = RefCell::default();
+        }
+
+        CACHE.with(|cache| {
+            if let Some(re) = cache.borrow().get(pattern) {
+                return Ok(re.clone());
+            }
+            let re = regex::Regex::new(pattern).map_err(|err| {
+                Error::new(
+                    ErrorKind::InvalidArguments,
+                    format!("invalid regular expression {:?}", pattern),
+                )
+                .with_source(err)
+            })?;
+            let mut cache = cache.borrow_mut();
+            if cache.len() >= REGEX_CACHE_SIZE {
+                cache.clear();
+            }
+            cache.insert(pattern.to_string(), re.clone());
+            Ok(re)
+        })
+    }
+
+    /// Converts the groups of a match into values like Python's `findall`.
+    ///
+    /// Without groups the match itself is returned, with a single group just
+    /// that group and with multiple groups a list of all of them.  Groups
+    /// that did not participate in the match are `none`.
+    #[cfg(feature = "regex")]
+    fn captures_to_value(captures: &regex::Captures) -> Value {
+        let group = |idx: usize| {
+            captures
+                .get(idx)
+                .map_or(Value::from(()), |m| Value::from(m.as_str()))
+        };
+        match captures.len() {
+            1 => group(0),
+            2 => group(1),
+            n => Value::from((1..n).map(group).collect::<Vec<_>>()),
+        }
+    }
+
+    /// Checks if a regular expression matches at the start of a value.
+    ///
+    /// Use `^` and `$` in the pattern to match the whole value.  The regular
+    /// expression syntax is the one of the [`regex`](https://docs.rs/regex)
+    /// crate.
+    ///
+    /// ```jinja
+    /// {% if version|regex_match("\\d+\\.\\d+") %}...{% endif %}
+    /// ```
+    #[cfg_attr(docsrs, doc(cfg(all(feature = "builtins", feature = "regex"))))]
+    #[cfg(feature = "regex")]
+    pub fn regex_match(_: &State, value: String, pattern: String) -> Result<bool, Error> {
+        Ok(compile_regex(&pattern)?
+            .find(&value)
+            .map_or(false, |m| m.start() == 0))
+    }
+
+    /// Searches a value for the first match of a regular expression.
+    ///
+    /// If the pattern has no groups the matched text is returned, with one
+    /// group the text of that group and with multiple groups a list of them.
+    /// If the pattern does not match, `none` is returned.
+    ///
+    /// ```jinja
+    /// {{ "release-1.2"|regex_search("(\\d+)\\.(\\d+)") }} -> ["1", "2"]
+    /// ```
+    #[cfg_attr(docsrs, doc(cfg(all(feature = "builtins", feature = "regex"))))]
+    #[cfg(feature = "regex")]
+    pub fn regex_search(_: &State, value: String, pattern: String) -> Result<Value, Error> {
+        Ok(compile_regex(&pattern)?
+            .captures(&value)
+            .map_or(Value::from(()), |captures| captures_to_value(&captures)))
+    }
+
+    /// Replaces matches of a regular expression.
+    ///
+    /// Groups can be referenced in the replacement with `$1` or `${name}`.
+    /// By default all matches are replaced, the optional third argument
+    /// limits the number of replacements.
+    ///
+    /// ```jinja
+    /// {{ "a-b_c"|regex_replace("[-_]", " ") }} -> a b c
+    /// ```
+    #[cfg_attr(docsrs, doc(cfg(all(feature = "builtins", feature = "regex"))))]
+    #[cfg(feature = "regex")]
+    pub fn regex_replace(
+        _: &State,
+        value: String,
+        pattern: String,
+        replacement: String,
+        count: Option<usize>,
+    ) -> Result<String, Error> {
+        Ok(compile_regex(&pattern)?
+            .replacen(&value, count.unwrap_or(0), replacement.as_str())
+            .into_owned())
+    }
+
+    /// Returns all non-overlapping matches of a regular expression.
+    ///
+    /// The items follow the same rules as [`regex_search`] so patterns with
+    /// multiple groups return a list of lists.
+    ///
+    /// ```jinja
+    /// {{ "a=1, b=2"|regex_findall("(\\w)=(\\d)") }} -> [["a", "1"], ["b", "2"]]
+    /// ```
+    #[cfg_attr(docsrs, doc(cfg(all(feature = "builtins", feature = "regex"))))]
+    #[cfg(feature = "regex")]
+    pub fn regex_findall(_: &State, value: String, pattern: String) -> Result<Value, Error> {
+        Ok(Value::from(
+            compile_regex(&pattern)?
+                .captures_iter(&value)
+                .map(|captures| captures_to_value(&captures))
+                .collect::<Vec<_>>(),
+        ))
+    }
+
     #[test]
     fn test_basics() {
         fn test(_: &State, a: u32, b: u32) -> Result<u32, Error> {
@@ -723,13 +2597,7 @@ mod builtins {
         }
 
         let env = crate::Environment::new();
-        let state = State {
-            env: &env,
-            ctx: crate::vm::Context::default(),
-            auto_escape: crate::AutoEscape::None,
-            current_block: None,
-            name: "<unknown>",
-        };
+        let state = env.new_state(());
         let bx = BoxedFilter::new(test);
         assert_eq!(
             bx.apply_to(&state, Value::from(23), vec![Value::from(42)])
@@ -749,13 +2617,7 @@ mod builtins {
         }
 
         let env = crate::Environment::new();
-        let state = State {
-            env: &env,
-            ctx: crate::vm::Context::default(),
-            auto_escape: crate::AutoEscape::None,
-            current_block: None,
-            name: "<unknown>",
-        };
+        let state = env.new_state(());
         let bx = BoxedFilter::new(add);
         assert_eq!(
             bx.apply_to(&state, Value::from(23), vec![Value::from(42)])
@@ -0,0 +1,205 @@
+//! Reformats template source.
+use crate::error::Error;
+use crate::lexer::tokenize_raw;
+use crate::parser::parse_with_syntax;
+use crate::syntax::Syntax;
+use crate::tokens::Token;
+use crate::utils::matches;
+
+/// Identifiers that act as operators or introduce statements.
+///
+/// An operator following one of these is unary and a parenthesis is not a
+/// call.
+const KEYWORDS: &[&str] = &[
+    "and",
+    "as",
+    "autoescape",
+    "block",
+    "component",
+    "elif",
+    "else",
+    "extends",
+    "filter",
+    "for",
+    "from",
+    "if",
+    "import",
+    "in",
+    "include",
+    "is",
+    "not",
+    "or",
+    "props",
+    "recursive",
+    "set",
+    "with",
+];
+
+/// Formats a template.
+///
+/// The contents of variable and block tags are reprinted with normalized
+/// whitespace: one space inside the delimiters, spaces around binary
+/// operators and after commas, and none around `.`, `|` and within calls
+/// and subscripts.  Everything else including template data, comments, raw
+/// blocks and whitespace control markers is left untouched as whitespace
+/// outside of tags is part of the output.  Formatting a template therefore
+/// never changes what it renders and formatting twice gives the same
+/// result.
+///
+/// The template is parsed first and syntax errors are returned.  Custom
+/// tags are unknown to this function, use
+/// [`Environment::format_template`](crate::Environment::format_template)
+/// to format templates that use them.
+///
+/// ```
+/// # use minijinja::{format_template, syntax::Syntax};
+/// let rv = format_template("{%if x>1%}{{x|join( ',' )}}{%endif%}", &Syntax::default()).unwrap();
+/// assert_eq!(rv, "{% if x > 1 %}{{ x|join(',') }}{% endif %}");
+/// ```
+pub fn format_template(source: &str, syntax: &Syntax) -> Result<String, Error> {
+    format_template_with_tags(source, syntax, &|_| None)
+}
+
+pub(crate) fn format_template_with_tags(
+    source: &str,
+    syntax: &Syntax,
+    custom_tags: &dyn Fn(&str) -> Option<bool>,
+) -> Result<String, Error> {
+    parse_with_syntax(source, "<template>", syntax, custom_tags)?;
+
+    let mut rv = String::with_capacity(source.len());
+    let mut pos = 0;
+    let mut tag = None::<Vec<(Token<'_>, &str)>>;
+    for item in tokenize_raw(source, false, syntax.clone(), true) {
+        let (token, span) = item?;
+        let (start, end) = (span.start_offset, span.end_offset);
+        match token {
+            Token::VariableStart(_) | Token::BlockStart(_) => {
+                rv.push_str(source[pos..end].trim_end_matches(|c| c == ' ' || c == '\t'));
+                rv.push(' ');
+                tag = Some(Vec::new());
+            }
+            Token::VariableEnd(_) | Token::BlockEnd(_) => {
+                write_tokens(&mut rv, &tag.take().unwrap_or_default());
+                // line statements end with the newline or the end of input
+                let marker = &source[start..end];
+                if !marker.trim().is_empty() {
+                    rv.push(' ');
+                }
+                rv.push_str(marker);
+            }
+            token => match tag {
+                Some(ref mut tokens) => {
+                    let text = &source[start..end];
+                    tokens.push((token, text));
+                }
+                None => rv.push_str(&source[pos..end]),
+            },
+        }
+        pos = end;
+    }
+    rv.push_str(&source[pos..]);
+    Ok(rv)
+}
+
+fn is_open(token: &Token) -> bool {
+    matches!(
+        token,
+        Token::ParenOpen | Token::BracketOpen | Token::BraceOpen
+    )
+}
+
+fn is_close(token: &Token) -> bool {
+    matches!(
+        token,
+        Token::ParenClose | Token::BracketClose | Token::BraceClose
+    )
+}
+
+/// Checks if a token can end an operand.
+fn ends_operand(token: &Token) -> bool {
+    match token {
+        Token::Ident(name) => !KEYWORDS.contains(name),
+        Token::Str(_) | Token::Int(_) | Token::Float(_) => true,
+        token => is_close(token),
+    }
+}
+
+fn is_operator(token: &Token) -> bool {
+    matches!(
+        token,
+        Token::Plus
+            | Token::Minus
+            | Token::Mul
+            | Token::Div
+            | Token::FloorDiv
+            | Token::Pow
+            | Token::Mod
+            | Token::Bang
+            | Token::Tilde
+            | Token::Eq
+            | Token::Ne
+            | Token::Gt
+            | Token::Gte
+            | Token::Lt
+            | Token::Lte
+    )
+}
+
+/// Writes the tokens within a tag with normalized whitespace.
+fn write_tokens(rv: &mut String, tokens: &[(Token<'_>, &str)]) {
+    let mut brackets = Vec::new();
+    let mut prev: Option<&Token> = None;
+    let mut prev_unary = false;
+    for &(ref token, text) in tokens {
+        let in_parens = brackets.last() == Some(&'(');
+        let space = match prev {
+            None => false,
+            Some(prev) => {
+                if prev_unary
+                    || is_open(prev)
+                    || is_close(token)
+                    || matches!(prev, Token::Dot | Token::Pipe)
+                    || matches!(
+                        token,
+                        Token::Comma | Token::Dot | Token::Pipe | Token::Colon
+                    )
+                {
+                    false
+                } else if matches!(token, Token::ParenOpen | Token::BracketOpen) {
+                    !ends_operand(prev)
+                } else if matches!(prev, Token::Colon) {
+                    brackets.last() != Some(&'[')
+                } else if matches!(token, Token::Assign) || matches!(prev, Token::Assign) {
+                    !in_parens
+                } else {
+                    true
+                }
+            }
+        };
+        if space {
+            rv.push(' ');
+        }
+
+        // the lexer folds the minus into negative number literals
+        match *token {
+            Token::Int(val) if val < 0 => rv.push('-'),
+            Token::Float(val) if val.is_sign_negative() => rv.push('-'),
+            _ => {}
+        }
+        rv.push_str(text);
+
+        prev_unary = matches!(token, Token::Bang)
+            || (is_operator(token) && !prev.map_or(false, ends_operand));
+        match token {
+            Token::ParenOpen => brackets.push('('),
+            Token::BracketOpen => brackets.push('['),
+            Token::BraceOpen => brackets.push('{'),
+            token if is_close(token) => {
+                brackets.pop();
+            }
+            _ => {}
+        }
+        prev = Some(token);
+    }
+}
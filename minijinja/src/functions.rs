@@ -42,7 +42,7 @@ use std::collections::BTreeMap;
 use std::fmt;
 use std::sync::Arc;
 
-use crate::error::Error;
+use crate::error::{Error, ErrorKind};
 use crate::value::{FunctionArgs, Object, Value};
 use crate::vm::State;
 
@@ -96,6 +96,15 @@ impl BoxedFunction {
         )
     }
 
+    /// Creates a new boxed function that receives all arguments unconverted.
+    #[cfg(feature = "builtins")]
+    pub fn new_variadic<F>(f: F) -> BoxedFunction
+    where
+        F: Fn(&State, Vec<Value>) -> Result<Value, Error> + Sync + Send + 'static,
+    {
+        BoxedFunction(Arc::new(f), std::any::type_name::<F>())
+    }
+
     /// Invokes the function.
     pub fn invoke(&self, state: &State, args: Vec<Value>) -> Result<Value, Error> {
         (self.0)(state, args)
@@ -139,18 +148,61 @@ pub(crate) fn get_globals() -> BTreeMap<&'static str, Value> {
     #[cfg(feature = "builtins")]
     {
         rv.insert("range", BoxedFunction::new(range).to_value());
-        rv.insert("dict", BoxedFunction::new(dict).to_value());
-        rv.insert("debug", BoxedFunction::new(debug).to_value());
+        rv.insert("dict", BoxedFunction::new_variadic(dict).to_value());
+        rv.insert("joiner", BoxedFunction::new(joiner).to_value());
+        rv.insert("now", BoxedFunction::new(now).to_value());
+        rv.insert("uuid4", BoxedFunction::new(uuid4).to_value());
+        rv.insert("random_token", BoxedFunction::new(random_token).to_value());
+        #[cfg(feature = "sync")]
+        {
+            rv.insert("cycler", BoxedFunction::new_variadic(cycler).to_value());
+            rv.insert(
+                "namespace",
+                BoxedFunction::new_variadic(namespace).to_value(),
+            );
+        }
+        #[cfg(feature = "debug")]
+        {
+            rv.insert("debug", BoxedFunction::new(debug).to_value());
+        }
     }
     rv
 }
 
+/// Assigns an attribute for `{% set obj.attr = value %}`.
+///
+/// Like in Jinja2 this is only possible for objects created by
+/// [`namespace`].
+pub(crate) fn set_namespace_attr(obj: &Value, name: &str, value: Value) -> Result<(), Error> {
+    #[cfg(all(feature = "builtins", feature = "sync"))]
+    {
+        if let Some(ns) = obj.downcast_object_ref::<builtins::Namespace>() {
+            ns.set(name, value);
+            return Ok(());
+        }
+    }
+    let _ = (name, value);
+    Err(Error::new(
+        ErrorKind::InvalidOperation,
+        format!(
+            "cannot assign attribute on {}, only namespace objects can be modified",
+            obj.kind()
+        ),
+    ))
+}
+
 #[cfg(feature = "builtins")]
 mod builtins {
     use super::*;
 
-    use crate::error::ErrorKind;
-    use crate::value::ValueKind;
+    use std::fmt::Write;
+    use std::sync::atomic::{AtomicBool, Ordering};
+    #[cfg(feature = "sync")]
+    use std::sync::{atomic::AtomicUsize, Mutex};
+
+    use crate::key::Key;
+    use crate::utils::glob_match_path;
+    use crate::value::{DateTime, Kwargs, RcType, ValueMap, ValueRepr};
 
     /// Returns a range.
     ///
@@ -168,7 +220,7 @@ mod builtins {
     /// ```
     #[cfg_attr(docsrs, doc(cfg(feature = "builtins")))]
     pub fn range(
-        _state: &State,
+        state: &State,
         lower: u32,
         upper: Option<u32>,
         step: Option<u32>,
@@ -177,6 +229,8 @@ mod builtins {
             Some(upper) => (lower..upper),
             None => (0..lower),
         };
+        let len = rng.len() / step.unwrap_or(1).max(1) as usize;
+        state.check_memory(len * std::mem::size_of::<Value>())?;
         Ok(if let Some(step) = step {
             rng.step_by(step as usize).collect()
         } else {
@@ -184,26 +238,444 @@ mod builtins {
         })
     }
 
+    /// Collects the arguments of `dict` and `namespace` into a map.
+    ///
+    /// The optional positional argument is a map or a sequence of key/value
+    /// pairs, the keyword arguments are merged on top of it.
+    fn collect_map(func: &str, args: Vec<Value>) -> Result<ValueMap<Key<'static>, Value>, Error> {
+        if args.len() > 2 {
+            return Err(Error::new(
+                ErrorKind::InvalidArguments,
+                format!("{} takes at most one positional argument", func),
+            ));
+        }
+        let mut rv = ValueMap::new();
+        for arg in args {
+            match arg.0 {
+                ValueRepr::Undefined | ValueRepr::None => {}
+                ValueRepr::Map(ref map) => {
+                    rv.extend(map.iter().map(|(k, v)| (k.clone(), v.clone())));
+                }
+                ValueRepr::Dynamic(_) if arg.len().is_none() => {
+                    rv.extend(
+                        arg.iter_as_str_map()
+                            .map(|(k, v)| (Key::make_string_key(k), v)),
+                    );
+                }
+                _ => {
+                    let items = arg.try_into_vec().map_err(|err| {
+                        Error::new(
+                            ErrorKind::InvalidArguments,
+                            format!("{} expects a map or a sequence of pairs", func),
+                        )
+                        .with_source(err)
+                    })?;
+                    for item in items {
+                        let mut pair = item.try_into_vec()?;
+                        if pair.len() != 2 {
+                            return Err(Error::new(
+                                ErrorKind::InvalidArguments,
+                                format!(
+                                    "{} expects pairs, got a sequence of length {}",
+                                    func,
+                                    pair.len()
+                                ),
+                            ));
+                        }
+                        let value = pair.pop().unwrap();
+                        rv.insert(pair.pop().unwrap().try_into_key()?, value);
+                    }
+                }
+            }
+        }
+        Ok(rv)
+    }
+
     /// Creates a dictionary.
     ///
     /// This is a convenient alternative for a dictionary literal.
-    /// `{"foo": "bar"}` is the same as `dict(foo="bar")`.
+    /// `{"foo": "bar"}` is the same as `dict(foo="bar")`.  Like in Jinja2 a
+    /// map or a sequence of key/value pairs can be passed as positional
+    /// argument, keyword arguments are added on top of it:
     ///
     /// ```jinja
     /// <script>const CONFIG = {{ dict(
     ///   DEBUG=true,
     ///   API_URL_PREFIX="/api"
     /// )|tojson }};</script>
+    /// {% set headers = dict([("Accept", "text/html")], Host=host) %}
     /// ```
     #[cfg_attr(docsrs, doc(cfg(feature = "builtins")))]
-    pub fn dict(_state: &State, value: Value) -> Result<Value, Error> {
-        if value.is_undefined() {
-            Ok(Value::from(BTreeMap::<bool, Value>::new()))
-        } else if value.kind() != ValueKind::Map {
-            Err(Error::from(ErrorKind::ImpossibleOperation))
-        } else {
-            Ok(value)
+    pub fn dict(_state: &State, args: Vec<Value>) -> Result<Value, Error> {
+        Ok(Value(ValueRepr::Map(RcType::new(collect_map(
+            "dict", args,
+        )?))))
+    }
+
+    /// Creates a namespace object.
+    ///
+    /// Variables set in a loop or another scope are not visible once that
+    /// scope ends.  A namespace can carry values out of such a scope as its
+    /// attributes can be changed with `{% set ns.attr = value %}`.  It's
+    /// initialized from the same arguments as [`dict`]:
+    ///
+    /// ```jinja
+    /// {% set ns = namespace(found=false) %}
+    /// {% for item in items %}
+    ///   {% if item.check_something() %}
+    ///     {% set ns.found = true %}
+    ///   {% endif %}
+    /// {% endfor %}
+    /// Found item having something: {{ ns.found }}
+    /// ```
+    ///
+    /// This function is only available if the `sync` feature is enabled.
+    #[cfg_attr(docsrs, doc(cfg(all(feature = "builtins", feature = "sync"))))]
+    #[cfg(feature = "sync")]
+    pub fn namespace(_state: &State, args: Vec<Value>) -> Result<Value, Error> {
+        let mut data = ValueMap::new();
+        for (key, value) in collect_map("namespace", args)? {
+            match key.as_str() {
+                Some(name) => data.insert(name.to_string(), value),
+                None => {
+                    return Err(Error::new(
+                        ErrorKind::InvalidArguments,
+                        "namespace attributes must be strings",
+                    ))
+                }
+            };
+        }
+        Ok(Value::from_object(Namespace {
+            data: Mutex::new(data),
+        }))
+    }
+
+    #[cfg(feature = "sync")]
+    #[derive(Debug)]
+    pub(crate) struct Namespace {
+        data: Mutex<ValueMap<String, Value>>,
+    }
+
+    #[cfg(feature = "sync")]
+    impl Namespace {
+        pub(crate) fn set(&self, name: &str, value: Value) {
+            self.data.lock().unwrap().insert(name.to_string(), value);
+        }
+    }
+
+    #[cfg(feature = "sync")]
+    impl fmt::Display for Namespace {
+        fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+            write!(f, "<namespace {{")?;
+            for (idx, (key, value)) in self.data.lock().unwrap().iter().enumerate() {
+                if idx > 0 {
+                    write!(f, ", ")?;
+                }
+                write!(f, "{:?}: {:?}", key, value)?;
+            }
+            write!(f, "}}>")
+        }
+    }
+
+    #[cfg(feature = "sync")]
+    impl Object for Namespace {
+        fn get_attr(&self, name: &str) -> Option<Value> {
+            self.data.lock().unwrap().get(name).cloned()
+        }
+    }
+
+    /// Creates a cycler that cycles through the given values.
+    ///
+    /// This works like `loop.cycle` but can be used outside of loops or
+    /// across multiple loops.  The returned object has the following
+    /// attributes and methods:
+    ///
+    /// - `current`: the value the cycler is currently at.
+    /// - `next()`: returns the current value and advances to the next one.
+    /// - `reset()`: resets the cycler to the first value.
+    ///
+    /// Like in Jinja2 every call to `next()` advances the cycler for all
+    /// uses of it, also across includes and macros the object is passed to.
+    ///
+    /// ```jinja
+    /// {% set row_class = cycler("odd", "even") %}
+    /// {% for folder in folders %}
+    ///   <li class="folder {{ row_class.next() }}">{{ folder }}
+    /// {% endfor %}
+    /// {% for file in files %}
+    ///   <li class="file {{ row_class.next() }}">{{ file }}
+    /// {% endfor %}
+    /// ```
+    ///
+    /// This function is only available if the `sync` feature is enabled.
+    #[cfg_attr(docsrs, doc(cfg(all(feature = "builtins", feature = "sync"))))]
+    #[cfg(feature = "sync")]
+    pub fn cycler(_state: &State, items: Vec<Value>) -> Result<Value, Error> {
+        if items.is_empty() {
+            return Err(Error::new(
+                ErrorKind::InvalidArguments,
+                "at least one item has to be provided to cycler",
+            ));
+        }
+        Ok(Value::from_object(Cycler {
+            items,
+            pos: AtomicUsize::new(0),
+        }))
+    }
+
+    #[cfg(feature = "sync")]
+    #[derive(Debug)]
+    struct Cycler {
+        items: Vec<Value>,
+        pos: AtomicUsize,
+    }
+
+    #[cfg(feature = "sync")]
+    impl Cycler {
+        fn current(&self) -> Value {
+            self.items[self.pos.load(Ordering::Relaxed)].clone()
+        }
+    }
+
+    #[cfg(feature = "sync")]
+    impl fmt::Display for Cycler {
+        fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+            write!(f, "<cycler {}>", self.current())
+        }
+    }
+
+    #[cfg(feature = "sync")]
+    impl Object for Cycler {
+        fn attributes(&self) -> &[&str] {
+            &["current"][..]
+        }
+
+        fn get_attr(&self, name: &str) -> Option<Value> {
+            match name {
+                "current" => Some(self.current()),
+                _ => None,
+            }
+        }
+
+        fn call_method(
+            &self,
+            _state: &State,
+            name: &str,
+            args: Vec<Value>,
+        ) -> Result<Value, Error> {
+            if !args.is_empty() {
+                return Err(Error::new(
+                    ErrorKind::InvalidArguments,
+                    format!("cycler.{} does not take arguments", name),
+                ));
+            }
+            match name {
+                "next" => {
+                    let len = self.items.len();
+                    let pos = self
+                        .pos
+                        .fetch_update(Ordering::Relaxed, Ordering::Relaxed, |pos| {
+                            Some((pos + 1) % len)
+                        })
+                        .unwrap();
+                    Ok(self.items[pos].clone())
+                }
+                "reset" => {
+                    self.pos.store(0, Ordering::Relaxed);
+                    Ok(Value::from(()))
+                }
+                _ => Err(Error::new(
+                    ErrorKind::ImpossibleOperation,
+                    format!("cycler has no method named {}", name),
+                )),
+            }
+        }
+    }
+
+    /// Creates a joiner to join multiple sections.
+    ///
+    /// A joiner is passed a string and will return that string every time
+    /// it's called, except the first time (in which situation it returns an
+    /// empty string).  The separator defaults to `", "`.
+    ///
+    /// ```jinja
+    /// {% set pipe = joiner("|") %}
+    /// {% if categories %}{{ pipe() }}
+    ///   Categories: {{ categories|join(", ") }}
+    /// {% endif %}
+    /// {% if author %}{{ pipe() }}
+    ///   Author: {{ author }}
+    /// {% endif %}
+    /// ```
+    #[cfg_attr(docsrs, doc(cfg(feature = "builtins")))]
+    pub fn joiner(_state: &State, sep: Option<String>) -> Result<Value, Error> {
+        Ok(Value::from_object(Joiner {
+            sep: sep.unwrap_or_else(|| ", ".into()),
+            used: AtomicBool::new(false),
+        }))
+    }
+
+    #[derive(Debug)]
+    struct Joiner {
+        sep: String,
+        used: AtomicBool,
+    }
+
+    impl fmt::Display for Joiner {
+        fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+            write!(f, "<joiner {:?}>", self.sep)
+        }
+    }
+
+    impl Object for Joiner {
+        fn call(&self, _state: &State, args: Vec<Value>) -> Result<Value, Error> {
+            if !args.is_empty() {
+                return Err(Error::new(
+                    ErrorKind::InvalidArguments,
+                    "joiner does not take arguments",
+                ));
+            }
+            Ok(Value::from(if self.used.swap(true, Ordering::Relaxed) {
+                self.sep.as_str()
+            } else {
+                ""
+            }))
+        }
+    }
+
+    /// Returns the current time as [`DateTime`](crate::value::DateTime).
+    ///
+    /// The time is in UTC unless another timezone is passed with the `tz`
+    /// keyword argument.  As there is no timezone database only `UTC` and
+    /// fixed offsets (eg: `+02:00`) are supported.  The returned value
+    /// renders in RFC 3339 format, can be compared with other datetimes
+    /// and RFC 3339 strings and supports `strftime`:
+    ///
+    /// ```jinja
+    /// <p>Generated at {{ now(tz="+02:00").strftime("%Y-%m-%d %H:%M") }}
+    /// {% if now() - user.created_at < 86400 %}<p>Welcome!{% endif %}
+    /// ```
+    #[cfg_attr(docsrs, doc(cfg(feature = "builtins")))]
+    pub fn now(_state: &State, kwargs: Kwargs) -> Result<Value, Error> {
+        let mut rv = DateTime::now();
+        if let Some(tz) = kwargs.get::<Option<String>>("tz")? {
+            rv = rv.with_timezone(&tz)?;
+        }
+        kwargs.assert_all_used()?;
+        Ok(Value::from_object(rv))
+    }
+
+    /// Returns a random UUID (version 4).
+    ///
+    /// The randomness comes from the source configured with
+    /// [`Environment::set_random_source`](crate::Environment::set_random_source).
+    ///
+    /// ```jinja
+    /// request_id = "{{ uuid4() }}"
+    /// ```
+    #[cfg_attr(docsrs, doc(cfg(feature = "builtins")))]
+    pub fn uuid4(state: &State) -> Result<String, Error> {
+        let mut bytes = [0u8; 16];
+        state.env.fill_random(&mut bytes);
+        bytes[6] = (bytes[6] & 0x0f) | 0x40;
+        bytes[8] = (bytes[8] & 0x3f) | 0x80;
+        let mut rv = String::with_capacity(36);
+        for (idx, b) in bytes.iter().enumerate() {
+            if idx == 4 || idx == 6 || idx == 8 || idx == 10 {
+                rv.push('-');
+            }
+            write!(rv, "{:02x}", b).unwrap();
         }
+        Ok(rv)
+    }
+
+    /// Returns a random alphanumeric token.
+    ///
+    /// The token has `length` characters (32 by default, at most 1024) from
+    /// `A-Z`, `a-z` and `0-9`.  The randomness comes from the source
+    /// configured with
+    /// [`Environment::set_random_source`](crate::Environment::set_random_source).
+    /// As tokens are often used as secrets the built-in source, which is not
+    /// cryptographically secure, is not used and the function fails unless
+    /// a source is configured.  For secrets that source has to be backed by
+    /// a cryptographically secure random number generator.  If the source
+    /// keeps producing bytes that cannot be mapped onto the alphabet an
+    /// error is returned.
+    ///
+    /// ```jinja
+    /// <input type="hidden" name="form_id" value="{{ random_token(16) }}">
+    /// ```
+    #[cfg_attr(docsrs, doc(cfg(feature = "builtins")))]
+    pub fn random_token(state: &State, length: Option<usize>) -> Result<String, Error> {
+        const CHARS: &[u8; 62] = b"ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789";
+        let length = length.unwrap_or(32);
+        if length > 1024 {
+            return Err(Error::new(
+                ErrorKind::InvalidArguments,
+                "token length must not exceed 1024",
+            ));
+        }
+        // a working source needs about length / 60 refills, so running out
+        // of attempts means the source is broken (for instance constant)
+        const MAX_REFILLS: usize = 64;
+        let mut rv = String::with_capacity(length);
+        let mut buf = [0u8; 64];
+        for _ in 0..MAX_REFILLS {
+            if rv.len() == length {
+                break;
+            }
+            state.env.fill_configured_random(&mut buf)?;
+            // only use bytes that map evenly onto the alphabet
+            for &b in buf.iter().filter(|&&b| (b as usize) < CHARS.len() * 4) {
+                if rv.len() == length {
+                    break;
+                }
+                rv.push(CHARS[b as usize % CHARS.len()] as char);
+            }
+        }
+        if rv.len() < length {
+            return Err(Error::new(
+                ErrorKind::InvalidOperation,
+                "random source did not produce usable bytes",
+            ));
+        }
+        Ok(rv)
+    }
+
+    /// Returns the sorted names of the templates known to the environment.
+    ///
+    /// An optional glob pattern filters the names.  `*` matches any number
+    /// of characters within a directory, `?` a single character and `**`
+    /// any number of directories.  This allows plugin style discovery of
+    /// partials:
+    ///
+    /// ```jinja
+    /// {% for name in list_templates("partials/*.html") %}
+    ///   {% include name %}
+    /// {% endfor %}
+    /// ```
+    ///
+    /// The names are the ones returned by
+    /// [`Environment::template_names`](crate::Environment::template_names).
+    /// As this reveals every template the loader can find to the templates,
+    /// the function is not registered by default and has to be added
+    /// explicitly:
+    ///
+    /// ```
+    /// # use minijinja::Environment;
+    /// # let mut env = Environment::new();
+    /// env.add_function("list_templates", minijinja::functions::list_templates);
+    /// ```
+    #[cfg_attr(docsrs, doc(cfg(feature = "builtins")))]
+    pub fn list_templates(state: &State, pattern: Option<String>) -> Result<Value, Error> {
+        let names = state.env.template_names()?;
+        Ok(Value::from(match pattern {
+            Some(pattern) => names
+                .into_iter()
+                .filter(|name| glob_match_path(&pattern, name))
+                .collect(),
+            None => names,
+        }))
     }
 
     /// Outputs the current context stringified.
@@ -216,7 +688,10 @@ mod builtins {
     /// ```jinja
     /// <pre>{{ debug() }}</pre>
     /// ```
-    #[cfg_attr(docsrs, doc(cfg(feature = "builtins")))]
+    ///
+    /// This function is only available if the `debug` feature is enabled.
+    #[cfg_attr(docsrs, doc(cfg(all(feature = "builtins", feature = "debug"))))]
+    #[cfg(feature = "debug")]
     pub fn debug(state: &State) -> Result<String, Error> {
         Ok(format!("{:#?}", state))
     }
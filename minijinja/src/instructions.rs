@@ -1,7 +1,7 @@
 #[cfg(feature = "internal_debug")]
 use std::fmt;
 
-use crate::value::Value;
+use crate::value::{Value, ValueKind};
 
 /// This loop has the loop var.
 pub const LOOP_FLAG_WITH_LOOP_VAR: u8 = 1;
@@ -9,6 +9,10 @@ pub const LOOP_FLAG_WITH_LOOP_VAR: u8 = 1;
 /// This loop is recursive.
 pub const LOOP_FLAG_RECURSIVE: u8 = 2;
 
+/// This loop unpacks into two targets and iterates over the items of map
+/// objects.
+pub const LOOP_FLAG_PAIRS: u8 = 4;
+
 /// Represents an instruction for the VM.
 #[derive(Clone, PartialEq, Eq)]
 pub enum Instruction<'source> {
@@ -24,9 +28,26 @@ pub enum Instruction<'source> {
     /// Looks up an attribute.
     GetAttr(&'source str),
 
+    /// Sets an attribute on a namespace object.
+    ///
+    /// The object is on top of the stack, the value below it.
+    SetAttr(&'source str),
+
     /// Looks up an item.
     GetItem,
 
+    /// Looks up an attribute, undefined values stay undefined.
+    ///
+    /// This is used by the `defined` and `undefined` tests to look up
+    /// attributes of values that might not exist.
+    ProbeAttr(&'source str),
+
+    /// Looks up an item, undefined values stay undefined.
+    ProbeItem,
+
+    /// Slices a value with start, stop and step from the stack.
+    Slice,
+
     /// Loads a constant value.
     LoadConst(Value),
 
@@ -39,9 +60,22 @@ pub enum Instruction<'source> {
     /// Unpacks a list into N stack items.
     UnpackList(usize),
 
+    /// Unpacks a list into targets with a catch-all target in between.
+    ///
+    /// The arguments are the number of targets before and after the
+    /// catch-all which receives the remaining items as list.
+    UnpackListStarred(usize, usize),
+
     /// Appends to the list.
     ListAppend,
 
+    /// Extends the list with the items of a sequence.
+    ListExtend,
+
+    /// Merges the last n maps on the stack into a map of keyword arguments
+    /// which is appended to the list below unless it ends up empty.
+    MergeKwargs(usize),
+
     /// Add the top two values
     Add,
 
@@ -144,6 +178,27 @@ pub enum Instruction<'source> {
     /// Includes another template.
     Include(bool),
 
+    /// Renders a component template with the props map on the stack.
+    RenderComponent,
+
+    /// Declares a prop of a component.
+    ///
+    /// The prop is checked against the optional kind.  If the flag is set a
+    /// default value is on the stack.
+    DeclareProp(&'source str, Option<ValueKind>, bool),
+
+    /// Enters a custom tag with the arguments on the stack.
+    ///
+    /// If the tag produces a value right away it is emitted and execution
+    /// jumps to the target, skipping the body.
+    EnterTag(&'source str, usize),
+
+    /// Renders a custom tag.
+    ///
+    /// If the flag is set the captured body is on the stack, above the
+    /// arguments.
+    ExitTag(&'source str, bool),
+
     /// Sets the auto escape flag to the current value.
     PushAutoEscape,
 
@@ -188,14 +243,25 @@ impl<'source> fmt::Debug for Instruction<'source> {
         match *self {
             Instruction::EmitRaw(s) => write!(f, "EMIT_RAW (string {:?})", s),
             Instruction::StoreLocal(n) => write!(f, "STORE_LOCAL (var {:?})", n),
+            Instruction::SetAttr(n) => write!(f, "SETATTR (key {:?})", n),
             Instruction::Lookup(n) => write!(f, "LOOKUP (var {:?})", n),
             Instruction::GetAttr(n) => write!(f, "GETATTR (key {:?})", n),
             Instruction::GetItem => write!(f, "GETITEM"),
+            Instruction::ProbeAttr(n) => write!(f, "PROBEATTR (key {:?})", n),
+            Instruction::ProbeItem => write!(f, "PROBEITEM"),
+            Instruction::Slice => write!(f, "SLICE"),
             Instruction::LoadConst(ref v) => write!(f, "LOAD_CONST (value {:?})", v),
             Instruction::BuildMap(n) => write!(f, "BUILD_MAP ({:?} pairs)", n),
             Instruction::BuildList(n) => write!(f, "BUILD_LIST ({:?} items)", n),
             Instruction::UnpackList(n) => write!(f, "UNPACK_LIST ({:?} items)", n),
+            Instruction::UnpackListStarred(before, after) => write!(
+                f,
+                "UNPACK_LIST_STARRED ({:?} before, {:?} after)",
+                before, after
+            ),
             Instruction::ListAppend => write!(f, "LIST_APPEND"),
+            Instruction::ListExtend => write!(f, "LIST_EXTEND"),
+            Instruction::MergeKwargs(n) => write!(f, "MERGE_KWARGS ({:?} maps)", n),
             Instruction::Add => write!(f, "ADD"),
             Instruction::Sub => write!(f, "SUB"),
             Instruction::Mul => write!(f, "MUL"),
@@ -223,11 +289,19 @@ impl<'source> fmt::Debug for Instruction<'source> {
             Instruction::PushLoop(flags) => {
                 let recursive = flags & LOOP_FLAG_RECURSIVE != 0;
                 let loop_var = flags & LOOP_FLAG_WITH_LOOP_VAR != 0;
-                write!(
-                    f,
-                    "PUSH_LOOP (loop var: {:?}, recursive: {:?})",
-                    loop_var, recursive
-                )
+                if flags & LOOP_FLAG_PAIRS != 0 {
+                    write!(
+                        f,
+                        "PUSH_LOOP (loop var: {:?}, recursive: {:?}, pairs: true)",
+                        loop_var, recursive
+                    )
+                } else {
+                    write!(
+                        f,
+                        "PUSH_LOOP (loop var: {:?}, recursive: {:?})",
+                        loop_var, recursive
+                    )
+                }
             }
             Instruction::PushWith => write!(f, "PUSH_WITH"),
             Instruction::Iterate(t) => write!(f, "ITERATE (exit to {:>05x})", t),
@@ -239,6 +313,18 @@ impl<'source> fmt::Debug for Instruction<'source> {
             Instruction::CallBlock(n) => write!(f, "CALL_BLOCK (name {:?})", n),
             Instruction::LoadBlocks => write!(f, "LOAD_BLOCKS"),
             Instruction::Include(b) => write!(f, "INCLUDE (ignore missing {:?})", b),
+            Instruction::RenderComponent => write!(f, "RENDER_COMPONENT"),
+            Instruction::DeclareProp(n, k, d) => {
+                write!(
+                    f,
+                    "DECLARE_PROP (name {:?}, kind {:?}, default {:?})",
+                    n, k, d
+                )
+            }
+            Instruction::EnterTag(n, t) => {
+                write!(f, "ENTER_TAG (name {:?}, to {:>05x})", n, t)
+            }
+            Instruction::ExitTag(n, b) => write!(f, "EXIT_TAG (name {:?}, body {:?})", n, b),
             Instruction::PushAutoEscape => write!(f, "PUSH_AUTO_ESCAPE"),
             Instruction::PopAutoEscape => write!(f, "POP_AUTO_ESCAPE"),
             Instruction::BeginCapture => write!(f, "BEGIN_CAPTURE"),
@@ -359,6 +445,17 @@ impl<'source> Instructions<'source> {
         rv
     }
 
+    /// Returns the names of the props declared by the template.
+    pub fn declared_props(&self) -> Vec<&'source str> {
+        self.instructions
+            .iter()
+            .filter_map(|instr| match *instr {
+                Instruction::DeclareProp(name, _, _) => Some(name),
+                _ => None,
+            })
+            .collect()
+    }
+
     /// Returns the number of instructions
     pub fn len(&self) -> usize {
         self.instructions.len()
@@ -1,6 +1,7 @@
 use std::borrow::Cow;
 
 use crate::error::{Error, ErrorKind};
+use crate::syntax::Syntax;
 use crate::tokens::{Span, Token};
 use crate::utils::{matches, memchr, memstr, unescape};
 
@@ -8,21 +9,140 @@ enum LexerState {
     Template,
     InVariable,
     InBlock,
+    InLineStatement,
 }
 
-fn find_marker(a: &str) -> Option<usize> {
+#[derive(Debug, Copy, Clone, PartialEq, Eq)]
+enum LineMarker {
+    Statement,
+    Comment,
+}
+
+#[derive(Debug, Copy, Clone, PartialEq, Eq)]
+enum StartMarker {
+    Variable,
+    Block,
+    Comment,
+}
+
+/// Returns the start marker (and its length) at the beginning of the string.
+///
+/// If multiple markers match, the longest one wins.
+fn match_start_marker(a: &str, syntax: &Syntax) -> Option<(StartMarker, usize)> {
+    let mut rv = None;
+    for &(marker, delim) in &[
+        (StartMarker::Variable, &syntax.variable_start),
+        (StartMarker::Block, &syntax.block_start),
+        (StartMarker::Comment, &syntax.comment_start),
+    ] {
+        if a.starts_with(&delim[..]) && rv.map_or(true, |(_, len)| delim.len() > len) {
+            rv = Some((marker, delim.len()));
+        }
+    }
+    rv
+}
+
+fn find_marker(a: &str, syntax: &Syntax) -> Option<usize> {
     let bytes = a.as_bytes();
+    let first_bytes = [
+        syntax.variable_start.as_bytes()[0],
+        syntax.block_start.as_bytes()[0],
+        syntax.comment_start.as_bytes()[0],
+    ];
     let mut offset = 0;
     loop {
-        let idx = memchr(&bytes[offset..], b'{')?;
-        if let Some(b'{') | Some(b'%') | Some(b'#') = bytes.get(offset + idx + 1).copied() {
+        // the default syntax has the same first byte for all markers which
+        // lets us use the much faster memchr.
+        let idx = if first_bytes[0] == first_bytes[1] && first_bytes[0] == first_bytes[2] {
+            memchr(&bytes[offset..], first_bytes[0])?
+        } else {
+            bytes[offset..]
+                .iter()
+                .position(|x| first_bytes.contains(x))?
+        };
+        if match_start_marker(&a[offset + idx..], syntax).is_some() {
             return Some(offset + idx);
         }
         offset += idx + 1;
+        // skip to the next char boundary to not slice into a multi-byte
+        // character on the next iteration.
+        while !a.is_char_boundary(offset) {
+            offset += 1;
+        }
+    }
+}
+
+fn is_horizontal_whitespace(c: u8) -> bool {
+    c == b' ' || c == b'\t'
+}
+
+/// Returns the line marker (and the length to skip) at the beginning of `rest`.
+///
+/// Line statements are only recognized at the start of a line but may be
+/// indented, line comments are recognized anywhere.  In both cases the
+/// whitespace in front of the prefix is skipped as well.
+fn match_line_marker(input: &str, rest: &str, syntax: &Syntax) -> Option<(LineMarker, usize)> {
+    let ws = rest
+        .as_bytes()
+        .iter()
+        .take_while(|&&c| is_horizontal_whitespace(c))
+        .count();
+    let offset = input.len() - rest.len();
+    let at_line_start = offset == 0 || input.as_bytes()[offset - 1] == b'\n';
+    let mut rv = None;
+    if let Some(ref prefix) = syntax.line_statement_prefix {
+        if at_line_start && rest[ws..].starts_with(&prefix[..]) {
+            rv = Some((LineMarker::Statement, ws + prefix.len()));
+        }
+    }
+    if let Some(ref prefix) = syntax.line_comment_prefix {
+        if rest[ws..].starts_with(&prefix[..])
+            && rv.map_or(true, |(_, len)| ws + prefix.len() > len)
+        {
+            rv = Some((LineMarker::Comment, ws + prefix.len()));
+        }
+    }
+    rv
+}
+
+/// Finds the next line statement or line comment after the start of `a`.
+///
+/// The returned offset is where the template data in front of the marker
+/// ends.  This excludes the indentation of line statements and the
+/// whitespace in front of line comments.
+fn find_line_marker(a: &str, syntax: &Syntax) -> Option<usize> {
+    let bytes = a.as_bytes();
+    let mut rv = None;
+
+    if let Some(ref prefix) = syntax.line_statement_prefix {
+        let mut offset = 0;
+        while let Some(idx) = memchr(&bytes[offset..], b'\n') {
+            let line_start = offset + idx + 1;
+            let ws = bytes[line_start..]
+                .iter()
+                .take_while(|&&c| is_horizontal_whitespace(c))
+                .count();
+            if a[line_start + ws..].starts_with(&prefix[..]) {
+                rv = Some(line_start);
+                break;
+            }
+            offset = line_start;
+        }
     }
+
+    if let Some(ref prefix) = syntax.line_comment_prefix {
+        if let Some(mut idx) = memstr(&bytes[..rv.unwrap_or(bytes.len())], prefix.as_bytes()) {
+            while idx > 0 && is_horizontal_whitespace(bytes[idx - 1]) {
+                idx -= 1;
+            }
+            rv = Some(idx);
+        }
+    }
+
+    rv
 }
 
-fn skip_basic_tag(block_str: &str, name: &str) -> Option<usize> {
+fn skip_basic_tag(block_str: &str, name: &str, block_end: &str) -> Option<usize> {
     let mut ptr = block_str;
 
     if let Some(rest) = ptr.strip_prefix('-') {
@@ -40,15 +160,36 @@ fn skip_basic_tag(block_str: &str, name: &str) -> Option<usize> {
     if let Some(rest) = ptr.strip_prefix('-') {
         ptr = rest;
     }
-    ptr = ptr.strip_prefix("%}")?;
+    ptr = ptr.strip_prefix(block_end)?;
 
     Some(block_str.len() - ptr.len())
 }
 
+/// Checks for an end delimiter optionally prefixed by a whitespace marker.
+///
+/// Returns the length of the delimiter and if whitespace should be removed.
+fn match_end_marker(a: &str, delim: &str) -> Option<(usize, bool)> {
+    if let Some(rest) = a.strip_prefix('-') {
+        if rest.starts_with(delim) {
+            return Some((delim.len() + 1, true));
+        }
+    }
+    if a.starts_with(delim) {
+        Some((delim.len(), false))
+    } else {
+        None
+    }
+}
+
 /// Tokenizes without whitespace handling.
-fn tokenize_raw(
+///
+/// Comments are skipped unless `keep_comments` is set in which case they
+/// are emitted as [`Token::Comment`].
+pub(crate) fn tokenize_raw(
     input: &str,
     in_expr: bool,
+    syntax: Syntax,
+    keep_comments: bool,
 ) -> impl Iterator<Item = Result<(Token<'_>, Span), Error>> {
     let mut rest = input;
     let mut stack = vec![if in_expr {
@@ -57,6 +198,7 @@ fn tokenize_raw(
         LexerState::Template
     }];
     let mut failed = false;
+    let mut paren_balance = 0usize;
     let mut current_line = 1;
     let mut current_col = 0;
 
@@ -69,19 +211,21 @@ fn tokenize_raw(
 
     macro_rules! span {
         ($start:expr) => {{
-            let (start_line, start_col) = $start;
+            let (start_line, start_col, start_offset) = $start;
             Span {
                 start_line,
                 start_col,
                 end_line: current_line,
                 end_col: current_col,
+                start_offset,
+                end_offset: input.len() - rest.len(),
             }
         }};
     }
 
     macro_rules! loc {
         () => {
-            (current_line, current_col)
+            (current_line, current_col, input.len() - rest.len())
         };
     }
 
@@ -185,34 +329,72 @@ fn tokenize_raw(
     }
 
     std::iter::from_fn(move || loop {
-        if rest.is_empty() || failed {
+        if failed {
+            return None;
+        }
+        if rest.is_empty() {
+            // line statements are also terminated by the end of the input
+            if let Some(&LexerState::InLineStatement) = stack.last() {
+                stack.pop();
+                return Some(Ok((Token::BlockEnd(false), span!(loc!()))));
+            }
             return None;
         }
 
         let old_loc = loc!();
         match stack.last() {
             Some(LexerState::Template) => {
-                match rest.get(..2) {
-                    Some("{{") => {
-                        let ws = if rest.as_bytes().get(2) == Some(&b'-') {
-                            advance!(3);
+                match match_line_marker(input, rest, &syntax) {
+                    Some((LineMarker::Statement, skip)) => {
+                        advance!(skip);
+                        paren_balance = 0;
+                        stack.push(LexerState::InLineStatement);
+                        return Some(Ok((Token::BlockStart(false), span!(old_loc))));
+                    }
+                    Some((LineMarker::Comment, skip)) => {
+                        // line comments run until the end of the line but the
+                        // newline itself is retained.
+                        let mut end = memchr(&rest.as_bytes()[skip..], b'\n')
+                            .map_or(rest.len(), |idx| skip + idx);
+                        if end > skip && rest.as_bytes()[end - 1] == b'\r' {
+                            end -= 1;
+                        }
+                        let comment = &advance!(end)[skip..];
+                        if keep_comments {
+                            return Some(Ok((Token::Comment(comment), span!(old_loc))));
+                        }
+                        continue;
+                    }
+                    None => {}
+                }
+
+                match match_start_marker(rest, &syntax) {
+                    Some((StartMarker::Variable, skip)) => {
+                        let ws = if rest.as_bytes().get(skip) == Some(&b'-') {
+                            advance!(skip + 1);
                             true
                         } else {
-                            advance!(2);
+                            advance!(skip);
                             false
                         };
                         stack.push(LexerState::InVariable);
                         return Some(Ok((Token::VariableStart(ws), span!(old_loc))));
                     }
-                    Some("{%") => {
+                    Some((StartMarker::Block, skip)) => {
                         // raw blocks require some special handling.  If we are at the beginning of a raw
                         // block we want to skip everything until {% endraw %} completely ignoring iterior
                         // syntax and emit the entire raw block as TemplateData.
-                        if let Some(mut ptr) = skip_basic_tag(&rest[2..], "raw") {
-                            ptr += 2;
-                            while let Some(block) = memstr(&rest.as_bytes()[ptr..], b"{%") {
-                                ptr += block + 2;
-                                if let Some(endraw) = skip_basic_tag(&rest[ptr..], "endraw") {
+                        if let Some(mut ptr) =
+                            skip_basic_tag(&rest[skip..], "raw", &syntax.block_end)
+                        {
+                            ptr += skip;
+                            while let Some(block) =
+                                memstr(&rest.as_bytes()[ptr..], syntax.block_start.as_bytes())
+                            {
+                                ptr += block + skip;
+                                if let Some(endraw) =
+                                    skip_basic_tag(&rest[ptr..], "endraw", &syntax.block_end)
+                                {
                                     let result = &rest[..ptr + endraw];
                                     advance!(ptr + endraw);
                                     return Some(Ok((Token::TemplateData(result), span!(old_loc))));
@@ -221,40 +403,54 @@ fn tokenize_raw(
                             syntax_error!("unexpected end of raw block");
                         }
 
-                        let ws = if rest.as_bytes().get(2) == Some(&b'-') {
-                            advance!(3);
+                        let ws = if rest.as_bytes().get(skip) == Some(&b'-') {
+                            advance!(skip + 1);
                             true
                         } else {
-                            advance!(2);
+                            advance!(skip);
                             false
                         };
 
                         stack.push(LexerState::InBlock);
                         return Some(Ok((Token::BlockStart(ws), span!(old_loc))));
                     }
-                    Some("{#") => {
-                        if let Some(comment_end) = memstr(rest.as_bytes(), b"#}") {
-                            advance!(comment_end + 2);
+                    Some((StartMarker::Comment, skip)) => {
+                        if let Some(comment_end) =
+                            memstr(&rest.as_bytes()[skip..], syntax.comment_end.as_bytes())
+                        {
+                            let comment = &advance!(skip + comment_end + syntax.comment_end.len())
+                                [skip..skip + comment_end];
+                            if keep_comments {
+                                return Some(Ok((Token::Comment(comment), span!(old_loc))));
+                            }
                         } else {
                             syntax_error!("unexpected end of comment");
                         }
                     }
-                    _ => {}
+                    None => {}
                 }
 
-                let lead = match find_marker(rest) {
-                    Some(start) => advance!(start),
-                    None => advance!(rest.len()),
+                let end = match (find_marker(rest, &syntax), find_line_marker(rest, &syntax)) {
+                    (Some(a), Some(b)) => a.min(b),
+                    (Some(a), None) | (None, Some(a)) => a,
+                    (None, None) => rest.len(),
                 };
+                let lead = advance!(end);
                 return Some(Ok((Token::TemplateData(lead), span!(old_loc))));
             }
-            Some(&LexerState::InBlock) | Some(&LexerState::InVariable) => {
+            Some(&LexerState::InBlock)
+            | Some(&LexerState::InVariable)
+            | Some(&LexerState::InLineStatement) => {
+                // line statements end with the line unless there are open
+                // parentheses or brackets in which case they continue.
+                let newline_ends_statement =
+                    matches!(stack.last(), Some(&LexerState::InLineStatement))
+                        && paren_balance == 0;
+
                 // in blocks whitespace is generally ignored, skip it.
-                match rest
-                    .as_bytes()
-                    .iter()
-                    .position(|&x| !x.is_ascii_whitespace())
-                {
+                match rest.as_bytes().iter().position(|&x| {
+                    !x.is_ascii_whitespace() || (newline_ends_statement && x == b'\n')
+                }) {
                     Some(0) => {}
                     None => {
                         advance!(rest.len());
@@ -267,27 +463,39 @@ fn tokenize_raw(
                 }
 
                 // look out for the end of blocks
-                if let Some(&LexerState::InBlock) = stack.last() {
-                    if let Some("-%}") = rest.get(..3) {
-                        stack.pop();
-                        advance!(3);
-                        return Some(Ok((Token::BlockEnd(true), span!(old_loc))));
-                    }
-                    if let Some("%}") = rest.get(..2) {
-                        stack.pop();
-                        advance!(2);
-                        return Some(Ok((Token::BlockEnd(false), span!(old_loc))));
+                match stack.last() {
+                    Some(&LexerState::InBlock) => {
+                        if let Some((skip, ws)) = match_end_marker(rest, &syntax.block_end) {
+                            stack.pop();
+                            advance!(skip);
+                            return Some(Ok((Token::BlockEnd(ws), span!(old_loc))));
+                        }
                     }
-                } else {
-                    if let Some("-}}") = rest.get(..3) {
-                        stack.pop();
-                        advance!(3);
-                        return Some(Ok((Token::VariableEnd(true), span!(old_loc))));
+                    Some(&LexerState::InVariable) => {
+                        if let Some((skip, ws)) = match_end_marker(rest, &syntax.variable_end) {
+                            stack.pop();
+                            advance!(skip);
+                            return Some(Ok((Token::VariableEnd(ws), span!(old_loc))));
+                        }
                     }
-                    if let Some("}}") = rest.get(..2) {
-                        stack.pop();
-                        advance!(2);
-                        return Some(Ok((Token::VariableEnd(false), span!(old_loc))));
+                    _ => {
+                        if newline_ends_statement {
+                            if rest.starts_with('\n') {
+                                stack.pop();
+                                advance!(1);
+                                return Some(Ok((Token::BlockEnd(false), span!(old_loc))));
+                            }
+                            // a trailing colon (`# for x in seq:`) is permitted
+                            if rest.starts_with(':')
+                                && rest[1..]
+                                    .trim_start_matches(|c| c == ' ' || c == '\t' || c == '\r')
+                                    .get(..1)
+                                    .map_or(true, |x| x == "\n")
+                            {
+                                advance!(1);
+                                continue;
+                            }
+                        }
                     }
                 }
 
@@ -340,6 +548,15 @@ fn tokenize_raw(
                     _ => None,
                 };
                 if let Some(op) = op {
+                    match op {
+                        Token::ParenOpen | Token::BracketOpen | Token::BraceOpen => {
+                            paren_balance += 1;
+                        }
+                        Token::ParenClose | Token::BracketClose | Token::BraceClose => {
+                            paren_balance = paren_balance.saturating_sub(1);
+                        }
+                        _ => {}
+                    }
                     advance!(1);
                     return Some(Ok((op, span!(old_loc))));
                 }
@@ -372,32 +589,81 @@ fn tokenize_raw(
     })
 }
 
+/// HTML elements in which whitespace is significant.
+const WHITESPACE_SENSITIVE_ELEMENTS: &[&str] = &["pre", "textarea", "script"];
+
+/// Checks if the bytes start with the given tag name.
+fn starts_with_tag(rest: &[u8], tag: &str) -> bool {
+    rest.get(..tag.len())
+        .map_or(false, |x| x.eq_ignore_ascii_case(tag.as_bytes()))
+        && rest
+            .get(tag.len())
+            .map_or(true, |&c| c == b'>' || c == b'/' || c.is_ascii_whitespace())
+}
+
+/// Returns the whitespace sensitive element open at the end of the data.
+///
+/// `open` is the element that was open at the start of the data.
+fn scan_html_elements(data: &str, mut open: Option<&'static str>) -> Option<&'static str> {
+    let bytes = data.as_bytes();
+    let mut pos = 0;
+    while let Some(idx) = memchr(&bytes[pos..], b'<') {
+        pos += idx + 1;
+        let rest = &bytes[pos..];
+        open = match open {
+            Some(tag) if rest.first() == Some(&b'/') && starts_with_tag(&rest[1..], tag) => None,
+            Some(tag) => Some(tag),
+            None => WHITESPACE_SENSITIVE_ELEMENTS
+                .iter()
+                .copied()
+                .find(|tag| starts_with_tag(rest, tag)),
+        };
+    }
+    open
+}
+
 /// Automatically removes whitespace around blocks.
+///
+/// If `html_aware` is enabled whitespace is retained within the contents of
+/// `<pre>`, `<textarea>` and `<script>` elements.
 fn whitespace_filter<'a, I: Iterator<Item = Result<(Token<'a>, Span), Error>>>(
     iter: I,
+    html_aware: bool,
 ) -> impl Iterator<Item = Result<(Token<'a>, Span), Error>> {
     let mut iter = iter.peekable();
     let mut remove_leading_ws = false;
+    let mut open_element = None;
     // TODO: this does not update spans
     std::iter::from_fn(move || match iter.next() {
         Some(Ok((Token::TemplateData(mut data), span))) => {
             if remove_leading_ws {
                 remove_leading_ws = false;
-                data = data.trim_start();
+                if open_element.is_none() {
+                    data = data.trim_start();
+                }
+            }
+            if html_aware {
+                open_element = scan_html_elements(data, open_element);
             }
-            if matches!(
-                iter.peek(),
-                Some(Ok((Token::VariableStart(true), _))) | Some(Ok((Token::BlockStart(true), _)))
-            ) {
+            if open_element.is_none()
+                && matches!(
+                    iter.peek(),
+                    Some(Ok((Token::VariableStart(true), _)))
+                        | Some(Ok((Token::BlockStart(true), _)))
+                )
+            {
                 data = data.trim_end();
             }
             Some(Ok((Token::TemplateData(data), span)))
         }
         rv @ Some(Ok((Token::VariableEnd(true), _)))
-        | rv @ Some(Ok((Token::BlockStart(true), _))) => {
+        | rv @ Some(Ok((Token::BlockEnd(true), _))) => {
             remove_leading_ws = true;
             rv
         }
+        // comments are transparent for whitespace removal as they would
+        // otherwise not show up in the token stream at all.
+        rv @ Some(Ok((Token::Comment(_), _))) => rv,
         other => {
             remove_leading_ws = false;
             other
@@ -406,11 +672,37 @@ fn whitespace_filter<'a, I: Iterator<Item = Result<(Token<'a>, Span), Error>>>(
 }
 
 /// Tokenizes the source.
+#[cfg(any(test, feature = "unstable_machinery"))]
 pub fn tokenize(
     input: &str,
     in_expr: bool,
 ) -> impl Iterator<Item = Result<(Token<'_>, Span), Error>> {
-    whitespace_filter(tokenize_raw(input, in_expr))
+    tokenize_with_syntax(input, in_expr, &Syntax::default())
+}
+
+/// Tokenizes the source with a custom syntax.
+///
+/// The syntax is expected to have been validated.
+#[cfg(any(test, feature = "unstable_machinery"))]
+pub fn tokenize_with_syntax<'a>(
+    input: &'a str,
+    in_expr: bool,
+    syntax: &Syntax,
+) -> impl Iterator<Item = Result<(Token<'a>, Span), Error>> {
+    tokenize_with_options(input, in_expr, syntax, false)
+}
+
+/// Tokenizes the source with a custom syntax and optionally retains comments.
+pub(crate) fn tokenize_with_options<'a>(
+    input: &'a str,
+    in_expr: bool,
+    syntax: &Syntax,
+    keep_comments: bool,
+) -> impl Iterator<Item = Result<(Token<'a>, Span), Error>> {
+    whitespace_filter(
+        tokenize_raw(input, in_expr, syntax.clone(), keep_comments),
+        syntax.html_aware_whitespace,
+    )
 }
 
 #[test]
@@ -433,18 +725,105 @@ fn test_whitespace_filter() {
     "###);
 }
 
+#[test]
+fn test_scan_html_elements() {
+    assert_eq!(scan_html_elements("<div><pre class=x>", None), Some("pre"));
+    assert_eq!(scan_html_elements("</PRE><p>", Some("pre")), None);
+    assert_eq!(
+        scan_html_elements("<b></textarea>", Some("pre")),
+        Some("pre")
+    );
+    assert_eq!(scan_html_elements("<script>x</script>", None), None);
+    assert_eq!(scan_html_elements("<preview>", None), None);
+    assert_eq!(scan_html_elements("<textarea", None), Some("textarea"));
+}
+
 #[test]
 fn test_find_marker() {
-    assert!(find_marker("{").is_none());
-    assert!(find_marker("foo").is_none());
-    assert!(find_marker("foo {").is_none());
-    assert_eq!(find_marker("foo {{"), Some(4));
+    let syntax = Syntax::default();
+    assert!(find_marker("{", &syntax).is_none());
+    assert!(find_marker("foo", &syntax).is_none());
+    assert!(find_marker("foo {", &syntax).is_none());
+    assert_eq!(find_marker("foo {{", &syntax), Some(4));
+
+    let syntax = Syntax {
+        variable_start: "${".into(),
+        variable_end: "}".into(),
+        ..Syntax::default()
+    };
+    assert!(find_marker("foo {{", &syntax).is_none());
+    assert_eq!(find_marker("f\u{e4}\u{e4} $ {% x", &syntax), Some(8));
+    assert_eq!(find_marker("foo ${", &syntax), Some(4));
 }
 
 #[test]
 fn test_is_basic_tag() {
-    assert_eq!(skip_basic_tag(" raw %}", "raw"), Some(7));
-    assert_eq!(skip_basic_tag(" raw %}", "endraw"), None);
-    assert_eq!(skip_basic_tag("  raw  %}", "raw"), Some(9));
-    assert_eq!(skip_basic_tag("-  raw  -%}", "raw"), Some(11));
+    assert_eq!(skip_basic_tag(" raw %}", "raw", "%}"), Some(7));
+    assert_eq!(skip_basic_tag(" raw %}", "endraw", "%}"), None);
+    assert_eq!(skip_basic_tag("  raw  %}", "raw", "%}"), Some(9));
+    assert_eq!(skip_basic_tag("-  raw  -%}", "raw", "%}"), Some(11));
+    assert_eq!(skip_basic_tag(" raw >>", "raw", ">>"), Some(7));
+}
+
+#[test]
+fn test_custom_syntax() {
+    let syntax = Syntax {
+        block_start: "<%".into(),
+        block_end: "%>".into(),
+        variable_start: "${".into(),
+        variable_end: "}".into(),
+        comment_start: "<#".into(),
+        comment_end: "#>".into(),
+        ..Syntax::default()
+    };
+    let input = "{{ a }} <# x #}#>${ b -} <%- raw %>${ c }<% endraw %>";
+    let tokens: Result<Vec<_>, _> = tokenize_with_syntax(input, false, &syntax).collect();
+    let tokens = tokens.unwrap().into_iter().map(|x| x.0).collect::<Vec<_>>();
+    insta::assert_debug_snapshot!(&tokens, @r###"
+    [
+        TEMPLATE_DATA("{{ a }} "),
+        TEMPLATE_DATA(""),
+        VARIABLE_START(false),
+        IDENT(b),
+        VARIABLE_END(true),
+        TEMPLATE_DATA(""),
+        TEMPLATE_DATA("<%- raw %>${ c }<% endraw %>"),
+    ]
+    "###);
+}
+
+#[test]
+fn test_line_statements() {
+    let syntax = Syntax {
+        line_statement_prefix: Some("#".into()),
+        line_comment_prefix: Some("##".into()),
+        ..Syntax::default()
+    };
+    let input = "a ## comment\n  # for x in [1,\n 2]:\n## x\n{{ x }}\n# endfor";
+    let tokens: Result<Vec<_>, _> = tokenize_with_syntax(input, false, &syntax).collect();
+    let tokens = tokens.unwrap().into_iter().map(|x| x.0).collect::<Vec<_>>();
+    insta::assert_debug_snapshot!(&tokens, @r###"
+    [
+        TEMPLATE_DATA("a"),
+        TEMPLATE_DATA("\n"),
+        BLOCK_END(false),
+        IDENT(for),
+        IDENT(x),
+        IDENT(in),
+        BRACKET_OPEN,
+        INT(1),
+        COMMA,
+        INT(2),
+        BRACKET_CLOSE,
+        BLOCK_END(false),
+        TEMPLATE_DATA("\n"),
+        VARIABLE_START(false),
+        IDENT(x),
+        VARIABLE_END(false),
+        TEMPLATE_DATA("\n"),
+        BLOCK_END(false),
+        IDENT(endfor),
+        BLOCK_END(false),
+    ]
+    "###);
 }
@@ -99,25 +99,47 @@
 //!   is a forever unstable API which mainly exists to aid debugging complex issues.
 //! - `json`: When enabled the `tojson` filter is added as builtin filter.
 //! - `urlencode`: When enabled the `urlencode` filter is added as builtin filter.
+//! - `encoding`: When enabled the `b64encode`, `b64decode`, `hex`, `md5`, `sha1` and
+//!   `sha256` filters are added as builtin filters.
+//! - `regex`: When enabled the `regex_match`, `regex_search`, `regex_replace` and
+//!   `regex_findall` filters are added as builtin filters.
+//! - `unicode`: When enabled the `truncate` filter counts grapheme clusters and never
+//!   splits them, and the `graphemes` filter is added as builtin filter.
 //! - `preserve_order`: When enable the internal value implementation uses an indexmap
 //!   which preserves the original order of maps and structs.
+//! - `threads`: enables [`Template::render_blocks_concurrently`] and makes
+//!   [`Environment::render_directory`] render on multiple threads.  This
+//!   requires Rust 1.63.
 //!
 //! Additionally to cut down on size of the engine some default
 //! functionality can be removed:
 //!
 //! - `builtins`: if this feature is removed the default filters, tests and
-//!   functions are not implemented.
+//!   functions are not implemented.  To start from a curated set instead of
+//!   the defaults use [`Environment::empty`] which registers none of them.
 //! - `sync`: this feature makes MiniJinja's type `Send` and `Sync`.  If this feature
 //!   is disabled sending types across threads is often not possible.  Thread bounds
 //!   of things like callbacks however are not changing which means code that uses
 //!   MiniJinja still needs to be threadsafe.
 //! - `debug`: if this feature is removed some debug functionality of the engine is
-//!   removed as well.  This mainly affects the quality of error reporting.
+//!   removed as well.  This mainly affects the quality of error reporting, the
+//!   [`debugger`] hooks and the `debug()` global function.
 //! - `key_interning`: if this feature is removed the automatic string interning in
 //!   the value type is disabled.  The default behavior can cut down on the memory
 //!   consumption of the value type by interning all string keys used in values.
 //! - `deserialization`: when removed this disables deserialization support for
-//!   the [`Value`](crate::value::Value) type.
+//!   the [`Value`](crate::value::Value) type and deserializing other types from
+//!   values.
+//!
+//! MiniJinja compiles to WebAssembly (`wasm32-unknown-unknown` and `wasm32-wasi`).
+//! For embedding the engine in a browser where binary size matters the smallest
+//! useful build is typically achieved by disabling the default features and only
+//! turning on `builtins`:
+//!
+//! ```toml
+//! [dependencies]
+//! minijinja = { version = "*", default-features = false, features = ["builtins"] }
+//! ```
 #![allow(clippy::cognitive_complexity)]
 #![cfg_attr(docsrs, feature(doc_cfg))]
 #![doc(html_logo_url = "https://github.com/mitsuhiko/minijinja/raw/main/artwork/logo-square.png")]
@@ -126,19 +148,30 @@ mod key;
 mod ast;
 mod compiler;
 mod context;
+mod datetime;
+mod directory;
 mod environment;
 mod error;
+mod format;
 mod instructions;
 mod lexer;
+mod output;
 mod parser;
+mod pprint;
 mod tokens;
 mod utils;
 mod vm;
 
+#[cfg(feature = "debug")]
+#[cfg_attr(docsrs, doc(cfg(feature = "debug")))]
+pub mod debugger;
+pub mod email;
+pub mod extensions;
 pub mod filters;
 pub mod functions;
 pub mod meta;
 pub mod syntax;
+pub mod tags;
 pub mod tests;
 pub mod value;
 
@@ -148,15 +181,24 @@ mod deserialize;
 #[cfg(feature = "source")]
 mod source;
 
-pub use self::environment::{Environment, Expression, Template};
+pub use self::compiler::OptimizationLevel;
+pub use self::directory::RenderDirectoryOptions;
+pub use self::environment::{
+    escape_formatter, Environment, Expression, PreparedTemplate, RenderOptions, Template,
+    UsageStats,
+};
 pub use self::error::{Error, ErrorKind};
-pub use self::utils::{AutoEscape, HtmlEscape};
+pub use self::format::format_template;
+pub use self::output::Output;
+pub use self::pprint::ReprLimits;
+pub use self::tokens::{Span, Token};
+pub use self::utils::{AutoEscape, FloatFormat, HtmlEscape, UndefinedBehavior};
 
 #[cfg(feature = "debug")]
 pub use self::error::DebugInfo;
 
 #[cfg(feature = "source")]
-pub use self::source::Source;
+pub use self::source::{LoadFromPathOptions, Source};
 
 pub use self::context::*;
 pub use self::vm::State;
@@ -176,7 +218,8 @@ pub mod machinery {
     pub use crate::compiler::Compiler;
     pub use crate::instructions::{Instruction, Instructions};
     pub use crate::lexer::tokenize;
-    pub use crate::parser::parse;
+    pub use crate::output::Output;
+    pub use crate::parser::{parse, parse_with_comments};
     pub use crate::tokens::{Span, Token};
     pub use crate::vm::{simple_eval, Vm};
 }
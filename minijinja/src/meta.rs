@@ -6,11 +6,12 @@
 //! environment can be appropriately initialized.  Likewise it can be used to
 //! identify variables that need to be supplied into the context based on what
 //! templates are using.
-use std::collections::HashSet;
+use std::collections::{BTreeMap, BTreeSet, HashSet};
 
 use crate::ast;
 use crate::error::Error;
 use crate::parser::parse;
+use crate::value::ValueKind;
 
 /// Given a template source returns a set of undeclared variables.
 ///
@@ -33,175 +34,465 @@ use crate::parser::parse;
 /// assert!(names.contains("seq"));
 /// ```
 pub fn find_undeclared_variables(source: &str) -> Result<HashSet<String>, Error> {
-    struct State {
-        out: HashSet<String>,
-        assigned: Vec<HashSet<String>>,
+    let ast = parse(source, "<string>")?;
+    let mut state = State::new();
+    walk(&ast, &mut state);
+    Ok(state.out)
+}
+
+/// The dependencies of a block as determined by [`Template::block_dependencies`].
+///
+/// [`Template::block_dependencies`]: crate::Template::block_dependencies
+#[derive(Debug, Clone, Default, PartialEq)]
+pub struct BlockDependencies {
+    variables: BTreeSet<String>,
+    filters: BTreeSet<String>,
+    includes: BTreeSet<String>,
+    dynamic: bool,
+}
+
+impl BlockDependencies {
+    /// Returns the variables the block looks up from the context.
+    ///
+    /// Like with [`find_undeclared_variables`] only the names of top-level
+    /// variables are returned.  Variables set within the block are not
+    /// included and variables set by the template outside of the block are
+    /// replaced by the variables their value is computed from.
+    pub fn variables(&self) -> &BTreeSet<String> {
+        &self.variables
+    }
+
+    /// Returns the names of the filters the block uses.
+    pub fn filters(&self) -> &BTreeSet<String> {
+        &self.filters
+    }
+
+    /// Returns the templates the block includes.
+    ///
+    /// As with [`find_referenced_templates`] the string `"*"` is included if
+    /// a template is referenced by a variable or expression.  Components are
+    /// included as well.
+    pub fn includes(&self) -> &BTreeSet<String> {
+        &self.includes
+    }
+
+    /// Returns `true` if the output of the block can depend on more than
+    /// the variables it references.
+    ///
+    /// This is the case for blocks that include other templates, render
+    /// components or custom tags, or refer to `self` or `super`.
+    pub fn is_dynamic(&self) -> bool {
+        self.dynamic
+    }
+}
+
+/// The result of the static analysis of a template on compilation.
+pub(crate) struct Analysis {
+    pub blocks: BTreeMap<String, BlockDependencies>,
+    pub paths: BTreeSet<String>,
+}
+
+/// Analyzes a template for its block dependencies and the undeclared
+/// attribute paths it accesses.
+pub(crate) fn analyze(ast: &ast::Stmt) -> Analysis {
+    let mut state = State::new();
+    walk(ast, &mut state);
+    Analysis {
+        blocks: state.blocks,
+        paths: state.paths,
+    }
+}
+
+/// What the value of a variable set by the template was computed from.
+#[derive(Clone, Default)]
+struct Alias {
+    variables: BTreeSet<String>,
+    paths: BTreeSet<String>,
+    filters: BTreeSet<String>,
+    dynamic: bool,
+}
+
+/// Tracks the undeclared variables while walking a template.
+struct State {
+    out: HashSet<String>,
+    assigned: Vec<HashSet<String>>,
+    aliases: Vec<BTreeMap<String, Alias>>,
+    // aliases of the enclosing template which are visible within a block
+    inherited: BTreeMap<String, Alias>,
+    filters: BTreeSet<String>,
+    includes: BTreeSet<String>,
+    blocks: BTreeMap<String, BlockDependencies>,
+    paths: BTreeSet<String>,
+    dynamic: bool,
+}
+
+impl State {
+    fn new() -> State {
+        State {
+            out: HashSet::new(),
+            assigned: vec![Default::default()],
+            aliases: vec![Default::default()],
+            inherited: BTreeMap::new(),
+            filters: BTreeSet::new(),
+            includes: BTreeSet::new(),
+            blocks: BTreeMap::new(),
+            paths: BTreeSet::new(),
+            dynamic: false,
+        }
+    }
+
+    fn is_assigned(&self, name: &str) -> bool {
+        self.assigned.iter().any(|x| x.contains(name))
+    }
+
+    /// Checks if a name refers to a variable set by the template itself
+    /// rather than one coming from the context.
+    fn is_local(&self, name: &str) -> bool {
+        self.is_assigned(name) && !self.out.contains(name)
     }
 
-    impl State {
-        fn is_assigned(&self, name: &str) -> bool {
-            self.assigned.iter().any(|x| x.contains(name))
+    /// Returns the alias for a variable of the enclosing template that is
+    /// not shadowed.
+    fn alias(&self, name: &str) -> Option<&Alias> {
+        if self.is_assigned(name) {
+            None
+        } else {
+            self.inherited.get(name)
         }
+    }
 
-        fn assign(&mut self, name: &str) {
-            self.assigned.last_mut().unwrap().insert(name.to_string());
+    /// Returns all aliases visible in the current scope.
+    fn visible_aliases(&self) -> BTreeMap<String, Alias> {
+        let mut rv = self.inherited.clone();
+        for scope in &self.aliases {
+            rv.extend(scope.iter().map(|(k, v)| (k.clone(), v.clone())));
         }
+        rv
+    }
 
-        fn push(&mut self) {
-            self.assigned.push(Default::default());
+    /// Computes what the value of an expression is computed from.
+    fn alias_for(&self, expr: &ast::Expr) -> Alias {
+        let mut expr_state = State::new();
+        expr_state.assign("self");
+        expr_state.inherited = self.visible_aliases();
+        visit_expr(expr, &mut expr_state);
+        Alias {
+            variables: expr_state.out.into_iter().collect(),
+            paths: expr_state.paths,
+            filters: expr_state.filters,
+            dynamic: expr_state.dynamic,
         }
+    }
 
-        fn pop(&mut self) {
-            self.assigned.pop();
+    fn record_path(&mut self, root: &str, path: String) {
+        if !self.is_local(root) && self.alias(root).is_none() {
+            self.paths.insert(path);
         }
     }
 
-    fn visit_expr(expr: &ast::Expr, state: &mut State) {
-        match expr {
-            ast::Expr::Var(var) => {
-                if !state.is_assigned(var.id) {
-                    state.out.insert(var.id.to_string());
-                    state.assign(var.id);
-                }
-            }
-            ast::Expr::Const(_) => {}
-            ast::Expr::UnaryOp(expr) => visit_expr(&expr.expr, state),
-            ast::Expr::BinOp(expr) => {
-                visit_expr(&expr.left, state);
-                visit_expr(&expr.right, state);
-            }
-            ast::Expr::IfExpr(expr) => {
-                visit_expr(&expr.test_expr, state);
-                visit_expr(&expr.true_expr, state);
-                if let Some(ref false_expr) = expr.false_expr {
-                    visit_expr(false_expr, state);
-                }
+    fn assign(&mut self, name: &str) {
+        self.assigned.last_mut().unwrap().insert(name.to_string());
+    }
+
+    fn assign_alias(&mut self, name: &str, alias: &Alias) {
+        self.assign(name);
+        self.aliases
+            .last_mut()
+            .unwrap()
+            .insert(name.to_string(), alias.clone());
+    }
+
+    fn push(&mut self) {
+        self.assigned.push(Default::default());
+        self.aliases.push(Default::default());
+    }
+
+    fn pop(&mut self) {
+        self.assigned.pop();
+        self.aliases.pop();
+    }
+
+    fn include(&mut self, expr: &ast::Expr) {
+        self.dynamic = true;
+        if let ast::Expr::Const(val) = expr {
+            if let Some(s) = val.value.as_str() {
+                self.includes.insert(s.to_string());
+                return;
             }
-            ast::Expr::Filter(expr) => {
-                if let Some(ref expr) = expr.expr {
-                    visit_expr(expr, state);
-                }
-                for arg in &expr.args {
-                    visit_expr(arg, state);
-                }
+        }
+        self.includes.insert("*".into());
+    }
+}
+
+/// Returns the root variable and the dotted path of an attribute lookup
+/// if it can be determined statically.
+fn static_path<'a>(expr: &ast::Expr<'a>) -> Option<(&'a str, String)> {
+    match expr {
+        ast::Expr::Var(var) => Some((var.id, var.id.to_string())),
+        ast::Expr::GetAttr(expr) => {
+            static_path(&expr.expr).map(|(root, path)| (root, format!("{}.{}", path, expr.name)))
+        }
+        ast::Expr::GetItem(expr) => {
+            let key = match expr.subscript_expr {
+                ast::Expr::Const(ref val) => match val.value.as_str() {
+                    Some(s) => s.to_string(),
+                    None if val.value.kind() == ValueKind::Number => val.value.to_string(),
+                    None => return None,
+                },
+                _ => return None,
+            };
+            static_path(&expr.expr).map(|(root, path)| (root, format!("{}.{}", path, key)))
+        }
+        _ => None,
+    }
+}
+
+fn visit_var(name: &str, state: &mut State) {
+    if name == "self" || name == "super" {
+        state.dynamic = true;
+    }
+    // variables of the enclosing template resolve to what they were set from
+    if let Some(alias) = state.alias(name).cloned() {
+        state.out.extend(alias.variables);
+        state.paths.extend(alias.paths);
+        state.filters.extend(alias.filters);
+        state.dynamic |= alias.dynamic;
+    } else if !state.is_assigned(name) {
+        state.out.insert(name.to_string());
+        state.assign(name);
+    }
+}
+
+fn visit_expr(expr: &ast::Expr, state: &mut State) {
+    if let ast::Expr::GetAttr(_) | ast::Expr::GetItem(_) = expr {
+        if let Some((root, path)) = static_path(expr) {
+            state.record_path(root, path);
+            visit_var(root, state);
+            return;
+        }
+    }
+    match expr {
+        ast::Expr::Var(var) => {
+            state.record_path(var.id, var.id.to_string());
+            visit_var(var.id, state);
+        }
+        ast::Expr::Const(_) => {}
+        ast::Expr::UnaryOp(expr) => visit_expr(&expr.expr, state),
+        ast::Expr::BinOp(expr) => {
+            visit_expr(&expr.left, state);
+            visit_expr(&expr.right, state);
+        }
+        ast::Expr::IfExpr(expr) => {
+            visit_expr(&expr.test_expr, state);
+            visit_expr(&expr.true_expr, state);
+            if let Some(ref false_expr) = expr.false_expr {
+                visit_expr(false_expr, state);
             }
-            ast::Expr::Test(expr) => {
-                visit_expr(&expr.expr, state);
-                for arg in &expr.args {
-                    visit_expr(arg, state);
-                }
+        }
+        ast::Expr::Filter(expr) => {
+            state.filters.insert(expr.name.to_string());
+            if let Some(ref expr) = expr.expr {
+                visit_expr(expr, state);
             }
-            ast::Expr::GetAttr(expr) => {
-                visit_expr(&expr.expr, state);
+            for arg in &expr.args {
+                visit_expr(arg, state);
             }
-            ast::Expr::GetItem(expr) => {
-                visit_expr(&expr.expr, state);
-                visit_expr(&expr.subscript_expr, state);
+        }
+        ast::Expr::Test(expr) => {
+            visit_expr(&expr.expr, state);
+            for arg in &expr.args {
+                visit_expr(arg, state);
             }
-            ast::Expr::Call(expr) => {
-                visit_expr(&expr.expr, state);
-                for arg in &expr.args {
-                    visit_expr(arg, state);
+        }
+        ast::Expr::GetAttr(expr) => {
+            visit_expr(&expr.expr, state);
+        }
+        ast::Expr::GetItem(expr) => {
+            visit_expr(&expr.expr, state);
+            visit_expr(&expr.subscript_expr, state);
+        }
+        ast::Expr::Slice(expr) => {
+            visit_expr(&expr.expr, state);
+            for part in [&expr.start, &expr.stop, &expr.step].iter() {
+                if let Some(part) = part {
+                    visit_expr(part, state);
                 }
             }
-            ast::Expr::List(expr) => {
-                for value in &expr.items {
-                    visit_expr(value, state);
-                }
+        }
+        ast::Expr::Call(expr) => {
+            visit_expr(&expr.expr, state);
+            for arg in &expr.args {
+                visit_expr(arg, state);
             }
-            ast::Expr::Map(expr) => {
-                for (key, value) in expr.keys.iter().zip(expr.values.iter()) {
-                    visit_expr(key, state);
-                    visit_expr(value, state);
-                }
+        }
+        ast::Expr::List(expr) => {
+            for value in &expr.items {
+                visit_expr(value, state);
+            }
+        }
+        ast::Expr::Map(expr) => {
+            for (key, value) in expr.keys.iter().zip(expr.values.iter()) {
+                visit_expr(key, state);
+                visit_expr(value, state);
             }
         }
+        ast::Expr::Splat(expr) => visit_expr(&expr.expr, state),
     }
+}
 
-    fn assign_nested(expr: &ast::Expr, state: &mut State) {
-        match expr {
-            ast::Expr::Var(var) => {
-                state.assign(var.id);
-            }
-            ast::Expr::List(list) => {
-                for expr in &list.items {
-                    assign_nested(expr, state);
-                }
+fn assign_nested(expr: &ast::Expr, source: &Alias, state: &mut State) {
+    match expr {
+        ast::Expr::Var(var) => {
+            state.assign_alias(var.id, source);
+        }
+        ast::Expr::List(list) => {
+            for expr in &list.items {
+                assign_nested(expr, source, state);
             }
-            _ => {}
         }
+        ast::Expr::Splat(splat) => assign_nested(&splat.expr, source, state),
+        // `{% set ns.attr = value %}` modifies an existing namespace
+        ast::Expr::GetAttr(attr) => visit_expr(&attr.expr, state),
+        _ => {}
     }
+}
 
-    fn walk(node: &ast::Stmt, state: &mut State) {
-        match node {
-            ast::Stmt::Template(stmt) => {
-                state.assign("self");
-                stmt.children.iter().for_each(|x| walk(x, state));
+fn walk(node: &ast::Stmt, state: &mut State) {
+    match node {
+        ast::Stmt::Template(stmt) => {
+            state.assign("self");
+            stmt.children.iter().for_each(|x| walk(x, state));
+        }
+        ast::Stmt::EmitExpr(expr) => visit_expr(&expr.expr, state),
+        ast::Stmt::EmitRaw(_) | ast::Stmt::Extends(_) => {}
+        #[cfg(feature = "unstable_machinery")]
+        ast::Stmt::Comment(_) => {}
+        ast::Stmt::Include(stmt) => {
+            visit_expr(&stmt.name, state);
+            state.include(&stmt.name);
+        }
+        ast::Stmt::ForLoop(stmt) => {
+            let source = state.alias_for(&stmt.iter);
+            state.push();
+            state.assign_alias("loop", &source);
+            visit_expr(&stmt.iter, state);
+            assign_nested(&stmt.target, &source, state);
+            if let Some(ref filter_expr) = stmt.filter_expr {
+                visit_expr(filter_expr, state);
             }
-            ast::Stmt::EmitExpr(expr) => visit_expr(&expr.expr, state),
-            ast::Stmt::EmitRaw(_) | ast::Stmt::Extends(_) | ast::Stmt::Include(_) => {}
-            ast::Stmt::ForLoop(stmt) => {
-                state.push();
-                state.assign("loop");
-                visit_expr(&stmt.iter, state);
-                assign_nested(&stmt.target, state);
-                if let Some(ref filter_expr) = stmt.filter_expr {
-                    visit_expr(filter_expr, state);
-                }
-                stmt.body.iter().for_each(|x| walk(x, state));
-                state.pop();
-                state.push();
-                stmt.else_body.iter().for_each(|x| walk(x, state));
-                state.pop();
+            stmt.body.iter().for_each(|x| walk(x, state));
+            state.pop();
+            state.push();
+            stmt.else_body.iter().for_each(|x| walk(x, state));
+            state.pop();
+        }
+        ast::Stmt::IfCond(stmt) => {
+            visit_expr(&stmt.expr, state);
+            state.push();
+            stmt.true_body.iter().for_each(|x| walk(x, state));
+            state.pop();
+            state.push();
+            stmt.false_body.iter().for_each(|x| walk(x, state));
+            state.pop();
+        }
+        ast::Stmt::WithBlock(stmt) => {
+            state.push();
+            for (target, expr) in &stmt.assignments {
+                let source = state.alias_for(expr);
+                assign_nested(target, &source, state);
+                visit_expr(expr, state);
             }
-            ast::Stmt::IfCond(stmt) => {
-                visit_expr(&stmt.expr, state);
-                state.push();
-                stmt.true_body.iter().for_each(|x| walk(x, state));
-                state.pop();
-                state.push();
-                stmt.false_body.iter().for_each(|x| walk(x, state));
-                state.pop();
+            stmt.body.iter().for_each(|x| walk(x, state));
+            state.pop();
+        }
+        ast::Stmt::Set(stmt) => {
+            let source = state.alias_for(&stmt.expr);
+            assign_nested(&stmt.target, &source, state);
+            visit_expr(&stmt.expr, state);
+        }
+        ast::Stmt::Block(stmt) => {
+            // blocks are walked on their own so that their dependencies can
+            // be recorded, afterwards they are merged into the outer scope.
+            let mut block_state = State::new();
+            block_state.inherited = state.visible_aliases();
+            block_state.assign("self");
+            block_state.assign("super");
+            stmt.body.iter().for_each(|x| walk(x, &mut block_state));
+            for name in block_state.out.iter() {
+                if !state.is_assigned(name) {
+                    state.out.insert(name.clone());
+                }
             }
-            ast::Stmt::WithBlock(stmt) => {
-                state.push();
-                for (target, expr) in &stmt.assignments {
-                    assign_nested(target, state);
-                    visit_expr(expr, state);
+            for path in block_state.paths.iter() {
+                let root = path.split('.').next().unwrap_or("");
+                if !state.is_local(root) {
+                    state.paths.insert(path.clone());
                 }
-                stmt.body.iter().for_each(|x| walk(x, state));
-                state.pop();
             }
-            ast::Stmt::Set(stmt) => {
-                assign_nested(&stmt.target, state);
-                visit_expr(&stmt.expr, state);
+            state.filters.extend(block_state.filters.iter().cloned());
+            state.includes.extend(block_state.includes.iter().cloned());
+            state.dynamic |= block_state.dynamic;
+            state.blocks.append(&mut block_state.blocks);
+            state.blocks.insert(
+                stmt.name.to_string(),
+                BlockDependencies {
+                    variables: block_state.out.into_iter().collect(),
+                    filters: block_state.filters,
+                    includes: block_state.includes,
+                    dynamic: block_state.dynamic,
+                },
+            );
+        }
+        ast::Stmt::AutoEscape(stmt) => {
+            state.push();
+            stmt.body.iter().for_each(|x| walk(x, state));
+            state.pop();
+        }
+        ast::Stmt::FilterBlock(stmt) => {
+            visit_expr(&stmt.filter, state);
+            state.push();
+            stmt.body.iter().for_each(|x| walk(x, state));
+            state.pop();
+        }
+        ast::Stmt::Component(stmt) => {
+            visit_expr(&stmt.name, state);
+            state.include(&stmt.name);
+            for (_, expr) in &stmt.props {
+                visit_expr(expr, state);
             }
-            ast::Stmt::Block(stmt) => {
+            for (_, body) in &stmt.slots {
                 state.push();
-                state.assign("super");
-                stmt.body.iter().for_each(|x| walk(x, state));
+                body.iter().for_each(|x| walk(x, state));
                 state.pop();
             }
-            ast::Stmt::AutoEscape(stmt) => {
-                state.push();
-                stmt.body.iter().for_each(|x| walk(x, state));
-                state.pop();
+            state.push();
+            stmt.body.iter().for_each(|x| walk(x, state));
+            state.pop();
+        }
+        ast::Stmt::CustomTag(stmt) => {
+            state.dynamic = true;
+            for expr in &stmt.args {
+                visit_expr(expr, state);
             }
-            ast::Stmt::FilterBlock(stmt) => {
+            if let Some(ref body) = stmt.body {
                 state.push();
-                stmt.body.iter().for_each(|x| walk(x, state));
+                body.iter().for_each(|x| walk(x, state));
                 state.pop();
             }
         }
+        ast::Stmt::Props(stmt) => {
+            for prop in &stmt.props {
+                if let Some(ref default) = prop.default {
+                    visit_expr(default, state);
+                }
+                // props are supplied by the caller
+                if !state.is_assigned(prop.name) {
+                    state.out.insert(prop.name.to_string());
+                    state.assign(prop.name);
+                }
+            }
+        }
     }
-
-    let ast = parse(source, "<string>")?;
-    let mut state = State {
-        out: HashSet::new(),
-        assigned: vec![Default::default()],
-    };
-    walk(&ast, &mut state);
-    Ok(state.out)
 }
 
 /// Given a template source returns a set of referenced templates by name.
@@ -238,6 +529,8 @@ pub fn find_referenced_templates(source: &str) -> Result<HashSet<String>, Error>
         match node {
             ast::Stmt::Template(stmt) => stmt.children.iter().for_each(|x| walk(x, out)),
             ast::Stmt::EmitExpr(_) | ast::Stmt::EmitRaw(_) | ast::Stmt::Set(_) => {}
+            #[cfg(feature = "unstable_machinery")]
+            ast::Stmt::Comment(_) => {}
             ast::Stmt::ForLoop(stmt) => stmt
                 .body
                 .iter()
@@ -254,6 +547,16 @@ pub fn find_referenced_templates(source: &str) -> Result<HashSet<String>, Error>
             ast::Stmt::Include(stmt) => record_reference(&stmt.name, out),
             ast::Stmt::AutoEscape(stmt) => stmt.body.iter().for_each(|x| walk(x, out)),
             ast::Stmt::FilterBlock(stmt) => stmt.body.iter().for_each(|x| walk(x, out)),
+            ast::Stmt::Component(stmt) => {
+                record_reference(&stmt.name, out);
+                stmt.slots
+                    .iter()
+                    .flat_map(|(_, body)| body.iter())
+                    .chain(stmt.body.iter())
+                    .for_each(|x| walk(x, out));
+            }
+            ast::Stmt::Props(_) => {}
+            ast::Stmt::CustomTag(stmt) => stmt.body.iter().flatten().for_each(|x| walk(x, out)),
         }
     }
 
@@ -0,0 +1,133 @@
+use std::fmt;
+
+use crate::error::{Error, ErrorKind};
+use crate::utils::{find_html_escape, html_escape_for};
+
+/// The output buffer the engine renders into.
+///
+/// Templates normally render to strings but byte values are emitted
+/// verbatim which means that the output is not necessarily valid UTF-8.
+/// Because of this the engine renders into a byte buffer and only converts
+/// it into a string at the very end if needed.
+#[derive(Debug, Default, Clone)]
+pub struct Output {
+    buf: Vec<u8>,
+    // set once bytes that are not valid UTF-8 on their own were written
+    needs_validation: bool,
+}
+
+impl Output {
+    /// Creates an empty output buffer.
+    pub fn new() -> Output {
+        Output::default()
+    }
+
+    /// Creates an empty output buffer that can hold `capacity` bytes
+    /// without reallocating.
+    pub fn with_capacity(capacity: usize) -> Output {
+        Output {
+            buf: Vec::with_capacity(capacity),
+            needs_validation: false,
+        }
+    }
+
+    /// Writes raw bytes to the output.
+    pub fn write_bytes(&mut self, bytes: &[u8]) {
+        self.track_bytes(bytes);
+        self.buf.extend_from_slice(bytes);
+    }
+
+    /// Writes bytes to the output with HTML escaping applied.
+    ///
+    /// Only ASCII characters are escaped so this never alters other bytes.
+    pub fn write_html_escaped_bytes(&mut self, bytes: &[u8]) {
+        self.track_bytes(bytes);
+        let first = match find_html_escape(bytes) {
+            Some(idx) => idx,
+            None => return self.buf.extend_from_slice(bytes),
+        };
+        let mut start = 0;
+        for (idx, b) in bytes.iter().enumerate().skip(first) {
+            if let Some(quoted) = html_escape_for(*b) {
+                self.buf.extend_from_slice(&bytes[start..idx]);
+                self.buf.extend_from_slice(quoted.as_bytes());
+                start = idx + 1;
+            }
+        }
+        self.buf.extend_from_slice(&bytes[start..]);
+    }
+
+    fn track_bytes(&mut self, bytes: &[u8]) {
+        if !self.needs_validation && std::str::from_utf8(bytes).is_err() {
+            self.needs_validation = true;
+        }
+    }
+
+    /// Returns the bytes written so far.
+    pub fn as_bytes(&self) -> &[u8] {
+        &self.buf
+    }
+
+    /// Converts the output into bytes.
+    pub fn into_bytes(self) -> Vec<u8> {
+        self.buf
+    }
+
+    /// Converts the output into a string.
+    ///
+    /// Invalid UTF-8 sequences (which can only be emitted by byte values) are
+    /// replaced with the unicode replacement character.  Use
+    /// [`try_into_string`](Self::try_into_string) to detect this.
+    pub fn into_string(self) -> String {
+        if !self.needs_validation {
+            // SAFETY: strings and byte chunks that were valid UTF-8 on their
+            // own were written which concatenate to valid UTF-8.
+            return unsafe { String::from_utf8_unchecked(self.buf) };
+        }
+        match String::from_utf8(self.buf) {
+            Ok(rv) => rv,
+            Err(err) => String::from_utf8_lossy(err.as_bytes()).into_owned(),
+        }
+    }
+
+    /// Converts the output into a string or fails if it is not valid UTF-8.
+    pub fn try_into_string(self) -> Result<String, Error> {
+        if !self.needs_validation {
+            return Ok(self.into_string());
+        }
+        String::from_utf8(self.buf).map_err(|err| {
+            Error::new(ErrorKind::InvalidOperation, "output is not valid UTF-8").with_source(err)
+        })
+    }
+}
+
+impl fmt::Write for Output {
+    #[inline(always)]
+    fn write_str(&mut self, s: &str) -> fmt::Result {
+        self.buf.extend_from_slice(s.as_bytes());
+        Ok(())
+    }
+}
+
+#[test]
+fn test_output() {
+    use std::fmt::Write;
+
+    let mut out = Output::new();
+    write!(out, "a{}", 1).unwrap();
+    out.write_bytes(b"\xff");
+    assert_eq!(out.as_bytes(), b"a1\xff");
+    assert_eq!(out.clone().into_string(), "a1\u{fffd}");
+    assert!(out.clone().try_into_string().is_err());
+    assert_eq!(out.into_bytes(), b"a1\xff");
+
+    // chunks that are only valid together still convert
+    let mut out = Output::new();
+    out.write_bytes(b"\xc3");
+    out.write_bytes(b"\xa4");
+    assert_eq!(out.try_into_string().unwrap(), "\u{e4}");
+
+    let mut out = Output::new();
+    out.write_html_escaped_bytes(b"<\xe4>&");
+    assert_eq!(out.as_bytes(), b"&lt;\xe4&gt;&amp;");
+}
@@ -1,9 +1,16 @@
 use crate::ast::{self, Spanned};
 use crate::error::{Error, ErrorKind};
-use crate::lexer::tokenize;
+use crate::lexer::tokenize_with_options;
+use crate::syntax::Syntax;
 use crate::tokens::{Span, Token};
 use crate::utils::matches;
-use crate::value::Value;
+use crate::value::{Value, ValueKind};
+
+/// The default maximum nesting depth of expressions.
+///
+/// The parser and compiler are recursive so deeply nested expressions
+/// could otherwise overflow the stack.
+pub(crate) const DEFAULT_MAX_EXPR_DEPTH: usize = 30;
 
 const RESERVED_NAMES: [&str; 8] = [
     "true", "True", "false", "False", "none", "None", "loop", "self",
@@ -60,24 +67,55 @@ struct TokenStream<'a> {
     iter: Box<dyn Iterator<Item = Result<(Token<'a>, Span), Error>> + 'a>,
     current: Option<Result<(Token<'a>, Span), Error>>,
     current_span: Span,
+    failed: bool,
 }
 
 impl<'a> TokenStream<'a> {
     /// Tokenize a template
-    pub fn new(source: &'a str, in_expr: bool) -> TokenStream<'a> {
+    pub fn new(
+        source: &'a str,
+        in_expr: bool,
+        syntax: &Syntax,
+        keep_comments: bool,
+    ) -> TokenStream<'a> {
         TokenStream {
-            iter: (Box::new(tokenize(source, in_expr)) as Box<dyn Iterator<Item = _>>),
+            iter: (Box::new(tokenize_with_options(
+                source,
+                in_expr,
+                syntax,
+                keep_comments,
+            )) as Box<dyn Iterator<Item = _>>),
             current: None,
             current_span: Span::default(),
+            failed: false,
+        }
+    }
+
+    /// Shifts the line numbers of all tokens by `offset`.
+    pub fn set_line_offset(&mut self, offset: usize) {
+        if offset > 0 {
+            let iter = std::mem::replace(&mut self.iter, Box::new(std::iter::empty()));
+            self.iter = Box::new(iter.map(move |rv| {
+                rv.map(|(token, mut span)| {
+                    span.start_line += offset;
+                    span.end_line += offset;
+                    (token, span)
+                })
+            }));
         }
     }
 
     /// Advance the stream.
+    ///
+    /// Once the lexer failed the stream behaves as if the end of the input
+    /// was reached.
     pub fn next(&mut self) -> Result<Option<(Token<'a>, Span)>, Error> {
         let rv = self.current.take();
-        self.current = self.iter.next();
-        if let Some(Ok((_, span))) = rv {
-            self.current_span = span;
+        self.current = if self.failed { None } else { self.iter.next() };
+        match rv {
+            Some(Ok((_, span))) => self.current_span = span,
+            Some(Err(_)) => self.failed = true,
+            None => {}
         }
         rv.transpose()
     }
@@ -89,7 +127,10 @@ impl<'a> TokenStream<'a> {
         }
         match self.current {
             Some(Ok(ref tok)) => Ok(Some((&tok.0, tok.1))),
-            Some(Err(_)) => Err(self.current.take().unwrap().unwrap_err()),
+            Some(Err(_)) => {
+                self.failed = true;
+                Err(self.current.take().unwrap().unwrap_err())
+            }
             None => Ok(None),
         }
     }
@@ -98,6 +139,7 @@ impl<'a> TokenStream<'a> {
     pub fn expand_span(&self, mut span: Span) -> Span {
         span.end_line = self.current_span.end_line;
         span.end_col = self.current_span.end_col;
+        span.end_offset = self.current_span.end_offset;
         span
     }
 
@@ -107,8 +149,13 @@ impl<'a> TokenStream<'a> {
     }
 }
 
-struct Parser<'a> {
+struct Parser<'a, 't> {
     stream: TokenStream<'a>,
+    custom_tags: &'t dyn Fn(&str) -> Option<bool>,
+    depth: usize,
+    max_depth: usize,
+    recovered_errors: Option<Vec<Error>>,
+    lexer_error_recorded: bool,
 }
 
 macro_rules! binop {
@@ -149,7 +196,7 @@ macro_rules! unaryop {
             Ok(ast::Expr::UnaryOp(Spanned::new(
                 ast::UnaryOp {
                     op,
-                    expr: self.$func()?,
+                    expr: self.nested(|p| p.$func())?,
                 },
                 self.stream.expand_span(span),
             )))
@@ -157,13 +204,75 @@ macro_rules! unaryop {
     };
 }
 
-impl<'a> Parser<'a> {
-    pub fn new(source: &'a str, in_expr: bool) -> Parser<'a> {
+impl<'a, 't> Parser<'a, 't> {
+    pub fn new(
+        source: &'a str,
+        in_expr: bool,
+        syntax: &Syntax,
+        custom_tags: &'t dyn Fn(&str) -> Option<bool>,
+        keep_comments: bool,
+    ) -> Parser<'a, 't> {
         Parser {
-            stream: TokenStream::new(source, in_expr),
+            stream: TokenStream::new(source, in_expr, syntax, keep_comments),
+            custom_tags,
+            depth: 0,
+            max_depth: DEFAULT_MAX_EXPR_DEPTH,
+            recovered_errors: None,
+            lexer_error_recorded: false,
         }
     }
 
+    /// Records an error in recovery mode and skips to the end of the tag.
+    ///
+    /// If recovery is disabled the error is passed through.  After the lexer
+    /// failed the rest of the input cannot be tokenized and only the first
+    /// error is recorded.
+    fn recover(&mut self, mut err: Error) -> Result<(), Error> {
+        let lexer_failed = self.stream.failed;
+        let errors = match self.recovered_errors {
+            Some(ref mut errors) => errors,
+            None => return Err(err),
+        };
+        if !lexer_failed || !self.lexer_error_recorded {
+            if err.span().is_none() {
+                err.set_span(self.stream.current_span());
+            }
+            errors.push(err);
+            self.lexer_error_recorded = lexer_failed;
+        }
+        loop {
+            match self.stream.current() {
+                Ok(Some((Token::VariableEnd(..), _))) | Ok(Some((Token::BlockEnd(..), _))) => {
+                    self.stream.next()?;
+                    break;
+                }
+                Ok(Some((Token::TemplateData(_), _)))
+                | Ok(Some((Token::VariableStart(..), _)))
+                | Ok(Some((Token::BlockStart(..), _)))
+                | Ok(None) => break,
+                Ok(Some(_)) => {
+                    self.stream.next()?;
+                }
+                Err(err) => return self.recover(err),
+            }
+        }
+        Ok(())
+    }
+
+    /// Invokes a parse function one nesting level deeper.
+    fn nested<R, F: FnOnce(&mut Self) -> Result<R, Error>>(&mut self, f: F) -> Result<R, Error> {
+        if self.depth >= self.max_depth {
+            syntax_error!(
+                "exceeded maximum expression nesting depth of {}",
+                self.max_depth
+            );
+        }
+        self.depth += 1;
+        let rv = f(self);
+        self.depth -= 1;
+        rv
+    }
+
     fn parse_ifexpr(&mut self) -> Result<ast::Expr<'a>, Error> {
         let mut span = self.stream.current_span();
         let mut expr = self.parse_or()?;
@@ -173,7 +282,7 @@ impl<'a> Parser<'a> {
                 let expr2 = self.parse_or()?;
                 let expr3 = if matches!(self.stream.current()?, Some((Token::Ident("else"), _))) {
                     self.stream.next()?;
-                    Some(self.parse_ifexpr()?)
+                    Some(self.nested(|p| p.parse_ifexpr())?)
                 } else {
                     None
                 };
@@ -289,12 +398,37 @@ impl<'a> Parser<'a> {
                 }
                 Some((Token::BracketOpen, span)) => {
                     self.stream.next()?;
-                    let subscript_expr = self.parse_expr()?;
+                    let mut start = None;
+                    if !matches!(self.stream.current()?, Some((Token::Colon, _))) {
+                        let subscript_expr = self.parse_expr()?;
+                        if !matches!(self.stream.current()?, Some((Token::Colon, _))) {
+                            expect_token!(self, Token::BracketClose, "`]`")?;
+                            expr = ast::Expr::GetItem(Spanned::new(
+                                ast::GetItem {
+                                    expr,
+                                    subscript_expr,
+                                },
+                                self.stream.expand_span(span),
+                            ));
+                            continue;
+                        }
+                        start = Some(subscript_expr);
+                    }
+                    expect_token!(self, Token::Colon, "`:`")?;
+                    let stop = self.parse_slice_part()?;
+                    let step = if matches!(self.stream.current()?, Some((Token::Colon, _))) {
+                        self.stream.next()?;
+                        self.parse_slice_part()?
+                    } else {
+                        None
+                    };
                     expect_token!(self, Token::BracketClose, "`]`")?;
-                    expr = ast::Expr::GetItem(Spanned::new(
-                        ast::GetItem {
+                    expr = ast::Expr::Slice(Spanned::new(
+                        ast::Slice {
                             expr,
-                            subscript_expr,
+                            start,
+                            stop,
+                            step,
                         },
                         self.stream.expand_span(span),
                     ));
@@ -312,6 +446,13 @@ impl<'a> Parser<'a> {
         Ok(expr)
     }
 
+    fn parse_slice_part(&mut self) -> Result<Option<ast::Expr<'a>>, Error> {
+        match self.stream.current()? {
+            Some((Token::Colon, _)) | Some((Token::BracketClose, _)) => Ok(None),
+            _ => Ok(Some(self.parse_expr()?)),
+        }
+    }
+
     fn parse_filter_expr(&mut self, expr: ast::Expr<'a>) -> Result<ast::Expr<'a>, Error> {
         let mut expr = expr;
         loop {
@@ -375,15 +516,60 @@ impl<'a> Parser<'a> {
         let mut first_span = None;
         let mut kwargs_keys = Vec::new();
         let mut kwargs_values = Vec::new();
+        let mut kwargs_splats = Vec::new();
+
+        macro_rules! flush_kwargs {
+            () => {
+                if !kwargs_keys.is_empty() {
+                    kwargs_splats.push(ast::Expr::Map(ast::Spanned::new(
+                        ast::Map {
+                            keys: std::mem::replace(&mut kwargs_keys, Vec::new()),
+                            values: std::mem::replace(&mut kwargs_values, Vec::new()),
+                        },
+                        self.stream.expand_span(first_span.take().unwrap()),
+                    )));
+                }
+            };
+        }
 
         expect_token!(self, Token::ParenOpen, "`(`")?;
         loop {
             if matches!(self.stream.current()?, Some((Token::ParenClose, _))) {
                 break;
             }
-            if !args.is_empty() || !kwargs_keys.is_empty() {
+            let has_kwargs = !kwargs_keys.is_empty() || !kwargs_splats.is_empty();
+            if !args.is_empty() || has_kwargs {
                 expect_token!(self, Token::Comma, "`,`")?;
             }
+
+            // argument splats
+            let splat = match self.stream.current()? {
+                Some((Token::Mul, span)) => Some((false, span)),
+                Some((Token::Pow, span)) => Some((true, span)),
+                _ => None,
+            };
+            if let Some((kwargs, span)) = splat {
+                if !kwargs && has_kwargs {
+                    return Err(Error::new(
+                        ErrorKind::SyntaxError,
+                        "non-keyword arg after keyword arg",
+                    ));
+                }
+                self.stream.next()?;
+                let expr = self.parse_expr_noif()?;
+                let splat = ast::Expr::Splat(Spanned::new(
+                    ast::Splat { expr, kwargs },
+                    self.stream.expand_span(span),
+                ));
+                if kwargs {
+                    flush_kwargs!();
+                    kwargs_splats.push(splat);
+                } else {
+                    args.push(splat);
+                }
+                continue;
+            }
+
             let expr = self.parse_expr()?;
 
             // keyword argument
@@ -391,6 +577,24 @@ impl<'a> Parser<'a> {
                 ast::Expr::Var(ref var)
                     if matches!(self.stream.current()?, Some((Token::Assign, _))) =>
                 {
+                    if kwargs_splats
+                        .iter()
+                        .filter_map(|chunk| match chunk {
+                            ast::Expr::Map(m) => Some(&m.keys),
+                            _ => None,
+                        })
+                        .chain(Some(&kwargs_keys))
+                        .flatten()
+                        .any(|key| match key {
+                            ast::Expr::Const(c) => c.value.as_str() == Some(var.id),
+                            _ => false,
+                        })
+                    {
+                        return Err(Error::new(
+                            ErrorKind::SyntaxError,
+                            format!("duplicate keyword argument {}", var.id),
+                        ));
+                    }
                     self.stream.next()?;
                     if first_span.is_none() {
                         first_span = Some(var.span());
@@ -403,7 +607,7 @@ impl<'a> Parser<'a> {
                     )));
                     kwargs_values.push(self.parse_expr_noif()?);
                 }
-                _ if !kwargs_keys.is_empty() => {
+                _ if has_kwargs => {
                     return Err(Error::new(
                         ErrorKind::SyntaxError,
                         "non-keyword arg after keyword arg",
@@ -415,14 +619,26 @@ impl<'a> Parser<'a> {
             }
         }
 
-        if !kwargs_keys.is_empty() {
-            args.push(ast::Expr::Map(ast::Spanned::new(
-                ast::Map {
-                    keys: kwargs_keys,
-                    values: kwargs_values,
-                },
-                self.stream.expand_span(first_span.unwrap()),
-            )));
+        // keyword arguments are passed as a trailing map.  If keyword
+        // splats are involved the map is assembled at runtime from all
+        // chunks so the explicit ones are wrapped in splats as well.
+        flush_kwargs!();
+        if kwargs_splats.len() == 1 && matches!(kwargs_splats[0], ast::Expr::Map(_)) {
+            args.extend(kwargs_splats);
+        } else {
+            args.extend(kwargs_splats.into_iter().map(|expr| match expr {
+                ast::Expr::Map(map) => {
+                    let span = map.span();
+                    ast::Expr::Splat(Spanned::new(
+                        ast::Splat {
+                            expr: ast::Expr::Map(map),
+                            kwargs: true,
+                        },
+                        span,
+                    ))
+                }
+                other => other,
+            }));
         }
 
         expect_token!(self, Token::ParenClose, "`)`")?;
@@ -525,11 +741,11 @@ impl<'a> Parser<'a> {
     }
 
     pub fn parse_expr(&mut self) -> Result<ast::Expr<'a>, Error> {
-        self.parse_ifexpr()
+        self.nested(|p| p.parse_ifexpr())
     }
 
     pub fn parse_expr_noif(&mut self) -> Result<ast::Expr<'a>, Error> {
-        self.parse_or()
+        self.nested(|p| p.parse_or())
     }
 
     fn parse_stmt(&mut self) -> Result<ast::Stmt<'a>, Error> {
@@ -571,7 +787,21 @@ impl<'a> Parser<'a> {
                 self.parse_filter_block()?,
                 self.stream.expand_span(span),
             ))),
-            Token::Ident(name) => syntax_error!("unknown statement {}", name),
+            Token::Ident("component") => Ok(ast::Stmt::Component(Spanned::new(
+                self.parse_component()?,
+                self.stream.expand_span(span),
+            ))),
+            Token::Ident("props") => Ok(ast::Stmt::Props(Spanned::new(
+                self.parse_props()?,
+                self.stream.expand_span(span),
+            ))),
+            Token::Ident(name) => match (self.custom_tags)(name) {
+                Some(has_body) => Ok(ast::Stmt::CustomTag(Spanned::new(
+                    self.parse_custom_tag(name, has_body)?,
+                    self.stream.expand_span(span),
+                ))),
+                None => syntax_error!("unknown statement {}", name),
+            },
             token => syntax_error!("unknown {}, expected statement", token),
         }
     }
@@ -602,16 +832,30 @@ impl<'a> Parser<'a> {
             ) {
                 break;
             }
-            items.push(
-                if matches!(self.stream.current()?, Some((Token::ParenOpen, _))) {
+            items.push(match self.stream.current()? {
+                Some((Token::ParenOpen, _)) => {
                     self.stream.next()?;
                     let rv = self.parse_assignment()?;
                     expect_token!(self, Token::ParenClose, "`)`")?;
                     rv
-                } else {
-                    self.parse_assign_name()?
-                },
-            );
+                }
+                // catch-all target that receives the remaining items
+                Some((Token::Mul, star_span)) => {
+                    self.stream.next()?;
+                    if items.iter().any(|x| matches!(x, ast::Expr::Splat(_))) {
+                        syntax_error!("multiple starred names in assignment");
+                    }
+                    let expr = self.parse_assign_name()?;
+                    ast::Expr::Splat(Spanned::new(
+                        ast::Splat {
+                            expr,
+                            kwargs: false,
+                        },
+                        self.stream.expand_span(star_span),
+                    ))
+                }
+                _ => self.parse_assign_name()?,
+            });
             if matches!(self.stream.current()?, Some((Token::Comma, _))) {
                 is_tuple = true;
             } else {
@@ -620,6 +864,9 @@ impl<'a> Parser<'a> {
         }
 
         if !is_tuple && items.len() == 1 {
+            if let ast::Expr::Splat(_) = items[0] {
+                syntax_error!("starred assignment target must be in a tuple");
+            }
             Ok(items.into_iter().next().unwrap())
         } else {
             Ok(ast::Expr::List(Spanned::new(
@@ -729,7 +976,17 @@ impl<'a> Parser<'a> {
             expect_token!(self, Token::ParenClose, "`)`")?;
             assign
         } else {
-            self.parse_assign_name()?
+            let target = self.parse_assign_name()?;
+            if let Some((Token::Dot, span)) = self.stream.current()? {
+                self.stream.next()?;
+                let (name, _) = expect_token!(self, Token::Ident(name) => name, "identifier")?;
+                ast::Expr::GetAttr(Spanned::new(
+                    ast::GetAttr { name, expr: target },
+                    self.stream.expand_span(span),
+                ))
+            } else {
+                target
+            }
         };
         expect_token!(self, Token::Assign, "assignment operator")?;
         let expr = self.parse_expr()?;
@@ -818,41 +1075,189 @@ impl<'a> Parser<'a> {
         Ok(ast::FilterBlock { filter, body })
     }
 
+    fn parse_custom_tag(
+        &mut self,
+        name: &'a str,
+        has_body: bool,
+    ) -> Result<ast::CustomTag<'a>, Error> {
+        let mut args = Vec::new();
+        while !matches!(self.stream.current()?, Some((Token::BlockEnd(..), _))) {
+            if !args.is_empty() {
+                expect_token!(self, Token::Comma, "`,`")?;
+            }
+            args.push(self.parse_expr()?);
+        }
+        let body = if has_body {
+            let end_tag = format!("end{}", name);
+            expect_token!(self, Token::BlockEnd(..), "end of block")?;
+            let body = self.subparse(&|tok| matches!(tok, Token::Ident(x) if *x == end_tag))?;
+            self.stream.next()?;
+            Some(body)
+        } else {
+            None
+        };
+        Ok(ast::CustomTag { name, args, body })
+    }
+
+    fn parse_component(&mut self) -> Result<ast::Component<'a>, Error> {
+        let name = self.parse_expr()?;
+        let mut props = Vec::new();
+        if matches!(self.stream.current()?, Some((Token::Ident("with"), _))) {
+            self.stream.next()?;
+            while !matches!(self.stream.current()?, Some((Token::BlockEnd(..), _))) {
+                if !props.is_empty() {
+                    expect_token!(self, Token::Comma, "comma")?;
+                }
+                let (prop, _) = expect_token!(self, Token::Ident(name) => name, "identifier")?;
+                if prop == "slots" {
+                    syntax_error!("slots is reserved and cannot be passed as prop");
+                }
+                if props.iter().any(|&(x, _)| x == prop) {
+                    syntax_error!("duplicate prop {}", prop);
+                }
+                expect_token!(self, Token::Assign, "assignment operator")?;
+                props.push((prop, self.parse_expr()?));
+            }
+        }
+        expect_token!(self, Token::BlockEnd(..), "end of block")?;
+
+        let mut slots: Vec<(&'a str, Vec<ast::Stmt<'a>>)> = Vec::new();
+        let mut body = Vec::new();
+        loop {
+            body.extend(self.subparse(&|tok| {
+                matches!(tok, Token::Ident("endcomponent") | Token::Ident("slot"))
+            })?);
+            match self.stream.next()? {
+                Some((Token::Ident("slot"), _)) => {
+                    let (slot, _) = expect_token!(self, Token::Ident(name) => name, "identifier")?;
+                    if slot == "default" {
+                        syntax_error!("the default slot cannot be declared explicitly");
+                    }
+                    if slots.iter().any(|&(x, _)| x == slot) {
+                        syntax_error!("duplicate slot {}", slot);
+                    }
+                    expect_token!(self, Token::BlockEnd(..), "end of block")?;
+                    let slot_body = self.subparse(&|tok| matches!(tok, Token::Ident("endslot")))?;
+                    self.stream.next()?;
+                    expect_token!(self, Token::BlockEnd(..), "end of block")?;
+                    slots.push((slot, slot_body));
+                }
+                Some(_) => break,
+                None => syntax_error!("unexpected end of input, expected endcomponent"),
+            }
+        }
+
+        Ok(ast::Component {
+            name,
+            props,
+            slots,
+            body,
+        })
+    }
+
+    fn parse_props(&mut self) -> Result<ast::Props<'a>, Error> {
+        let mut props = Vec::new();
+        while !matches!(self.stream.current()?, Some((Token::BlockEnd(..), _))) {
+            if !props.is_empty() {
+                expect_token!(self, Token::Comma, "comma")?;
+            }
+            let (name, _) = expect_token!(self, Token::Ident(name) => name, "identifier")?;
+            if RESERVED_NAMES.contains(&name) || name == "slots" {
+                syntax_error!("cannot declare reserved variable name {} as prop", name);
+            }
+            let kind = if matches!(self.stream.current()?, Some((Token::Colon, _))) {
+                self.stream.next()?;
+                let (ty, _) = expect_token!(self, Token::Ident(name) => name, "type name")?;
+                Some(match ty {
+                    "bool" => ValueKind::Bool,
+                    "number" => ValueKind::Number,
+                    "string" => ValueKind::String,
+                    "bytes" => ValueKind::Bytes,
+                    "sequence" => ValueKind::Seq,
+                    "map" => ValueKind::Map,
+                    _ => syntax_error!("unknown type {} for prop {}", ty, name),
+                })
+            } else {
+                None
+            };
+            let default = if matches!(self.stream.current()?, Some((Token::Assign, _))) {
+                self.stream.next()?;
+                Some(self.parse_expr()?)
+            } else {
+                None
+            };
+            props.push(ast::Prop {
+                name,
+                kind,
+                default,
+            });
+        }
+        if props.is_empty() {
+            syntax_error!("expected at least one prop");
+        }
+        Ok(ast::Props { props })
+    }
+
     fn subparse(
         &mut self,
         end_check: &dyn Fn(&Token) -> bool,
     ) -> Result<Vec<ast::Stmt<'a>>, Error> {
         let mut rv = Vec::new();
-        while let Some((token, span)) = self.stream.next()? {
+        loop {
+            let (token, span) = match self.stream.next() {
+                Ok(Some(rv)) => rv,
+                Ok(None) => break,
+                Err(err) => {
+                    self.recover(err)?;
+                    continue;
+                }
+            };
             match token {
                 Token::TemplateData(raw) => {
                     rv.push(ast::Stmt::EmitRaw(Spanned::new(ast::EmitRaw { raw }, span)))
                 }
-                Token::VariableStart(_) => {
-                    let expr = self.parse_expr()?;
-                    rv.push(ast::Stmt::EmitExpr(Spanned::new(
-                        ast::EmitExpr { expr },
-                        self.stream.expand_span(span),
-                    )));
-                    expect_token!(self, Token::VariableEnd(..), "end of variable block")?;
-                }
-                Token::BlockStart(_) => {
-                    let (tok, _span) = match self.stream.current()? {
-                        Some(rv) => rv,
-                        None => syntax_error!("unexpected end of input, expected keyword"),
-                    };
-                    if end_check(tok) {
-                        return Ok(rv);
-                    }
-                    rv.push(self.parse_stmt()?);
-                    expect_token!(self, Token::BlockEnd(..), "end of block")?;
+                #[cfg(feature = "unstable_machinery")]
+                Token::Comment(raw) => {
+                    rv.push(ast::Stmt::Comment(Spanned::new(ast::Comment { raw }, span)))
                 }
+                Token::VariableStart(_) => match self.parse_emit_expr(span) {
+                    Ok(stmt) => rv.push(stmt),
+                    Err(err) => self.recover(err)?,
+                },
+                Token::BlockStart(_) => match self.stream.current() {
+                    Ok(Some((tok, _))) if end_check(tok) => return Ok(rv),
+                    Ok(Some(_)) => match self.parse_stmt_tag() {
+                        Ok(stmt) => rv.push(stmt),
+                        Err(err) => self.recover(err)?,
+                    },
+                    Ok(None) => self.recover(Error::new(
+                        ErrorKind::SyntaxError,
+                        "unexpected end of input, expected keyword",
+                    ))?,
+                    Err(err) => self.recover(err)?,
+                },
                 _ => unreachable!("lexer produced garbage"),
             }
         }
         Ok(rv)
     }
 
+    fn parse_emit_expr(&mut self, span: Span) -> Result<ast::Stmt<'a>, Error> {
+        let expr = self.parse_expr()?;
+        let rv = ast::Stmt::EmitExpr(Spanned::new(
+            ast::EmitExpr { expr },
+            self.stream.expand_span(span),
+        ));
+        expect_token!(self, Token::VariableEnd(..), "end of variable block")?;
+        Ok(rv)
+    }
+
+    fn parse_stmt_tag(&mut self) -> Result<ast::Stmt<'a>, Error> {
+        let rv = self.parse_stmt()?;
+        expect_token!(self, Token::BlockEnd(..), "end of block")?;
+        Ok(rv)
+    }
+
     pub fn parse(&mut self) -> Result<ast::Stmt<'a>, Error> {
         // start the stream
         self.stream.next()?;
@@ -871,19 +1276,63 @@ pub fn parse<'source, 'name>(
     source: &'source str,
     filename: &'name str,
 ) -> Result<ast::Stmt<'source>, Error> {
-    // we want to chop off a single newline at the end.  This means that a template
-    // by default does not end in a newline which is a useful property to allow
-    // inline templates to work.  If someone wants a trailing newline the expectation
-    // is that the user adds it themselves for achieve consistency.
-    let mut source = source;
-    if source.ends_with('\n') {
-        source = &source[..source.len() - 1];
-    }
-    if source.ends_with('\r') {
-        source = &source[..source.len() - 1];
-    }
+    parse_with_syntax(source, filename, &Syntax::default(), &|_| None)
+}
+
+/// Parses a template with a custom syntax
+///
+/// `custom_tags` is invoked for statements that are not built-in.  It
+/// returns `Some(has_body)` for registered custom tags.
+pub fn parse_with_syntax<'source, 'name>(
+    source: &'source str,
+    filename: &'name str,
+    syntax: &Syntax,
+    custom_tags: &dyn Fn(&str) -> Option<bool>,
+) -> Result<ast::Stmt<'source>, Error> {
+    parse_with_line_offset(
+        source,
+        filename,
+        syntax,
+        custom_tags,
+        0,
+        DEFAULT_MAX_EXPR_DEPTH,
+    )
+}
+
+/// Parses a template and retains its comments.
+///
+/// Comments show up as [`Comment`](ast::Comment) nodes in the position where
+/// they appear in the template.  This is useful for tooling such as
+/// documentation extractors or formatters.  The compiler ignores comment
+/// nodes.
+#[cfg(feature = "unstable_machinery")]
+pub fn parse_with_comments<'source, 'name>(
+    source: &'source str,
+    filename: &'name str,
+    syntax: &Syntax,
+    custom_tags: &dyn Fn(&str) -> Option<bool>,
+) -> Result<ast::Stmt<'source>, Error> {
+    let mut parser = Parser::new(chop_newline(source), false, syntax, custom_tags, true);
+    parser.parse().map_err(|mut err| {
+        if err.line().is_none() {
+            err.set_location(filename, parser.stream.current_span().start_line)
+        }
+        err
+    })
+}
 
-    let mut parser = Parser::new(source, false);
+/// Parses a template that starts at line `line_offset + 1` of a file.
+pub(crate) fn parse_with_line_offset<'source, 'name>(
+    source: &'source str,
+    filename: &'name str,
+    syntax: &Syntax,
+    custom_tags: &dyn Fn(&str) -> Option<bool>,
+    line_offset: usize,
+    max_depth: usize,
+) -> Result<ast::Stmt<'source>, Error> {
+    let mut parser = Parser::new(chop_newline(source), false, syntax, custom_tags, false);
+    parser.stream.set_line_offset(line_offset);
+    parser.max_depth = max_depth;
     parser.parse().map_err(|mut err| {
         if err.line().is_none() {
             err.set_location(filename, parser.stream.current_span().start_line)
@@ -892,9 +1341,72 @@ pub fn parse<'source, 'name>(
     })
 }
 
-/// Parses an expression
-pub fn parse_expr(source: &str) -> Result<ast::Expr<'_>, Error> {
-    let mut parser = Parser::new(source, true);
+/// Parses a template and collects all syntax errors.
+///
+/// Instead of stopping at the first error the parser skips to the end of
+/// the offending tag and continues.  The returned template lacks the tags
+/// that failed to parse.
+pub(crate) fn parse_with_recovery<'source, 'name>(
+    source: &'source str,
+    filename: &'name str,
+    syntax: &Syntax,
+    custom_tags: &dyn Fn(&str) -> Option<bool>,
+    line_offset: usize,
+    max_depth: usize,
+) -> (ast::Stmt<'source>, Vec<Error>) {
+    let mut parser = Parser::new(chop_newline(source), false, syntax, custom_tags, false);
+    parser.stream.set_line_offset(line_offset);
+    parser.max_depth = max_depth;
+    parser.recovered_errors = Some(Vec::new());
+    let rv = parser.parse();
+    let mut errors = parser.recovered_errors.take().unwrap_or_default();
+    let template = match rv {
+        Ok(template) => template,
+        Err(err) => {
+            errors.push(err);
+            ast::Stmt::Template(Spanned::new(
+                ast::Template {
+                    children: Vec::new(),
+                },
+                Span::default(),
+            ))
+        }
+    };
+    for err in errors.iter_mut() {
+        if err.line().is_none() {
+            let line = match err.span() {
+                Some(span) => span.start_line,
+                None => parser.stream.current_span().start_line,
+            };
+            err.set_location(filename, line);
+        }
+    }
+    (template, errors)
+}
+
+/// Chops off a single newline at the end.
+///
+/// This means that a template by default does not end in a newline which
+/// is a useful property to allow inline templates to work.  If someone
+/// wants a trailing newline the expectation is that the user adds it
+/// themselves for achieve consistency.
+fn chop_newline(mut source: &str) -> &str {
+    if source.ends_with('\n') {
+        source = &source[..source.len() - 1];
+    }
+    if source.ends_with('\r') {
+        source = &source[..source.len() - 1];
+    }
+    source
+}
+
+/// Parses an expression with a nesting limit.
+pub(crate) fn parse_expr_with_max_depth(
+    source: &str,
+    max_depth: usize,
+) -> Result<ast::Expr<'_>, Error> {
+    let mut parser = Parser::new(source, true, &Syntax::default(), &|_| None, false);
+    parser.max_depth = max_depth;
     parser.parse_expr().map_err(|mut err| {
         if err.line().is_none() {
             err.set_location("<expression>", parser.stream.current_span().start_line)
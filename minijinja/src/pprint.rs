@@ -0,0 +1,271 @@
+use std::fmt;
+use std::fmt::Write;
+
+use crate::value::{Value, ValueRepr};
+
+/// Limits for the debug output of values.
+///
+/// Debug output of large contexts can easily grow to megabytes of text.
+/// These limits are applied by the `pprint` filter, the `debug` function
+/// and the variables shown in the debug info of errors.  Containers nested
+/// deeper than `max_depth` are shown as `[...]` or `{...}`, only the first
+/// `max_items` items of sequences and maps are shown and strings are cut
+/// off after `max_string_len` characters.  Limits that are `None` are not
+/// enforced which is the default.
+///
+/// See [`Environment::set_repr_limits`](crate::Environment::set_repr_limits).
+#[derive(Debug, Clone, Copy, Default, PartialEq, Eq)]
+pub struct ReprLimits {
+    /// The maximum depth containers are shown at.
+    pub max_depth: Option<usize>,
+    /// The maximum number of items shown per sequence or map.
+    pub max_items: Option<usize>,
+    /// The maximum number of characters shown per string.
+    pub max_string_len: Option<usize>,
+}
+
+/// Pretty prints values with limits.
+///
+/// The output format matches the alternative debug formatting of values
+/// (`{:#?}`) but the printer stops descending into values that are nested
+/// deeper than `max_depth` and elides items of sequences and maps beyond
+/// `max_items`.  Dynamic objects are printed by their attributes and objects
+/// that (directly or indirectly) contain themselves are detected and printed
+/// as `<cycle>` rather than recursing forever.  Strings longer than
+/// `max_string_len` characters are cut off.
+#[derive(Debug, Clone, Copy)]
+pub(crate) struct PrettyPrinter {
+    pub max_depth: usize,
+    pub max_items: usize,
+    pub max_string_len: usize,
+}
+
+impl Default for PrettyPrinter {
+    fn default() -> PrettyPrinter {
+        PrettyPrinter {
+            max_depth: usize::MAX,
+            max_items: usize::MAX,
+            max_string_len: usize::MAX,
+        }
+    }
+}
+
+impl From<ReprLimits> for PrettyPrinter {
+    fn from(limits: ReprLimits) -> PrettyPrinter {
+        PrettyPrinter {
+            max_depth: limits.max_depth.unwrap_or(usize::MAX),
+            max_items: limits.max_items.unwrap_or(usize::MAX),
+            max_string_len: limits.max_string_len.unwrap_or(usize::MAX),
+        }
+    }
+}
+
+/// Formats a value on a single line for error messages.
+///
+/// The output is cut off after `max_len` characters so that large values
+/// do not end up in full in the message.
+pub(crate) fn short_repr(value: &Value, max_len: usize) -> String {
+    struct Limited {
+        buf: String,
+        left: usize,
+    }
+
+    impl Write for Limited {
+        fn write_str(&mut self, s: &str) -> fmt::Result {
+            for c in s.chars() {
+                if self.left == 0 {
+                    return Err(fmt::Error);
+                }
+                self.buf.push(c);
+                self.left -= 1;
+            }
+            Ok(())
+        }
+    }
+
+    let mut out = Limited {
+        buf: String::new(),
+        left: max_len,
+    };
+    if write!(out, "{:?}", value).is_err() {
+        out.buf.push_str("...");
+    }
+    out.buf
+}
+
+/// Debug formats a value with a pretty printer.
+pub(crate) struct Repr<'a>(pub &'a Value, pub &'a PrettyPrinter);
+
+impl<'a> fmt::Debug for Repr<'a> {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        f.write_str(&self.1.format(self.0))
+    }
+}
+
+impl PrettyPrinter {
+    /// Formats a value into a string.
+    pub fn format(&self, value: &Value) -> String {
+        let mut rv = String::new();
+        self.write_value(&mut rv, value, 0, &mut Vec::new());
+        rv
+    }
+
+    fn write_value(&self, out: &mut String, value: &Value, depth: usize, seen: &mut Vec<usize>) {
+        match value.0 {
+            ValueRepr::Seq(ref items) => {
+                if items.is_empty() {
+                    out.push_str("[]");
+                } else if depth >= self.max_depth {
+                    out.push_str("[...]");
+                } else {
+                    out.push('[');
+                    for item in items.iter().take(self.max_items) {
+                        self.newline(out, depth + 1);
+                        self.write_value(out, item, depth + 1, seen);
+                        out.push(',');
+                    }
+                    self.write_elision(out, items.len(), depth + 1);
+                    self.newline(out, depth);
+                    out.push(']');
+                }
+            }
+            ValueRepr::Map(ref items) => {
+                if items.is_empty() {
+                    out.push_str("{}");
+                } else if depth >= self.max_depth {
+                    out.push_str("{...}");
+                } else {
+                    out.push('{');
+                    for (key, value) in items.iter().take(self.max_items) {
+                        self.newline(out, depth + 1);
+                        write!(out, "{:?}: ", key).unwrap();
+                        self.write_value(out, value, depth + 1, seen);
+                        out.push(',');
+                    }
+                    self.write_elision(out, items.len(), depth + 1);
+                    self.newline(out, depth);
+                    out.push('}');
+                }
+            }
+            ValueRepr::Dynamic(ref obj) => {
+                let attrs = obj.attributes();
+                let ptr = &**obj as *const _ as *const u8 as usize;
+                if attrs.is_empty() {
+                    write!(out, "{:?}", obj).unwrap();
+                } else if seen.contains(&ptr) {
+                    out.push_str("<cycle>");
+                } else if depth >= self.max_depth {
+                    out.push_str("{...}");
+                } else {
+                    seen.push(ptr);
+                    out.push('{');
+                    for attr in attrs.iter().take(self.max_items) {
+                        self.newline(out, depth + 1);
+                        write!(out, "{:?}: ", attr).unwrap();
+                        let value = obj.get_attr(attr).unwrap_or(Value::UNDEFINED);
+                        self.write_value(out, &value, depth + 1, seen);
+                        out.push(',');
+                    }
+                    self.write_elision(out, attrs.len(), depth + 1);
+                    self.newline(out, depth);
+                    out.push('}');
+                    seen.pop();
+                }
+            }
+            ValueRepr::String(ref s) | ValueRepr::SafeString(ref s) => {
+                match s.char_indices().nth(self.max_string_len) {
+                    Some((idx, _)) => {
+                        let rest = s[idx..].chars().count();
+                        write!(out, "{:?}... ({} more)", &s[..idx], rest).unwrap();
+                    }
+                    None => write!(out, "{:?}", s).unwrap(),
+                }
+            }
+            _ => write!(out, "{:?}", value).unwrap(),
+        }
+    }
+
+    fn write_elision(&self, out: &mut String, len: usize, depth: usize) {
+        if len > self.max_items {
+            self.newline(out, depth);
+            write!(out, "... ({} more)", len - self.max_items).unwrap();
+        }
+    }
+
+    fn newline(&self, out: &mut String, depth: usize) {
+        out.push('\n');
+        for _ in 0..depth {
+            out.push_str("    ");
+        }
+    }
+}
+
+#[test]
+fn test_pprint_limits() {
+    let value = Value::from_serializable(&vec![vec![1, 2, 3], vec![4, 5, 6], vec![7, 8, 9]]);
+    let printer = PrettyPrinter {
+        max_depth: 1,
+        max_items: 2,
+        max_string_len: usize::MAX,
+    };
+    assert_eq!(
+        printer.format(&value),
+        "[\n    [...],\n    [...],\n    ... (1 more)\n]"
+    );
+    assert_eq!(
+        PrettyPrinter::default().format(&Value::from(vec![1])),
+        format!("{:#?}", Value::from(vec![1]))
+    );
+}
+
+#[test]
+fn test_pprint_string_limit() {
+    let printer = PrettyPrinter::from(ReprLimits {
+        max_string_len: Some(3),
+        ..ReprLimits::default()
+    });
+    assert_eq!(
+        printer.format(&Value::from(vec!["abcdef", "äöü"])),
+        "[\n    \"abc\"... (3 more),\n    \"äöü\",\n]"
+    );
+}
+
+#[test]
+fn test_pprint_cycle() {
+    use std::fmt;
+    use std::sync::Mutex;
+
+    use crate::value::{Object, RcType};
+
+    #[derive(Debug, Default)]
+    struct Node(Mutex<Option<Value>>);
+
+    impl fmt::Display for Node {
+        fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+            write!(f, "<node>")
+        }
+    }
+
+    impl Object for Node {
+        fn attributes(&self) -> &[&str] {
+            &["next"][..]
+        }
+
+        fn get_attr(&self, name: &str) -> Option<Value> {
+            match name {
+                "next" => self.0.lock().unwrap().clone(),
+                _ => None,
+            }
+        }
+    }
+
+    let node = RcType::new(Node::default());
+    let value = Value::from_rc_object(node.clone());
+    *node.0.lock().unwrap() = Some(value.clone());
+    assert_eq!(
+        PrettyPrinter::default().format(&value),
+        "{\n    \"next\": <cycle>,\n}"
+    );
+    // break the cycle so the test does not leak
+    node.0.lock().unwrap().take();
+}
@@ -1,17 +1,22 @@
-use std::collections::HashMap;
+use std::collections::{BTreeMap, HashMap, HashSet};
 use std::fmt;
 use std::fs;
-use std::path::Path;
+use std::io::{self, Read};
+use std::path::{Path, PathBuf};
 use std::sync::Arc;
 
 use memo_map::MemoMap;
 use self_cell::self_cell;
 
-use crate::environment::CompiledTemplate;
+use crate::compiler::OptimizationLevel;
+use crate::environment::{CompiledTemplate, FrontMatterParser};
 use crate::error::{Error, ErrorKind};
-use crate::value::RcType;
+use crate::parser::DEFAULT_MAX_EXPR_DEPTH;
+use crate::syntax::Syntax;
+use crate::value::{RcType, Value};
 
 type LoadFunc = dyn for<'a> Fn(&'a str) -> Result<String, Error> + Send + Sync;
+type ListFunc = dyn Fn() -> Result<Vec<String>, Error> + Send + Sync;
 
 /// Utility for dynamic template loading.
 ///
@@ -31,6 +36,12 @@ type LoadFunc = dyn for<'a> Fn(&'a str) -> Result<String, Error> + Send + Sync;
 #[cfg_attr(docsrs, doc(cfg(feature = "source")))]
 pub struct Source {
     backing: SourceBacking,
+    syntax: Syntax,
+    custom_tags: BTreeMap<String, bool>,
+    optimization_level: OptimizationLevel,
+    max_expression_depth: usize,
+    front_matter_parser: Option<RcType<FrontMatterParser>>,
+    lister: Option<Arc<ListFunc>>,
 }
 
 #[derive(Clone)]
@@ -97,6 +108,12 @@ impl Source {
             backing: SourceBacking::Static {
                 templates: HashMap::new(),
             },
+            syntax: Syntax::default(),
+            custom_tags: BTreeMap::new(),
+            optimization_level: OptimizationLevel::default(),
+            max_expression_depth: DEFAULT_MAX_EXPR_DEPTH,
+            front_matter_parser: None,
+            lister: None,
         }
     }
 
@@ -135,9 +152,83 @@ impl Source {
                     None => Err(Error::new_not_found(name)),
                 }),
             },
+            syntax: Syntax::default(),
+            custom_tags: BTreeMap::new(),
+            optimization_level: OptimizationLevel::default(),
+            max_expression_depth: DEFAULT_MAX_EXPR_DEPTH,
+            front_matter_parser: None,
+            lister: None,
         }
     }
 
+    /// Sets the syntax for templates added to or loaded by the source.
+    ///
+    /// Templates that were already added keep the syntax they were compiled
+    /// with.  The syntax is validated first.
+    pub fn set_syntax(&mut self, syntax: Syntax) -> Result<(), Error> {
+        syntax.validate()?;
+        self.syntax = syntax;
+        Ok(())
+    }
+
+    /// Sets the optimization level for templates added to or loaded by the
+    /// source.
+    pub fn set_optimization_level(&mut self, level: OptimizationLevel) {
+        self.optimization_level = level;
+    }
+
+    /// Sets the maximum nesting depth of expressions for templates added to
+    /// or loaded by the source.
+    ///
+    /// This works like
+    /// [`Environment::set_max_expression_depth`](crate::Environment::set_max_expression_depth).
+    pub fn set_max_expression_depth(&mut self, depth: usize) {
+        self.max_expression_depth = depth;
+    }
+
+    /// Sets a parser for front matter at the start of templates.
+    ///
+    /// This works like
+    /// [`Environment::set_front_matter_parser`](crate::Environment::set_front_matter_parser)
+    /// which also sets the parser on the source of the environment.
+    pub fn set_front_matter_parser<F>(&mut self, f: F)
+    where
+        F: Fn(&str, &str) -> Result<Value, Error> + Sync + Send + 'static,
+    {
+        self.front_matter_parser = Some(RcType::new(f));
+    }
+
+    /// Sets a function that enumerates the templates the loader can load.
+    ///
+    /// A loader only learns about template names when they are requested.
+    /// The lister lets a source created with
+    /// [`with_loader`](Self::with_loader) report the templates it could load
+    /// so that [`Environment::template_names`](crate::Environment::template_names)
+    /// and the `list_templates` function can include them before they were
+    /// loaded.
+    ///
+    /// ```rust
+    /// # use minijinja::{Source, Environment};
+    /// let mut source = Source::with_loader(|name| match name {
+    ///     "a.html" | "b.html" => Ok(Some(format!("I am {}", name))),
+    ///     _ => Ok(None),
+    /// });
+    /// source.set_template_lister(|| Ok(vec!["a.html".into(), "b.html".into()]));
+    /// let mut env = Environment::new();
+    /// env.set_source(source);
+    /// assert_eq!(env.template_names().unwrap(), vec!["a.html", "b.html"]);
+    /// ```
+    pub fn set_template_lister<F>(&mut self, f: F)
+    where
+        F: Fn() -> Result<Vec<String>, Error> + Send + Sync + 'static,
+    {
+        self.lister = Some(Arc::new(f));
+    }
+
+    pub(crate) fn set_front_matter_parser_rc(&mut self, parser: RcType<FrontMatterParser>) {
+        self.front_matter_parser = Some(parser);
+    }
+
     /// Adds a new template into the source.
     ///
     /// This is similar to the method of the same name on the environment but
@@ -148,11 +239,50 @@ impl Source {
         name: N,
         source: S,
     ) -> Result<(), Error> {
-        let source = source.into();
-        let name = name.into();
+        let syntax = self.syntax.clone();
+        self._add_template(name.into(), source.into(), &syntax)
+    }
+
+    /// Registers the name of a custom tag for parsing.
+    pub(crate) fn add_custom_tag(&mut self, name: &str, has_body: bool) {
+        self.custom_tags.insert(name.to_string(), has_body);
+    }
+
+    /// Adds a new template with a custom syntax into the source.
+    ///
+    /// This is similar to [`add_template`](Self::add_template) but the
+    /// template is compiled with the given syntax.
+    pub fn add_template_with_syntax<N: Into<String>, S: Into<String>>(
+        &mut self,
+        name: N,
+        source: S,
+        syntax: Syntax,
+    ) -> Result<(), Error> {
+        syntax.validate()?;
+        self._add_template(name.into(), source.into(), &syntax)
+    }
+
+    fn _add_template(
+        &mut self,
+        name: String,
+        source: String,
+        syntax: &Syntax,
+    ) -> Result<(), Error> {
         let owner = (name.clone(), source);
+        let optimization_level = self.optimization_level;
+        let max_expression_depth = self.max_expression_depth;
+        let custom_tags = &self.custom_tags;
+        let front_matter_parser = self.front_matter_parser.as_deref();
         let tmpl = LoadedTemplate::try_new(owner, |(name, source)| -> Result<_, Error> {
-            CompiledTemplate::from_name_and_source(name.as_str(), source)
+            CompiledTemplate::from_name_and_source(
+                name.as_str(),
+                source,
+                syntax,
+                &|name| custom_tags.get(name).copied(),
+                optimization_level,
+                max_expression_depth,
+                front_matter_parser,
+            )
         })?;
 
         match self.backing {
@@ -185,67 +315,64 @@ impl Source {
     /// This function takes two arguments: `path` which is the path to where the templates are
     /// stored and `extensions` which is a list of file extensions that should be considered to
     /// be templates.  Hidden files are always ignored.
+    ///
+    /// For templates that are not fully trusted (for instance because users
+    /// can upload them) use [`load_from_path_with_options`](Self::load_from_path_with_options)
+    /// which can restrict what is loaded.
     pub fn load_from_path<P: AsRef<Path>>(
         &mut self,
         path: P,
         extensions: &[&str],
+    ) -> Result<(), Error> {
+        let options = LoadFromPathOptions {
+            extensions: extensions.iter().map(|x| x.to_string()).collect(),
+            ..LoadFromPathOptions::default()
+        };
+        self.load_from_path_with_options(path, &options)
+    }
+
+    /// Loads templates from a path with [`LoadFromPathOptions`].
+    ///
+    /// This works like [`load_from_path`](Self::load_from_path) but the
+    /// options control how symlinks are handled and how large templates can
+    /// be.  Loading fails on the first file that violates the options.
+    ///
+    /// ```no_run
+    /// # use minijinja::{LoadFromPathOptions, Source};
+    /// let mut source = Source::new();
+    /// source.load_from_path_with_options("uploads", &LoadFromPathOptions {
+    ///     extensions: vec!["html".into()],
+    ///     follow_symlinks: false,
+    ///     restrict_to_root: true,
+    ///     max_template_size: Some(64 * 1024),
+    /// }).unwrap();
+    /// ```
+    pub fn load_from_path_with_options<P: AsRef<Path>>(
+        &mut self,
+        path: P,
+        options: &LoadFromPathOptions,
     ) -> Result<(), Error> {
         let path = fs::canonicalize(&path).map_err(|err| {
             Error::new(ErrorKind::InvalidOperation, "unable to load template").with_source(err)
         })?;
+        let mut visited = HashSet::new();
+        visited.insert(path.clone());
+        walk(self, &path, &path, options, &mut visited)
+    }
 
-        fn walk(
-            source: &mut Source,
-            root: &Path,
-            dir: &Path,
-            extensions: &[&str],
-        ) -> Result<(), Error> {
-            if dir.is_dir() {
-                for entry in fs::read_dir(dir).map_err(|err| {
-                    Error::new(ErrorKind::InvalidOperation, "failed to walk directory")
-                        .with_source(err)
-                })? {
-                    let entry = entry.map_err(|err| {
-                        Error::new(ErrorKind::InvalidOperation, "failed to walk directory")
-                            .with_source(err)
-                    })?;
-                    let path = entry.path();
-
-                    let filename = match path.file_name().and_then(|x| x.to_str()) {
-                        Some(filename) => filename,
-                        None => continue,
-                    };
-
-                    if filename.starts_with('.') {
-                        continue;
-                    }
-
-                    if path.is_dir() {
-                        walk(source, root, &path, extensions)?;
-                    } else if extensions.contains(&filename.rsplit('.').next().unwrap_or("")) {
-                        let name = path
-                            .strip_prefix(root)
-                            .unwrap()
-                            .display()
-                            .to_string()
-                            .replace('\\', "/");
-                        source.add_template(
-                            name,
-                            fs::read_to_string(path).map_err(|err| {
-                                Error::new(
-                                    ErrorKind::TemplateNotFound,
-                                    "unable to load template from file system",
-                                )
-                                .with_source(err)
-                            })?,
-                        )?;
-                    }
-                }
+    /// Returns the names of the templates that were added or loaded and the
+    /// ones reported by the template lister.
+    pub(crate) fn template_names(&self) -> Result<Vec<String>, Error> {
+        let mut rv: Vec<String> = match &self.backing {
+            SourceBacking::Dynamic { templates, .. } => {
+                templates.iter().map(|x| x.0.clone()).collect()
             }
-            Ok(())
+            SourceBacking::Static { templates } => templates.keys().cloned().collect(),
+        };
+        if let Some(ref lister) = self.lister {
+            rv.extend(lister()?);
         }
-
-        walk(self, &path, &path, extensions)
+        Ok(rv)
     }
 
     /// Gets a compiled template from the source.
@@ -257,7 +384,15 @@ impl Source {
                     let owner = (name.to_owned(), source);
                     let tmpl =
                         LoadedTemplate::try_new(owner, |(name, source)| -> Result<_, Error> {
-                            CompiledTemplate::from_name_and_source(name.as_str(), source)
+                            CompiledTemplate::from_name_and_source(
+                                name.as_str(),
+                                source,
+                                &self.syntax,
+                                &|name| self.custom_tags.get(name).copied(),
+                                self.optimization_level,
+                                self.max_expression_depth,
+                                self.front_matter_parser.as_deref(),
+                            )
                         })?;
                     Ok(RcType::new(tmpl))
                 })?
@@ -270,6 +405,140 @@ impl Source {
     }
 }
 
+/// Options for [`Source::load_from_path_with_options`].
+#[cfg_attr(docsrs, doc(cfg(feature = "source")))]
+#[derive(Debug, Clone)]
+pub struct LoadFromPathOptions {
+    /// The file extensions of templates.  Other files are ignored.
+    pub extensions: Vec<String>,
+    /// Follow symlinks to files and directories.  The default is `true`,
+    /// if disabled symlinks are ignored.
+    pub follow_symlinks: bool,
+    /// Fail if a symlink points outside of the template directory.  The
+    /// default is `false`.
+    pub restrict_to_root: bool,
+    /// The maximum size of a template file in bytes.  Larger files fail to
+    /// load.  The default is no limit.
+    pub max_template_size: Option<u64>,
+}
+
+impl Default for LoadFromPathOptions {
+    fn default() -> LoadFromPathOptions {
+        LoadFromPathOptions {
+            extensions: Vec::new(),
+            follow_symlinks: true,
+            restrict_to_root: false,
+            max_template_size: None,
+        }
+    }
+}
+
+fn walk_error(msg: &str, path: &Path) -> Error {
+    Error::new(
+        ErrorKind::InvalidOperation,
+        format!("{} ({})", msg, path.display()),
+    )
+}
+
+/// Reads a template file.
+///
+/// The size limit is enforced while reading as the file can change after
+/// its metadata was looked at.
+fn read_template(path: &Path, target: &Path, max_size: Option<u64>) -> Result<String, Error> {
+    let load_error = |err: io::Error| {
+        Error::new(
+            ErrorKind::TemplateNotFound,
+            "unable to load template from file system",
+        )
+        .with_source(err)
+    };
+    let file = fs::File::open(target).map_err(load_error)?;
+    // one byte past the limit is enough to know that the file is too large
+    let limit = max_size.map_or(u64::MAX, |max_size| max_size.saturating_add(1));
+    let mut buf = Vec::new();
+    file.take(limit).read_to_end(&mut buf).map_err(load_error)?;
+    if max_size.map_or(false, |max_size| buf.len() as u64 > max_size) {
+        return Err(walk_error("template exceeds maximum size", path));
+    }
+    String::from_utf8(buf)
+        .map_err(|err| load_error(io::Error::new(io::ErrorKind::InvalidData, err)))
+}
+
+fn walk(
+    source: &mut Source,
+    root: &Path,
+    dir: &Path,
+    options: &LoadFromPathOptions,
+    visited: &mut HashSet<PathBuf>,
+) -> Result<(), Error> {
+    if !dir.is_dir() {
+        return Ok(());
+    }
+    let entries = fs::read_dir(dir).map_err(|err| {
+        Error::new(ErrorKind::InvalidOperation, "failed to walk directory").with_source(err)
+    })?;
+    for entry in entries {
+        let entry = entry.map_err(|err| {
+            Error::new(ErrorKind::InvalidOperation, "failed to walk directory").with_source(err)
+        })?;
+        let path = entry.path();
+
+        let filename = match path.file_name().and_then(|x| x.to_str()) {
+            Some(filename) => filename,
+            None => continue,
+        };
+        if filename.starts_with('.') {
+            continue;
+        }
+
+        let is_symlink = entry.file_type().map(|x| x.is_symlink()).unwrap_or(false);
+        let target = if is_symlink {
+            if !options.follow_symlinks {
+                continue;
+            }
+            // dangling symlinks are skipped like other unreadable entries
+            let target = match fs::canonicalize(&path) {
+                Ok(target) => target,
+                Err(_) => continue,
+            };
+            if options.restrict_to_root && !target.starts_with(root) {
+                return Err(walk_error("symlink points outside of template root", &path));
+            }
+            target
+        } else {
+            path.clone()
+        };
+
+        let metadata = fs::metadata(&target).map_err(|err| {
+            Error::new(
+                ErrorKind::TemplateNotFound,
+                "unable to load template from file system",
+            )
+            .with_source(err)
+        })?;
+        if metadata.is_dir() {
+            // symlinked directories can form cycles
+            if !is_symlink || visited.insert(target.clone()) {
+                walk(source, root, &path, options, visited)?;
+            }
+        } else if options
+            .extensions
+            .iter()
+            .any(|ext| ext == filename.rsplit('.').next().unwrap_or(""))
+        {
+            let contents = read_template(&path, &target, options.max_template_size)?;
+            let name = path
+                .strip_prefix(root)
+                .unwrap()
+                .display()
+                .to_string()
+                .replace('\\', "/");
+            source.add_template(name, contents)?;
+        }
+    }
+    Ok(())
+}
+
 #[test]
 fn test_source_replace_static() {
     let mut source = Source::new();
@@ -291,3 +560,132 @@ fn test_source_replace_dynamic() {
     let rv = env.get_template("a").unwrap().render(()).unwrap();
     assert_eq!(rv, "2");
 }
+
+#[test]
+fn test_source_syntax() {
+    let mut source = Source::with_loader(|_| Ok(Some("<< x >> {{ x }}".into())));
+    source
+        .set_syntax(Syntax {
+            variable_start: "<<".into(),
+            variable_end: ">>".into(),
+            ..Syntax::default()
+        })
+        .unwrap();
+    let mut env = crate::Environment::new();
+    env.set_source(source);
+    let rv = env
+        .get_template("a")
+        .unwrap()
+        .render(crate::context!(x => 42))
+        .unwrap();
+    assert_eq!(rv, "42 {{ x }}");
+}
+
+#[test]
+fn test_source_custom_tags() {
+    use crate::tags::Tag;
+    use crate::value::Value;
+    use crate::State;
+
+    struct Answer;
+
+    impl Tag for Answer {
+        fn has_body(&self) -> bool {
+            false
+        }
+
+        fn render(&self, _: &State, _: &[Value], _: Option<Value>) -> Result<Value, Error> {
+            Ok(Value::from(42))
+        }
+    }
+
+    let mut env = crate::Environment::new();
+    env.set_source(Source::with_loader(|_| Ok(Some("{% answer %}".into()))));
+    env.add_tag("answer", Answer);
+    assert_eq!(env.get_template("a").unwrap().render(()).unwrap(), "42");
+
+    let mut env = crate::Environment::new();
+    env.add_tag("answer", Answer);
+    env.set_source(Source::with_loader(|_| Ok(Some("{% answer %}".into()))));
+    assert_eq!(env.get_template("a").unwrap().render(()).unwrap(), "42");
+}
+
+#[cfg(unix)]
+#[test]
+fn test_load_from_path_options() {
+    use std::os::unix::fs::symlink;
+
+    let base = std::env::temp_dir().join(format!("minijinja-load-{}", std::process::id()));
+    let root = base.join("templates");
+    let outside = base.join("outside");
+    fs::create_dir_all(root.join("sub")).unwrap();
+    fs::create_dir_all(&outside).unwrap();
+    fs::write(root.join("index.html"), "index").unwrap();
+    fs::write(root.join("sub/big.html"), "x".repeat(100)).unwrap();
+    fs::write(root.join("notes.txt"), "notes").unwrap();
+    fs::write(outside.join("secret.html"), "secret").unwrap();
+    symlink(root.join("index.html"), root.join("alias.html")).unwrap();
+    symlink(outside.join("secret.html"), root.join("secret.html")).unwrap();
+    symlink(&root, root.join("sub/loop")).unwrap();
+
+    let mut options = LoadFromPathOptions {
+        extensions: vec!["html".into()],
+        ..LoadFromPathOptions::default()
+    };
+    let mut source = Source::new();
+    source.load_from_path_with_options(&root, &options).unwrap();
+    let mut names = source.template_names().unwrap();
+    names.sort();
+    assert_eq!(
+        names,
+        vec!["alias.html", "index.html", "secret.html", "sub/big.html"]
+    );
+
+    options.restrict_to_root = true;
+    let err = Source::new()
+        .load_from_path_with_options(&root, &options)
+        .unwrap_err();
+    assert!(err.to_string().contains("outside of template root"));
+
+    options.follow_symlinks = false;
+    let mut source = Source::new();
+    source.load_from_path_with_options(&root, &options).unwrap();
+    let mut names = source.template_names().unwrap();
+    names.sort();
+    assert_eq!(names, vec!["index.html", "sub/big.html"]);
+
+    options.max_template_size = Some(50);
+    let err = Source::new()
+        .load_from_path_with_options(&root, &options)
+        .unwrap_err();
+    assert!(err.to_string().contains("exceeds maximum size"));
+
+    // the limit is inclusive
+    options.max_template_size = Some(100);
+    let mut source = Source::new();
+    source.load_from_path_with_options(&root, &options).unwrap();
+    assert_eq!(source.template_names().unwrap().len(), 2);
+
+    fs::remove_dir_all(&base).unwrap();
+}
+
+#[test]
+fn test_source_template_lister() {
+    let mut source = Source::with_loader(|name| match name {
+        "a.txt" | "b.txt" => Ok(Some(name.to_uppercase())),
+        _ => Ok(None),
+    });
+    source.set_template_lister(|| Ok(vec!["b.txt".into(), "a.txt".into()]));
+    let mut env = crate::Environment::new();
+    env.set_source(source);
+    env.get_template("a.txt").unwrap();
+    assert_eq!(env.template_names().unwrap(), vec!["a.txt", "b.txt"]);
+
+    let mut source = Source::with_loader(|_| Ok(None));
+    source.set_template_lister(|| Err(Error::new(ErrorKind::InvalidOperation, "broken")));
+    env.set_source(source);
+    assert_eq!(
+        env.template_names().unwrap_err().kind(),
+        ErrorKind::InvalidOperation
+    );
+}
@@ -22,6 +22,9 @@
 //!   - [`{% filter %}`](#-filter-)
 //!   - [`{% autoescape %}`](#-autoescape-)
 //!   - [`{% raw %}`](#-raw-)
+//!   - [`{% component %}`](#-component-)
+//! - [Custom Delimiters](#custom-delimiters)
+//! - [Line Statements](#line-statements)
 //!
 //! </details>
 //!
@@ -134,8 +137,12 @@
 //! - ``()``: Call a callable: ``{{ super() }}``.  Inside of the parentheses you
 //!   can use positional arguments.  Additionally keyword arguments are supported
 //!   which are treated like a dict syntax.  Eg: `foo(a=1, b=2)` is the same as
-//!   `foo({"a": 1, "b": 2})`.
-//! - ``.`` / ``[]``: Get an attribute of an object.
+//!   `foo({"a": 1, "b": 2})`.  Sequences can be passed as positional arguments
+//!   with `*` and maps (or objects) as keyword arguments with `**`: eg:
+//!   `foo(*args, **kwargs)`.  This works for filter and test arguments too.
+//! - ``.`` / ``[]``: Get an attribute of an object.  Negative indexes count
+//!   from the end and sequences and strings can be sliced like in Python:
+//!   `{{ items[1:] }}`, `{{ items[::-1] }}`.
 //!
 //! ### If Expressions
 //!
@@ -172,6 +179,17 @@
 //! </ul>
 //! ```
 //!
+//! Iterating over a map yields its keys.  The keys keep their type so a map
+//! with integer keys yields integers.  Maps are ordered by key unless the
+//! `preserve_order` feature is enabled in which case the insertion order is
+//! kept:
+//!
+//! ```jinja
+//! {% for name in users %}
+//!   <li>{{ name }}: {{ users[name].email }}</li>
+//! {% endfor %}
+//! ```
+//!
 //! It's also possible to unpack tuples while iterating:
 //!
 //! ```jinja
@@ -183,6 +201,18 @@
 //! </ul>
 //! ```
 //!
+//! One target can be prefixed with `*` to collect all items that are not
+//! assigned to other targets into a list:
+//!
+//! ```jinja
+//! {% for first, *rest in rows %}
+//!   <li>{{ first }}: {{ rest|join(", ") }}</li>
+//! {% endfor %}
+//! ```
+//!
+//! To get the keys and values of a map use the `items` filter:
+//! `{% for key, value in map|items %}`.
+//!
 //! Inside of the for block you can access some special variables:
 //!
 //! - `loop.index`: The current iteration of the loop. (1 indexed)
@@ -386,6 +416,15 @@
 //!  
 //! Included templates have access to the variables of the active context.
 //!
+//! Template names starting with `./` or `../` are resolved relative to the
+//! template that contains the tag.  This works for `include`, `extends` and
+//! `component` and allows directories of templates to reference each other
+//! without knowing where they are located:
+//!
+//! ```jinja
+//! {% include './partials/nav.html' %}
+//! ```
+//!
 //! ## `{% with %}`
 //!
 //! The with statement makes it possible to create a new inner scope.  Variables set within
@@ -418,6 +457,16 @@
 //! Please keep in mind that it is not possible to set variables inside a block
 //! and have them show up outside of it.  This also applies to loops.  The only
 //! exception to that rule are if statements which do not introduce a scope.
+//! To carry values out of a loop use a
+//! [`namespace`](crate::functions::namespace) whose attributes can be set:
+//!
+//! ```jinja
+//! {% set ns = namespace(found=false) %}
+//! {% for item in items %}
+//!   {% if item.active %}{% set ns.found = true %}{% endif %}
+//! {% endfor %}
+//! {{ ns.found }}
+//! ```
 //!
 //! ## `{% filter %}`
 //!
@@ -466,5 +515,471 @@
 //! </ul>
 //! {% endraw %}
 //! ```
+//!
+//! ## `{% component %}`
+//!
+//! Components are templates that are rendered with a set of props and slots
+//! rather than the context of the caller.  The props are passed after `with`
+//! and everything in the body of the tag is passed as the default slot.
+//! Additional named slots can be passed with `{% slot %}`:
+//!
+//! ```jinja
+//! {% component "card.html" with title="Welcome", level=2 %}
+//!   {% slot footer %}<a href="/">Home</a>{% endslot %}
+//!   This becomes the body of the card.
+//! {% endcomponent %}
+//! ```
+//!
+//! Within the component the props are available as variables and the rendered
+//! slots can be found in the `slots` map.  Slots that were not passed are
+//! undefined.  A component can declare the props it accepts with
+//! `{% props %}`.  Props without a default value are required and if a
+//! component declares its props, passing any other prop is an error:
+//!
+//! ```jinja
+//! {% props title, level=1 %}
+//! <div class="card">
+//!   <h{{ level }}>{{ title }}</h{{ level }}>
+//!   {{ slots.default }}
+//!   {% if slots.footer %}<footer>{{ slots.footer }}</footer>{% endif %}
+//! </div>
+//! ```
+//!
+//! Props can also be annotated with the type of value they accept.  Passing a
+//! value of another type fails with an error that names the component, the
+//! prop and the expected type.  Default values are not checked.  The
+//! supported types are `bool`, `number`, `string`, `bytes`, `sequence` and
+//! `map`:
+//!
+//! ```jinja
+//! {% props title: string, level: number = 1, tags: sequence = [] %}
+//! ```
+//!
+//! ## Custom Tags
+//!
+//! Applications and extensions can register additional tags on the
+//! environment.  They take a comma separated list of arguments and, if they
+//! have a body, are closed with `end` followed by their name:
+//!
+//! ```jinja
+//! {% cache "sidebar", 60 %}...{% endcache %}
+//! ```
+//!
+//! For more information see [`tags`](crate::tags).
+//!
+//! # Whitespace Control
+//!
+//! A minus sign at the start or end of a tag or expression (`{%-`, `-%}`,
+//! `{{-`, `-}}`) removes the whitespace before or after it.  When generating
+//! HTML this can break the contents of elements where whitespace matters.
+//! With [`Syntax::html_aware_whitespace`] enabled, whitespace in the contents
+//! of `<pre>`, `<textarea>` and `<script>` elements is always retained:
+//!
+//! ```rust
+//! # use minijinja::{Environment, syntax::Syntax};
+//! let mut env = Environment::new();
+//! env.add_template_with_syntax(
+//!     "snippet.html",
+//!     "<p>\n  {{- code -}}\n</p><pre>\n  {{- code -}}\n</pre>",
+//!     Syntax { html_aware_whitespace: true, ..Syntax::default() },
+//! ).unwrap();
+//! let tmpl = env.get_template("snippet.html").unwrap();
+//! let rv = tmpl.render(minijinja::context!(code => "x")).unwrap();
+//! assert_eq!(rv, "<p>x</p><pre>\n  x\n</pre>");
+//! ```
+//!
+//! # Custom Delimiters
+//!
+//! The delimiters used for tags, expressions and comments can be changed with
+//! a [`Syntax`] object.  This is useful if the templated files use the default
+//! delimiters for something else.  The syntax can be set for the entire
+//! environment with [`Environment::set_syntax`](crate::Environment::set_syntax)
+//! or for individual templates with
+//! [`Environment::add_template_with_syntax`](crate::Environment::add_template_with_syntax):
+//!
+//! ```rust
+//! # use minijinja::{Environment, syntax::Syntax};
+//! let mut env = Environment::new();
+//! env.add_template_with_syntax("config.yml", "name: ${{ name }}", Syntax {
+//!     variable_start: "${{".into(),
+//!     ..Syntax::default()
+//! }).unwrap();
+//! ```
+//!
+//! # Line Statements
+//!
+//! If a line statement prefix is configured on the [`Syntax`], lines starting
+//! with that prefix are treated as tags.  The prefix can be indented and a
+//! trailing colon is permitted which makes this very convenient for
+//! configuration files.  Statements continue on the next line if parentheses,
+//! brackets or braces are left open.  With a line comment prefix the rest of a
+//! line can be turned into a comment:
+//!
+//! ```jinja
+//! # for item in items:
+//!   # if item.enabled
+//! {{ item.name }} = {{ item.value }}   ## only enabled items
+//!   # endif
+//! # endfor
+//! ```
+//!
+//! The line statement (including the newline) is removed from the output,
+//! a line comment removes the comment and the whitespace in front of it but
+//! retains the newline.
+use std::borrow::Cow;
+
+use crate::error::{Error, ErrorKind};
+use crate::lexer::tokenize_raw;
+use crate::tokens::{Span, Token};
+
+/// The delimiters of the template syntax.
+///
+/// The default syntax uses `{% %}` for tags, `{{ }}` for expressions and
+/// `{# #}` for comments.  A syntax needs to pass [`validate`](Self::validate)
+/// before it can be used.
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct Syntax {
+    /// The start delimiter of tags (defaults to `{%`).
+    pub block_start: Cow<'static, str>,
+    /// The end delimiter of tags (defaults to `%}`).
+    pub block_end: Cow<'static, str>,
+    /// The start delimiter of expressions (defaults to `{{`).
+    pub variable_start: Cow<'static, str>,
+    /// The end delimiter of expressions (defaults to `}}`).
+    pub variable_end: Cow<'static, str>,
+    /// The start delimiter of comments (defaults to `{#`).
+    pub comment_start: Cow<'static, str>,
+    /// The end delimiter of comments (defaults to `#}`).
+    pub comment_end: Cow<'static, str>,
+    /// The prefix that marks a line as statement (disabled by default).
+    pub line_statement_prefix: Option<Cow<'static, str>>,
+    /// The prefix that starts a comment until the end of the line (disabled
+    /// by default).
+    pub line_comment_prefix: Option<Cow<'static, str>>,
+    /// Retains whitespace in the contents of `<pre>`, `<textarea>` and
+    /// `<script>` elements even if a tag or expression asks for it to be
+    /// removed (disabled by default).
+    pub html_aware_whitespace: bool,
+}
+
+impl Default for Syntax {
+    fn default() -> Syntax {
+        Syntax {
+            block_start: Cow::Borrowed("{%"),
+            block_end: Cow::Borrowed("%}"),
+            variable_start: Cow::Borrowed("{{"),
+            variable_end: Cow::Borrowed("}}"),
+            comment_start: Cow::Borrowed("{#"),
+            comment_end: Cow::Borrowed("#}"),
+            line_statement_prefix: None,
+            line_comment_prefix: None,
+            html_aware_whitespace: false,
+        }
+    }
+}
+
+impl Syntax {
+    /// Checks if the syntax is usable.
+    ///
+    /// All delimiters and prefixes must be non-empty, must not start or end
+    /// in whitespace and the three start delimiters as well as the two line
+    /// prefixes must be different from each other.
+    pub fn validate(&self) -> Result<(), Error> {
+        let delimiters = [
+            ("block_start", &self.block_start),
+            ("block_end", &self.block_end),
+            ("variable_start", &self.variable_start),
+            ("variable_end", &self.variable_end),
+            ("comment_start", &self.comment_start),
+            ("comment_end", &self.comment_end),
+        ];
+        let prefixes = [
+            ("line_statement_prefix", &self.line_statement_prefix),
+            ("line_comment_prefix", &self.line_comment_prefix),
+        ];
+        let all = delimiters.iter().copied().chain(
+            prefixes
+                .iter()
+                .filter_map(|&(name, prefix)| prefix.as_ref().map(|x| (name, x))),
+        );
+        for (name, delimiter) in all {
+            if delimiter.is_empty() {
+                return Err(Error::new(
+                    ErrorKind::InvalidSyntax,
+                    format!("delimiter {} must not be empty", name),
+                ));
+            }
+            if delimiter.trim() != delimiter {
+                return Err(Error::new(
+                    ErrorKind::InvalidSyntax,
+                    format!(
+                        "delimiter {} ({:?}) must not start or end with whitespace",
+                        name, delimiter
+                    ),
+                ));
+            }
+        }
+        let starts = [delimiters[0], delimiters[2], delimiters[4]];
+        for (idx, &(name, delimiter)) in starts.iter().enumerate() {
+            for &(other_name, other) in &starts[idx + 1..] {
+                if delimiter == other {
+                    return Err(Error::new(
+                        ErrorKind::InvalidSyntax,
+                        format!(
+                            "delimiters {} and {} overlap (both are {:?})",
+                            name, other_name, delimiter
+                        ),
+                    ));
+                }
+            }
+        }
+        if let (Some(statement), Some(comment)) =
+            (&self.line_statement_prefix, &self.line_comment_prefix)
+        {
+            if statement == comment {
+                return Err(Error::new(
+                    ErrorKind::InvalidSyntax,
+                    format!(
+                        "line_statement_prefix and line_comment_prefix overlap (both are {:?})",
+                        statement
+                    ),
+                ));
+            }
+        }
+        Ok(())
+    }
+}
+
+/// Tokenizes a template for tooling such as language servers.
+///
+/// The tokens cover the source exactly as written: template data is not
+/// changed by whitespace control and comments are retained as
+/// [`Token::Comment`].  Every token comes with a [`Span`] that carries
+/// lines, columns and byte offsets.  Use a [`LineIndex`] to map between
+/// them for positions that do not fall on a token.
+///
+/// The syntax is validated first.  If the lexer fails the error is the
+/// last item of the iterator.
+///
+/// ```
+/// # use minijinja::{syntax::{tokenize, Syntax}, Token};
+/// let tokens = tokenize("a {{ b }}", &Syntax::default())
+///     .unwrap()
+///     .collect::<Result<Vec<_>, _>>()
+///     .unwrap();
+/// assert_eq!(tokens[2].0, Token::Ident("b"));
+/// assert_eq!((tokens[2].1.start_offset, tokens[2].1.end_offset), (5, 6));
+/// ```
+pub fn tokenize<'source>(
+    source: &'source str,
+    syntax: &Syntax,
+) -> Result<impl Iterator<Item = Result<(Token<'source>, Span), Error>> + 'source, Error> {
+    syntax.validate()?;
+    Ok(tokenize_raw(source, false, syntax.clone(), true))
+}
+
+/// Maps between byte offsets and lines and columns of a source.
+///
+/// Lines start at 1 and columns at 0 and count characters, just like in a
+/// [`Span`].  This is independent of the syntax so it also works for
+/// positions within template data or comments.  Editors that count columns
+/// in UTF-16 code units (such as language server clients) can use
+/// [`position_utf16`](Self::position_utf16) and
+/// [`offset_utf16`](Self::offset_utf16) instead.
+///
+/// ```
+/// # use minijinja::syntax::LineIndex;
+/// let index = LineIndex::new("a\nbäc");
+/// assert_eq!(index.position(5), (2, 2));
+/// assert_eq!(index.offset(2, 2), 5);
+/// ```
+#[derive(Debug, Clone)]
+pub struct LineIndex<'source> {
+    source: &'source str,
+    line_starts: Vec<usize>,
+}
+
+impl<'source> LineIndex<'source> {
+    /// Creates an index for a source.
+    pub fn new(source: &'source str) -> LineIndex<'source> {
+        let line_starts = std::iter::once(0)
+            .chain(source.match_indices('\n').map(|(idx, _)| idx + 1))
+            .collect();
+        LineIndex {
+            source,
+            line_starts,
+        }
+    }
+
+    /// Returns the line and column of a byte offset.
+    ///
+    /// Offsets past the end of the source are clamped and offsets within a
+    /// character are moved to its start.
+    pub fn position(&self, offset: usize) -> (usize, usize) {
+        self.position_with(offset, |_| 1)
+    }
+
+    /// Like [`position`](Self::position) but the column counts UTF-16 code
+    /// units.
+    pub fn position_utf16(&self, offset: usize) -> (usize, usize) {
+        self.position_with(offset, char::len_utf16)
+    }
+
+    /// Returns the byte offset of a line and column.
+    ///
+    /// Columns past the end of a line are clamped to the end of the line
+    /// (before the line break) and lines past the end of the source map to
+    /// the end of the source.
+    pub fn offset(&self, line: usize, col: usize) -> usize {
+        self.offset_with(line, col, |_| 1)
+    }
+
+    /// Like [`offset`](Self::offset) but the column counts UTF-16 code
+    /// units.  A column within a surrogate pair maps to the start of the
+    /// character.
+    pub fn offset_utf16(&self, line: usize, col: usize) -> usize {
+        self.offset_with(line, col, char::len_utf16)
+    }
+
+    fn position_with(&self, offset: usize, width: fn(char) -> usize) -> (usize, usize) {
+        let mut offset = offset.min(self.source.len());
+        while !self.source.is_char_boundary(offset) {
+            offset -= 1;
+        }
+        let line = match self.line_starts.binary_search(&offset) {
+            Ok(idx) => idx,
+            Err(idx) => idx - 1,
+        };
+        let col = self.source[self.line_starts[line]..offset]
+            .chars()
+            .map(width)
+            .sum();
+        (line + 1, col)
+    }
+
+    fn offset_with(&self, line: usize, col: usize, width: fn(char) -> usize) -> usize {
+        let start = match self.line_starts.get(line.saturating_sub(1)) {
+            Some(&start) => start,
+            None => return self.source.len(),
+        };
+        let mut text = &self.source[start..];
+        if let Some(end) = text.find('\n') {
+            text = &text[..end];
+        }
+        if text.ends_with('\r') {
+            text = &text[..text.len() - 1];
+        }
+        let mut remaining = col;
+        for (idx, c) in text.char_indices() {
+            let width = width(c);
+            if remaining < width {
+                return start + idx;
+            }
+            remaining -= width;
+        }
+        start + text.len()
+    }
+}
+
+#[test]
+fn test_line_index() {
+    let index = LineIndex::new("ab\n\u{e4}{{ x }}\n");
+    assert_eq!(index.offset(1, 1), 1);
+    assert_eq!(index.offset(1, 10), 2);
+    assert_eq!(index.offset(2, 0), 3);
+    assert_eq!(index.offset(2, 1), 5);
+    assert_eq!(index.offset(2, 100), 12);
+    assert_eq!(index.offset(3, 0), 13);
+    assert_eq!(index.offset(4, 0), 13);
+    assert_eq!(index.position(0), (1, 0));
+    assert_eq!(index.position(3), (2, 0));
+    assert_eq!(index.position(4), (2, 0));
+    assert_eq!(index.position(5), (2, 1));
+    assert_eq!(index.position(100), (3, 0));
+
+    let index = LineIndex::new("a\r\nb");
+    assert_eq!(index.offset(1, 5), 1);
+    assert_eq!(index.offset(2, 5), 4);
+}
+
+#[test]
+fn test_line_index_utf16() {
+    let index = LineIndex::new("x\n\u{1f600}y");
+    assert_eq!(index.position_utf16(6), (2, 2));
+    assert_eq!(index.position(6), (2, 1));
+    assert_eq!(index.offset_utf16(2, 2), 6);
+    assert_eq!(index.offset_utf16(2, 1), 2);
+    assert_eq!(index.offset_utf16(2, 3), 7);
+    assert_eq!(index.offset(2, 1), 6);
+}
+
+#[test]
+fn test_tokenize_offsets() {
+    let syntax = Syntax {
+        variable_start: "${".into(),
+        variable_end: "}".into(),
+        ..Syntax::default()
+    };
+    let source = "\u{e4} ${ x.y }{# c #}";
+    let index = LineIndex::new(source);
+    for item in tokenize(source, &syntax).unwrap() {
+        let (_, span) = item.unwrap();
+        assert_eq!(
+            index.position(span.start_offset),
+            (span.start_line, span.start_col)
+        );
+        assert_eq!(
+            index.position(span.end_offset),
+            (span.end_line, span.end_col)
+        );
+    }
+    assert!(tokenize(
+        source,
+        &Syntax {
+            block_start: "".into(),
+            ..Syntax::default()
+        }
+    )
+    .is_err());
+}
+
+#[test]
+fn test_validate() {
+    assert!(Syntax::default().validate().is_ok());
+
+    let err = Syntax {
+        block_start: "".into(),
+        ..Syntax::default()
+    }
+    .validate()
+    .unwrap_err();
+    assert_eq!(
+        err.to_string(),
+        "invalid syntax: delimiter block_start must not be empty"
+    );
+
+    let err = Syntax {
+        comment_start: "{{".into(),
+        ..Syntax::default()
+    }
+    .validate()
+    .unwrap_err();
+    assert_eq!(
+        err.to_string(),
+        "invalid syntax: delimiters variable_start and comment_start overlap (both are \"{{\")"
+    );
+
+    let err = Syntax {
+        line_statement_prefix: Some("#".into()),
+        line_comment_prefix: Some("#".into()),
+        ..Syntax::default()
+    }
+    .validate()
+    .unwrap_err();
+    assert_eq!(
+        err.to_string(),
+        "invalid syntax: line_statement_prefix and line_comment_prefix overlap (both are \"#\")"
+    );
+}
 
 // this is just for docs
@@ -0,0 +1,348 @@
+//! Support for custom statement tags.
+//!
+//! Custom tags extend the template language with new statements.  A tag is
+//! registered on the environment with
+//! [`Environment::add_tag`](crate::Environment::add_tag) (usually from within
+//! an [`Extension`](crate::extensions::Extension)) and has to be registered
+//! before the templates that use it are loaded as tags are resolved when a
+//! template is parsed.
+//!
+//! A tag takes a comma separated list of expressions as arguments.  Tags
+//! with a body are closed with `end` followed by the name of the tag:
+//!
+//! ```jinja
+//! {% shout "!" %}hello {{ name }}{% endshout %}
+//! ```
+//!
+//! When the tag is rendered, [`Tag::enter`] is invoked with the evaluated
+//! arguments first.  If it returns a value, that value is emitted and the
+//! body is skipped entirely.  Otherwise the body is rendered and passed to
+//! [`Tag::render`] which returns the value to emit.  Values returned by the
+//! tag are auto escaped like the result of any other expression, so tags
+//! that return markup should mark it as safe.  The body is already escaped
+//! and marked as safe if auto escaping is enabled.
+//!
+//! ```rust
+//! # use minijinja::{Environment, Error, State};
+//! # use minijinja::value::Value;
+//! use minijinja::tags::Tag;
+//!
+//! struct Shout;
+//!
+//! impl Tag for Shout {
+//!     fn render(&self, _state: &State, args: &[Value], body: Option<Value>) -> Result<Value, Error> {
+//!         let suffix = args.get(0).map(|x| x.to_string()).unwrap_or_default();
+//!         Ok(Value::from(format!("{}{}", body.unwrap().to_string().to_uppercase(), suffix)))
+//!     }
+//! }
+//!
+//! let mut env = Environment::new();
+//! env.add_tag("shout", Shout);
+//! env.add_template("hello.txt", "{% shout '!' %}hello {{ name }}{% endshout %}").unwrap();
+//! let tmpl = env.get_template("hello.txt").unwrap();
+//! assert_eq!(tmpl.render(minijinja::context!(name => "world")).unwrap(), "HELLO WORLD!");
+//! ```
+use std::collections::HashMap;
+use std::fmt;
+use std::sync::Mutex;
+use std::time::{Duration, Instant};
+
+use crate::error::{Error, ErrorKind};
+use crate::value::{as_f64, Value};
+use crate::vm::State;
+
+/// A custom statement tag.
+pub trait Tag: Send + Sync {
+    /// Returns `true` if the tag has a body.
+    ///
+    /// The body of a tag ends with `end` followed by the tag name.  The
+    /// default implementation returns `true`.
+    fn has_body(&self) -> bool {
+        true
+    }
+
+    /// Invoked with the arguments of the tag before the body is rendered.
+    ///
+    /// If this returns a value, the value is emitted instead of invoking
+    /// [`render`](Self::render) and the body is not rendered.  The default
+    /// implementation returns `None`.
+    fn enter(&self, state: &State, args: &[Value]) -> Result<Option<Value>, Error> {
+        let _state = state;
+        let _args = args;
+        Ok(None)
+    }
+
+    /// Renders the tag.
+    ///
+    /// `body` is the rendered body for tags with a body and `None`
+    /// otherwise.  The returned value is emitted.
+    fn render(&self, state: &State, args: &[Value], body: Option<Value>) -> Result<Value, Error>;
+}
+
+/// A rendered fragment stored in a [`Cache`].
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct Fragment {
+    /// The rendered content.
+    pub content: String,
+    /// Indicates if the content was already escaped.
+    pub safe: bool,
+}
+
+/// A cache for rendered fragments used by [`CacheTag`].
+pub trait Cache: Send + Sync {
+    /// Looks up a fragment that was not expired yet.
+    fn get(&self, key: &str) -> Option<Fragment>;
+
+    /// Stores a fragment.
+    ///
+    /// If a time to live is given the fragment must no longer be returned
+    /// once it expired.
+    fn set(&self, key: &str, fragment: Fragment, ttl: Option<Duration>);
+}
+
+/// The longest time to live the cache tag accepts (about 136 years).
+const MAX_TTL_SECS: f64 = u32::MAX as f64;
+
+/// A simple [`Cache`] that keeps fragments in memory.
+///
+/// Expired fragments are removed when they are looked up.  The cache holds
+/// a limited number of fragments.  Once it is full, expired fragments are
+/// removed and if that does not free up space, the oldest fragment is
+/// evicted.
+pub struct MemoryCache {
+    fragments: Mutex<HashMap<String, CacheEntry>>,
+    capacity: usize,
+    next_seq: Mutex<u64>,
+}
+
+struct CacheEntry {
+    fragment: Fragment,
+    expires: Option<Instant>,
+    // the insertion order, the smallest entry is evicted first.
+    seq: u64,
+}
+
+impl Default for MemoryCache {
+    fn default() -> MemoryCache {
+        MemoryCache::with_capacity(1024)
+    }
+}
+
+impl MemoryCache {
+    /// Creates an empty cache that holds up to 1024 fragments.
+    pub fn new() -> MemoryCache {
+        MemoryCache::default()
+    }
+
+    /// Creates an empty cache that holds up to `capacity` fragments.
+    pub fn with_capacity(capacity: usize) -> MemoryCache {
+        MemoryCache {
+            fragments: Mutex::default(),
+            capacity,
+            next_seq: Mutex::new(0),
+        }
+    }
+
+    /// Removes all fragments from the cache.
+    pub fn clear(&self) {
+        self.fragments.lock().unwrap().clear();
+    }
+}
+
+impl fmt::Debug for MemoryCache {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        f.debug_struct("MemoryCache")
+            .field("len", &self.fragments.lock().unwrap().len())
+            .field("capacity", &self.capacity)
+            .finish()
+    }
+}
+
+impl Cache for MemoryCache {
+    fn get(&self, key: &str) -> Option<Fragment> {
+        let mut fragments = self.fragments.lock().unwrap();
+        match fragments.get(key) {
+            Some(entry) if entry.expires.map_or(false, |x| x <= Instant::now()) => {
+                fragments.remove(key);
+                None
+            }
+            Some(entry) => Some(entry.fragment.clone()),
+            None => None,
+        }
+    }
+
+    fn set(&self, key: &str, fragment: Fragment, ttl: Option<Duration>) {
+        if self.capacity == 0 {
+            return;
+        }
+        let now = Instant::now();
+        // a ttl too large to represent never expires
+        let expires = ttl.and_then(|ttl| now.checked_add(ttl));
+        let mut fragments = self.fragments.lock().unwrap();
+        if fragments.len() >= self.capacity && !fragments.contains_key(key) {
+            fragments.retain(|_, entry| entry.expires.map_or(true, |x| x > now));
+            if fragments.len() >= self.capacity {
+                let oldest = fragments
+                    .iter()
+                    .min_by_key(|(_, entry)| entry.seq)
+                    .map(|(key, _)| key.clone());
+                if let Some(oldest) = oldest {
+                    fragments.remove(&oldest);
+                }
+            }
+        }
+        let seq = {
+            let mut next_seq = self.next_seq.lock().unwrap();
+            *next_seq += 1;
+            *next_seq
+        };
+        fragments.insert(
+            key.to_string(),
+            CacheEntry {
+                fragment,
+                expires,
+                seq,
+            },
+        );
+    }
+}
+
+/// Implements the `{% cache %}` tag.
+///
+/// The tag caches the rendered body under a key and renders the body only if
+/// the cache does not have it.  The optional second argument is the time to
+/// live in seconds:
+///
+/// ```jinja
+/// {% cache "nav-" ~ user.id, 300 %}
+///   {% for item in expensive_navigation() %}...{% endfor %}
+/// {% endcache %}
+/// ```
+///
+/// Cached fragments remember if they were escaped, so cached HTML is not
+/// escaped a second time.  The tag is not registered by default:
+///
+/// ```rust
+/// # use minijinja::Environment;
+/// use minijinja::tags::{CacheTag, MemoryCache};
+///
+/// let mut env = Environment::new();
+/// env.add_tag("cache", CacheTag::new(MemoryCache::new()));
+/// ```
+pub struct CacheTag<C> {
+    cache: C,
+}
+
+impl<C: Cache> CacheTag<C> {
+    /// Creates a cache tag that is backed by the given cache.
+    pub fn new(cache: C) -> CacheTag<C> {
+        CacheTag { cache }
+    }
+
+    /// Returns the underlying cache.
+    pub fn cache(&self) -> &C {
+        &self.cache
+    }
+}
+
+impl<C: fmt::Debug> fmt::Debug for CacheTag<C> {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        f.debug_struct("CacheTag")
+            .field("cache", &self.cache)
+            .finish()
+    }
+}
+
+fn cache_key(args: &[Value]) -> Result<String, Error> {
+    match args.get(0) {
+        Some(key) if !key.is_undefined() && !key.is_none() => Ok(key.to_string()),
+        _ => Err(Error::new(
+            ErrorKind::InvalidArguments,
+            "cache tag requires a key",
+        )),
+    }
+}
+
+impl<C: Cache> Tag for CacheTag<C> {
+    fn enter(&self, _state: &State, args: &[Value]) -> Result<Option<Value>, Error> {
+        if args.len() > 2 {
+            return Err(Error::new(
+                ErrorKind::InvalidArguments,
+                "cache tag takes a key and an optional ttl",
+            ));
+        }
+        Ok(self.cache.get(&cache_key(args)?).map(|fragment| {
+            if fragment.safe {
+                Value::from_safe_string(fragment.content)
+            } else {
+                Value::from(fragment.content)
+            }
+        }))
+    }
+
+    fn render(&self, _state: &State, args: &[Value], body: Option<Value>) -> Result<Value, Error> {
+        let body = body.unwrap_or_default();
+        // byte output cannot be represented as fragment and is not cached
+        if let Some(content) = body.as_str() {
+            let ttl = match args.get(1) {
+                Some(ttl) if !ttl.is_none() => match as_f64(ttl) {
+                    Some(secs) if secs >= 0.0 && secs <= MAX_TTL_SECS => {
+                        Some(Duration::from_secs_f64(secs))
+                    }
+                    _ => {
+                        return Err(Error::new(
+                            ErrorKind::InvalidArguments,
+                            format!("cache ttl must be between 0 and {} seconds", MAX_TTL_SECS),
+                        ))
+                    }
+                },
+                _ => None,
+            };
+            let fragment = Fragment {
+                content: content.to_string(),
+                safe: body.is_safe(),
+            };
+            self.cache.set(&cache_key(args)?, fragment, ttl);
+        }
+        Ok(body)
+    }
+}
+
+#[test]
+fn test_memory_cache_expiry() {
+    let cache = MemoryCache::new();
+    let fragment = Fragment {
+        content: "hello".into(),
+        safe: false,
+    };
+    cache.set("a", fragment.clone(), None);
+    cache.set("b", fragment.clone(), Some(Duration::from_secs(0)));
+    cache.set("c", fragment.clone(), Some(Duration::from_secs(3600)));
+    assert_eq!(cache.get("a"), Some(fragment.clone()));
+    assert_eq!(cache.get("b"), None);
+    assert_eq!(cache.get("c"), Some(fragment.clone()));
+    cache.set("d", fragment.clone(), Some(Duration::from_secs(u64::MAX)));
+    assert_eq!(cache.get("d"), Some(fragment));
+    cache.clear();
+    assert_eq!(cache.get("a"), None);
+}
+
+#[test]
+fn test_memory_cache_capacity() {
+    let cache = MemoryCache::with_capacity(2);
+    let fragment = Fragment {
+        content: "hello".into(),
+        safe: false,
+    };
+    cache.set("a", fragment.clone(), None);
+    cache.set("b", fragment.clone(), Some(Duration::from_secs(0)));
+    cache.set("c", fragment.clone(), None);
+    // the expired fragment makes room
+    assert_eq!(cache.get("a"), Some(fragment.clone()));
+    cache.set("c", fragment.clone(), None);
+    cache.set("d", fragment.clone(), None);
+    // otherwise the oldest one is evicted
+    assert_eq!(cache.get("a"), None);
+    assert_eq!(cache.get("c"), Some(fragment.clone()));
+    assert_eq!(cache.get("d"), Some(fragment));
+}
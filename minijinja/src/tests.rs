@@ -155,6 +155,10 @@ mod builtins {
     }
 
     /// Checks if a value is defined.
+    ///
+    /// Attributes and items of undefined values can be checked as well,
+    /// `{{ user.name is defined }}` is false if `user` is undefined.  This
+    /// also applies to the `undefined` test.
     #[cfg_attr(docsrs, doc(cfg(feature = "builtins")))]
     pub fn is_defined(_state: &State, v: Value) -> Result<bool, Error> {
         Ok(!v.is_undefined())
@@ -203,13 +207,7 @@ mod builtins {
         }
 
         let env = crate::Environment::new();
-        let state = State {
-            env: &env,
-            ctx: crate::vm::Context::default(),
-            auto_escape: crate::AutoEscape::None,
-            current_block: None,
-            name: "<unknown>",
-        };
+        let state = env.new_state(());
         let bx = BoxedTest::new(test);
         assert!(bx
             .perform(&state, Value::from(23), vec![Value::from(23)])
@@ -6,6 +6,8 @@ use std::fmt;
 pub enum Token<'a> {
     /// Raw template data.
     TemplateData(&'a str),
+    /// The contents of a comment (only produced if comments are retained).
+    Comment(&'a str),
     /// Variable block start (with or without whitespace removal).
     VariableStart(bool),
     /// Variable block start (with or without whitespace removal).
@@ -80,6 +82,7 @@ impl<'a> fmt::Debug for Token<'a> {
     fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
         match self {
             Token::TemplateData(s) => write!(f, "TEMPLATE_DATA({:?})", s),
+            Token::Comment(s) => write!(f, "COMMENT({:?})", s),
             Token::VariableStart(ws) => write!(f, "VARIABLE_START({:?})", ws),
             Token::VariableEnd(ws) => write!(f, "VARIABLE_END({:?})", ws),
             Token::BlockStart(ws) => write!(f, "BLOCK_END({:?})", ws),
@@ -122,6 +125,7 @@ impl<'a> fmt::Display for Token<'a> {
     fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
         match self {
             Token::TemplateData(_) => write!(f, "template-data"),
+            Token::Comment(_) => write!(f, "comment"),
             Token::VariableStart(_) => write!(f, "start of variable block"),
             Token::VariableEnd(_) => write!(f, "end of variable block"),
             Token::BlockStart(_) => write!(f, "start of block"),
@@ -161,12 +165,17 @@ impl<'a> fmt::Display for Token<'a> {
 }
 
 /// Token span information
-#[derive(Clone, Copy, Default)]
+///
+/// Lines start at 1, columns at 0 and count characters.  The offsets are
+/// byte offsets into the tokenized source.
+#[derive(Clone, Copy, Default, PartialEq, Eq)]
 pub struct Span {
     pub start_line: usize,
     pub start_col: usize,
     pub end_line: usize,
     pub end_col: usize,
+    pub start_offset: usize,
+    pub end_offset: usize,
 }
 
 impl fmt::Debug for Span {
@@ -1,4 +1,6 @@
+use std::borrow::Cow;
 use std::char::decode_utf16;
+use std::cmp::Ordering;
 use std::collections::BTreeMap;
 use std::fmt;
 use std::iter::{once, repeat};
@@ -27,13 +29,157 @@ pub fn memstr(haystack: &[u8], needle: &[u8]) -> Option<usize> {
         .position(|window| window == needle)
 }
 
+/// Resolves a template name relative to the template referencing it.
+///
+/// Names starting with `./` or `../` are relative to the directory of
+/// `current`, all other names are returned unchanged.
+pub fn join_template_name<'a>(current: &str, name: &'a str) -> Result<Cow<'a, str>, Error> {
+    if !name.starts_with("./") && !name.starts_with("../") {
+        return Ok(Cow::Borrowed(name));
+    }
+    let mut parts: Vec<&str> = current.split('/').collect();
+    parts.pop();
+    for segment in name.split('/') {
+        match segment {
+            "" | "." => {}
+            ".." => {
+                if parts.pop().is_none() {
+                    return Err(Error::new(
+                        ErrorKind::InvalidOperation,
+                        format!(
+                            "template name {} is outside of the template root (relative to {})",
+                            name, current
+                        ),
+                    ));
+                }
+            }
+            segment => parts.push(segment),
+        }
+    }
+    Ok(Cow::Owned(parts.join("/")))
+}
+
 /// Controls the autoescaping behavior.
+///
+/// The enum is non exhaustive as some variants depend on crate features.
 #[derive(Debug, Copy, Clone, PartialEq, Eq)]
+#[non_exhaustive]
 pub enum AutoEscape {
     /// Do not apply auto escaping
     None,
     /// Use HTML auto escaping rules
     Html,
+    /// Write values as JSON that is safe to embed in HTML
+    ///
+    /// This is meant for `<script>` blocks: `{{ config }}` writes the value
+    /// as a JavaScript literal and characters that could end the script
+    /// block are escaped.  Safe strings are written unchanged.  This
+    /// requires the `json` feature.
+    #[cfg(feature = "json")]
+    Js,
+}
+
+/// Controls how the engine deals with undefined values.
+///
+/// Undefined values are for instance the result of looking up variables
+/// that do not exist in the context or missing attributes of objects.
+/// Testing for undefined values with `is defined` and replacing them with
+/// the `default` filter works with all behaviors.  This includes attributes
+/// and items of undefined values such as `user.name|default("anonymous")`.
+#[derive(Debug, Copy, Clone, PartialEq, Eq)]
+pub enum UndefinedBehavior {
+    /// Undefined values render as empty strings, iterate as empty sequences
+    /// and are false in boolean checks.  This is the default.
+    Lenient,
+    /// Like [`Strict`](Self::Strict) but undefined values can be checked in
+    /// `if` conditions and other boolean contexts where they are false.  This
+    /// is useful for templates that rely on `{% if var %}` for optional
+    /// variables while still catching typos in printed variables.
+    SemiStrict,
+    /// Printing or iterating over undefined values as well as using them in
+    /// boolean checks fails with an [`UndefinedError`](crate::ErrorKind::UndefinedError).
+    /// Concatenating them with `~` and checking for containment with `in`
+    /// counts as printing or iterating, and so does passing them to the
+    /// built-in filters that print or iterate over their input.  Custom
+    /// filters receive undefined values unchanged.  Taking the `length` of
+    /// an undefined value counts as a boolean check.
+    /// Additionally comparing values that cannot be ordered (eg: a string
+    /// with a number) with `<`, `<=`, `>` or `>=` fails instead of
+    /// evaluating to `false`.
+    Strict,
+}
+
+impl Default for UndefinedBehavior {
+    fn default() -> UndefinedBehavior {
+        UndefinedBehavior::Lenient
+    }
+}
+
+/// Controls how floating point numbers are written to the output.
+///
+/// This can be configured with
+/// [`Environment::set_float_format`](crate::Environment::set_float_format).
+#[derive(Debug, Copy, Clone, PartialEq, Eq)]
+pub enum FloatFormat {
+    /// Writes the shortest representation that reads back as the same
+    /// number and always with a decimal point (`1.0`, `0.1`, `1e20` is
+    /// written as `100000000000000000000.0`).  This is the default.
+    Default,
+    /// Writes floats like Python's `str` does and therefore like Jinja2.
+    ///
+    /// Very large and very small numbers use exponent notation (`1e+16`,
+    /// `1e-05`) and special values are written as `inf`, `-inf` and `nan`.
+    Python,
+    /// Writes floats with a fixed number of decimal places (`Fixed(2)`
+    /// writes `1.50`).
+    Fixed(usize),
+}
+
+impl Default for FloatFormat {
+    fn default() -> FloatFormat {
+        FloatFormat::Default
+    }
+}
+
+/// Formats a float according to the given format.
+pub fn format_float(value: f64, format: FloatFormat) -> String {
+    if value.is_nan() {
+        if format != FloatFormat::Default {
+            return "nan".into();
+        }
+    } else if value.is_infinite() && format != FloatFormat::Default {
+        return if value > 0.0 { "inf" } else { "-inf" }.into();
+    }
+    match format {
+        FloatFormat::Default => {
+            let mut rv = value.to_string();
+            if !rv.contains('.') {
+                rv.push_str(".0");
+            }
+            rv
+        }
+        FloatFormat::Python => {
+            // the shortest digits that round-trip, as mantissa and exponent
+            let exp_repr = format!("{:e}", value);
+            let (mantissa, exp) = exp_repr.split_at(exp_repr.find('e').unwrap());
+            let exp: i32 = exp[1..].parse().unwrap();
+            if (-4..16).contains(&exp) {
+                let mut rv = value.to_string();
+                if !rv.contains('.') {
+                    rv.push_str(".0");
+                }
+                rv
+            } else {
+                format!(
+                    "{}e{}{:02}",
+                    mantissa,
+                    if exp < 0 { '-' } else { '+' },
+                    exp.abs()
+                )
+            }
+        }
+        FloatFormat::Fixed(precision) => format!("{:.*}", precision, value),
+    }
 }
 
 /// Helper to HTML escape a string.
@@ -45,43 +191,138 @@ impl<'a> fmt::Display for HtmlEscape<'a> {
         {
             fmt::Display::fmt(&v_htmlescape::escape(self.0), f)
         }
-        // this is taken from askama-escape
         #[cfg(not(feature = "v_htmlescape"))]
         {
             let bytes = self.0.as_bytes();
+            let first = match find_html_escape(bytes) {
+                Some(idx) => idx,
+                None => return f.write_str(self.0),
+            };
+            // once there is something to escape, escaped characters tend to
+            // be close together so a plain loop over the rest is faster.
             let mut start = 0;
-
-            for (i, b) in bytes.iter().enumerate() {
-                macro_rules! escaping_body {
-                    ($quote:expr) => {{
-                        if start < i {
-                            f.write_str(unsafe {
-                                std::str::from_utf8_unchecked(&bytes[start..i])
-                            })?;
-                        }
-                        f.write_str($quote)?;
-                        start = i + 1;
-                    }};
-                }
-                if b.wrapping_sub(b'"') <= b'>' - b'"' {
-                    match *b {
-                        b'<' => escaping_body!("&lt;"),
-                        b'>' => escaping_body!("&gt;"),
-                        b'&' => escaping_body!("&amp;"),
-                        b'"' => escaping_body!("&quot;"),
-                        b'\'' => escaping_body!("&#x27;"),
-                        b'/' => escaping_body!("&#x2f;"),
-                        _ => (),
+            for (idx, b) in bytes.iter().enumerate().skip(first) {
+                if let Some(quoted) = html_escape_for(*b) {
+                    if start < idx {
+                        // escaped characters are ascii, so these are char boundaries
+                        f.write_str(unsafe { std::str::from_utf8_unchecked(&bytes[start..idx]) })?;
                     }
+                    f.write_str(quoted)?;
+                    start = idx + 1;
                 }
             }
+            f.write_str(unsafe { std::str::from_utf8_unchecked(&bytes[start..]) })
+        }
+    }
+}
 
-            if start < bytes.len() {
-                f.write_str(unsafe { std::str::from_utf8_unchecked(&bytes[start..]) })
-            } else {
-                Ok(())
+/// Returns the HTML escaped replacement of a byte if it needs escaping.
+#[inline(always)]
+pub(crate) fn html_escape_for(b: u8) -> Option<&'static str> {
+    // all escaped characters are in this range, checking it first keeps
+    // the common case of characters that are not escaped fast.
+    if b.wrapping_sub(b'"') > b'>' - b'"' {
+        return None;
+    }
+    match b {
+        b'<' => Some("&lt;"),
+        b'>' => Some("&gt;"),
+        b'&' => Some("&amp;"),
+        b'"' => Some("&quot;"),
+        b'\'' => Some("&#x27;"),
+        b'/' => Some("&#x2f;"),
+        _ => None,
+    }
+}
+
+/// Returns true if any byte of the word is one of the escaped characters.
+///
+/// This checks all eight bytes at once: `x ^ splat(c)` has a zero byte
+/// where `x` has the byte `c`, and `(v - 0x01..) & !v & 0x80..` is non-zero
+/// if and only if `v` has a zero byte.
+#[inline(always)]
+fn word_needs_html_escape(x: u64) -> bool {
+    const LO: u64 = 0x0101_0101_0101_0101;
+    const HI: u64 = 0x8080_8080_8080_8080;
+    #[inline(always)]
+    fn has_zero_byte(v: u64) -> bool {
+        v.wrapping_sub(LO) & !v & HI != 0
+    }
+    has_zero_byte(x ^ (LO * b'<' as u64))
+        || has_zero_byte(x ^ (LO * b'>' as u64))
+        || has_zero_byte(x ^ (LO * b'&' as u64))
+        || has_zero_byte(x ^ (LO * b'"' as u64))
+        || has_zero_byte(x ^ (LO * b'\'' as u64))
+        || has_zero_byte(x ^ (LO * b'/' as u64))
+}
+
+/// Returns the index of the first byte that needs HTML escaping.
+///
+/// Text without special characters is skipped eight bytes at a time, so
+/// checking that nothing needs escaping is cheap.
+pub(crate) fn find_html_escape(bytes: &[u8]) -> Option<usize> {
+    let mut offset = 0;
+    let mut chunks = bytes.chunks_exact(8);
+    for chunk in &mut chunks {
+        let mut word = [0; 8];
+        word.copy_from_slice(chunk);
+        if word_needs_html_escape(u64::from_ne_bytes(word)) {
+            break;
+        }
+        offset += 8;
+    }
+    bytes[offset..]
+        .iter()
+        .position(|b| html_escape_for(*b).is_some())
+        .map(|idx| offset + idx)
+}
+
+/// Helper to escape a string for use in a JavaScript string literal.
+///
+/// Besides quotes and backslashes this escapes the characters that are
+/// significant in HTML (so that `</script>` cannot end a script block),
+/// control characters and the line and paragraph separators which older
+/// JavaScript engines do not accept in string literals.
+#[cfg(feature = "builtins")]
+pub(crate) struct JsEscape<'a>(pub &'a str);
+
+#[cfg(feature = "builtins")]
+impl<'a> fmt::Display for JsEscape<'a> {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        use std::fmt::Write;
+        for c in self.0.chars() {
+            match c {
+                '\\' | '"' | '\'' | '`' | '<' | '>' | '&' | '=' | '-' | ';' | '\u{2028}'
+                | '\u{2029}' => write!(f, "\\u{:04x}", c as u32)?,
+                c if (c as u32) < 0x20 => write!(f, "\\u{:04x}", c as u32)?,
+                c => f.write_char(c)?,
+            }
+        }
+        Ok(())
+    }
+}
+
+/// Helper to make serialized JSON safe for embedding in HTML.
+///
+/// This escapes the characters that are significant in HTML as well as the
+/// line and paragraph separators.  These can only appear in strings in JSON
+/// so the result is still valid JSON and a valid JavaScript literal.
+#[cfg(feature = "json")]
+pub(crate) struct ScriptSafeJson<'a>(pub &'a str);
+
+#[cfg(feature = "json")]
+impl<'a> fmt::Display for ScriptSafeJson<'a> {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        use std::fmt::Write;
+        for c in self.0.chars() {
+            match c {
+                '<' | '>' | '&' | '\'' | '\u{2028}' | '\u{2029}' => {
+                    write!(f, "\\u{:04x}", c as u32)?
+                }
+                c => f.write_char(c)?,
             }
         }
+        Ok(())
     }
 }
 
@@ -167,6 +408,227 @@ pub fn unescape(s: &str) -> Result<String, Error> {
     .unescape(s)
 }
 
+/// Returns the length of the HTML entity at the start of the string.
+///
+/// This accepts named (`&amp;`), decimal (`&#39;`) and hexadecimal
+/// (`&#x27;`) character references that are terminated with a semicolon.
+fn html_entity_len(s: &str) -> Option<usize> {
+    let bytes = s.as_bytes();
+    if bytes.first() != Some(&b'&') {
+        return None;
+    }
+    let (start, max_len, valid): (usize, usize, fn(&u8) -> bool) = match bytes.get(1) {
+        Some(b'#') => match bytes.get(2) {
+            Some(b'x') | Some(b'X') => (3, 6, u8::is_ascii_hexdigit),
+            _ => (2, 7, u8::is_ascii_digit),
+        },
+        Some(c) if c.is_ascii_alphabetic() => (1, 32, u8::is_ascii_alphanumeric),
+        _ => return None,
+    };
+    let len = bytes[start..].iter().take_while(|x| valid(*x)).count();
+    if len == 0 || len > max_len || bytes.get(start + len) != Some(&b';') {
+        return None;
+    }
+    Some(start + len + 1)
+}
+
+/// Helper to HTML escape a string without escaping existing entities.
+///
+/// This works like [`HtmlEscape`] but character references that are
+/// already in the string (eg: `&amp;`) are left alone so that pre-escaped
+/// input does not end up double escaped.
+pub(crate) struct HtmlEscapeKeepEntities<'a>(pub &'a str);
+
+impl<'a> fmt::Display for HtmlEscapeKeepEntities<'a> {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        let mut rest = self.0;
+        while let Some(idx) = rest.find('&') {
+            fmt::Display::fmt(&HtmlEscape(&rest[..idx]), f)?;
+            rest = &rest[idx..];
+            match html_entity_len(rest) {
+                Some(len) => {
+                    f.write_str(&rest[..len])?;
+                    rest = &rest[len..];
+                }
+                None => {
+                    f.write_str("&amp;")?;
+                    rest = &rest[1..];
+                }
+            }
+        }
+        fmt::Display::fmt(&HtmlEscape(rest), f)
+    }
+}
+
+/// Matches a string against a simple glob pattern.
+///
+/// `*` matches any number of characters and `?` matches exactly one.
+#[cfg_attr(not(any(feature = "threads", feature = "builtins")), allow(dead_code))]
+pub fn glob_match(pattern: &str, s: &str) -> bool {
+    let pattern = pattern.chars().collect::<Vec<_>>();
+    let s = s.chars().collect::<Vec<_>>();
+    let (mut p, mut i) = (0, 0);
+    let mut backtrack = None;
+    while i < s.len() {
+        match pattern.get(p) {
+            Some('*') => {
+                backtrack = Some((p, i));
+                p += 1;
+            }
+            Some(&c) if c == '?' || c == s[i] => {
+                p += 1;
+                i += 1;
+            }
+            _ => match backtrack {
+                Some((star_p, star_i)) => {
+                    p = star_p + 1;
+                    i = star_i + 1;
+                    backtrack = Some((star_p, star_i + 1));
+                }
+                None => return false,
+            },
+        }
+    }
+    pattern[p..].iter().all(|&c| c == '*')
+}
+
+/// Calls `f` for every index below `count` on up to `threads` threads.
+///
+/// The calling thread takes part in the work so that progress is made even
+/// if no thread can be spawned.  The results are returned in index order.
+/// A panic in `f` is resumed once all threads finished.
+#[cfg(feature = "threads")]
+pub fn run_concurrently<T, F>(count: usize, threads: usize, f: F) -> Vec<T>
+where
+    T: Send,
+    F: Fn(usize) -> T + Sync,
+{
+    use std::sync::atomic::{AtomicUsize, Ordering};
+
+    let next = AtomicUsize::new(0);
+    let work = || {
+        let mut rv = Vec::new();
+        loop {
+            let idx = next.fetch_add(1, Ordering::Relaxed);
+            if idx >= count {
+                break rv;
+            }
+            rv.push((idx, f(idx)));
+        }
+    };
+    let mut results = std::thread::scope(|scope| {
+        let handles = (1..threads.min(count))
+            .map_while(|_| std::thread::Builder::new().spawn_scoped(scope, work).ok())
+            .collect::<Vec<_>>();
+        let mut results = work();
+        let mut panic = None;
+        for handle in handles {
+            match handle.join() {
+                Ok(rv) => results.extend(rv),
+                Err(payload) => panic = Some(payload),
+            }
+        }
+        if let Some(payload) = panic {
+            std::panic::resume_unwind(payload);
+        }
+        results
+    });
+    results.sort_by_key(|x| x.0);
+    results.into_iter().map(|x| x.1).collect()
+}
+
+/// Matches a `/` separated path against a glob pattern.
+///
+/// Each component is matched with [`glob_match`] so `*` does not cross
+/// directories.  A `**` component matches any number of components.
+#[cfg_attr(not(feature = "builtins"), allow(dead_code))]
+pub fn glob_match_path(pattern: &str, path: &str) -> bool {
+    fn matches_components(pattern: &[&str], path: &[&str]) -> bool {
+        match pattern.split_first() {
+            None => path.is_empty(),
+            Some((&"**", rest)) => {
+                (0..=path.len()).any(|idx| matches_components(rest, &path[idx..]))
+            }
+            Some((component_pattern, rest)) => match path.split_first() {
+                Some((component, path_rest)) => {
+                    glob_match(component_pattern, component) && matches_components(rest, path_rest)
+                }
+                None => false,
+            },
+        }
+    }
+    matches_components(
+        &pattern.split('/').collect::<Vec<_>>(),
+        &path.split('/').collect::<Vec<_>>(),
+    )
+}
+
+/// Compares two strings in natural order.
+///
+/// Runs of ASCII digits are compared by their numeric value so that `item2`
+/// sorts before `item10`.  Everything else is compared character by
+/// character.
+#[cfg_attr(not(feature = "builtins"), allow(dead_code))]
+pub fn natural_cmp(a: &str, b: &str) -> Ordering {
+    fn split_digits(s: &str) -> (&str, &str) {
+        s.split_at(s.find(|c: char| !c.is_ascii_digit()).unwrap_or(s.len()))
+    }
+
+    let (mut a, mut b) = (a, b);
+    loop {
+        match (a.chars().next(), b.chars().next()) {
+            (None, None) => return Ordering::Equal,
+            (None, Some(_)) => return Ordering::Less,
+            (Some(_), None) => return Ordering::Greater,
+            (Some(x), Some(y)) if x.is_ascii_digit() && y.is_ascii_digit() => {
+                let (a_num, a_rest) = split_digits(a);
+                let (b_num, b_rest) = split_digits(b);
+                let a_trimmed = a_num.trim_start_matches('0');
+                let b_trimmed = b_num.trim_start_matches('0');
+                // numbers without leading zeroes compare by length first,
+                // leading zeroes only break ties (`1` before `01`).
+                let ordering = a_trimmed
+                    .len()
+                    .cmp(&b_trimmed.len())
+                    .then_with(|| a_trimmed.cmp(b_trimmed))
+                    .then_with(|| a_num.len().cmp(&b_num.len()));
+                if ordering != Ordering::Equal {
+                    return ordering;
+                }
+                a = a_rest;
+                b = b_rest;
+            }
+            (Some(x), Some(y)) => {
+                if x != y {
+                    return x.cmp(&y);
+                }
+                a = &a[x.len_utf8()..];
+                b = &b[y.len_utf8()..];
+            }
+        }
+    }
+}
+
+/// Fills a buffer with random bytes.
+///
+/// The bytes are derived from the randomly keyed hashers of the standard
+/// library so they are unpredictable enough for identifiers but this is not
+/// a cryptographically secure random number generator.
+pub fn fill_random(buf: &mut [u8]) {
+    use std::collections::hash_map::RandomState;
+    use std::hash::{BuildHasher, Hasher};
+    use std::sync::atomic::{AtomicUsize, Ordering};
+
+    static COUNTER: AtomicUsize = AtomicUsize::new(0);
+
+    for chunk in buf.chunks_mut(8) {
+        let mut hasher = RandomState::new().build_hasher();
+        hasher.write_usize(COUNTER.fetch_add(1, Ordering::Relaxed));
+        let bytes = hasher.finish().to_le_bytes();
+        chunk.copy_from_slice(&bytes[..chunk.len()]);
+    }
+}
+
 pub struct BTreeMapKeysDebug<'a, K: fmt::Debug, V>(pub &'a BTreeMap<K, V>);
 
 impl<'a, K: fmt::Debug, V> fmt::Debug for BTreeMapKeysDebug<'a, K, V> {
@@ -194,6 +656,58 @@ fn test_html_escape() {
     let input = "<>&\"'/";
     let output = HtmlEscape(input).to_string();
     assert_eq!(output, "&lt;&gt;&amp;&quot;&#x27;&#x2f;");
+    let input = "a longer string with <b>tags</b> and ümläuts & more";
+    let output = HtmlEscape(input).to_string();
+    assert_eq!(
+        output,
+        "a longer string with &lt;b&gt;tags&lt;&#x2f;b&gt; and ümläuts &amp; more"
+    );
+}
+
+#[test]
+fn test_find_html_escape() {
+    assert_eq!(find_html_escape(b""), None);
+    assert_eq!(find_html_escape(b"hello world, 1+2=3 #!"), None);
+    for special in b"<>&\"'/" {
+        for pos in 0..20 {
+            let mut input = vec![b'x'; 20];
+            input[pos] = *special;
+            assert_eq!(find_html_escape(&input), Some(pos));
+        }
+    }
+    // bytes that are off by one from the escaped ones
+    assert_eq!(find_html_escape(b";=?%(.0\xbc\xa6\xa2"), None);
+}
+
+#[test]
+fn test_html_escape_keep_entities() {
+    let input = "a &amp; b &#39; &#x27; &copy; & c &#; &#xZZ; &foo <&amp>";
+    let output = HtmlEscapeKeepEntities(input).to_string();
+    assert_eq!(
+        output,
+        "a &amp; b &#39; &#x27; &copy; &amp; c &amp;#; &amp;#xZZ; &amp;foo &lt;&amp;amp&gt;"
+    );
+}
+
+#[test]
+fn test_join_template_name() {
+    assert_eq!(join_template_name("a/b.html", "c.html").unwrap(), "c.html");
+    assert_eq!(
+        join_template_name("a/b.html", "./c.html").unwrap(),
+        "a/c.html"
+    );
+    assert_eq!(
+        join_template_name("a/b/c.html", "../d/./e.html").unwrap(),
+        "a/d/e.html"
+    );
+    assert_eq!(join_template_name("b.html", "./c.html").unwrap(), "c.html");
+    assert_eq!(
+        join_template_name("a/b.html", "../../c.html")
+            .unwrap_err()
+            .to_string(),
+        "invalid operation: template name ../../c.html is outside of the \
+         template root (relative to a/b.html)"
+    );
 }
 
 #[test]
@@ -203,3 +717,74 @@ fn test_unescape() {
     assert_eq!(unescape("foobarbaz").unwrap(), "foobarbaz");
     assert_eq!(unescape(r"\ud83d\udca9").unwrap(), "💩");
 }
+
+#[test]
+fn test_glob_match() {
+    assert!(glob_match("_*", "_header.html"));
+    assert!(!glob_match("_*", "header.html"));
+    assert!(glob_match("*.html", "index.html"));
+    assert!(glob_match("a*b*c", "aXXbYYc"));
+    assert!(!glob_match("a*b*c", "aXXbYY"));
+    assert!(glob_match("?.txt", "a.txt"));
+    assert!(glob_match("*", ""));
+}
+
+#[test]
+#[cfg(feature = "threads")]
+fn test_run_concurrently() {
+    let rv = run_concurrently(100, 4, |idx| idx * 2);
+    assert_eq!(rv, (0..100).map(|x| x * 2).collect::<Vec<_>>());
+    assert_eq!(run_concurrently(3, 0, |idx| idx), vec![0, 1, 2]);
+    assert!(run_concurrently(0, 4, |idx| idx).is_empty());
+}
+
+#[test]
+fn test_glob_match_path() {
+    assert!(glob_match_path("partials/*.html", "partials/nav.html"));
+    assert!(!glob_match_path("partials/*.html", "partials/sub/nav.html"));
+    assert!(!glob_match_path("partials/*.html", "nav.html"));
+    assert!(glob_match_path("partials/**/*.html", "partials/nav.html"));
+    assert!(glob_match_path(
+        "partials/**/*.html",
+        "partials/a/b/nav.html"
+    ));
+    assert!(glob_match_path("**", "a/b"));
+    assert!(!glob_match_path("*", "a/b"));
+}
+
+#[test]
+fn test_format_float() {
+    let python = |x| format_float(x, FloatFormat::Python);
+    assert_eq!(python(1.0), "1.0");
+    assert_eq!(python(0.1), "0.1");
+    assert_eq!(python(-2.5), "-2.5");
+    assert_eq!(python(1e15), "1000000000000000.0");
+    assert_eq!(python(1e16), "1e+16");
+    assert_eq!(python(1.5e300), "1.5e+300");
+    assert_eq!(python(0.0001), "0.0001");
+    assert_eq!(python(0.00001), "1e-05");
+    assert_eq!(python(-1.25e-7), "-1.25e-07");
+    assert_eq!(python(f64::INFINITY), "inf");
+    assert_eq!(python(f64::NEG_INFINITY), "-inf");
+    assert_eq!(python(f64::NAN), "nan");
+    assert_eq!(
+        format_float(1e16, FloatFormat::Default),
+        "10000000000000000.0"
+    );
+    assert_eq!(format_float(1.5, FloatFormat::Fixed(2)), "1.50");
+    assert_eq!(format_float(2.0 / 3.0, FloatFormat::Fixed(0)), "1");
+}
+
+#[test]
+fn test_natural_cmp() {
+    let mut items = vec![
+        "item10", "item2", "item1", "item01", "a", "item", "v1.10", "v1.9",
+    ];
+    items.sort_by(|a, b| natural_cmp(a, b));
+    assert_eq!(
+        items,
+        vec!["a", "item", "item1", "item01", "item2", "item10", "v1.9", "v1.10"]
+    );
+    assert_eq!(natural_cmp("x007", "x7"), Ordering::Greater);
+    assert_eq!(natural_cmp("abc", "abc"), Ordering::Equal);
+}
@@ -36,6 +36,22 @@
 //! let v = u64::try_from(Value::from(42)).unwrap();
 //! ```
 //!
+//! For more complex types (such as an options map passed to a function) a
+//! value can be deserialized with [`serde`] unless the `deserialization`
+//! feature is disabled:
+//!
+//! ```
+//! # #[cfg(feature = "deserialization")] {
+//! # use std::collections::BTreeMap;
+//! # use minijinja::value::Value;
+//! use serde::Deserialize;
+//! let value = Value::from_serializable(&[("width", 4), ("height", 2)]
+//!     .iter().cloned().collect::<BTreeMap<_, _>>());
+//! let size = BTreeMap::<String, u32>::deserialize(value).unwrap();
+//! assert_eq!(size["width"], 4);
+//! # }
+//! ```
+//!
 //! # Value Function Arguments
 //!
 //! [Filters](crate::filters) and [tests](crate::tests) can take values as arguments
@@ -76,11 +92,14 @@ use std::sync::atomic::{self, AtomicBool, AtomicUsize};
 
 use serde::ser::{self, Serialize, Serializer};
 
+use crate::datetime;
 use crate::error::{Error, ErrorKind};
 use crate::key::{Key, KeySerializer};
-use crate::utils::{matches, OnDrop};
+use crate::utils::{format_float, matches, FloatFormat, OnDrop};
 use crate::vm::State;
 
+pub use crate::datetime::{DateTime, Duration};
+
 #[cfg(feature = "sync")]
 pub(crate) type RcType<T> = std::sync::Arc<T>;
 
@@ -97,6 +116,24 @@ pub(crate) type ValueMap<K, V> = indexmap::IndexMap<K, V>;
 #[cfg(not(feature = "preserve_order"))]
 pub(crate) type ValueMap<K, V> = std::collections::BTreeMap<K, V>;
 
+/// Creates a map that can hold at least `capacity` items without reallocating.
+///
+/// Struct serialization passes exact field counts which means that with
+/// `preserve_order` the map for a struct is allocated exactly once.  B-trees
+/// cannot preallocate so the hint is ignored otherwise.
+#[inline(always)]
+fn value_map_with_capacity<K: Ord + std::hash::Hash, V>(capacity: usize) -> ValueMap<K, V> {
+    #[cfg(feature = "preserve_order")]
+    {
+        ValueMap::with_capacity(capacity)
+    }
+    #[cfg(not(feature = "preserve_order"))]
+    {
+        let _capacity = capacity;
+        ValueMap::new()
+    }
+}
+
 thread_local! {
     static INTERNAL_SERIALIZATION: AtomicBool = AtomicBool::new(false);
     static LAST_VALUE_HANDLE: AtomicUsize = AtomicUsize::new(0);
@@ -123,6 +160,51 @@ pub fn serializing_for_value() -> bool {
     INTERNAL_SERIALIZATION.with(|flag| flag.load(atomic::Ordering::Relaxed))
 }
 
+/// Merges multiple maps into a single map value.
+///
+/// This is the way to compose template contexts: maps later in the
+/// iterator override the keys of earlier ones, so the typical use is to
+/// pass the defaults first and the overrides last.  Dynamic objects
+/// contribute their [`attributes`](Object::attributes), values that are
+/// not maps (including undefined and none) are skipped.  The values
+/// themselves are not touched, so values created with
+/// [`Value::from_lazy`] stay lazy until a template uses them.
+///
+/// ```
+/// # use minijinja::{context, value::merge_maps};
+/// let base = context!(title => "Untitled", lang => "en");
+/// let ctx = merge_maps(vec![base, context!(title => "Hello")]);
+/// assert_eq!(ctx.get_attr("title").unwrap().as_str(), Some("Hello"));
+/// assert_eq!(ctx.get_attr("lang").unwrap().as_str(), Some("en"));
+/// ```
+///
+/// The [`context!`](crate::context) macro supports the same with a
+/// `..base` spread syntax.
+pub fn merge_maps<I, V>(iter: I) -> Value
+where
+    I: IntoIterator<Item = V>,
+    V: Into<Value>,
+{
+    let mut rv = ValueMap::new();
+    for value in iter {
+        let value = value.into();
+        match value.0 {
+            ValueRepr::Map(ref map) => {
+                for (key, value) in map.iter() {
+                    rv.insert(key.clone(), value.clone());
+                }
+            }
+            ValueRepr::Dynamic(_) => {
+                for (key, value) in value.iter_as_str_map() {
+                    rv.insert(Key::String(RcType::new(key.to_string())), value);
+                }
+            }
+            _ => {}
+        }
+    }
+    ValueRepr::Map(RcType::new(rv)).into()
+}
+
 /// Enables a temporary code section within which some value
 /// optimizations are enabled.  Currently this is exclusively
 /// used to automatically intern keys when the `key_interning`
@@ -279,6 +361,7 @@ impl fmt::Debug for ValueRepr {
             ValueRepr::Bytes(val) => fmt::Debug::fmt(val, f),
             ValueRepr::Seq(val) => fmt::Debug::fmt(val, f),
             ValueRepr::Map(val) => fmt::Debug::fmt(val, f),
+            ValueRepr::Dynamic(val) if val.is_secret() => fmt::Debug::fmt(SECRET_MASK, f),
             ValueRepr::Dynamic(val) => fmt::Debug::fmt(val, f),
         }
     }
@@ -288,18 +371,37 @@ impl fmt::Debug for ValueRepr {
 #[derive(Clone)]
 pub struct Value(pub(crate) ValueRepr);
 
+// Values compare according to the following rules:
+//
+// - numbers (including bools) compare by their numeric value.  Integers
+//   are compared exactly, if a float is involved both sides are compared
+//   as floats.
+// - strings, safe strings and chars are ordered by their contents.
+//   Strings and safe strings never compare equal however.
+// - bytes are compared to other bytes, sequences are compared
+//   lexicographically and maps are only compared for equality.
+// - `none` and `undefined` are only equal to themselves.
+// - dynamic objects can define the comparison through
+//   `Object::eq_value` and `Object::cmp_value`.  Otherwise they are only
+//   equal to themselves.
+//
+// All other combinations are not equal and not ordered.
+
 impl PartialEq for Value {
     fn eq(&self, other: &Self) -> bool {
         match (&self.0, &other.0) {
+            (ValueRepr::Undefined, ValueRepr::Undefined) => true,
             (ValueRepr::None, ValueRepr::None) => true,
             (ValueRepr::String(a), ValueRepr::String(b))
             | (ValueRepr::SafeString(a), ValueRepr::SafeString(b)) => a == b,
+            (ValueRepr::Char(a), ValueRepr::Char(b)) => a == b,
+            (ValueRepr::Char(_), ValueRepr::String(_))
+            | (ValueRepr::String(_), ValueRepr::Char(_)) => as_cmp_str(self) == as_cmp_str(other),
             (ValueRepr::Bytes(a), ValueRepr::Bytes(b)) => a == b,
-            _ => match coerce(self, other) {
-                Some(CoerceResult::F64(a, b)) => a == b,
-                Some(CoerceResult::I128(a, b)) => a == b,
-                None => false,
-            },
+            (ValueRepr::Seq(a), ValueRepr::Seq(b)) => a == b,
+            (ValueRepr::Map(a), ValueRepr::Map(b)) => a == b,
+            (ValueRepr::Dynamic(_), _) | (_, ValueRepr::Dynamic(_)) => eq_objects(self, other),
+            _ => cmp_numbers(self, other) == Some(Ordering::Equal),
         }
     }
 }
@@ -309,19 +411,81 @@ impl Eq for Value {}
 impl PartialOrd for Value {
     fn partial_cmp(&self, other: &Self) -> Option<Ordering> {
         match (&self.0, &other.0) {
+            (ValueRepr::Undefined, ValueRepr::Undefined) => Some(Ordering::Equal),
             (ValueRepr::None, ValueRepr::None) => Some(Ordering::Equal),
-            (ValueRepr::String(a), ValueRepr::String(b))
-            | (ValueRepr::SafeString(a), ValueRepr::SafeString(b)) => a.partial_cmp(b),
             (ValueRepr::Bytes(a), ValueRepr::Bytes(b)) => a.partial_cmp(b),
-            _ => match coerce(self, other) {
-                Some(CoerceResult::F64(a, b)) => a.partial_cmp(&b),
-                Some(CoerceResult::I128(a, b)) => a.partial_cmp(&b),
-                None => None,
+            (ValueRepr::Seq(a), ValueRepr::Seq(b)) => a.iter().partial_cmp(b.iter()),
+            (ValueRepr::Dynamic(a), _) => a
+                .cmp_value(other)
+                .or_else(|| match other.0 {
+                    ValueRepr::Dynamic(ref b) => b.cmp_value(self).map(Ordering::reverse),
+                    _ => None,
+                })
+                .or_else(|| {
+                    if self == other {
+                        Some(Ordering::Equal)
+                    } else {
+                        None
+                    }
+                }),
+            (_, ValueRepr::Dynamic(b)) => b.cmp_value(self).map(Ordering::reverse),
+            _ => match (as_cmp_str(self), as_cmp_str(other)) {
+                (Some(a), Some(b)) => Some(a.cmp(&b)),
+                (None, None) => cmp_numbers(self, other),
+                _ => None,
             },
         }
     }
 }
 
+fn eq_objects(a: &Value, b: &Value) -> bool {
+    if let (ValueRepr::Dynamic(a), ValueRepr::Dynamic(b)) = (&a.0, &b.0) {
+        if RcType::as_ptr(a) as *const u8 == RcType::as_ptr(b) as *const u8 {
+            return true;
+        }
+    }
+    let rv = match a.0 {
+        ValueRepr::Dynamic(ref obj) => obj.eq_value(b),
+        _ => None,
+    };
+    rv.or_else(|| match b.0 {
+        ValueRepr::Dynamic(ref obj) => obj.eq_value(a),
+        _ => None,
+    })
+    .unwrap_or(false)
+}
+
+fn as_cmp_str(value: &Value) -> Option<Cow<'_, str>> {
+    match value.0 {
+        ValueRepr::String(ref s) | ValueRepr::SafeString(ref s) => Some(Cow::Borrowed(s.as_str())),
+        ValueRepr::Char(c) => Some(Cow::Owned(c.to_string())),
+        _ => None,
+    }
+}
+
+/// Compares two numbers (or bools).
+fn cmp_numbers(a: &Value, b: &Value) -> Option<Ordering> {
+    if matches!(a.0, ValueRepr::F64(_)) || matches!(b.0, ValueRepr::F64(_)) {
+        return as_f64(a)?.partial_cmp(&as_f64(b)?);
+    }
+    as_f64(a)?;
+    as_f64(b)?;
+    match (
+        i128::try_from(a.clone()).ok(),
+        i128::try_from(b.clone()).ok(),
+    ) {
+        (Some(a), Some(b)) => Some(a.cmp(&b)),
+        // integers that do not fit into an i128 are larger than all others
+        (None, Some(_)) => Some(Ordering::Greater),
+        (Some(_), None) => Some(Ordering::Less),
+        (None, None) => Some(
+            u128::try_from(a.clone())
+                .ok()?
+                .cmp(&u128::try_from(b.clone()).ok()?),
+        ),
+    }
+}
+
 impl fmt::Debug for Value {
     fn fmt(&self, f: &mut fmt::Formatter<'_>) -> Result<(), std::fmt::Error> {
         fmt::Debug::fmt(&self.0, f)
@@ -443,7 +607,7 @@ enum CoerceResult {
     F64(f64, f64),
 }
 
-fn as_f64(value: &Value) -> Option<f64> {
+pub(crate) fn as_f64(value: &Value) -> Option<f64> {
     Some(match value.0 {
         ValueRepr::Bool(x) => x as i64 as f64,
         ValueRepr::U64(x) => x as f64,
@@ -485,13 +649,7 @@ impl fmt::Display for Value {
             ValueRepr::Bool(val) => write!(f, "{}", val),
             ValueRepr::U64(val) => write!(f, "{}", val),
             ValueRepr::I64(val) => write!(f, "{}", val),
-            ValueRepr::F64(val) => {
-                let mut num = val.to_string();
-                if !num.contains('.') {
-                    num.push_str(".0");
-                }
-                write!(f, "{}", num)
-            }
+            ValueRepr::F64(val) => write!(f, "{}", format_float(*val, FloatFormat::Default)),
             ValueRepr::Char(val) => write!(f, "{}", val),
             ValueRepr::None => write!(f, "none"),
             ValueRepr::I128(val) => write!(f, "{}", val),
@@ -519,6 +677,7 @@ impl fmt::Display for Value {
                 write!(f, "}}")
             }
             ValueRepr::U128(val) => write!(f, "{}", val),
+            ValueRepr::Dynamic(x) if x.is_secret() => f.write_str(SECRET_MASK),
             ValueRepr::Dynamic(x) => write!(f, "{}", x),
         }
     }
@@ -530,7 +689,7 @@ impl Default for Value {
     }
 }
 
-fn int_as_value(val: i128) -> Value {
+pub(crate) fn int_as_value(val: i128) -> Value {
     if val as i64 as i128 == val {
         (val as i64).into()
     } else {
@@ -541,6 +700,9 @@ fn int_as_value(val: i128) -> Value {
 macro_rules! math_binop {
     ($name:ident, $int:ident, $float:tt) => {
         pub(crate) fn $name(lhs: &Value, rhs: &Value) -> Result<Value, Error> {
+            if let Some(rv) = datetime::arithmetic(stringify!($float), lhs, rhs) {
+                return rv;
+            }
             fn do_it(lhs: &Value, rhs: &Value) -> Option<Value> {
                 match coerce(lhs, rhs)? {
                     CoerceResult::I128(a, b) => Some(int_as_value(a.$int(b))),
@@ -565,7 +727,6 @@ macro_rules! math_binop {
 math_binop!(add, wrapping_add, +);
 math_binop!(sub, wrapping_sub, -);
 math_binop!(mul, wrapping_mul, *);
-math_binop!(rem, wrapping_rem_euclid, %);
 
 pub(crate) fn div(lhs: &Value, rhs: &Value) -> Result<Value, Error> {
     fn do_it(lhs: &Value, rhs: &Value) -> Option<Value> {
@@ -585,23 +746,85 @@ pub(crate) fn div(lhs: &Value, rhs: &Value) -> Result<Value, Error> {
     })
 }
 
-pub(crate) fn int_div(lhs: &Value, rhs: &Value) -> Result<Value, Error> {
-    fn do_it(lhs: &Value, rhs: &Value) -> Option<Value> {
-        match coerce(lhs, rhs)? {
-            CoerceResult::I128(a, b) => Some(int_as_value(a.div_euclid(b))),
-            CoerceResult::F64(a, b) => Some(a.div_euclid(b).into()),
+/// Floored integer division and modulo like in Python.
+///
+/// Unlike Rust's truncating and euclidean variants the quotient is rounded
+/// towards negative infinity and the sign of the remainder follows the
+/// divisor.  Returns `None` on division by zero.
+fn int_floor_divmod(a: i128, b: i128) -> Option<(i128, i128)> {
+    if b == 0 {
+        return None;
+    }
+    let mut div = a.wrapping_div(b);
+    let mut rem = a.wrapping_rem(b);
+    if rem != 0 && (rem < 0) != (b < 0) {
+        div -= 1;
+        rem += b;
+    }
+    Some((div, rem))
+}
+
+/// The float version of [`int_floor_divmod`], modelled after CPython.
+fn float_floor_divmod(a: f64, b: f64) -> Option<(f64, f64)> {
+    if b == 0.0 {
+        return None;
+    }
+    let mut rem = a % b;
+    let mut div = (a - rem) / b;
+    if rem != 0.0 {
+        if (b < 0.0) != (rem < 0.0) {
+            rem += b;
+            div -= 1.0;
         }
+    } else {
+        rem = 0f64.copysign(b);
     }
-    do_it(lhs, rhs).ok_or_else(|| {
-        Error::new(
-            ErrorKind::ImpossibleOperation,
-            format!(
-                "tried to use // operator on unsupported types {} and {}",
-                lhs.kind(),
-                rhs.kind()
-            ),
-        )
-    })
+    let floor_div = if div != 0.0 {
+        let floor_div = div.floor();
+        if div - floor_div > 0.5 {
+            floor_div + 1.0
+        } else {
+            floor_div
+        }
+    } else {
+        0f64.copysign(a / b)
+    };
+    Some((floor_div, rem))
+}
+
+fn floor_divmod(op: &str, lhs: &Value, rhs: &Value, want_rem: bool) -> Result<Value, Error> {
+    let rv =
+        match coerce(lhs, rhs) {
+            Some(CoerceResult::I128(a, b)) => int_floor_divmod(a, b)
+                .map(|(div, rem)| int_as_value(if want_rem { rem } else { div })),
+            Some(CoerceResult::F64(a, b)) => float_floor_divmod(a, b)
+                .map(|(div, rem)| Value::from(if want_rem { rem } else { div })),
+            None => {
+                return Err(Error::new(
+                    ErrorKind::ImpossibleOperation,
+                    format!(
+                        "tried to use {} operator on unsupported types {} and {}",
+                        op,
+                        lhs.kind(),
+                        rhs.kind()
+                    ),
+                ))
+            }
+        };
+    rv.ok_or_else(|| Error::new(ErrorKind::ImpossibleOperation, "tried to divide by zero"))
+}
+
+/// Implements a binary `//` operation on values with Python semantics.
+pub(crate) fn int_div(lhs: &Value, rhs: &Value) -> Result<Value, Error> {
+    floor_divmod("//", lhs, rhs, false)
+}
+
+/// Implements a binary `%` operation on values with Python semantics.
+pub(crate) fn rem(lhs: &Value, rhs: &Value) -> Result<Value, Error> {
+    if let Some(rv) = datetime::arithmetic("%", lhs, rhs) {
+        return rv;
+    }
+    floor_divmod("%", lhs, rhs, true)
 }
 
 /// Implements a binary `pow` operation on values.
@@ -666,6 +889,8 @@ pub(crate) fn contains(container: &Value, value: &Value) -> Result<Value, Error>
             };
             return Ok(Value::from(map.get(&key).is_some()));
         }
+        // undefined values are empty
+        ValueRepr::Undefined => Ok(Value::from(false)),
         ValueRepr::String(ref s) | ValueRepr::SafeString(ref s) => {
             return Ok(Value::from(if let Some(s2) = value.as_str() {
                 s.contains(&s2)
@@ -680,6 +905,116 @@ pub(crate) fn contains(container: &Value, value: &Value) -> Result<Value, Error>
     }
 }
 
+/// Resolves a possibly negative index against a length.
+fn resolve_index(idx: i64, len: usize) -> Option<usize> {
+    let idx = if idx < 0 {
+        (len as i64).checked_add(idx)?
+    } else {
+        idx
+    };
+    usize::try_from(idx).ok().filter(|&idx| idx < len)
+}
+
+fn slice_index(value: Value) -> Result<Option<i64>, Error> {
+    match value.0 {
+        ValueRepr::None | ValueRepr::Undefined => Ok(None),
+        _ => i64::try_from(value).map(Some).map_err(|_| {
+            Error::new(
+                ErrorKind::ImpossibleOperation,
+                "slice indexes must be integers",
+            )
+        }),
+    }
+}
+
+/// Returns the indexes selected by a slice like Python does.
+fn slice_indexes(
+    len: usize,
+    start: Option<i64>,
+    stop: Option<i64>,
+    step: i64,
+) -> impl Iterator<Item = usize> {
+    let len = len as i64;
+    let clamp = |idx: Option<i64>, default: i64| match idx {
+        None => default,
+        Some(idx) => {
+            let idx = if idx < 0 { idx + len } else { idx };
+            if step > 0 {
+                idx.max(0).min(len)
+            } else {
+                idx.max(-1).min(len - 1)
+            }
+        }
+    };
+    let (idx, stop) = if step > 0 {
+        (clamp(start, 0), clamp(stop, len))
+    } else {
+        (clamp(start, len - 1), clamp(stop, -1))
+    };
+    let mut idx = Some(idx);
+    std::iter::from_fn(move || {
+        let rv = idx?;
+        if (step > 0 && rv < stop) || (step < 0 && rv > stop) {
+            // a step past the range of i64 ends the slice
+            idx = rv.checked_add(step);
+            Some(rv as usize)
+        } else {
+            None
+        }
+    })
+}
+
+/// Implements slicing of sequences, strings, bytes and sequence-like objects.
+///
+/// Like in Python the indexes can be negative and are clamped to the
+/// length of the value.  For objects only the selected items are
+/// looked up.
+pub(crate) fn slice(value: Value, start: Value, stop: Value, step: Value) -> Result<Value, Error> {
+    let start = slice_index(start)?;
+    let stop = slice_index(stop)?;
+    let step = slice_index(step)?.unwrap_or(1);
+    if step == 0 {
+        return Err(Error::new(
+            ErrorKind::ImpossibleOperation,
+            "cannot slice by step size of 0",
+        ));
+    }
+
+    match value.0 {
+        ValueRepr::Undefined => Err(Error::from(ErrorKind::UndefinedError)),
+        ValueRepr::Seq(ref items) => Ok(Value::from(
+            slice_indexes(items.len(), start, stop, step)
+                .map(|idx| items[idx].clone())
+                .collect::<Vec<_>>(),
+        )),
+        ValueRepr::String(ref s) | ValueRepr::SafeString(ref s) => {
+            let chars = s.chars().collect::<Vec<_>>();
+            let rv = slice_indexes(chars.len(), start, stop, step)
+                .map(|idx| chars[idx])
+                .collect::<String>();
+            Ok(if let ValueRepr::SafeString(_) = value.0 {
+                Value::from_safe_string(rv)
+            } else {
+                Value::from(rv)
+            })
+        }
+        ValueRepr::Bytes(ref b) => Ok(Value::from_bytes(
+            slice_indexes(b.len(), start, stop, step)
+                .map(|idx| b[idx])
+                .collect(),
+        )),
+        ValueRepr::Dynamic(ref obj) if obj.len().is_some() => Ok(Value::from(
+            slice_indexes(obj.len().unwrap(), start, stop, step)
+                .filter_map(|idx| obj.get_index(idx))
+                .collect::<Vec<_>>(),
+        )),
+        _ => Err(Error::new(
+            ErrorKind::ImpossibleOperation,
+            format!("value of type {} cannot be sliced", value.kind()),
+        )),
+    }
+}
+
 macro_rules! primitive_try_from {
     ($ty:ident, {
         $($pat:pat $(if $if_expr:expr)? => $expr:expr,)*
@@ -824,6 +1159,153 @@ impl<T: ArgType> ArgType for Vec<T> {
     }
 }
 
+/// Utility to accept keyword arguments.
+///
+/// Keyword arguments are passed to filters, tests and functions as a map in
+/// the last argument.  Declaring that argument as `Kwargs` makes it possible
+/// to look up the arguments by name with the same conversions as positional
+/// arguments.  Arguments that are required are looked up as concrete types,
+/// optional arguments as [`Option`]:
+///
+/// ```
+/// # use minijinja::{Environment, Error, State};
+/// use minijinja::value::Kwargs;
+///
+/// fn indent(_state: &State, value: String, kwargs: Kwargs) -> Result<String, Error> {
+///     let width: usize = kwargs.get::<Option<usize>>("width")?.unwrap_or(4);
+///     let prefix: String = kwargs.get("prefix")?;
+///     kwargs.assert_all_used()?;
+///     Ok(format!("{}{}{}", prefix, " ".repeat(width), value))
+/// }
+///
+/// let mut env = Environment::new();
+/// env.add_filter("indent_with", indent);
+/// env.add_template("x", "[{{ 'x'|indent_with(prefix='>', width=2) }}]").unwrap();
+/// let tmpl = env.get_template("x").unwrap();
+/// assert_eq!(tmpl.render(()).unwrap(), "[>  x]");
+/// ```
+///
+/// Missing required arguments, arguments of the wrong type and (with
+/// [`assert_all_used`](Self::assert_all_used)) unknown arguments are
+/// reported with the name of the argument.
+#[derive(Debug, Default)]
+pub struct Kwargs {
+    values: Vec<(String, Value)>,
+    used: RefCell<Vec<bool>>,
+}
+
+impl Kwargs {
+    fn lookup(&self, key: &str) -> Option<Value> {
+        let idx = self.values.iter().position(|x| x.0 == key)?;
+        self.used.borrow_mut()[idx] = true;
+        Some(self.values[idx].1.clone())
+    }
+
+    /// Looks up a keyword argument and converts it.
+    ///
+    /// If the argument is missing the conversion receives `None` which means
+    /// that this fails for required arguments and returns `None` for
+    /// [`Option`].
+    pub fn get<T: ArgType>(&self, key: &str) -> Result<T, Error> {
+        let value = self.lookup(key);
+        let missing = value.is_none();
+        T::from_value(value).map_err(|err| {
+            if missing {
+                Error::new(
+                    ErrorKind::InvalidArguments,
+                    format!("missing keyword argument {}", key),
+                )
+            } else {
+                Error::new(
+                    ErrorKind::InvalidArguments,
+                    format!("invalid value for keyword argument {}", key),
+                )
+                .with_source(err)
+            }
+        })
+    }
+
+    /// Checks if a keyword argument was passed.
+    pub fn has(&self, key: &str) -> bool {
+        self.values.iter().any(|x| x.0 == key)
+    }
+
+    /// Iterates over the names of the passed keyword arguments.
+    ///
+    /// With the `preserve_order` feature the names are returned in the
+    /// order they were passed, otherwise they are sorted.
+    pub fn args(&self) -> impl Iterator<Item = &str> {
+        self.values.iter().map(|x| x.0.as_str())
+    }
+
+    /// Fails if a keyword argument was passed that was not looked up.
+    pub fn assert_all_used(&self) -> Result<(), Error> {
+        let used = self.used.borrow();
+        match self.values.iter().zip(used.iter()).find(|x| !*x.1) {
+            Some(((key, _), _)) => Err(Error::new(
+                ErrorKind::InvalidArguments,
+                format!("unknown keyword argument {}", key),
+            )),
+            None => Ok(()),
+        }
+    }
+}
+
+impl ArgType for Kwargs {
+    fn from_value(value: Option<Value>) -> Result<Self, Error> {
+        match value {
+            None => Ok(Kwargs::default()),
+            Some(value) if matches!(value.0, ValueRepr::Map(_)) => {
+                let values = value
+                    .iter_as_str_map()
+                    .map(|(k, v)| (k.to_string(), v))
+                    .collect::<Vec<_>>();
+                Ok(Kwargs {
+                    used: RefCell::new(vec![false; values.len()]),
+                    values,
+                })
+            }
+            Some(_) => Err(Error::new(
+                ErrorKind::InvalidArguments,
+                "expected keyword arguments",
+            )),
+        }
+    }
+}
+
+/// Utility to accept an argument that is converted with serde.
+///
+/// This makes it possible to bind an entire options map to a struct in one
+/// go.  Defaults and required fields are declared with the usual serde
+/// attributes (eg: `#[serde(default)]`).  This is only available if the
+/// `deserialization` feature is enabled.
+///
+/// ```
+/// # use std::collections::BTreeMap;
+/// # use minijinja::{Environment, Error, State};
+/// use minijinja::value::ViaDeserialize;
+///
+/// fn sum_values(_state: &State, map: ViaDeserialize<BTreeMap<String, i64>>) -> Result<i64, Error> {
+///     Ok(map.0.values().sum())
+/// }
+///
+/// let mut env = Environment::new();
+/// env.add_function("sum_values", sum_values);
+/// env.add_template("x", "{{ sum_values(a=1, b=2) }}").unwrap();
+/// assert_eq!(env.get_template("x").unwrap().render(()).unwrap(), "3");
+/// ```
+#[cfg(feature = "deserialization")]
+#[cfg_attr(docsrs, doc(cfg(feature = "deserialization")))]
+#[derive(Debug, Clone)]
+pub struct ViaDeserialize<T>(pub T);
+
+#[cfg(feature = "deserialization")]
+impl<T: serde::de::DeserializeOwned> ArgType for ViaDeserialize<T> {
+    fn from_value(value: Option<Value>) -> Result<Self, Error> {
+        T::deserialize(value.unwrap_or(Value::UNDEFINED)).map(ViaDeserialize)
+    }
+}
+
 #[allow(clippy::len_without_is_empty)]
 impl Value {
     /// The undefined value
@@ -843,6 +1325,31 @@ impl Value {
         ValueRepr::SafeString(RcType::new(value)).into()
     }
 
+    /// Marks a string value as safe without copying the string.
+    ///
+    /// Values that are not strings are converted into a safe string.
+    pub(crate) fn into_safe_string(self) -> Value {
+        match self.0 {
+            ValueRepr::String(s) => ValueRepr::SafeString(s).into(),
+            ValueRepr::SafeString(_) => self,
+            _ => Value::from_safe_string(self.to_string()),
+        }
+    }
+
+    /// Creates a value from bytes.
+    ///
+    /// When printed in a template the bytes are emitted verbatim (HTML escaping
+    /// only touches ASCII characters) so they can be used to produce output
+    /// that is not valid UTF-8.  To retrieve such output use
+    /// [`Template::render_to_bytes`](crate::Template::render_to_bytes).
+    ///
+    /// In templates bytes have a length, indexing them returns the byte as
+    /// integer and slicing them returns bytes again.  Bytes are only equal to
+    /// other bytes, never to strings.
+    pub fn from_bytes(value: Vec<u8>) -> Value {
+        ValueRepr::Bytes(RcType::new(value)).into()
+    }
+
     /// Creates a value from a reference counted dynamic object.
     pub(crate) fn from_rc_object<T: Object + 'static>(value: RcType<T>) -> Value {
         ValueRepr::Dynamic(value as RcType<dyn Object>).into()
@@ -853,6 +1360,133 @@ impl Value {
         Value::from_rc_object(RcType::new(value))
     }
 
+    /// Creates a value that lazily iterates over the given iterator.
+    ///
+    /// The items are only produced as a loop or filter advances, which makes
+    /// it possible to feed very long or infinite streams into templates.
+    /// The value can only be iterated over once, afterwards it behaves like
+    /// an empty sequence.
+    ///
+    /// ```
+    /// # use minijinja::{context, Environment};
+    /// # use minijinja::value::Value;
+    /// # let mut env = Environment::new();
+    /// # env.add_template("rows.txt", "{% for row in items|batch(2) %}{{ row }}{% endfor %}").unwrap();
+    /// let tmpl = env.get_template("rows.txt").unwrap();
+    /// let items = Value::from_iterator((1..).take(5));
+    /// assert_eq!(tmpl.render(context!(items)).unwrap(), "[1, 2][3, 4][5]");
+    /// ```
+    ///
+    /// This requires the `sync` feature.
+    #[cfg(feature = "sync")]
+    pub fn from_iterator<I>(iter: I) -> Value
+    where
+        I: IntoIterator,
+        I::IntoIter: Send + 'static,
+        I::Item: Into<Value> + 'static,
+    {
+        Value::from_object(OneShotIterator::new(iter.into_iter().map(Into::into)))
+    }
+
+    /// Creates a value that lazily iterates over the items of a channel.
+    ///
+    /// Like [`from_iterator`](Self::from_iterator) this creates a value that
+    /// can be iterated over once.  Each step of a loop waits for the next
+    /// item and the loop ends once all senders were dropped.  This lets a
+    /// producer running on another thread feed a template loop directly.
+    ///
+    /// When the value is dropped (because the render finished, failed or
+    /// only needed the first few items) the channel is disconnected and the
+    /// producer's `send` fails, which tells the producer to stop.
+    ///
+    /// ```
+    /// # use minijinja::{context, Environment};
+    /// # use minijinja::value::Value;
+    /// # let mut env = Environment::new();
+    /// # env.add_template("rows.txt", "{% for row in rows %}{{ row }} {% endfor %}").unwrap();
+    /// let (tx, rx) = std::sync::mpsc::channel();
+    /// let producer = std::thread::spawn(move || {
+    ///     for idx in 0..3 {
+    ///         tx.send(idx).unwrap();
+    ///     }
+    /// });
+    /// let tmpl = env.get_template("rows.txt").unwrap();
+    /// let rows = Value::from_receiver(rx);
+    /// assert_eq!(tmpl.render(context!(rows)).unwrap(), "0 1 2 ");
+    /// producer.join().unwrap();
+    /// ```
+    ///
+    /// This requires the `sync` feature.
+    #[cfg(feature = "sync")]
+    pub fn from_receiver<T>(receiver: std::sync::mpsc::Receiver<T>) -> Value
+    where
+        T: Into<Value> + Send + 'static,
+    {
+        Value::from_iterator(receiver)
+    }
+
+    /// Creates a value that is computed on first use.
+    ///
+    /// The function is invoked at most once, the first time a template looks
+    /// up the value (by name, attribute, index or by iterating over a
+    /// sequence containing it), passes it to a filter, test or function or
+    /// when the value is serialized.  This means expensive parts of the context
+    /// (such as the results of database queries) are only computed if a
+    /// template actually uses them.  If the function fails the error is
+    /// reported as a render error at the location of the access, with the
+    /// source of the original error retained.
+    ///
+    /// ```
+    /// # use minijinja::{context, Environment};
+    /// # use minijinja::value::Value;
+    /// # let mut env = Environment::new();
+    /// # env.add_template("user.txt", "{% if show %}{{ user.name }}{% endif %}").unwrap();
+    /// let tmpl = env.get_template("user.txt").unwrap();
+    /// let user = Value::from_lazy(|| Ok(context!(name => "Peter")));
+    /// assert_eq!(tmpl.render(context!(show => true, user)).unwrap(), "Peter");
+    /// ```
+    ///
+    /// This requires the `sync` feature.
+    #[cfg(feature = "sync")]
+    pub fn from_lazy<F, V>(f: F) -> Value
+    where
+        F: FnOnce() -> Result<V, Error> + Send + 'static,
+        V: Into<Value>,
+    {
+        LAZY_VALUES_CREATED.store(true, atomic::Ordering::Relaxed);
+        Value::from_object(LazyValue {
+            state: std::sync::Mutex::new(LazyState::Pending(Box::new(move || f().map(Into::into)))),
+        })
+    }
+
+    /// Computes the value if it was created by [`from_lazy`](Self::from_lazy).
+    pub(crate) fn resolve_lazy(self) -> Result<Value, Error> {
+        #[cfg(feature = "sync")]
+        {
+            if let Some(lazy) = self.downcast_object_ref::<LazyValue>() {
+                return lazy.resolve();
+            }
+        }
+        Ok(self)
+    }
+
+    /// Computes all lazy values in this value, including the ones nested
+    /// in sequences and maps.
+    ///
+    /// This is used before values are handed to filters, tests and
+    /// functions which would otherwise see the unresolved object.
+    /// Sequences and maps are only copied if they contain lazy values.
+    pub(crate) fn resolve_lazy_deep(self) -> Result<Value, Error> {
+        #[cfg(feature = "sync")]
+        {
+            // nothing to do unless a lazy value was ever created.
+            if LAZY_VALUES_CREATED.load(atomic::Ordering::Relaxed) {
+                return resolve_lazy_deep(self);
+            }
+        }
+        Ok(self)
+    }
+
     /// Returns some reference to the boxed object if it is of type `T`, or None if it isn’t.
     ///
     /// This is basically the "reverse" of [`from_object`](Self::from_object).
@@ -925,6 +1559,14 @@ impl Value {
         }
     }
 
+    /// If this is a bytes value, returns it as a byte slice.
+    pub fn as_bytes(&self) -> Option<&[u8]> {
+        match &self.0 {
+            ValueRepr::Bytes(ref b) => Some(&b[..]),
+            _ => None,
+        }
+    }
+
     /// Is this value true?
     pub fn is_true(&self) -> bool {
         match self.0 {
@@ -966,19 +1608,32 @@ impl Value {
             ValueRepr::String(ref s) | ValueRepr::SafeString(ref s) => Some(s.chars().count()),
             ValueRepr::Map(ref items) => Some(items.len()),
             ValueRepr::Seq(ref items) => Some(items.len()),
-            ValueRepr::Dynamic(ref dy) => Some(dy.attributes().len()),
+            ValueRepr::Bytes(ref b) => Some(b.len()),
+            ValueRepr::Dynamic(ref dy) => Some(dy.len().unwrap_or_else(|| dy.attributes().len())),
             _ => None,
         }
     }
 
     /// Looks up an attribute by attribute name.
+    ///
+    /// Like in Jinja2 this falls back to an item lookup on objects that
+    /// do not have the attribute.  Lazy values are computed.
     pub fn get_attr(&self, key: &str) -> Result<Value, Error> {
+        self.get_attr_with_fallback(key, true)
+            .and_then(Value::resolve_lazy)
+    }
+
+    /// Looks up an attribute, optionally without falling back to items.
+    pub(crate) fn get_attr_with_fallback(&self, key: &str, fallback: bool) -> Result<Value, Error> {
         let value = match self.0 {
             ValueRepr::Map(ref items) => {
                 let lookup_key = Key::Str(key);
                 items.get(&lookup_key).cloned()
             }
-            ValueRepr::Dynamic(ref dy) => dy.get_attr(key),
+            ValueRepr::Dynamic(ref dy) => match dy.get_attr(key) {
+                None if fallback => dy.get_item(&Value::from(key)),
+                rv => rv,
+            },
             ValueRepr::Undefined => {
                 return Err(Error::from(ErrorKind::UndefinedError));
             }
@@ -991,34 +1646,50 @@ impl Value {
     ///
     /// This is similar to [`get_attr`](Value::get_attr) but instead of using
     /// a string key this can be any key.  For instance this can be used to
-    /// index into sequences.
+    /// index into sequences.  Objects that do not have the item fall back to
+    /// an attribute lookup for string keys.  Lazy values are computed.
     pub fn get_item(&self, key: &Value) -> Result<Value, Error> {
+        self.get_item_with_fallback(key, true)
+            .and_then(Value::resolve_lazy)
+    }
+
+    /// Looks up an item, optionally without falling back to attributes.
+    pub(crate) fn get_item_with_fallback(
+        &self,
+        key: &Value,
+        fallback: bool,
+    ) -> Result<Value, Error> {
         if let ValueRepr::Undefined = self.0 {
             Err(Error::from(ErrorKind::UndefinedError))
         } else {
-            Ok(self.get_item_opt(key).unwrap_or(Value::UNDEFINED))
+            Ok(self.get_item_opt(key, fallback).unwrap_or(Value::UNDEFINED))
         }
     }
 
-    fn get_item_opt(&self, key: &Value) -> Option<Value> {
-        let key = Key::from_borrowed_value(key).ok()?;
+    fn get_item_opt(&self, key_value: &Value, fallback: bool) -> Option<Value> {
+        if let ValueRepr::Dynamic(ref dy) = self.0 {
+            if let Some(rv) = dy.get_item(key_value) {
+                return Some(rv);
+            }
+        }
+        let key = Key::from_borrowed_value(key_value).ok()?;
 
         match self.0 {
             ValueRepr::Map(ref items) => return items.get(&key).cloned(),
             ValueRepr::Seq(ref items) => {
                 if let Key::I64(idx) = key {
-                    let idx = isize::try_from(idx).ok()?;
-                    let idx = if idx < 0 {
-                        items.len() - (-idx as usize)
-                    } else {
-                        idx as usize
-                    };
-                    return items.get(idx).cloned();
+                    return items.get(resolve_index(idx, items.len())?).cloned();
+                }
+            }
+            ValueRepr::Bytes(ref b) => {
+                if let Key::I64(idx) = key {
+                    return b.get(resolve_index(idx, b.len())?).map(|&x| Value::from(x));
                 }
             }
             ValueRepr::Dynamic(ref dy) => match key {
-                Key::String(ref key) => return dy.get_attr(key),
-                Key::Str(key) => return dy.get_attr(key),
+                Key::String(ref key) if fallback => return dy.get_attr(key),
+                Key::Str(key) if fallback => return dy.get_attr(key),
+                Key::I64(idx) => return dy.get_index(resolve_index(idx, dy.len()?)?),
                 _ => {}
             },
             _ => {}
@@ -1074,12 +1745,26 @@ impl Value {
         }
     }
 
+    pub(crate) fn as_slice(&self) -> Result<&[Value], Error> {
+        match self.0 {
+            ValueRepr::Seq(ref v) => Ok(&v[..]),
+            _ => Err(Error::new(
+                ErrorKind::ImpossibleOperation,
+                "value is not a list",
+            )),
+        }
+    }
+
     pub(crate) fn try_into_vec(self) -> Result<Vec<Value>, Error> {
         match self.0 {
             ValueRepr::Seq(v) => Ok(match RcType::try_unwrap(v) {
                 Ok(v) => v,
                 Err(rc) => (*rc).clone(),
             }),
+            // objects that behave like sequences (see `Object::len`)
+            ValueRepr::Dynamic(ref obj) if obj.len().is_some() => Ok((0..obj.len().unwrap())
+                .map(|idx| obj.get_index(idx).unwrap_or(Value::UNDEFINED))
+                .collect()),
             _ => Err(Error::new(
                 ErrorKind::ImpossibleOperation,
                 "cannot convert value into list",
@@ -1103,7 +1788,21 @@ impl Value {
     }
 
     /// Iterates over the value.
+    ///
+    /// Map objects without an iterator yield the names of their attributes.
     pub(crate) fn iter(&self) -> ValueIterator {
+        self.iter_impl(false)
+    }
+
+    /// Iterates over the value for unpacking into two targets.
+    ///
+    /// This is like [`iter`](Self::iter) but map objects without an iterator
+    /// yield `[name, value]` pairs of their attributes.
+    pub(crate) fn iter_pairs(&self) -> ValueIterator {
+        self.iter_impl(true)
+    }
+
+    fn iter_impl(&self, pairs: bool) -> ValueIterator {
         let (iter_state, len) = match self.0 {
             ValueRepr::Seq(ref seq) => (ValueIteratorState::Seq(0, RcType::clone(seq)), seq.len()),
             #[cfg(feature = "preserve_order")]
@@ -1119,9 +1818,32 @@ impl Value {
                 ),
                 items.len(),
             ),
+            ValueRepr::Dynamic(ref obj) => match obj.iterate() {
+                Some(iter) => {
+                    return ValueIterator {
+                        iter_state: ValueIteratorState::Dynamic(iter),
+                        len: None,
+                    }
+                }
+                None if obj.len().is_none() => {
+                    let items = if pairs {
+                        self.iter_as_str_map()
+                            .map(|(k, v)| Value::from(vec![Value::from(k), v]))
+                            .collect::<Vec<_>>()
+                    } else {
+                        obj.attributes().iter().map(|x| Value::from(*x)).collect()
+                    };
+                    let len = items.len();
+                    (ValueIteratorState::Seq(0, RcType::new(items)), len)
+                }
+                None => (ValueIteratorState::Empty, 0),
+            },
             _ => (ValueIteratorState::Empty, 0),
         };
-        ValueIterator { iter_state, len }
+        ValueIterator {
+            iter_state,
+            len: Some(len),
+        }
     }
 }
 
@@ -1140,6 +1862,16 @@ impl Serialize for Value {
             return s.end();
         }
 
+        #[cfg(feature = "sync")]
+        {
+            if let Some(lazy) = self.downcast_object_ref::<LazyValue>() {
+                return lazy
+                    .resolve()
+                    .map_err(ser::Error::custom)?
+                    .serialize(serializer);
+            }
+        }
+
         match self.0 {
             ValueRepr::Bool(b) => serializer.serialize_bool(b),
             ValueRepr::U64(u) => serializer.serialize_u64(u),
@@ -1162,6 +1894,7 @@ impl Serialize for Value {
                 }
                 map.end()
             }
+            ValueRepr::Dynamic(ref n) if n.is_secret() => serializer.serialize_str(SECRET_MASK),
             ValueRepr::Dynamic(ref n) => {
                 use serde::ser::SerializeMap;
                 let fields = n.attributes();
@@ -1343,9 +2076,9 @@ impl Serializer for ValueSerializer {
         })
     }
 
-    fn serialize_map(self, _len: Option<usize>) -> Result<Self::SerializeMap, Error> {
+    fn serialize_map(self, len: Option<usize>) -> Result<Self::SerializeMap, Error> {
         Ok(SerializeMap {
-            entries: ValueMap::new(),
+            entries: value_map_with_capacity(len.unwrap_or(0)),
             key: None,
         })
     }
@@ -1353,11 +2086,11 @@ impl Serializer for ValueSerializer {
     fn serialize_struct(
         self,
         name: &'static str,
-        _len: usize,
+        len: usize,
     ) -> Result<Self::SerializeStruct, Error> {
         Ok(SerializeStruct {
             name,
-            fields: ValueMap::new(),
+            fields: value_map_with_capacity(len),
         })
     }
 
@@ -1366,11 +2099,11 @@ impl Serializer for ValueSerializer {
         _name: &'static str,
         _variant_index: u32,
         variant: &'static str,
-        _len: usize,
+        len: usize,
     ) -> Result<Self::SerializeStructVariant, Error> {
         Ok(SerializeStructVariant {
             variant,
-            map: ValueMap::new(),
+            map: value_map_with_capacity(len),
         })
     }
 }
@@ -1580,7 +2313,15 @@ impl ser::SerializeStructVariant for SerializeStructVariant {
 
 pub(crate) struct ValueIterator {
     iter_state: ValueIteratorState,
-    len: usize,
+    len: Option<usize>,
+}
+
+impl ValueIterator {
+    /// Returns the number of remaining items unless the value is iterated
+    /// lazily.
+    pub fn known_len(&self) -> Option<usize> {
+        self.len
+    }
 }
 
 impl Iterator for ValueIterator {
@@ -1588,18 +2329,21 @@ impl Iterator for ValueIterator {
 
     fn next(&mut self) -> Option<Self::Item> {
         self.iter_state.advance_state().map(|x| {
-            self.len -= 1;
+            if let Some(ref mut len) = self.len {
+                *len -= 1;
+            }
             x
         })
     }
 
     fn size_hint(&self) -> (usize, Option<usize>) {
-        (self.len, Some(self.len))
+        match self.len {
+            Some(len) => (len, Some(len)),
+            None => (0, None),
+        }
     }
 }
 
-impl ExactSizeIterator for ValueIterator {}
-
 impl fmt::Debug for ValueIterator {
     fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
         f.debug_struct("ValueIterator").finish()
@@ -1609,6 +2353,7 @@ impl fmt::Debug for ValueIterator {
 enum ValueIteratorState {
     Empty,
     Seq(usize, RcType<Vec<Value>>),
+    Dynamic(Box<dyn Iterator<Item = Value> + Send>),
     #[cfg(not(feature = "preserve_order"))]
     Map(Option<Key<'static>>, RcType<ValueMap<Key<'static>, Value>>),
     #[cfg(feature = "preserve_order")]
@@ -1619,6 +2364,7 @@ impl ValueIteratorState {
     fn advance_state(&mut self) -> Option<Value> {
         match self {
             ValueIteratorState::Empty => None,
+            ValueIteratorState::Dynamic(iter) => iter.next(),
             ValueIteratorState::Seq(idx, items) => items
                 .get(*idx)
                 .map(|x| {
@@ -1675,12 +2421,29 @@ pub trait Object: fmt::Display + fmt::Debug + Any + Sync + Send {
         None
     }
 
+    /// Invoked by the engine to look up an item of an object.
+    ///
+    /// This is used by the subscript syntax (`obj[key]`) and is useful for
+    /// map-like objects whose keys are not known attributes.  If `None` is
+    /// returned (the default) string keys are looked up as attributes and
+    /// integer keys with [`get_index`](Self::get_index).  Likewise
+    /// attribute lookups fall back to this method.  The fallback can be
+    /// disabled with
+    /// [`Environment::set_strict_attribute_lookup`](crate::Environment::set_strict_attribute_lookup).
+    fn get_item(&self, key: &Value) -> Option<Value> {
+        let _key = key;
+        None
+    }
+
     /// An enumeration of attributes that are known to exist on this object.
     ///
     /// The default implementation returns an empty slice.  If it's not possible
     /// to implement this, it's fine for the implementation to be omitted.  The
     /// enumeration here is used by the `for` loop to iterate over the attributes
-    /// on the value.
+    /// on the value unless the object implements [`iterate`](Self::iterate) or
+    /// [`len`](Self::len).  A loop with two targets (`{% for key, value in obj %}`)
+    /// iterates over the attributes and their values, as does the `items`
+    /// filter.
     fn attributes(&self) -> &[&str] {
         &[][..]
     }
@@ -1710,8 +2473,418 @@ pub trait Object: fmt::Display + fmt::Debug + Any + Sync + Send {
             "tried to call non callable object",
         ))
     }
+
+    /// Compares the object with another value for equality.
+    ///
+    /// This is used by `==` and `!=`, the `in` operator and filters such as
+    /// `unique`.  `other` is the value the object is compared with no
+    /// matter on which side of the operator the object is.  If `None` is
+    /// returned (the default) and the other value is an object as well,
+    /// its implementation is consulted.  Otherwise an object is only equal
+    /// to itself.
+    fn eq_value(&self, other: &Value) -> Option<bool> {
+        let _other = other;
+        None
+    }
+
+    /// Orders the object relative to another value.
+    ///
+    /// This is used by `<`, `<=`, `>` and `>=` as well as the `sort`
+    /// filter and has to return how this object compares to `other`.  The
+    /// default implementation returns `None` which means that the object
+    /// cannot be ordered relative to the value.
+    fn cmp_value(&self, other: &Value) -> Option<Ordering> {
+        let _other = other;
+        None
+    }
+
+    /// Returns the number of items if the object behaves like a sequence.
+    ///
+    /// Objects that return a length here can be indexed with integers
+    /// (including negative ones which count from the end) and sliced.  The
+    /// items are looked up with [`get_index`](Self::get_index) so only the
+    /// items that are needed have to be produced.  The default
+    /// implementation returns `None`.
+    fn len(&self) -> Option<usize> {
+        None
+    }
+
+    /// Returns the item at the given index.
+    ///
+    /// This is only invoked for indexes smaller than the length returned by
+    /// [`len`](Self::len).
+    fn get_index(&self, idx: usize) -> Option<Value> {
+        let _idx = idx;
+        None
+    }
+
+    /// Returns an iterator over the items of the object.
+    ///
+    /// Objects that return an iterator here can be looped over and passed to
+    /// filters such as `batch` or `list`.  Unlike for sequences the number
+    /// of items is not known upfront, so the items can be produced lazily
+    /// as the loop advances (for instance from a stream or a generator).
+    /// Within such loops `loop.length`, `loop.revindex` and `loop.last`
+    /// are undefined.  The default implementation returns `None`.
+    fn iterate(&self) -> Option<Box<dyn Iterator<Item = Value> + Send>> {
+        None
+    }
+
+    /// Marks the object as secret.
+    ///
+    /// The string and debug representation of secret objects is replaced
+    /// with [`SECRET_MASK`] and they serialize as that string.  See
+    /// [`Secret`] for a ready made secret string.
+    fn is_secret(&self) -> bool {
+        false
+    }
 }
 
+/// A map object that converts its values on access.
+///
+/// [`Value::from_serializable`] converts an entire structure upfront which is
+/// wasteful for large contexts where templates only look at a few values.  A
+/// lazy map instead holds on to the original values and only converts a value
+/// when it's accessed.  Note that the conversion happens on every access so
+/// values that are used often are best bound to a variable in the template.
+///
+/// As a [`Value`] can itself be stored in a lazy map, maps can be nested to
+/// also defer the conversion of deeper structures.
+///
+/// The keys are static strings (such as field names or literals) as the
+/// map hands them out as its attributes.
+///
+/// ```
+/// # use minijinja::{context, Environment};
+/// # use minijinja::value::{LazyMap, Value};
+/// let users: LazyMap<Vec<String>> = vec![
+///     ("active", vec!["john".to_string()]),
+///     ("inactive", vec!["jane".to_string(); 10000]),
+/// ]
+/// .into_iter()
+/// .collect();
+/// let env = Environment::new();
+/// let expr = env.compile_expression("users.active[0]").unwrap();
+/// let rv = expr.eval(context!(users => Value::from_object(users))).unwrap();
+/// assert_eq!(rv.to_string(), "john");
+/// ```
+pub struct LazyMap<V> {
+    attributes: Vec<&'static str>,
+    map: BTreeMap<&'static str, V>,
+}
+
+impl<V> std::iter::FromIterator<(&'static str, V)> for LazyMap<V> {
+    fn from_iter<T: IntoIterator<Item = (&'static str, V)>>(iter: T) -> Self {
+        let map: BTreeMap<&'static str, V> = iter.into_iter().collect();
+        let attributes = map.keys().copied().collect();
+        LazyMap { attributes, map }
+    }
+}
+
+impl<V: Serialize> fmt::Debug for LazyMap<V> {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        f.debug_map()
+            .entries(
+                self.map
+                    .iter()
+                    .map(|(k, v)| (k, Value::from_serializable(v))),
+            )
+            .finish()
+    }
+}
+
+impl<V: Serialize> fmt::Display for LazyMap<V> {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        write!(f, "{{")?;
+        for (idx, (key, val)) in self.map.iter().enumerate() {
+            if idx > 0 {
+                write!(f, ", ")?;
+            }
+            write!(f, "{:?}: {:?}", key, Value::from_serializable(val))?;
+        }
+        write!(f, "}}")
+    }
+}
+
+impl<V: Serialize + Send + Sync + 'static> Object for LazyMap<V> {
+    fn get_attr(&self, name: &str) -> Option<Value> {
+        self.map.get(name).map(Value::from_serializable)
+    }
+
+    fn attributes(&self) -> &[&str] {
+        &self.attributes[..]
+    }
+}
+
+/// The text that secrets are rendered as.
+pub const SECRET_MASK: &str = "*****";
+
+/// A string that must not end up in rendered output or logs.
+///
+/// Secrets can be passed to templates like any other value but whenever
+/// they would be converted into a string (when printed, passed to filters
+/// that work with strings, serialized or debug printed) they show up as
+/// [`SECRET_MASK`] instead.  Comparing a secret with `==` against another
+/// secret or a string is done in constant time.  The actual value can only
+/// be retrieved from Rust code with [`expose`](Self::expose).
+///
+/// Custom objects can be masked the same way by returning `true` from
+/// [`Object::is_secret`].
+///
+/// ```
+/// # use minijinja::{context, Environment};
+/// # use minijinja::value::{Secret, Value};
+/// let mut env = Environment::new();
+/// env.add_template("config.txt", "password={{ password }}").unwrap();
+/// let tmpl = env.get_template("config.txt").unwrap();
+/// let rv = tmpl.render(context!(
+///     password => Value::from_object(Secret::new("hunter2")),
+/// )).unwrap();
+/// assert_eq!(rv, "password=*****");
+/// ```
+pub struct Secret(String);
+
+impl Secret {
+    /// Wraps a string as secret.
+    pub fn new<S: Into<String>>(value: S) -> Secret {
+        Secret(value.into())
+    }
+
+    /// Returns the actual value of the secret.
+    pub fn expose(&self) -> &str {
+        &self.0
+    }
+}
+
+impl fmt::Debug for Secret {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        f.debug_tuple("Secret").field(&SECRET_MASK).finish()
+    }
+}
+
+impl fmt::Display for Secret {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        f.write_str(SECRET_MASK)
+    }
+}
+
+/// Compares two byte strings in constant time relative to their contents.
+fn constant_time_eq(a: &[u8], b: &[u8]) -> bool {
+    if a.len() != b.len() {
+        return false;
+    }
+    a.iter().zip(b.iter()).fold(0, |acc, (a, b)| acc | (a ^ b)) == 0
+}
+
+impl Object for Secret {
+    fn is_secret(&self) -> bool {
+        true
+    }
+
+    fn eq_value(&self, other: &Value) -> Option<bool> {
+        let other = match other.0 {
+            ValueRepr::String(ref s) | ValueRepr::SafeString(ref s) => s.as_str(),
+            _ => other.downcast_object_ref::<Secret>()?.expose(),
+        };
+        Some(constant_time_eq(self.0.as_bytes(), other.as_bytes()))
+    }
+}
+
+/// An iterator that can be iterated over once.
+#[cfg(feature = "sync")]
+pub(crate) struct OneShotIterator {
+    iter: std::sync::Mutex<Option<Box<dyn Iterator<Item = Value> + Send>>>,
+}
+
+#[cfg(feature = "sync")]
+impl OneShotIterator {
+    pub(crate) fn new<I: Iterator<Item = Value> + Send + 'static>(iter: I) -> OneShotIterator {
+        OneShotIterator {
+            iter: std::sync::Mutex::new(Some(Box::new(iter))),
+        }
+    }
+}
+
+#[cfg(feature = "sync")]
+impl fmt::Debug for OneShotIterator {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        f.debug_struct("OneShotIterator").finish()
+    }
+}
+
+#[cfg(feature = "sync")]
+impl fmt::Display for OneShotIterator {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        f.write_str("<iterator>")
+    }
+}
+
+#[cfg(feature = "sync")]
+impl Object for OneShotIterator {
+    fn iterate(&self) -> Option<Box<dyn Iterator<Item = Value> + Send>> {
+        let iter = self.iter.lock().unwrap_or_else(|x| x.into_inner()).take();
+        Some(iter.unwrap_or_else(|| Box::new(None.into_iter())))
+    }
+}
+
+#[cfg(feature = "sync")]
+static LAZY_VALUES_CREATED: AtomicBool = AtomicBool::new(false);
+
+#[cfg(feature = "sync")]
+fn contains_lazy(value: &Value) -> bool {
+    match value.0 {
+        ValueRepr::Seq(ref items) => items.iter().any(contains_lazy),
+        ValueRepr::Map(ref map) => map.values().any(contains_lazy),
+        ValueRepr::Dynamic(_) => value.downcast_object_ref::<LazyValue>().is_some(),
+        _ => false,
+    }
+}
+
+#[cfg(feature = "sync")]
+fn resolve_lazy_deep(value: Value) -> Result<Value, Error> {
+    if !contains_lazy(&value) {
+        return Ok(value);
+    }
+    match value.0 {
+        ValueRepr::Seq(ref items) => Ok(Value::from(
+            items
+                .iter()
+                .map(|item| resolve_lazy_deep(item.clone()))
+                .collect::<Result<Vec<_>, _>>()?,
+        )),
+        ValueRepr::Map(ref map) => {
+            let mut rv = value_map_with_capacity(map.len());
+            for (key, item) in map.iter() {
+                rv.insert(key.clone(), resolve_lazy_deep(item.clone())?);
+            }
+            Ok(Value(ValueRepr::Map(RcType::new(rv))))
+        }
+        _ => resolve_lazy_deep(value.resolve_lazy()?),
+    }
+}
+
+#[cfg(feature = "sync")]
+type LazyFn = Box<dyn FnOnce() -> Result<Value, Error> + Send>;
+
+/// The source of a failed lazy value, shared by all errors reporting it.
+#[cfg(feature = "sync")]
+#[derive(Clone)]
+pub(crate) struct LazySource(std::sync::Arc<dyn std::error::Error + Send + Sync>);
+
+#[cfg(feature = "sync")]
+impl LazySource {
+    pub(crate) fn inner(&self) -> &(dyn std::error::Error + 'static) {
+        &*self.0
+    }
+}
+
+#[cfg(feature = "sync")]
+impl fmt::Debug for LazySource {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        fmt::Debug::fmt(&self.0, f)
+    }
+}
+
+#[cfg(feature = "sync")]
+impl fmt::Display for LazySource {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        fmt::Display::fmt(&self.0, f)
+    }
+}
+
+#[cfg(feature = "sync")]
+impl std::error::Error for LazySource {
+    fn source(&self) -> Option<&(dyn std::error::Error + 'static)> {
+        self.0.source()
+    }
+}
+
+#[cfg(feature = "sync")]
+enum LazyState {
+    Pending(LazyFn),
+    Running,
+    Done(Value),
+    Failed(ErrorKind, Option<String>, Option<LazySource>),
+}
+
+/// A value that is computed on first use.
+#[cfg(feature = "sync")]
+pub(crate) struct LazyValue {
+    state: std::sync::Mutex<LazyState>,
+}
+
+#[cfg(feature = "sync")]
+impl LazyValue {
+    fn resolve(&self) -> Result<Value, Error> {
+        let mut state = self.state.lock().unwrap_or_else(|x| x.into_inner());
+        match std::mem::replace(&mut *state, LazyState::Running) {
+            LazyState::Pending(f) => {
+                // the lock is held while computing so that the function
+                // runs only once even if the value is shared between threads.
+                match f() {
+                    Ok(value) => {
+                        *state = LazyState::Done(value.clone());
+                        Ok(value)
+                    }
+                    Err(mut err) => {
+                        let source = err.take_source().map(|x| LazySource(x.into()));
+                        let kind = err.kind();
+                        let detail = err.detail().map(String::from);
+                        if let Some(ref source) = source {
+                            err = err.with_source(source.clone());
+                        }
+                        *state = LazyState::Failed(kind, detail, source);
+                        Err(err)
+                    }
+                }
+            }
+            LazyState::Running => Err(Error::new(
+                ErrorKind::InvalidOperation,
+                "lazy value panicked while it was computed",
+            )),
+            LazyState::Done(value) => {
+                *state = LazyState::Done(value.clone());
+                Ok(value)
+            }
+            LazyState::Failed(kind, detail, source) => {
+                let mut err = match detail {
+                    Some(ref detail) => Error::new(kind, detail.clone()),
+                    None => Error::from(kind),
+                };
+                if let Some(ref source) = source {
+                    err = err.with_source(source.clone());
+                }
+                *state = LazyState::Failed(kind, detail, source);
+                Err(err)
+            }
+        }
+    }
+}
+
+#[cfg(feature = "sync")]
+impl fmt::Debug for LazyValue {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        // formatting never computes the value, it only shows it if it is known
+        match *self.state.lock().unwrap_or_else(|x| x.into_inner()) {
+            LazyState::Done(ref value) => fmt::Debug::fmt(value, f),
+            _ => f.debug_struct("LazyValue").finish(),
+        }
+    }
+}
+
+#[cfg(feature = "sync")]
+impl fmt::Display for LazyValue {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        match *self.state.lock().unwrap_or_else(|x| x.into_inner()) {
+            LazyState::Done(ref value) => fmt::Display::fmt(value, f),
+            _ => f.write_str("<lazy>"),
+        }
+    }
+}
+
+#[cfg(feature = "sync")]
+impl Object for LazyValue {}
+
 /// Utility macro to create a value from a literal
 #[cfg(test)]
 macro_rules! value {
@@ -1720,6 +2893,31 @@ macro_rules! value {
     };
 }
 
+#[test]
+fn test_slice_large_step() {
+    let items = Value::from(vec![1, 2, 3]);
+    let slice_items = |start: i64, step: i64| {
+        slice(
+            items.clone(),
+            Value::from(start),
+            Value::from(()),
+            Value::from(step),
+        )
+        .unwrap()
+        .to_string()
+    };
+    assert_eq!(slice_items(1, i64::MAX), "[2]");
+    assert_eq!(slice_items(-1, i64::MIN), "[3]");
+    let bytes = slice(
+        Value::from(&b"abc"[..]),
+        Value::from(()),
+        Value::from(()),
+        Value::from(i64::MAX),
+    )
+    .unwrap();
+    assert_eq!(bytes.as_bytes(), Some(&b"a"[..]));
+}
+
 #[test]
 fn test_adding() {
     let err = add(&value!("a"), &value!(42)).unwrap_err();
@@ -1731,6 +2929,36 @@ fn test_adding() {
     assert_eq!(add(&value!(1), &value!(2)), Ok(value!(3)));
 }
 
+#[test]
+fn test_floor_division_and_modulo() {
+    for &(a, b, q, r) in &[
+        (7, 2, 3, 1),
+        (-7, 2, -4, 1),
+        (7, -2, -4, -1),
+        (-7, -2, 3, -1),
+        (6, -3, -2, 0),
+    ] {
+        assert_eq!(int_div(&value!(a), &value!(b)), Ok(value!(q)));
+        assert_eq!(rem(&value!(a), &value!(b)), Ok(value!(r)));
+    }
+    for &(a, b, q, r) in &[
+        (7.5, 2.0, 3.0, 1.5),
+        (-7.5, 2.0, -4.0, 0.5),
+        (7.5, -2.0, -4.0, -0.5),
+        (-7.5, -2.0, 3.0, -1.5),
+    ] {
+        assert_eq!(int_div(&value!(a), &value!(b)), Ok(value!(q)));
+        assert_eq!(rem(&value!(a), &value!(b)), Ok(value!(r)));
+    }
+
+    let err = rem(&value!(1), &value!(0)).unwrap_err();
+    assert_eq!(
+        err.to_string(),
+        "impossible operation: tried to divide by zero"
+    );
+    assert!(int_div(&value!(1.0), &value!(0.0)).is_err());
+}
+
 #[test]
 fn test_concat() {
     assert_eq!(
@@ -1768,6 +2996,35 @@ fn test_sort() {
     "###);
 }
 
+#[test]
+fn test_comparisons() {
+    let big = Value::from(u128::MAX);
+    assert!(big > Value::from(i64::MAX));
+    assert!(big > Value::from(-1));
+    assert!(Value::from(-1) < big);
+    assert!(big > Value::from(u128::MAX - 1));
+    assert!(big < Value::from(f64::INFINITY));
+    assert_eq!(Value::from(true), Value::from(1));
+    assert_eq!(Value::from(1), Value::from(1.0));
+    assert!(Value::from(1) < Value::from(1.5));
+    assert_eq!(Value::from('a'), Value::from("a"));
+    assert!(Value::from('a') < Value::from("ab"));
+    assert_ne!(Value::from("a"), Value::from_safe_string("a".into()));
+    assert!(Value::from("a") < Value::from_safe_string("b".into()));
+    assert_eq!(
+        Value::from(vec![1, 2]),
+        Value::from(vec![Value::from(1), Value::from(2.0)])
+    );
+    assert!(Value::from(vec![1, 2]) < Value::from(vec![1, 3]));
+    assert!(Value::from(vec![1]) < Value::from(vec![1, 0]));
+    assert_eq!(Value::UNDEFINED, Value::UNDEFINED);
+    assert_eq!(Value::from(()), Value::from(()));
+    assert_ne!(Value::from(()), Value::UNDEFINED);
+    assert_eq!(Value::from("1").partial_cmp(&Value::from(1)), None);
+    assert_eq!(Value::from(()).partial_cmp(&Value::from(0)), None);
+    assert_eq!(Value::from(f64::NAN).partial_cmp(&Value::from(0)), None);
+}
+
 #[test]
 fn test_safe_string_roundtrip() {
     let v = Value::from_safe_string("<b>HTML</b>".into());
@@ -1827,6 +3084,55 @@ fn test_string_key_lookup() {
     assert_eq!(m.get_item(&Value::from("foo")).unwrap(), Value::from(42));
 }
 
+#[test]
+fn test_attr_item_fallback() {
+    #[derive(Debug)]
+    struct Both;
+
+    impl fmt::Display for Both {
+        fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+            write!(f, "both")
+        }
+    }
+
+    impl Object for Both {
+        fn get_attr(&self, name: &str) -> Option<Value> {
+            match name {
+                "attr" => Some(Value::from("from attr")),
+                _ => None,
+            }
+        }
+
+        fn get_item(&self, key: &Value) -> Option<Value> {
+            match key.as_str()? {
+                "item" => Some(Value::from("from item")),
+                _ => None,
+            }
+        }
+    }
+
+    let obj = Value::from_object(Both);
+    assert_eq!(obj.get_attr("attr").unwrap(), Value::from("from attr"));
+    assert_eq!(obj.get_attr("item").unwrap(), Value::from("from item"));
+    assert_eq!(
+        obj.get_item(&Value::from("attr")).unwrap(),
+        Value::from("from attr")
+    );
+    assert_eq!(
+        obj.get_item(&Value::from("item")).unwrap(),
+        Value::from("from item")
+    );
+
+    assert!(obj
+        .get_attr_with_fallback("item", false)
+        .unwrap()
+        .is_undefined());
+    assert!(obj
+        .get_item_with_fallback(&Value::from("attr"), false)
+        .unwrap()
+        .is_undefined());
+}
+
 #[test]
 fn test_int_key_lookup() {
     let mut m = BTreeMap::new();
@@ -1886,3 +3192,41 @@ fn test_float_to_string() {
     assert_eq!(Value::from(42.4242f64).to_string(), "42.4242");
     assert_eq!(Value::from(42.0f32).to_string(), "42.0");
 }
+
+#[test]
+fn test_lazy_map() {
+    use std::sync::atomic::Ordering;
+
+    static CONVERSIONS: AtomicUsize = AtomicUsize::new(0);
+
+    struct Counted(u32);
+
+    impl Serialize for Counted {
+        fn serialize<S: Serializer>(&self, serializer: S) -> Result<S::Ok, S::Error> {
+            CONVERSIONS.fetch_add(1, Ordering::Relaxed);
+            serializer.serialize_u32(self.0)
+        }
+    }
+
+    let map: LazyMap<Counted> = ["k0", "k1", "k2", "k3", "k4"]
+        .iter()
+        .zip(0..)
+        .map(|(&k, x)| (k, Counted(x)))
+        .collect();
+    let value = Value::from_object(map);
+    assert_eq!(CONVERSIONS.load(Ordering::Relaxed), 0);
+    assert_eq!(value.get_attr("k3").unwrap(), Value::from(3));
+    assert_eq!(CONVERSIONS.load(Ordering::Relaxed), 1);
+    assert!(value.get_attr("missing").unwrap().is_undefined());
+    assert_eq!(value.len(), Some(5));
+    assert_eq!(value.iter_as_str_map().next(), Some(("k0", Value::from(0))));
+
+    // a value that is itself a lazy map is not converted eagerly
+    let outer: LazyMap<Value> = vec![("inner", value)].into_iter().collect();
+    let outer = Value::from_serializable(&Value::from_object(outer));
+    assert_eq!(
+        outer.get_attr("inner").unwrap().get_attr("k1").unwrap(),
+        Value::from(1)
+    );
+    assert_eq!(CONVERSIONS.load(Ordering::Relaxed), 3);
+}
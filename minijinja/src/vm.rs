@@ -1,16 +1,186 @@
+use std::any::{Any, TypeId};
+use std::cell::{Cell, RefCell};
+#[cfg(feature = "source")]
+use std::collections::HashMap;
 use std::collections::{BTreeMap, HashSet};
 use std::fmt::{self, Write};
-use std::sync::atomic::{AtomicUsize, Ordering};
-
-use crate::environment::Environment;
+use std::rc::Rc;
+use std::sync::atomic::{AtomicBool, AtomicUsize, Ordering};
+use std::sync::Arc;
+
+#[cfg(feature = "source")]
+use self_cell::self_cell;
+use serde::Serialize;
+
+use crate::compiler::Compiler;
+#[cfg(feature = "debug")]
+use crate::debugger::Location;
+use crate::environment::{Environment, Template};
 use crate::error::{Error, ErrorKind};
+use crate::functions::set_namespace_attr;
 use crate::instructions::{
-    Instruction, Instructions, LOOP_FLAG_RECURSIVE, LOOP_FLAG_WITH_LOOP_VAR,
+    Instruction, Instructions, LOOP_FLAG_PAIRS, LOOP_FLAG_RECURSIVE, LOOP_FLAG_WITH_LOOP_VAR,
 };
 use crate::key::Key;
-use crate::utils::matches;
-use crate::value::{self, Object, RcType, Value, ValueIterator, ValueRepr};
-use crate::AutoEscape;
+use crate::output::Output;
+use crate::parser::parse_expr_with_max_depth;
+use crate::pprint::{short_repr, PrettyPrinter, Repr, ReprLimits};
+use crate::utils::{join_template_name, matches};
+use crate::value::{self, Object, RcType, Value, ValueIterator, ValueKind, ValueMap, ValueRepr};
+use crate::{AutoEscape, UndefinedBehavior};
+
+/// Temporary values of filters and functions keyed by type and name.
+#[derive(Default)]
+pub(crate) struct Temps {
+    values: BTreeMap<(TypeId, String), Box<dyn Any>>,
+}
+
+impl fmt::Debug for Temps {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        f.debug_list()
+            .entries(self.values.keys().map(|x| &x.1))
+            .finish()
+    }
+}
+
+impl Temps {
+    fn get<T: 'static>(&self, name: &str) -> Option<&T> {
+        self.values
+            .get(&(TypeId::of::<T>(), name.to_string()))
+            .and_then(|x| x.downcast_ref())
+    }
+
+    fn insert<T: 'static>(&mut self, name: &str, value: T) -> Option<T> {
+        self.values
+            .insert((TypeId::of::<T>(), name.to_string()), Box::new(value))
+            .and_then(|x| x.downcast().ok())
+            .map(|x| *x)
+    }
+
+    fn remove<T: 'static>(&mut self, name: &str) -> Option<T> {
+        self.values
+            .remove(&(TypeId::of::<T>(), name.to_string()))
+            .and_then(|x| x.downcast().ok())
+            .map(|x| *x)
+    }
+}
+
+/// Returns the approximate number of bytes a value allocated.
+///
+/// Only the value itself is considered and not the values it contains as
+/// those were accounted for when they were created.
+fn approx_value_size(value: &Value) -> usize {
+    match value.0 {
+        ValueRepr::String(ref s) | ValueRepr::SafeString(ref s) => s.len(),
+        ValueRepr::Bytes(ref b) => b.len(),
+        ValueRepr::Seq(ref items) => items.len() * std::mem::size_of::<Value>(),
+        ValueRepr::Map(ref map) => map.len() * 2 * std::mem::size_of::<Value>(),
+        _ => 0,
+    }
+}
+
+/// Converts a value into the items for an unpacking assignment.
+///
+/// `count` is the number of targets.  If there is a catch-all target
+/// (`star` is the number of targets before it), the sequence only needs
+/// at least `count` items.
+fn unpack_sequence(value: Value, count: usize, star: Option<usize>) -> Result<Vec<Value>, Error> {
+    // the preview is only built for errors.  Converting a sequence never
+    // fails and copying other values is cheap.
+    let v = if matches!(value.kind(), ValueKind::Seq) {
+        value.try_into_vec()?
+    } else {
+        value.clone().try_into_vec().map_err(|err| {
+            Error::new(
+                ErrorKind::ImpossibleOperation,
+                format!(
+                    "cannot unpack: not a sequence (got {})",
+                    short_repr(&value, 60)
+                ),
+            )
+            .with_source(err)
+        })?
+    };
+    let ok = match star {
+        Some(_) => v.len() >= count,
+        None => v.len() == count,
+    };
+    if !ok {
+        return Err(Error::new(
+            ErrorKind::ImpossibleOperation,
+            format!(
+                "cannot unpack: sequence of wrong length (expected {}{}, got {}: {})",
+                if star.is_some() { "at least " } else { "" },
+                count,
+                v.len(),
+                short_repr(&Value::from(v), 60)
+            ),
+        ));
+    }
+    Ok(v)
+}
+
+/// Compiles an expression evaluated from within a template.
+fn compile_expression<'source>(
+    env: &Environment,
+    expr: &'source str,
+) -> Result<Instructions<'source>, Error> {
+    let ast = parse_expr_with_max_depth(expr, env.max_expression_depth())?;
+    let mut compiler = Compiler::new("<expression>", expr);
+    compiler.set_optimization_level(env.optimization_level());
+    compiler.compile_expr(&ast)?;
+    Ok(compiler.finish().0)
+}
+
+#[cfg(feature = "source")]
+self_cell! {
+    struct OwnedExpression {
+        owner: String,
+        #[covariant]
+        dependent: Instructions,
+    }
+}
+
+#[cfg(feature = "source")]
+impl fmt::Debug for OwnedExpression {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        fmt::Debug::fmt(&self.borrow_dependent(), f)
+    }
+}
+
+/// Formats a chain of template names for error messages.
+fn format_template_chain(chain: &[&str], name: &str) -> String {
+    let start = chain.iter().rposition(|x| *x == name).unwrap_or(0);
+    let mut rv = String::new();
+    for item in &chain[start..] {
+        rv.push_str(item);
+        rv.push_str(" -> ");
+    }
+    rv.push_str(name);
+    rv
+}
+
+/// The blocks of a template with all layers from the inheritance chain.
+///
+/// The table is shared between a template and everything it evaluates in a
+/// sub state (blocks, includes, super calls).  It's only copied when it needs
+/// to change which means that calling blocks is cheap.
+type BlockLayers<'a, 'env> = Rc<BTreeMap<&'env str, Vec<&'a Instructions<'env>>>>;
+
+/// Creates the block table for a template that does not extend another one yet.
+fn block_layers<'a, 'env>(
+    blocks: &'a BTreeMap<&'env str, Instructions<'env>>,
+) -> BlockLayers<'a, 'env> {
+    Rc::new(
+        blocks
+            .iter()
+            .map(|(&name, instr)| (name, vec![instr]))
+            .collect(),
+    )
+}
+
+/// The length of loops over lazy iterators.
+const UNKNOWN_LEN: usize = !0;
 
 pub struct LoopState {
     len: AtomicUsize,
@@ -45,7 +215,11 @@ impl Object for LoopState {
 
     fn get_attr(&self, name: &str) -> Option<Value> {
         let idx = self.idx.load(Ordering::Relaxed) as u64;
-        let len = self.len.load(Ordering::Relaxed) as u64;
+        let len = self.len.load(Ordering::Relaxed);
+        if len == UNKNOWN_LEN && matches!(name, "length" | "revindex" | "revindex0" | "last") {
+            return None;
+        }
+        let len = len as u64;
         match name {
             "index0" => Some(Value::from(idx)),
             "index" => Some(Value::from(idx + 1)),
@@ -69,11 +243,14 @@ impl Object for LoopState {
 
     fn call_method(&self, _state: &State, name: &str, args: Vec<Value>) -> Result<Value, Error> {
         if name == "cycle" {
-            let idx = self.idx.load(Ordering::Relaxed);
-            match args.get(idx % args.len()) {
-                Some(arg) => Ok(arg.clone()),
-                None => Ok(Value::UNDEFINED),
+            if args.is_empty() {
+                return Err(Error::new(
+                    ErrorKind::InvalidArguments,
+                    "no items for cycling given",
+                ));
             }
+            let idx = self.idx.load(Ordering::Relaxed);
+            Ok(args[idx % args.len()].clone())
         } else {
             Err(Error::new(
                 ErrorKind::ImpossibleOperation,
@@ -85,12 +262,11 @@ impl Object for LoopState {
 
 impl fmt::Display for LoopState {
     fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
-        write!(
-            f,
-            "<loop {}/{}>",
-            self.idx.load(Ordering::Relaxed),
-            self.len.load(Ordering::Relaxed)
-        )
+        let idx = self.idx.load(Ordering::Relaxed);
+        match self.len.load(Ordering::Relaxed) {
+            UNKNOWN_LEN => write!(f, "<loop {}/?>", idx),
+            len => write!(f, "<loop {}/{}>", idx, len),
+        }
     }
 }
 
@@ -152,12 +328,55 @@ impl<'env, 'vm> fmt::Debug for Frame<'env, 'vm> {
     }
 }
 
+/// The number of value stacks that are kept for reuse per thread.
+const MAX_POOLED_STACKS: usize = 16;
+
+/// Stacks that grew beyond this capacity are not kept for reuse.
+const MAX_POOLED_STACK_CAPACITY: usize = 256;
+
+thread_local! {
+    // value stacks of finished evaluations.  Every template, block, include
+    // and super call evaluates on its own stack, reusing the allocations
+    // saves a lot of small allocations per render.
+    static STACK_POOL: RefCell<Vec<Vec<Value>>> = RefCell::new(Vec::new());
+}
+
 #[cfg_attr(feature = "internal_debug", derive(Debug))]
 pub struct Stack {
     values: Vec<Value>,
 }
 
+impl Drop for Stack {
+    fn drop(&mut self) {
+        let mut values = std::mem::take(&mut self.values);
+        if values.capacity() == 0 || values.capacity() > MAX_POOLED_STACK_CAPACITY {
+            return;
+        }
+        // values are released before the pool is borrowed as dropping them
+        // can run arbitrary code.
+        values.clear();
+        STACK_POOL
+            .try_with(|pool| {
+                let mut pool = pool.borrow_mut();
+                if pool.len() < MAX_POOLED_STACKS {
+                    pool.push(values);
+                }
+            })
+            .ok();
+    }
+}
+
 impl Stack {
+    /// Creates an empty stack, reusing the allocation of a finished one.
+    pub fn new() -> Stack {
+        let values = STACK_POOL
+            .try_with(|pool| pool.borrow_mut().pop())
+            .ok()
+            .flatten()
+            .unwrap_or_default();
+        Stack { values }
+    }
+
     pub fn push(&mut self, arg: Value) {
         self.values.push(arg);
     }
@@ -178,20 +397,53 @@ impl Stack {
 #[derive(Default)]
 pub struct Context<'env, 'vm> {
     stack: Vec<Frame<'env, 'vm>>,
+    scoped_globals: RefCell<BTreeMap<String, Value>>,
 }
 
 impl<'env, 'vm> fmt::Debug for Context<'env, 'vm> {
     fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        self.debug_with(f, None)
+    }
+}
+
+/// Debug formats a context with the repr limits of the environment.
+struct LimitedContext<'a, 'env, 'vm>(&'a Context<'env, 'vm>, PrettyPrinter);
+
+impl<'a, 'env, 'vm> fmt::Debug for LimitedContext<'a, 'env, 'vm> {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        self.0.debug_with(f, Some(&self.1))
+    }
+}
+
+impl<'env, 'vm> Context<'env, 'vm> {
+    fn debug_with(
+        &self,
+        f: &mut fmt::Formatter<'_>,
+        printer: Option<&PrettyPrinter>,
+    ) -> fmt::Result {
+        fn entry(
+            m: &mut std::fmt::DebugMap,
+            key: &str,
+            value: &Value,
+            printer: Option<&PrettyPrinter>,
+        ) {
+            match printer {
+                Some(printer) => m.entry(&key, &Repr(value, printer)),
+                None => m.entry(&key, value),
+            };
+        }
+
         fn dump<'a>(
             m: &mut std::fmt::DebugMap,
             seen: &mut HashSet<&'a str>,
             ctx: &'a Context<'a, 'a>,
+            printer: Option<&PrettyPrinter>,
         ) -> fmt::Result {
             for frame in ctx.stack.iter().rev() {
                 for (key, value) in frame.locals.iter() {
                     if !seen.contains(key) {
                         seen.insert(*key);
-                        m.entry(key, value);
+                        entry(m, key, value, printer);
                     }
                 }
 
@@ -204,13 +456,13 @@ impl<'env, 'vm> fmt::Debug for Context<'env, 'vm> {
 
                 match frame.base {
                     FrameBase::Context(ctx) => {
-                        dump(m, seen, ctx)?;
+                        dump(m, seen, ctx, printer)?;
                     }
                     FrameBase::Value(ref value) => {
                         for (key, value) in value.iter_as_str_map() {
                             if !seen.contains(key) {
                                 seen.insert(key);
-                                m.entry(&key, &value);
+                                entry(m, key, &value, printer);
                             }
                         }
                     }
@@ -222,7 +474,7 @@ impl<'env, 'vm> fmt::Debug for Context<'env, 'vm> {
 
         let mut m = f.debug_map();
         let mut seen = HashSet::new();
-        dump(&mut m, &mut seen, self)?;
+        dump(&mut m, &mut seen, self, printer)?;
         m.finish()
     }
 }
@@ -231,9 +483,8 @@ impl<'env, 'vm> Context<'env, 'vm> {
     /// Freezes the context.
     ///
     /// This implementation is not particularly beautiful and highly inefficient.
-    /// Since it's only used for the debug support changing this is not too
-    /// critical.
-    #[cfg(feature = "debug")]
+    /// Since it's only used for the debug support and once per expression
+    /// evaluation changing this is not too critical.
     fn freeze<'a>(&'a self, env: &'a Environment) -> Locals {
         let mut rv = Locals::new();
 
@@ -275,6 +526,24 @@ impl<'env, 'vm> Context<'env, 'vm> {
 
     /// Looks up a variable in the context.
     pub fn load(&self, env: &Environment, key: &str) -> Option<Value> {
+        self.load_local(key).or_else(|| {
+            env.get_global(key)
+                .or_else(|| self.outermost().load_scoped_global(env, key))
+        })
+    }
+
+    /// Returns the context that holds the scoped globals.
+    fn outermost(&self) -> &Context<'env, 'vm> {
+        for frame in self.stack.iter().rev() {
+            if let FrameBase::Context(ctx) = frame.base {
+                return ctx.outermost();
+            }
+        }
+        self
+    }
+
+    /// Looks up a variable in the context without falling back to globals.
+    fn load_local(&self, key: &str) -> Option<Value> {
         for frame in self.stack.iter().rev() {
             // look at locals first
             if let Some(value) = frame.locals.get(key) {
@@ -291,17 +560,14 @@ impl<'env, 'vm> Context<'env, 'vm> {
             }
 
             match frame.base {
-                FrameBase::Context(ctx) => return ctx.load(env, key),
+                FrameBase::Context(ctx) => return ctx.load_local(key),
                 FrameBase::Value(ref value) => {
-                    let rv = value.get_attr(key);
+                    let rv = value.get_attr_with_fallback(key, true);
                     if let Ok(rv) = rv {
                         if !rv.is_undefined() {
                             return Some(rv);
                         }
                     }
-                    if let Some(value) = env.get_global(key) {
-                        return Some(value);
-                    }
                 }
                 FrameBase::None => continue,
             }
@@ -309,6 +575,28 @@ impl<'env, 'vm> Context<'env, 'vm> {
         None
     }
 
+    /// Looks up a scoped global, creating it on first use.
+    fn load_scoped_global(&self, env: &Environment, key: &str) -> Option<Value> {
+        let factory = env.get_scoped_global(key)?;
+        let mut scoped_globals = self.scoped_globals.borrow_mut();
+        if let Some(value) = scoped_globals.get(key) {
+            return Some(value.clone());
+        }
+        let value = factory();
+        scoped_globals.insert(key.to_string(), value.clone());
+        Some(value)
+    }
+
+    /// Returns the variables stored in the topmost layer.
+    pub fn exports(&self) -> Value {
+        Value::from(
+            self.stack
+                .last()
+                .map(|frame| frame.locals.clone())
+                .unwrap_or_default(),
+        )
+    }
+
     /// Pushes a new layer.
     pub fn push_frame(&mut self, layer: Frame<'env, 'vm>) {
         self.stack.push(layer);
@@ -343,6 +631,8 @@ pub struct State<'vm, 'env> {
     pub(crate) name: &'env str,
     pub(crate) current_block: Option<&'env str>,
     pub(crate) auto_escape: AutoEscape,
+    pub(crate) vm: Option<&'vm Vm<'env>>,
+    pub(crate) detached_temps: RefCell<Temps>,
 }
 
 impl<'vm, 'env> fmt::Debug for State<'vm, 'env> {
@@ -351,13 +641,42 @@ impl<'vm, 'env> fmt::Debug for State<'vm, 'env> {
         ds.field("name", &self.name);
         ds.field("current_block", &self.current_block);
         ds.field("auto_escape", &self.auto_escape);
-        ds.field("ctx", &self.ctx);
+        let limits = self.env.repr_limits();
+        if limits == ReprLimits::default() {
+            ds.field("ctx", &self.ctx);
+        } else {
+            ds.field("ctx", &LimitedContext(&self.ctx, limits.into()));
+        }
         ds.field("env", &self.env);
         ds.finish()
     }
 }
 
 impl<'vm, 'env> State<'vm, 'env> {
+    /// Creates a state that is not bound to a render.
+    pub(crate) fn new_detached(env: &'env Environment<'env>, root: Value) -> State<'vm, 'env> {
+        let mut ctx = Context::default();
+        ctx.push_frame(Frame::new(FrameBase::Value(root)));
+        State {
+            env,
+            ctx,
+            name: "<unknown>",
+            current_block: None,
+            auto_escape: AutoEscape::None,
+            vm: None,
+            detached_temps: RefCell::default(),
+        }
+    }
+
+    /// Returns the state with a different auto escaping.
+    ///
+    /// This is useful together with [`Environment::new_state`] to test
+    /// filters that behave differently depending on the auto escaping.
+    pub fn with_auto_escape(mut self, auto_escape: AutoEscape) -> State<'vm, 'env> {
+        self.auto_escape = auto_escape;
+        self
+    }
+
     /// Returns a reference to the current environment.
     pub fn env(&self) -> &Environment<'env> {
         self.env
@@ -373,6 +692,66 @@ impl<'vm, 'env> State<'vm, 'env> {
         self.auto_escape
     }
 
+    /// Renders another template and returns the output as safe string.
+    ///
+    /// The template only sees the given context, not the variables of the
+    /// current template.  It is rendered with its own auto escaping and
+    /// the result is marked as safe.  Names starting with `./` or `../` are
+    /// resolved relative to the current template.  Unlike rendering a
+    /// template obtained from [`Environment::get_template`] directly, the
+    /// render counts towards the include depth and uses up the fuel of the
+    /// current render.
+    ///
+    /// ```
+    /// # use minijinja::{context, Environment, Error, State};
+    /// # use minijinja::value::Value;
+    /// fn card(state: &State, title: String) -> Result<Value, Error> {
+    ///     state.render_template("card.html", context!(title))
+    /// }
+    ///
+    /// let mut env = Environment::new();
+    /// env.add_function("card", card);
+    /// env.add_template("card.html", "<h2>{{ title }}</h2>").unwrap();
+    /// env.add_template("page.html", "{{ card('A & B') }}").unwrap();
+    /// let rv = env.get_template("page.html").unwrap().render(()).unwrap();
+    /// assert_eq!(rv, "<h2>A &amp; B</h2>");
+    /// ```
+    pub fn render_template<S: Serialize>(&self, name: &str, ctx: S) -> Result<Value, Error> {
+        self._render_template(name, Value::from_serializable(&ctx))
+    }
+
+    /// Renders another template into a [`Write`](std::io::Write).
+    ///
+    /// This works like [`render_template`](Self::render_template) but writes
+    /// the output into the given writer once rendering succeeded instead of
+    /// returning it as value.
+    pub fn render_template_to<S: Serialize, W: std::io::Write>(
+        &self,
+        name: &str,
+        ctx: S,
+        mut w: W,
+    ) -> Result<(), Error> {
+        let output = self._render_template_output(name, Value::from_serializable(&ctx))?;
+        w.write_all(output.as_bytes()).map_err(|err| {
+            Error::new(ErrorKind::InvalidOperation, "failed to write output").with_source(err)
+        })
+    }
+
+    fn _render_template_output(&self, name: &str, ctx: Value) -> Result<Output, Error> {
+        match self.vm {
+            Some(vm) => vm.render_template(self.name, name, ctx),
+            None => Vm::new(self.env).render_template(self.name, name, ctx),
+        }
+    }
+
+    fn _render_template(&self, name: &str, ctx: Value) -> Result<Value, Error> {
+        let output = self._render_template_output(name, ctx)?;
+        Ok(match String::from_utf8(output.into_bytes()) {
+            Ok(rv) => Value::from_safe_string(rv),
+            Err(err) => Value::from_bytes(err.into_bytes()),
+        })
+    }
+
     /// Returns the name of the innermost block.
     pub fn current_block(&self) -> Option<&str> {
         self.current_block
@@ -383,6 +762,106 @@ impl<'vm, 'env> State<'vm, 'env> {
         self.ctx.load(self.env(), name)
     }
 
+    /// Fails if allocating `bytes` would exceed the memory budget.
+    ///
+    /// This is checked by filters and functions before they allocate large
+    /// values.  Nothing is taken from the budget, the returned value is
+    /// accounted for by the VM.
+    #[cfg(feature = "builtins")]
+    pub(crate) fn check_memory(&self, bytes: usize) -> Result<(), Error> {
+        match self.vm.and_then(|vm| vm.memory_budget.get()) {
+            Some(budget) if bytes > budget => Err(Error::from(ErrorKind::MemoryBudgetExceeded)),
+            _ => Ok(()),
+        }
+    }
+
+    /// Fails if the undefined behavior does not permit the use of an
+    /// undefined value.  `in_test` is set for boolean checks.
+    ///
+    /// This is checked by filters that print or iterate over their input.
+    pub(crate) fn check_undefined(&self, value: &Value, in_test: bool) -> Result<(), Error> {
+        let behavior = match self.vm {
+            Some(vm) => vm.undefined_behavior,
+            None => self.env.undefined_behavior(),
+        };
+        check_undefined(behavior, value, in_test)
+    }
+
+    fn with_temps<R, F: FnOnce(&mut Temps) -> R>(&self, f: F) -> R {
+        if let Some(vm) = self.vm {
+            if let Some(temps) = vm.temps.borrow_mut().last_mut() {
+                return f(temps);
+            }
+        }
+        f(&mut self.detached_temps.borrow_mut())
+    }
+
+    /// Looks up a temporary value.
+    ///
+    /// Temps let filters, tests and functions keep state for the duration of
+    /// a render, for instance to count invocations or to cache expensive
+    /// computations.  They are keyed by both name and type: a temp is only
+    /// found if it was stored with the same type.  Using a private type
+    /// therefore gives a filter its own namespace that cannot collide with
+    /// temps of unrelated filters.
+    ///
+    /// Temps are scoped to the current template.  Included templates (and
+    /// templates rendered with [`render_template`](Self::render_template))
+    /// start out without temps and theirs are dropped once they finish.
+    /// Blocks and parent templates share the temps of the template that is
+    /// rendered.
+    ///
+    /// ```
+    /// # use minijinja::{Environment, Error, State};
+    /// #[derive(Clone, Default)]
+    /// struct Counter(usize);
+    ///
+    /// fn next_id(state: &State) -> Result<String, Error> {
+    ///     let counter = state.get_or_set_temp("next_id", Counter::default);
+    ///     state.set_temp("next_id", Counter(counter.0 + 1));
+    ///     Ok(format!("id-{}", counter.0))
+    /// }
+    ///
+    /// let mut env = Environment::new();
+    /// env.add_function("next_id", next_id);
+    /// env.add_template("ids.txt", "{{ next_id() }} {{ next_id() }}").unwrap();
+    /// let tmpl = env.get_template("ids.txt").unwrap();
+    /// assert_eq!(tmpl.render(()).unwrap(), "id-0 id-1");
+    /// ```
+    pub fn get_temp<T: Clone + 'static>(&self, name: &str) -> Option<T> {
+        self.with_temps(|temps| temps.get::<T>(name).cloned())
+    }
+
+    /// Stores a temporary value and returns the previous value.
+    ///
+    /// See [`get_temp`](Self::get_temp) for how temps work.
+    pub fn set_temp<T: 'static>(&self, name: &str, value: T) -> Option<T> {
+        self.with_temps(|temps| temps.insert(name, value))
+    }
+
+    /// Looks up a temporary value or stores the value created by `f`.
+    ///
+    /// See [`get_temp`](Self::get_temp) for how temps work.
+    pub fn get_or_set_temp<T, F>(&self, name: &str, f: F) -> T
+    where
+        T: Clone + 'static,
+        F: FnOnce() -> T,
+    {
+        if let Some(rv) = self.get_temp(name) {
+            return rv;
+        }
+        let rv = f();
+        self.set_temp(name, rv.clone());
+        rv
+    }
+
+    /// Removes a temporary value and returns it.
+    ///
+    /// See [`get_temp`](Self::get_temp) for how temps work.
+    pub fn remove_temp<T: 'static>(&self, name: &str) -> Option<T> {
+        self.with_temps(|temps| temps.remove(name))
+    }
+
     pub(crate) fn apply_filter(
         &self,
         name: &str,
@@ -390,6 +869,7 @@ impl<'vm, 'env> State<'vm, 'env> {
         args: Vec<Value>,
     ) -> Result<Value, Error> {
         if let Some(filter) = self.env().get_filter(name) {
+            self.env().record_usage(|x| &mut x.filters, name);
             filter.apply_to(self, value, args)
         } else {
             Err(Error::new(
@@ -406,6 +886,7 @@ impl<'vm, 'env> State<'vm, 'env> {
         args: Vec<Value>,
     ) -> Result<bool, Error> {
         if let Some(test) = self.env().get_test(name) {
+            self.env().record_usage(|x| &mut x.tests, name);
             test.perform(self, value, args)
         } else {
             Err(Error::new(
@@ -415,6 +896,113 @@ impl<'vm, 'env> State<'vm, 'env> {
         }
     }
 
+    /// Evaluates an expression in the current context.
+    ///
+    /// The expression sees the same variables as the template at the point
+    /// where the function or filter was invoked, including variables set
+    /// with `{% set %}`, loop variables and globals.  The evaluation uses up
+    /// the fuel of the current render and honors its undefined behavior.
+    ///
+    /// ```
+    /// # use minijinja::{context, Environment, Error, State};
+    /// # use minijinja::value::Value;
+    /// fn subject(state: &State) -> Result<Value, Error> {
+    ///     state.eval_expr("'Welcome ' ~ user.name|title")
+    /// }
+    ///
+    /// let mut env = Environment::new();
+    /// env.add_function("subject", subject);
+    /// env.add_template("mail.txt", "{% set user = {'name': 'jane'} %}{{ subject() }}").unwrap();
+    /// let rv = env.get_template("mail.txt").unwrap().render(()).unwrap();
+    /// assert_eq!(rv, "Welcome Jane");
+    /// ```
+    pub fn eval_expr(&self, expr: &str) -> Result<Value, Error> {
+        let mut rv = self
+            .eval_expression_with_roots(expr, vec![Value::from(BTreeMap::<&str, Value>::new())])?;
+        Ok(rv.pop().unwrap_or_default())
+    }
+
+    /// Evaluates an expression once for every value.
+    ///
+    /// The value is bound to `name`, all other variables are looked up in
+    /// the current context.  The evaluation uses up the fuel of the current
+    /// render and honors its undefined behavior.
+    #[cfg(feature = "builtins")]
+    pub(crate) fn eval_expression_for_each(
+        &self,
+        expr: &str,
+        name: &str,
+        values: Vec<Value>,
+    ) -> Result<Vec<Value>, Error> {
+        let roots = values
+            .into_iter()
+            .map(|value| {
+                let mut root = BTreeMap::new();
+                root.insert(name, value);
+                Value::from(root)
+            })
+            .collect();
+        self.eval_expression_with_roots(expr, roots)
+    }
+
+    /// Evaluates an expression once for every root layered on top of the
+    /// current context.
+    fn eval_expression_with_roots(
+        &self,
+        expr: &str,
+        roots: Vec<Value>,
+    ) -> Result<Vec<Value>, Error> {
+        #[cfg(feature = "source")]
+        {
+            if let Some(vm) = self.vm {
+                let compiled = vm.compiled_expression(expr)?;
+                return self.eval_instructions_with_roots(compiled.borrow_dependent(), roots);
+            }
+        }
+        let instructions = compile_expression(self.env, expr)?;
+        self.eval_instructions_with_roots(&instructions, roots)
+    }
+
+    fn eval_instructions_with_roots(
+        &self,
+        instructions: &Instructions<'_>,
+        roots: Vec<Value>,
+    ) -> Result<Vec<Value>, Error> {
+        let blocks = BTreeMap::new();
+        let base = Value::from(self.ctx.freeze(self.env));
+
+        let mut vm = Vm::new(self.env);
+        if let Some(parent) = self.vm {
+            vm.set_undefined_behavior(parent.undefined_behavior);
+            vm.set_fuel(parent.fuel.get());
+            vm.set_cancel(parent.cancel.clone());
+            vm.set_memory_budget(parent.memory_budget.get());
+        }
+        let mut rv = Vec::with_capacity(roots.len());
+        let mut result = Ok(());
+        for root in roots {
+            match vm.eval_with_base(
+                instructions,
+                Some(base.clone()),
+                root,
+                &blocks,
+                AutoEscape::None,
+                &mut Output::new(),
+            ) {
+                Ok(value) => rv.push(value.unwrap_or_default()),
+                Err(err) => {
+                    result = Err(err);
+                    break;
+                }
+            }
+        }
+        if let Some(parent) = self.vm {
+            parent.fuel.set(vm.fuel.get());
+            parent.memory_budget.set(vm.memory_budget.get());
+        }
+        result.map(|_| rv)
+    }
+
     #[cfg(feature = "debug")]
     fn make_debug_info(
         &self,
@@ -426,7 +1014,49 @@ impl<'vm, 'env> State<'vm, 'env> {
             template_source: Some(instructions.source().to_string()),
             context: Some(Value::from(self.ctx.freeze(self.env))),
             referenced_names: Some(referenced_names.iter().map(|x| x.to_string()).collect()),
+            repr_limits: Some(self.env.repr_limits())
+                .filter(|x| *x != ReprLimits::default())
+                .map(Box::new),
+        }
+    }
+}
+
+/// Pops a template from the include stack when dropped.
+struct IncludeGuard<'a, 'env> {
+    vm: &'a Vm<'env>,
+}
+
+impl<'a, 'env> Drop for IncludeGuard<'a, 'env> {
+    fn drop(&mut self) {
+        self.vm.pop_include();
+    }
+}
+
+/// Marks a block as no longer rendering when dropped.
+struct BlockGuard<'a, 'env> {
+    vm: &'a Vm<'env>,
+}
+
+impl<'a, 'env> Drop for BlockGuard<'a, 'env> {
+    fn drop(&mut self) {
+        self.vm.block_stack.borrow_mut().pop();
+    }
+}
+
+fn check_undefined(behavior: UndefinedBehavior, value: &Value, in_test: bool) -> Result<(), Error> {
+    if value.is_undefined()
+        && match behavior {
+            UndefinedBehavior::Lenient => false,
+            UndefinedBehavior::SemiStrict => !in_test,
+            UndefinedBehavior::Strict => true,
         }
+    {
+        Err(Error::new(
+            ErrorKind::UndefinedError,
+            "undefined value used in strict mode",
+        ))
+    } else {
+        Ok(())
     }
 }
 
@@ -434,12 +1064,93 @@ impl<'vm, 'env> State<'vm, 'env> {
 #[cfg_attr(feature = "internal_debug", derive(Debug))]
 pub struct Vm<'env> {
     env: &'env Environment<'env>,
+    include_stack: RefCell<Vec<&'env str>>,
+    // blocks that are currently rendering together with the include depth
+    // they are rendering at.
+    block_stack: RefCell<Vec<(usize, &'env str)>>,
+    undefined_behavior: UndefinedBehavior,
+    fuel: Cell<Option<u64>>,
+    cancel: Option<Arc<AtomicBool>>,
+    // the remaining bytes of the memory budget.
+    memory_budget: Cell<Option<usize>>,
+    // the temps of each template on the include stack.
+    temps: RefCell<Vec<Temps>>,
+    // expressions compiled by filters and functions during the render.
+    #[cfg(feature = "source")]
+    expressions: RefCell<HashMap<String, Rc<OwnedExpression>>>,
 }
 
 impl<'env> Vm<'env> {
     /// Creates a new VM.
     pub fn new(env: &'env Environment<'env>) -> Vm<'env> {
-        Vm { env }
+        Vm {
+            env,
+            include_stack: RefCell::default(),
+            block_stack: RefCell::default(),
+            undefined_behavior: env.undefined_behavior(),
+            fuel: Cell::new(None),
+            cancel: None,
+            memory_budget: Cell::new(None),
+            temps: RefCell::default(),
+            #[cfg(feature = "source")]
+            expressions: RefCell::default(),
+        }
+    }
+
+    /// Returns an expression compiled during the render.
+    ///
+    /// The instructions own a copy of the expression so that expressions
+    /// built at runtime are kept for the rest of the render as well.
+    #[cfg(feature = "source")]
+    fn compiled_expression(&self, expr: &str) -> Result<Rc<OwnedExpression>, Error> {
+        if let Some(rv) = self.expressions.borrow().get(expr) {
+            return Ok(rv.clone());
+        }
+        let rv = Rc::new(OwnedExpression::try_new(expr.to_string(), |expr| {
+            compile_expression(self.env, expr)
+        })?);
+        self.expressions
+            .borrow_mut()
+            .insert(expr.to_string(), rv.clone());
+        Ok(rv)
+    }
+
+    /// Overrides the undefined behavior of the environment.
+    pub(crate) fn set_undefined_behavior(&mut self, behavior: UndefinedBehavior) {
+        self.undefined_behavior = behavior;
+    }
+
+    /// Limits the number of instructions the VM executes.
+    pub(crate) fn set_fuel(&mut self, fuel: Option<u64>) {
+        self.fuel.set(fuel);
+    }
+
+    /// Stops the VM once the flag is set.
+    pub(crate) fn set_cancel(&mut self, cancel: Option<Arc<AtomicBool>>) {
+        self.cancel = cancel;
+    }
+
+    /// Limits the number of bytes the VM may allocate.
+    pub(crate) fn set_memory_budget(&mut self, bytes: Option<usize>) {
+        self.memory_budget.set(bytes);
+    }
+
+    /// Takes the given number of bytes from the memory budget.
+    fn charge_memory(&self, bytes: usize) -> Result<(), Error> {
+        if let Some(budget) = self.memory_budget.get() {
+            if bytes > budget {
+                self.memory_budget.set(Some(0));
+                return Err(Error::from(ErrorKind::MemoryBudgetExceeded));
+            }
+            self.memory_budget.set(Some(budget - bytes));
+        }
+        Ok(())
+    }
+
+    /// Fails if the undefined behavior does not permit the use of an
+    /// undefined value.  `in_test` is set for boolean checks.
+    fn check_undefined(&self, value: &Value, in_test: bool) -> Result<(), Error> {
+        check_undefined(self.undefined_behavior, value, in_test)
     }
 
     /// Evaluates the given inputs
@@ -449,24 +1160,302 @@ impl<'env> Vm<'env> {
         root: Value,
         blocks: &BTreeMap<&'env str, Instructions<'env>>,
         initial_auto_escape: AutoEscape,
-        output: &mut String,
+        output: &mut Output,
+    ) -> Result<Option<Value>, Error> {
+        self.eval_with_base(
+            instructions,
+            None,
+            root,
+            blocks,
+            initial_auto_escape,
+            output,
+        )
+    }
+
+    /// Evaluates the given inputs with a base context.
+    ///
+    /// Variables are looked up in `root` first, then in `base`.
+    pub(crate) fn eval_with_base(
+        &self,
+        instructions: &Instructions<'env>,
+        base: Option<Value>,
+        root: Value,
+        blocks: &BTreeMap<&'env str, Instructions<'env>>,
+        initial_auto_escape: AutoEscape,
+        output: &mut Output,
+    ) -> Result<Option<Value>, Error> {
+        self.eval_root(
+            instructions,
+            base,
+            root,
+            blocks,
+            initial_auto_escape,
+            output,
+            None,
+        )
+    }
+
+    /// Like [`eval_with_base`](Self::eval_with_base) but also stores the
+    /// variables set at the top level of the template in `exports`.
+    #[allow(clippy::too_many_arguments)]
+    pub(crate) fn eval_root(
+        &self,
+        instructions: &Instructions<'env>,
+        base: Option<Value>,
+        root: Value,
+        blocks: &BTreeMap<&'env str, Instructions<'env>>,
+        initial_auto_escape: AutoEscape,
+        output: &mut Output,
+        exports: Option<&mut Value>,
+    ) -> Result<Option<Value>, Error> {
+        self.eval_layers(
+            instructions,
+            base,
+            root,
+            block_layers(blocks),
+            None,
+            initial_auto_escape,
+            output,
+            exports,
+        )
+    }
+
+    /// Evaluates a single block of a template in isolation.
+    ///
+    /// Blocks the template does not define are looked up in the templates it
+    /// extends and `super()` renders the definition of the parent template.
+    /// Only templates extended with a constant name are followed.  Returns
+    /// `false` if no template in the chain defines the block.
+    pub(crate) fn eval_block(
+        &self,
+        tmpl: Template<'env>,
+        name: &str,
+        base: Option<Value>,
+        root: Value,
+        initial_auto_escape: AutoEscape,
+        output: &mut Output,
+    ) -> Result<bool, Error> {
+        let mut chain = vec![tmpl.instructions().name()];
+        let mut layers = BTreeMap::new();
+        let mut current = tmpl;
+        loop {
+            for (name, instr) in current.blocks().iter() {
+                layers.entry(*name).or_insert_with(Vec::new).push(instr);
+            }
+            let parent = match current.parent() {
+                Some(parent) => self.get_template(current.instructions().name(), parent)?,
+                None => break,
+            };
+            let parent_name = parent.instructions().name();
+            if chain.contains(&parent_name) {
+                return Err(Error::new(
+                    ErrorKind::ImpossibleOperation,
+                    format!(
+                        "cycle in template inheritance: {}",
+                        format_template_chain(&chain, parent_name)
+                    ),
+                ));
+            }
+            chain.push(parent_name);
+            current = parent;
+        }
+        let (name, instructions) = match layers.get_key_value(name) {
+            Some((name, layers)) => (*name, layers[0]),
+            None => return Ok(false),
+        };
+        self.eval_layers(
+            instructions,
+            base,
+            root,
+            Rc::new(layers),
+            Some(name),
+            initial_auto_escape,
+            output,
+            None,
+        )?;
+        Ok(true)
+    }
+
+    #[allow(clippy::too_many_arguments)]
+    fn eval_layers(
+        &self,
+        instructions: &Instructions<'env>,
+        base: Option<Value>,
+        root: Value,
+        referenced_blocks: BlockLayers<'_, 'env>,
+        current_block: Option<&'env str>,
+        initial_auto_escape: AutoEscape,
+        output: &mut Output,
+        exports: Option<&mut Value>,
     ) -> Result<Option<Value>, Error> {
         let mut ctx = Context::default();
-        ctx.push_frame(Frame::new(FrameBase::Value(root)));
-        let mut referenced_blocks = BTreeMap::new();
-        for (&name, instr) in blocks.iter() {
-            referenced_blocks.insert(name, vec![instr]);
+        if let Some(base) = base {
+            ctx.push_frame(Frame::new(FrameBase::Value(base)));
         }
+        ctx.push_frame(Frame::new(FrameBase::Value(root)));
         let mut state = State {
             env: self.env,
             ctx,
             auto_escape: initial_auto_escape,
-            current_block: None,
+            current_block,
             name: instructions.name(),
+            vm: Some(self),
+            detached_temps: RefCell::default(),
         };
-        value::with_value_optimization(|| {
+        let _include = self.push_include(instructions.name());
+        let rv = value::with_value_optimization(|| {
             self.eval_state(&mut state, instructions, referenced_blocks, output)
-        })
+        })?;
+        if let Some(exports) = exports {
+            *exports = state.ctx.exports();
+        }
+        Ok(rv)
+    }
+
+    /// Renders a template with only the given context.
+    ///
+    /// The template is on the include stack (with its own temps) until the
+    /// render finished or failed, the caller has to check the include depth
+    /// first.
+    fn render_isolated(
+        &self,
+        tmpl: Template<'env>,
+        ctx: Value,
+        output: &mut Output,
+    ) -> Result<(), Error> {
+        let instructions = tmpl.instructions();
+        let referenced_blocks = block_layers(tmpl.blocks());
+        let mut sub_context = Context::default();
+        sub_context.push_frame(Frame::new(FrameBase::Value(ctx)));
+        let mut sub_state = State {
+            env: self.env,
+            ctx: sub_context,
+            auto_escape: tmpl.initial_auto_escape(),
+            current_block: None,
+            name: instructions.name(),
+            vm: Some(self),
+            detached_temps: RefCell::default(),
+        };
+        let _include = self.push_include(instructions.name());
+        self.eval_state(&mut sub_state, instructions, referenced_blocks, output)?;
+        Ok(())
+    }
+
+    /// Renders the template `name` from within the template `current`.
+    pub(crate) fn render_template(
+        &self,
+        current: &str,
+        name: &str,
+        ctx: Value,
+    ) -> Result<Output, Error> {
+        let tmpl = self.get_template(current, name)?;
+        self.check_include_depth(tmpl.instructions().name())?;
+        let mut output = Output::new();
+        self.render_isolated(tmpl, ctx, &mut output)?;
+        Ok(output)
+    }
+
+    /// Pushes a template to the include stack with empty temps.
+    ///
+    /// The template is popped again when the returned guard is dropped.
+    #[must_use]
+    fn push_include(&self, name: &'env str) -> IncludeGuard<'_, 'env> {
+        self.include_stack.borrow_mut().push(name);
+        self.temps.borrow_mut().push(Temps::default());
+        IncludeGuard { vm: self }
+    }
+
+    /// Pops a template from the include stack and drops its temps.
+    fn pop_include(&self) {
+        self.include_stack.borrow_mut().pop();
+        self.temps.borrow_mut().pop();
+    }
+
+    /// Looks up a template referenced from the template `current`.
+    ///
+    /// Names starting with `./` or `../` are resolved relative to `current`.
+    fn get_template(&self, current: &str, name: &str) -> Result<Template<'env>, Error> {
+        let tmpl = self.env.get_template(&join_template_name(current, name)?)?;
+        self.env.record_usage(|x| &mut x.templates, tmpl.name());
+        Ok(tmpl)
+    }
+
+    /// Marks a block as rendering and fails if it is rendering already.
+    ///
+    /// Blocks can invoke other blocks through `self`.  A block that directly
+    /// or indirectly invokes itself would recurse forever.  Blocks of
+    /// included templates are tracked separately as templates can be
+    /// included recursively.  The block is marked as no longer rendering
+    /// when the returned guard is dropped.
+    fn enter_block(&self, name: &'env str) -> Result<BlockGuard<'_, 'env>, Error> {
+        let depth = self.include_stack.borrow().len();
+        let mut block_stack = self.block_stack.borrow_mut();
+        let active = block_stack
+            .iter()
+            .filter(|x| x.0 == depth)
+            .map(|x| x.1)
+            .collect::<Vec<_>>();
+        if active.contains(&name) {
+            return Err(Error::new(
+                ErrorKind::ImpossibleOperation,
+                format!(
+                    "cycle in block rendering: {}",
+                    format_template_chain(&active, name)
+                ),
+            ));
+        }
+        block_stack.push((depth, name));
+        Ok(BlockGuard { vm: self })
+    }
+
+    /// Fails if including another template would exceed the include depth.
+    fn check_include_depth(&self, name: &str) -> Result<(), Error> {
+        let include_stack = self.include_stack.borrow();
+        let max_depth = self.env.max_include_depth();
+        if include_stack.len() <= max_depth {
+            return Ok(());
+        }
+        Err(Error::new(
+            ErrorKind::ImpossibleOperation,
+            if include_stack.contains(&name) {
+                format!(
+                    "cycle in template includes: {} (exceeded maximum \
+                     include depth of {})",
+                    format_template_chain(&include_stack, name),
+                    max_depth
+                )
+            } else {
+                format!("exceeded maximum include depth of {}", max_depth)
+            },
+        ))
+    }
+
+    /// Attaches the location of an instruction to an error.
+    ///
+    /// The evaluation loop fails in many places.  Keeping this out of line
+    /// keeps its stack frame small which matters for recursive includes.
+    #[inline(never)]
+    fn annotate_error(
+        &self,
+        mut err: Error,
+        state: &State<'_, 'env>,
+        instructions: &Instructions<'env>,
+        pc: usize,
+    ) -> Error {
+        if let Some(lineno) = instructions.get_line(pc) {
+            err.set_location(instructions.name(), lineno);
+        }
+        #[cfg(feature = "debug")]
+        {
+            if self.env.debug() && err.debug_info.is_none() {
+                err.debug_info = Some(state.make_debug_info(pc, instructions));
+            }
+        }
+        #[cfg(not(feature = "debug"))]
+        {
+            let _state = state;
+        }
+        err
     }
 
     /// This is the actual evaluation loop that works with a specific context.
@@ -474,30 +1463,21 @@ impl<'env> Vm<'env> {
         &self,
         state: &mut State<'_, 'env>,
         mut instructions: &Instructions<'env>,
-        mut blocks: BTreeMap<&'env str, Vec<&'_ Instructions<'env>>>,
-        output: &mut String,
+        mut blocks: BlockLayers<'_, 'env>,
+        output: &mut Output,
     ) -> Result<Option<Value>, Error> {
         let initial_auto_escape = state.auto_escape;
-        let mut stack = Stack { values: Vec::new() };
+        let mut stack = Stack::new();
         let mut auto_escape_stack = vec![];
         let mut capture_stack = vec![];
         let mut block_stack = vec![];
         let mut next_loop_recursion_jump = None;
+        let mut extends_chain = vec![];
         let mut pc = 0;
 
         macro_rules! bail {
             ($err:expr) => {{
-                let mut err = $err;
-                if let Some(lineno) = instructions.get_line(pc) {
-                    err.set_location(instructions.name(), lineno);
-                }
-                #[cfg(feature = "debug")]
-                {
-                    if self.env.debug() && err.debug_info.is_none() {
-                        err.debug_info = Some(state.make_debug_info(pc, &instructions));
-                    }
-                }
-                return Err(err);
+                return Err(self.annotate_error($err, state, instructions, pc));
             }};
         }
 
@@ -526,6 +1506,22 @@ impl<'env> Vm<'env> {
             }};
         }
 
+        macro_rules! op_cmp {
+            ($op:tt) => {{
+                let b = stack.pop();
+                let a = stack.pop();
+                if self.undefined_behavior == UndefinedBehavior::Strict
+                    && a.partial_cmp(&b).is_none()
+                {
+                    bail!(Error::new(
+                        ErrorKind::ImpossibleOperation,
+                        format!("cannot compare {} with {}", a.kind(), b.kind())
+                    ));
+                }
+                stack.push(Value::from(a $op b));
+            }};
+        }
+
         macro_rules! out {
             () => {
                 capture_stack.last_mut().unwrap_or(output)
@@ -534,18 +1530,24 @@ impl<'env> Vm<'env> {
 
         macro_rules! begin_capture {
             () => {
-                capture_stack.push(String::new());
+                capture_stack.push(Output::new());
             };
         }
 
         macro_rules! end_capture {
             () => {{
-                let captured = capture_stack.pop().unwrap();
-                // TODO: this should take the right auto escapine flag into account
-                stack.push(if !matches!(state.auto_escape, AutoEscape::None) {
-                    Value::from_safe_string(captured)
-                } else {
-                    Value::from(captured)
+                let captured = capture_stack.pop().unwrap().into_bytes();
+                stack.push(match String::from_utf8(captured) {
+                    // TODO: this should take the right auto escapine flag into account
+                    Ok(captured) => {
+                        if !matches!(state.auto_escape, AutoEscape::None) {
+                            Value::from_safe_string(captured)
+                        } else {
+                            Value::from(captured)
+                        }
+                    }
+                    // byte values were emitted, retain the captured bytes
+                    Err(err) => Value::from_bytes(err.into_bytes()),
                 });
             }};
         }
@@ -568,6 +1570,8 @@ impl<'env> Vm<'env> {
                     auto_escape: $auto_escape,
                     current_block: $current_block,
                     name: $instructions.name(),
+                    vm: Some(self),
+                    detached_temps: RefCell::default(),
                 };
                 self.eval_state(&mut sub_state, $instructions, $blocks, out!())?;
             }};
@@ -585,18 +1589,39 @@ impl<'env> Vm<'env> {
                         ));
                     }
                 };
-                if let Some(layers) = inner_blocks.get_mut(name) {
-                    layers.remove(0);
-                    let instructions = layers.first().unwrap();
-                    if $capture {
-                        begin_capture!();
+                // the table is shared with the caller, so this copies it
+                // before dropping the topmost layer.
+                let instructions = match Rc::make_mut(&mut inner_blocks).get_mut(name) {
+                    Some(layers) if layers.len() > 1 => {
+                        layers.remove(0);
+                        layers[0]
                     }
-                    sub_eval!(instructions);
-                    if $capture {
-                        end_capture!();
+                    Some(_) => {
+                        bail!(Error::new(
+                            ErrorKind::ImpossibleOperation,
+                            "no parent block exists",
+                        ));
                     }
-                } else {
-                    panic!("attempted to super unreferenced block");
+                    None => {
+                        bail!(Error::new(
+                            ErrorKind::ImpossibleOperation,
+                            format!("cannot super unknown block {}", name),
+                        ));
+                    }
+                };
+                if $capture {
+                    begin_capture!();
+                }
+                // the parent layer must only see the remaining layers so
+                // that a super call in there goes up one more level.
+                sub_eval!(
+                    instructions,
+                    inner_blocks,
+                    state.current_block,
+                    state.auto_escape
+                );
+                if $capture {
+                    end_capture!();
                 }
             };
         }
@@ -630,42 +1655,141 @@ impl<'env> Vm<'env> {
             };
         }
 
+        #[cfg(feature = "debug")]
+        let debugger = self.env.debugger();
+        #[cfg(feature = "debug")]
+        let mut last_line = None;
+        #[cfg(feature = "debug")]
+        {
+            if let Some(debugger) = debugger {
+                debugger.enter_template(state);
+            }
+        }
+
         while let Some(instr) = instructions.get(pc) {
+            if let Some(fuel) = self.fuel.get() {
+                if fuel == 0 {
+                    bail!(Error::new(
+                        ErrorKind::InvalidOperation,
+                        "engine ran out of fuel"
+                    ));
+                }
+                self.fuel.set(Some(fuel - 1));
+            }
+            if let Some(ref cancel) = self.cancel {
+                if cancel.load(Ordering::Relaxed) {
+                    bail!(Error::new(
+                        ErrorKind::InvalidOperation,
+                        "render was cancelled"
+                    ));
+                }
+            }
+
+            #[cfg(feature = "debug")]
+            {
+                if let Some(debugger) = debugger {
+                    let line = instructions.get_line(pc);
+                    if line != last_line {
+                        last_line = line;
+                        if let Some(line) = line {
+                            let location = Location {
+                                name: instructions.name(),
+                                line,
+                            };
+                            try_ctx!(debugger.before_line(state, &location));
+                        }
+                    }
+                }
+            }
+
             match instr {
                 Instruction::EmitRaw(val) => {
+                    try_ctx!(self.charge_memory(val.len()));
                     write!(out!(), "{}", val).unwrap();
                 }
                 Instruction::Emit => {
-                    try_ctx!(self.env.finalize(&stack.pop(), state.auto_escape, out!()));
+                    let value = try_ctx!(stack.pop().resolve_lazy_deep());
+                    try_ctx!(self.check_undefined(&value, false));
+                    let len_before = out!().as_bytes().len();
+                    try_ctx!(self.env.format(&value, state, out!()));
+                    try_ctx!(self.charge_memory(out!().as_bytes().len() - len_before));
                 }
                 Instruction::StoreLocal(name) => {
                     state.ctx.store(name, stack.pop());
                 }
+                Instruction::SetAttr(name) => {
+                    let obj = stack.pop();
+                    let value = stack.pop();
+                    try_ctx!(set_namespace_attr(&obj, name, value));
+                }
                 Instruction::Lookup(name) => {
-                    stack.push(state.ctx.load(self.env, name).unwrap_or(Value::UNDEFINED));
+                    let value = state.ctx.load(self.env, name).unwrap_or(Value::UNDEFINED);
+                    stack.push(try_ctx!(value.resolve_lazy()));
                 }
                 Instruction::GetAttr(name) => {
                     let value = stack.pop();
-                    stack.push(try_ctx!(value.get_attr(name)));
+                    let fallback = !self.env.strict_attribute_lookup();
+                    stack.push(try_ctx!(value
+                        .get_attr_with_fallback(name, fallback)
+                        .and_then(Value::resolve_lazy)));
                 }
                 Instruction::GetItem => {
                     let attr = stack.pop();
                     let value = stack.pop();
-                    stack.push(try_ctx!(value.get_item(&attr)));
+                    let fallback = !self.env.strict_attribute_lookup();
+                    stack.push(try_ctx!(value
+                        .get_item_with_fallback(&attr, fallback)
+                        .and_then(Value::resolve_lazy)));
+                }
+                Instruction::ProbeAttr(name) => {
+                    let value = stack.pop();
+                    if value.is_undefined() {
+                        stack.push(Value::UNDEFINED);
+                    } else {
+                        let fallback = !self.env.strict_attribute_lookup();
+                        stack.push(try_ctx!(value
+                            .get_attr_with_fallback(name, fallback)
+                            .and_then(Value::resolve_lazy)));
+                    }
+                }
+                Instruction::ProbeItem => {
+                    let attr = stack.pop();
+                    let value = stack.pop();
+                    if value.is_undefined() {
+                        stack.push(Value::UNDEFINED);
+                    } else {
+                        let fallback = !self.env.strict_attribute_lookup();
+                        stack.push(try_ctx!(value
+                            .get_item_with_fallback(&attr, fallback)
+                            .and_then(Value::resolve_lazy)));
+                    }
+                }
+                Instruction::Slice => {
+                    let step = stack.pop();
+                    let stop = stack.pop();
+                    let start = stack.pop();
+                    let obj = stack.pop();
+                    stack.push(try_ctx!(value::slice(obj, start, stop, step)));
                 }
                 Instruction::LoadConst(value) => {
                     stack.push(value.clone());
                 }
                 Instruction::BuildMap(pair_count) => {
-                    let mut map = BTreeMap::new();
+                    try_ctx!(self.charge_memory(pair_count * 2 * std::mem::size_of::<Value>()));
+                    let mut pairs = Vec::with_capacity(*pair_count);
                     for _ in 0..*pair_count {
                         let value = stack.pop();
                         let key: Key = try_ctx!(stack.pop().try_into_key());
-                        map.insert(key, value);
+                        pairs.push((key, value));
                     }
-                    stack.push(Value::from(map));
+                    // insert in source order so that later keys win and
+                    // ordered maps retain the order of keyword arguments.
+                    pairs.reverse();
+                    let map = pairs.into_iter().collect::<ValueMap<_, _>>();
+                    stack.push(Value(ValueRepr::Map(RcType::new(map))));
                 }
                 Instruction::BuildList(count) => {
+                    try_ctx!(self.charge_memory(count * std::mem::size_of::<Value>()));
                     let mut v = Vec::new();
                     for _ in 0..*count {
                         v.push(stack.pop());
@@ -674,33 +1798,77 @@ impl<'env> Vm<'env> {
                     stack.push(v.into());
                 }
                 Instruction::UnpackList(count) => {
-                    let mut v = try_ctx!(stack.pop().try_into_vec().map_err(|e| {
-                        Error::new(
-                            ErrorKind::ImpossibleOperation,
-                            "cannot unpack: not a sequence",
-                        )
-                        .with_source(e)
-                    }));
-                    if v.len() != *count {
-                        bail!(Error::new(
-                            ErrorKind::ImpossibleOperation,
-                            format!(
-                                "cannot unpack: sequence of wrong length (expected {}, got {})",
-                                *count,
-                                v.len()
-                            )
-                        ));
-                    }
+                    let mut v = try_ctx!(unpack_sequence(stack.pop(), *count, None));
                     for _ in 0..*count {
                         stack.push(v.pop().unwrap());
                     }
                 }
+                Instruction::UnpackListStarred(before, after) => {
+                    let mut v = try_ctx!(unpack_sequence(
+                        stack.pop(),
+                        *before + *after,
+                        Some(*before)
+                    ));
+                    let rest = v.split_off(*before);
+                    let mut rest = rest.into_iter();
+                    let mut tail = rest.by_ref().rev().take(*after).collect::<Vec<_>>();
+                    tail.reverse();
+                    v.push(Value::from(rest.collect::<Vec<_>>()));
+                    v.extend(tail);
+                    while let Some(item) = v.pop() {
+                        stack.push(item);
+                    }
+                }
                 Instruction::ListAppend => {
                     let item = stack.pop();
                     let mut list = try_ctx!(stack.pop().try_into_vec());
                     list.push(item);
                     stack.push(Value::from(list));
                 }
+                Instruction::ListExtend => {
+                    let items = stack.pop();
+                    let mut list = try_ctx!(stack.pop().try_into_vec());
+                    if items.kind() != ValueKind::Seq {
+                        bail!(Error::new(
+                            ErrorKind::ImpossibleOperation,
+                            format!("cannot splat value of type {} as arguments", items.kind()),
+                        ));
+                    }
+                    list.extend(try_ctx!(items.try_into_vec()));
+                    stack.push(Value::from(list));
+                }
+                Instruction::MergeKwargs(count) => {
+                    let mut chunks = Vec::with_capacity(*count);
+                    for _ in 0..*count {
+                        chunks.push(stack.pop());
+                    }
+                    chunks.reverse();
+                    let mut kwargs = ValueMap::new();
+                    for chunk in chunks {
+                        if chunk.kind() != ValueKind::Map {
+                            bail!(Error::new(
+                                ErrorKind::ImpossibleOperation,
+                                format!(
+                                    "cannot splat value of type {} as keyword arguments",
+                                    chunk.kind()
+                                ),
+                            ));
+                        }
+                        for (key, value) in chunk.iter_as_str_map() {
+                            if kwargs.insert(Key::make_string_key(key), value).is_some() {
+                                bail!(Error::new(
+                                    ErrorKind::ImpossibleOperation,
+                                    format!("duplicate keyword argument {}", key),
+                                ));
+                            }
+                        }
+                    }
+                    let mut list = try_ctx!(stack.pop().try_into_vec());
+                    if !kwargs.is_empty() {
+                        list.push(Value(ValueRepr::Map(RcType::new(kwargs))));
+                    }
+                    stack.push(Value::from(list));
+                }
                 Instruction::Add => func_binop!(add),
                 Instruction::Sub => func_binop!(sub),
                 Instruction::Mul => func_binop!(mul),
@@ -710,22 +1878,27 @@ impl<'env> Vm<'env> {
                 Instruction::Pow => func_binop!(pow),
                 Instruction::Eq => op_binop!(==),
                 Instruction::Ne => op_binop!(!=),
-                Instruction::Gt => op_binop!(>),
-                Instruction::Gte => op_binop!(>=),
-                Instruction::Lt => op_binop!(<),
-                Instruction::Lte => op_binop!(<=),
+                Instruction::Gt => op_cmp!(>),
+                Instruction::Gte => op_cmp!(>=),
+                Instruction::Lt => op_cmp!(<),
+                Instruction::Lte => op_cmp!(<=),
                 Instruction::Not => {
                     let a = stack.pop();
+                    try_ctx!(self.check_undefined(&a, true));
                     stack.push(Value::from(!a.is_true()));
                 }
                 Instruction::StringConcat => {
                     let a = stack.pop();
                     let b = stack.pop();
+                    try_ctx!(self.check_undefined(&a, false));
+                    try_ctx!(self.check_undefined(&b, false));
+                    try_ctx!(self.charge_memory(approx_value_size(&a) + approx_value_size(&b)));
                     stack.push(value::string_concat(b, &a));
                 }
                 Instruction::In => {
                     let container = stack.pop();
                     let value = stack.pop();
+                    try_ctx!(self.check_undefined(&container, false));
                     stack.push(try_ctx!(value::contains(&container, &value)));
                 }
                 Instruction::Neg => {
@@ -749,8 +1922,13 @@ impl<'env> Vm<'env> {
                 }
                 Instruction::PushLoop(flags) => {
                     let iterable = stack.pop();
-                    let iterator = iterable.iter();
-                    let len = iterator.len();
+                    try_ctx!(self.check_undefined(&iterable, false));
+                    let iterator = if *flags & LOOP_FLAG_PAIRS != 0 {
+                        iterable.iter_pairs()
+                    } else {
+                        iterable.iter()
+                    };
+                    let len = iterator.known_len().unwrap_or(UNKNOWN_LEN);
                     let depth = state
                         .ctx
                         .current_loop()
@@ -777,7 +1955,7 @@ impl<'env> Vm<'env> {
                     l.controller.idx.fetch_add(1, Ordering::Relaxed);
                     match l.iterator.next() {
                         Some(item) => {
-                            stack.push(item);
+                            stack.push(try_ctx!(item.resolve_lazy()));
                         }
                         None => {
                             pc = *jump_target;
@@ -791,12 +1969,14 @@ impl<'env> Vm<'env> {
                 }
                 Instruction::JumpIfFalse(jump_target) => {
                     let value = stack.pop();
+                    try_ctx!(self.check_undefined(&value, true));
                     if !value.is_true() {
                         pc = *jump_target;
                         continue;
                     }
                 }
                 Instruction::JumpIfFalseOrPop(jump_target) => {
+                    try_ctx!(self.check_undefined(stack.peek(), true));
                     if !stack.peek().is_true() {
                         pc = *jump_target;
                         continue;
@@ -805,6 +1985,7 @@ impl<'env> Vm<'env> {
                     }
                 }
                 Instruction::JumpIfTrueOrPop(jump_target) => {
+                    try_ctx!(self.check_undefined(stack.peek(), true));
                     if stack.peek().is_true() {
                         pc = *jump_target;
                         continue;
@@ -817,7 +1998,9 @@ impl<'env> Vm<'env> {
                     state.current_block = Some(name);
                     if let Some(layers) = blocks.get(name) {
                         let instructions = layers.first().unwrap();
+                        let block = try_ctx!(self.enter_block(name));
                         sub_eval!(instructions);
+                        drop(block);
                     } else {
                         bail!(Error::new(
                             ErrorKind::ImpossibleOperation,
@@ -836,9 +2019,27 @@ impl<'env> Vm<'env> {
                                 "template name was not a string",
                             )
                         })
-                        .and_then(|name| self.env.get_template(name)));
+                        .and_then(|name| self.get_template(instructions.name(), name)));
+
+                    // detect cycles in the inheritance chain.  Unlike with
+                    // includes these can never terminate.
+                    if extends_chain.is_empty() {
+                        extends_chain.push(instructions.name());
+                    }
+                    let name = tmpl.instructions().name();
+                    if extends_chain.contains(&name) {
+                        bail!(Error::new(
+                            ErrorKind::ImpossibleOperation,
+                            format!(
+                                "cycle in template inheritance: {}",
+                                format_template_chain(&extends_chain, name)
+                            )
+                        ));
+                    }
+                    extends_chain.push(name);
 
                     // first load the blocks
+                    let blocks = Rc::make_mut(&mut blocks);
                     for (name, instr) in tmpl.blocks().iter() {
                         blocks.entry(name).or_insert_with(Vec::new).push(instr);
                     }
@@ -850,6 +2051,10 @@ impl<'env> Vm<'env> {
                     instructions = tmpl.instructions();
                     state.name = instructions.name();
                     pc = 0;
+                    #[cfg(feature = "debug")]
+                    {
+                        last_line = None;
+                    }
                     continue;
                 }
                 Instruction::Include(ignore_missing) => {
@@ -867,7 +2072,7 @@ impl<'env> Vm<'env> {
                                 "template name was not a string",
                             )
                         }));
-                        let tmpl = match self.env.get_template(name) {
+                        let tmpl = match self.get_template(instructions.name(), name) {
                             Ok(tmpl) => tmpl,
                             Err(err) => {
                                 if err.kind() == ErrorKind::TemplateNotFound {
@@ -879,16 +2084,15 @@ impl<'env> Vm<'env> {
                             }
                         };
                         let instructions = tmpl.instructions();
-                        let mut referenced_blocks = BTreeMap::new();
-                        for (&name, instr) in tmpl.blocks().iter() {
-                            referenced_blocks.insert(name, vec![instr]);
-                        }
+                        try_ctx!(self.check_include_depth(instructions.name()));
+                        let include = self.push_include(instructions.name());
                         sub_eval!(
                             instructions,
-                            referenced_blocks,
+                            block_layers(tmpl.blocks()),
                             None,
                             tmpl.initial_auto_escape()
                         );
+                        drop(include);
                         templates_tried.clear();
                         break;
                     }
@@ -913,11 +2117,108 @@ impl<'env> Vm<'env> {
                         }
                     }
                 }
+                Instruction::RenderComponent => {
+                    let props = stack.pop();
+                    let name = stack.pop();
+                    let tmpl = try_ctx!(name
+                        .as_str()
+                        .ok_or_else(|| {
+                            Error::new(
+                                ErrorKind::ImpossibleOperation,
+                                "component name was not a string",
+                            )
+                        })
+                        .and_then(|name| self.get_template(instructions.name(), name)));
+                    let instructions = tmpl.instructions();
+
+                    // if the component declares its props, reject all others
+                    let declared_props = instructions.declared_props();
+                    if !declared_props.is_empty() {
+                        for (key, _) in props.iter_as_str_map() {
+                            if key != "slots" && !declared_props.contains(&key) {
+                                bail!(Error::new(
+                                    ErrorKind::InvalidArguments,
+                                    format!(
+                                        "unknown prop {} for component {}",
+                                        key,
+                                        instructions.name()
+                                    )
+                                ));
+                            }
+                        }
+                    }
+
+                    // unlike includes, components do not see the context of
+                    // the caller but only the props they are given.
+                    try_ctx!(self.check_include_depth(instructions.name()));
+                    self.render_isolated(tmpl, props, out!())?;
+                }
+                Instruction::DeclareProp(name, kind, has_default) => {
+                    let default = if *has_default {
+                        Some(stack.pop())
+                    } else {
+                        None
+                    };
+                    // props only come from the caller, never from globals
+                    match state.ctx.load_local(name) {
+                        Some(value) if !value.is_undefined() => {
+                            if let Some(kind) = *kind {
+                                // chars are strings as far as templates are concerned
+                                let actual = match value.kind() {
+                                    ValueKind::Char => ValueKind::String,
+                                    actual => actual,
+                                };
+                                if actual != kind {
+                                    bail!(Error::new(
+                                        ErrorKind::InvalidArguments,
+                                        format!(
+                                            "prop {} for component {} must be {}, got {}",
+                                            name,
+                                            instructions.name(),
+                                            kind,
+                                            actual
+                                        )
+                                    ));
+                                }
+                            }
+                        }
+                        _ => match default {
+                            Some(default) => state.ctx.store(name, default),
+                            None => bail!(Error::new(
+                                ErrorKind::InvalidArguments,
+                                format!(
+                                    "missing required prop {} for component {}",
+                                    name,
+                                    instructions.name()
+                                )
+                            )),
+                        },
+                    }
+                }
+                Instruction::EnterTag(name, jump_target) => {
+                    let tag = try_ctx!(self.env.get_tag(name));
+                    let args = try_ctx!(stack.peek().as_slice());
+                    if let Some(value) = try_ctx!(tag.enter(state, args)) {
+                        stack.pop();
+                        try_ctx!(self.env.format(&value, state, out!()));
+                        pc = *jump_target;
+                        continue;
+                    }
+                }
+                Instruction::ExitTag(name, has_body) => {
+                    let body = if *has_body { Some(stack.pop()) } else { None };
+                    let args = stack.pop();
+                    let tag = try_ctx!(self.env.get_tag(name));
+                    let value = try_ctx!(tag.render(state, try_ctx!(args.as_slice()), body));
+                    try_ctx!(self.env.format(&value, state, out!()));
+                }
                 Instruction::PushAutoEscape => {
                     let value = stack.pop();
                     auto_escape_stack.push(state.auto_escape);
                     state.auto_escape = match (value.as_str(), value == Value::from(true)) {
                         (Some("html"), _) => AutoEscape::Html,
+                        #[cfg(feature = "json")]
+                        (Some("js"), _) => AutoEscape::Js,
                         (Some("none"), _) | (None, false) => AutoEscape::None,
                         (None, true) => {
                             if matches!(initial_auto_escape, AutoEscape::None) {
@@ -944,17 +2245,26 @@ impl<'env> Vm<'env> {
                     end_capture!();
                 }
                 Instruction::ApplyFilter(name) => {
-                    let args = try_ctx!(stack.pop().try_into_vec());
-                    let value = stack.pop();
+                    let args = try_ctx!(stack
+                        .pop()
+                        .resolve_lazy_deep()
+                        .and_then(Value::try_into_vec));
+                    let value = try_ctx!(stack.pop().resolve_lazy_deep());
                     stack.push(try_ctx!(state.apply_filter(name, value, args)));
                 }
                 Instruction::PerformTest(name) => {
-                    let args = try_ctx!(stack.pop().try_into_vec());
-                    let value = stack.pop();
+                    let args = try_ctx!(stack
+                        .pop()
+                        .resolve_lazy_deep()
+                        .and_then(Value::try_into_vec));
+                    let value = try_ctx!(stack.pop().resolve_lazy_deep());
                     stack.push(Value::from(try_ctx!(state.perform_test(name, value, args))));
                 }
                 Instruction::CallFunction(function_name) => {
-                    let args = try_ctx!(stack.pop().try_into_vec());
+                    let args = try_ctx!(stack
+                        .pop()
+                        .resolve_lazy_deep()
+                        .and_then(Value::try_into_vec));
                     // super is a special function reserved for super-ing into blocks.
                     if *function_name == "super" {
                         if !args.is_empty() {
@@ -975,6 +2285,7 @@ impl<'env> Vm<'env> {
                         stack.push(args.into_iter().next().unwrap());
                         recurse_loop!(true);
                     } else if let Some(func) = state.ctx.load(self.env, function_name) {
+                        self.env.record_usage(|x| &mut x.functions, function_name);
                         stack.push(try_ctx!(func.call(state, args)));
                     } else {
                         bail!(Error::new(
@@ -984,12 +2295,18 @@ impl<'env> Vm<'env> {
                     }
                 }
                 Instruction::CallMethod(name) => {
-                    let args = try_ctx!(stack.pop().try_into_vec());
-                    let obj = stack.pop();
+                    let args = try_ctx!(stack
+                        .pop()
+                        .resolve_lazy_deep()
+                        .and_then(Value::try_into_vec));
+                    let obj = try_ctx!(stack.pop().resolve_lazy_deep());
                     stack.push(try_ctx!(obj.call_method(state, name, args)));
                 }
                 Instruction::CallObject => {
-                    let args = try_ctx!(stack.pop().try_into_vec());
+                    let args = try_ctx!(stack
+                        .pop()
+                        .resolve_lazy_deep()
+                        .and_then(Value::try_into_vec));
                     let obj = stack.pop();
                     stack.push(try_ctx!(obj.call(state, args)));
                 }
@@ -1007,9 +2324,32 @@ impl<'env> Vm<'env> {
                 }
                 Instruction::Nop => {}
             }
+
+            // account for the values that were created by the instruction.
+            if self.memory_budget.get().is_some()
+                && match instr {
+                    Instruction::CallFunction(name) => *name != "super",
+                    Instruction::ApplyFilter(_)
+                    | Instruction::CallMethod(_)
+                    | Instruction::CallObject
+                    | Instruction::Add
+                    | Instruction::Mul
+                    | Instruction::Slice => true,
+                    _ => false,
+                }
+            {
+                try_ctx!(self.charge_memory(approx_value_size(stack.peek())));
+            }
             pc += 1;
         }
 
+        #[cfg(feature = "debug")]
+        {
+            if let Some(debugger) = debugger {
+                debugger.leave_template(state);
+            }
+        }
+
         Ok(stack.try_pop())
     }
 }
@@ -1025,5 +2365,53 @@ pub fn simple_eval<S: serde::Serialize>(
     let empty_blocks = BTreeMap::new();
     let vm = Vm::new(&env);
     let root = Value::from_serializable(&ctx);
-    vm.eval(instructions, root, &empty_blocks, AutoEscape::None, output)
+    let mut out = Output::new();
+    let rv = vm.eval(
+        instructions,
+        root,
+        &empty_blocks,
+        AutoEscape::None,
+        &mut out,
+    );
+    output.push_str(&out.into_string());
+    rv
+}
+
+#[test]
+fn test_stack_pool() {
+    let mut stack = Stack::new();
+    stack.push(Value::from(1));
+    let capacity = stack.values.capacity();
+    drop(stack);
+    let stack = Stack::new();
+    assert!(stack.values.is_empty());
+    assert_eq!(stack.values.capacity(), capacity);
+}
+
+#[test]
+#[cfg(all(feature = "builtins", feature = "source"))]
+fn test_expression_cache() {
+    let mut env = Environment::new();
+    env.add_template(
+        "test.txt",
+        "{% for x in [[1, 2], [3]] %}{{ x|selectexpr('item > 1') }}{% endfor %}\
+         {{ [4]|rejectexpr(\"item \" ~ \"< 5\") }}",
+    )
+    .unwrap();
+    let tmpl = env.get_template("test.txt").unwrap();
+    let vm = Vm::new(&env);
+    let mut output = Output::new();
+    vm.eval(
+        tmpl.instructions(),
+        Value::UNDEFINED,
+        tmpl.blocks(),
+        AutoEscape::None,
+        &mut output,
+    )
+    .unwrap();
+    assert_eq!(output.into_string(), "[2][3][]");
+    // expressions built at runtime are cached too
+    let mut keys = vm.expressions.borrow().keys().cloned().collect::<Vec<_>>();
+    keys.sort();
+    assert_eq!(keys, vec!["item < 5", "item > 1"]);
 }
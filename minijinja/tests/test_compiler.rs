@@ -1,6 +1,7 @@
 #![cfg(feature = "unstable_machinery")]
-use minijinja::machinery::{Compiler, Instruction};
+use minijinja::machinery::{parse, Compiler, Instruction};
 use minijinja::value::Value;
+use minijinja::OptimizationLevel;
 
 #[test]
 fn test_for_loop() {
@@ -57,3 +58,15 @@ fn test_const() {
 
     insta::assert_debug_snapshot!(&c);
 }
+
+#[test]
+fn test_optimizations() {
+    let source = "{{ 60 * 60 * 24 }}{# comment #}a{{ [1, 2] ~ 'x' if true }}\
+                  {% if x %}b{% endif %}c{{ 1 // 0 }}{% raw %}r{% endraw %}d";
+    let ast = parse(source, "<unknown>").unwrap();
+    let mut c = Compiler::new("<unknown>", source);
+    c.set_optimization_level(OptimizationLevel::Basic);
+    c.compile_stmt(&ast).unwrap();
+
+    insta::assert_debug_snapshot!(&c.finish().0);
+}
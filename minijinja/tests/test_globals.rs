@@ -0,0 +1,136 @@
+//! Behavior of the built-in global functions compared to Jinja2.
+//!
+//! The expected values are what Jinja2 renders for the same template.
+#![cfg(all(feature = "builtins", feature = "sync"))]
+use minijinja::{context, Environment, ErrorKind};
+
+fn render(source: &str) -> Result<String, ErrorKind> {
+    let mut env = Environment::new();
+    env.add_template("test.txt", source).unwrap();
+    env.get_template("test.txt")
+        .unwrap()
+        .render(context!(pairs => vec![("a", 1), ("b", 2)]))
+        .map_err(|err| err.kind())
+}
+
+fn check(cases: &[(&str, Result<&str, ErrorKind>)]) {
+    for (source, expected) in cases {
+        assert_eq!(
+            render(source),
+            expected.map(|x| x.to_string()),
+            "{:?}",
+            source
+        );
+    }
+}
+
+#[test]
+fn test_range() {
+    check(&[
+        ("{{ range(3)|list }}", Ok("[0, 1, 2]")),
+        ("{{ range(1, 4)|list }}", Ok("[1, 2, 3]")),
+        ("{{ range(0, 10, 3)|list }}", Ok("[0, 3, 6, 9]")),
+        ("{{ range(3, 1)|list }}", Ok("[]")),
+    ]);
+}
+
+#[test]
+fn test_dict() {
+    check(&[
+        (
+            "{% for k, v in dict(a=1, b=2)|items %}{{ k }}={{ v }};{% endfor %}",
+            Ok("a=1;b=2;"),
+        ),
+        (
+            "{% for k, v in dict(pairs)|items %}{{ k }}={{ v }};{% endfor %}",
+            Ok("a=1;b=2;"),
+        ),
+        (
+            "{% for k, v in dict(pairs, c=3)|items %}{{ k }}={{ v }};{% endfor %}",
+            Ok("a=1;b=2;c=3;"),
+        ),
+        (
+            "{% for k, v in dict({'a': 1}, a=2)|items %}{{ k }}={{ v }};{% endfor %}",
+            Ok("a=2;"),
+        ),
+        ("{{ dict()|length }}", Ok("0")),
+        ("{{ dict(a=1).a }}", Ok("1")),
+        ("{{ dict(42) }}", Err(ErrorKind::InvalidArguments)),
+        ("{{ dict([[1, 2, 3]]) }}", Err(ErrorKind::InvalidArguments)),
+        (
+            "{{ dict(pairs, pairs, a=1) }}",
+            Err(ErrorKind::InvalidArguments),
+        ),
+    ]);
+}
+
+#[test]
+fn test_namespace() {
+    check(&[
+        (
+            "{% set ns = namespace(found=false) %}\
+             {% for x in [1, 2, 3] %}{% if x == 2 %}{% set ns.found = true %}{% endif %}{% endfor %}\
+             {{ ns.found }}",
+            Ok("true"),
+        ),
+        (
+            "{% set ns = namespace(total=0) %}\
+             {% for x in [1, 2, 3] %}{% set ns.total = ns.total + x %}{% endfor %}\
+             {{ ns.total }}",
+            Ok("6"),
+        ),
+        (
+            "{% set ns = namespace(dict(a=1), b=2) %}{{ ns.a }}|{{ ns.b }}",
+            Ok("1|2"),
+        ),
+        (
+            "{% set ns = namespace(pairs) %}{{ ns.a }}|{{ ns.missing is undefined }}",
+            Ok("1|true"),
+        ),
+        (
+            "{% set ns = namespace() %}{% set ns.x = 1 %}{{ ns.x }}",
+            Ok("1"),
+        ),
+        (
+            "{% set x = dict(a=1) %}{% set x.a = 2 %}",
+            Err(ErrorKind::InvalidOperation),
+        ),
+    ]);
+}
+
+#[test]
+fn test_cycler() {
+    check(&[
+        (
+            "{% set c = cycler('a', 'b') %}{{ c.next() }}{{ c.next() }}{{ c.next() }}",
+            Ok("aba"),
+        ),
+        (
+            "{% set c = cycler('a', 'b') %}{{ c.current }}{{ c.next() }}{{ c.current }}",
+            Ok("aab"),
+        ),
+        (
+            "{% set c = cycler('a', 'b') %}{{ c.next() }}{% set _ = c.reset() %}{{ c.next() }}",
+            Ok("aa"),
+        ),
+        (
+            "{% set c = cycler('a', 'b') %}{% for x in [1, 2, 3] %}{{ c.next() }}{% endfor %}\
+             {% for x in [1] %}{{ c.next() }}{% endfor %}",
+            Ok("abab"),
+        ),
+    ]);
+}
+
+#[test]
+fn test_joiner() {
+    check(&[
+        (
+            "{% set j = joiner() %}{% for x in [1, 2, 3] %}{{ j() }}{{ x }}{% endfor %}",
+            Ok("1, 2, 3"),
+        ),
+        (
+            "{% set j = joiner('|') %}{% for x in [1, 2] %}{{ j() }}{{ x }}{% endfor %}",
+            Ok("1|2"),
+        ),
+    ]);
+}
@@ -10,3 +10,41 @@ fn test_parser() {
         insta::assert_debug_snapshot!(&ast);
     });
 }
+
+#[test]
+fn test_parse_with_comments() {
+    use minijinja::machinery::ast::Stmt;
+    use minijinja::machinery::parse_with_comments;
+    use minijinja::syntax::Syntax;
+
+    let source = "{# doc: the page #}\n{% for x in seq %}{# inner #}{{ x -}}{# c #} {% endfor %}";
+    let ast = parse_with_comments(source, "page.html", &Syntax::default(), &|_| None).unwrap();
+    let children = match ast {
+        Stmt::Template(ref tmpl) => &tmpl.children,
+        _ => panic!("expected template"),
+    };
+    let comment = match children[0] {
+        Stmt::Comment(ref comment) => comment,
+        _ => panic!("expected comment"),
+    };
+    assert_eq!(comment.raw, " doc: the page ");
+    assert_eq!(comment.span().start_line, 1);
+    assert_eq!(comment.span().end_col, 19);
+
+    let body = match children[2] {
+        Stmt::ForLoop(ref for_loop) => &for_loop.body,
+        _ => panic!("expected for loop"),
+    };
+    assert!(matches!(body[0], Stmt::Comment(ref c) if c.raw == " inner "));
+    assert!(matches!(body[1], Stmt::EmitExpr(_)));
+    assert!(matches!(body[2], Stmt::Comment(ref c) if c.raw == " c "));
+    // whitespace control still applies across comments
+    assert!(matches!(body[3], Stmt::EmitRaw(ref raw) if raw.raw.is_empty()));
+
+    // regular parsing drops the comments
+    let ast = parse(source, "page.html").unwrap();
+    match ast {
+        Stmt::Template(ref tmpl) => assert!(!matches!(tmpl.children[0], Stmt::Comment(_))),
+        _ => panic!("expected template"),
+    }
+}
@@ -1,7 +1,12 @@
 use std::collections::BTreeMap;
 use std::fs;
 
-use minijinja::{context, Environment, Error, State};
+use minijinja::syntax::Syntax;
+use minijinja::value::Value;
+use minijinja::{
+    context, format_template, AutoEscape, Environment, Error, ErrorKind, RenderOptions, ReprLimits,
+    State, UndefinedBehavior,
+};
 
 #[test]
 fn test_vm() {
@@ -46,6 +51,28 @@ fn test_vm() {
     });
 }
 
+#[test]
+#[cfg(all(feature = "builtins", feature = "debug"))]
+fn test_debug() {
+    // an empty environment keeps the output independent of crate features
+    let mut env = Environment::empty();
+    env.add_function("debug", minijinja::functions::debug);
+    env.add_function("range", minijinja::functions::range);
+    env.add_filter("upper", minijinja::filters::upper);
+    env.add_test("odd", minijinja::tests::is_odd);
+    env.add_template(
+        "debug.txt",
+        "{% with f = range %}{% for x in f(upper) %}{{ debug() }}{% endfor %}{% endwith %}",
+    )
+    .unwrap();
+    let rv = env
+        .get_template("debug.txt")
+        .unwrap()
+        .render(context!(upper => 1))
+        .unwrap();
+    insta::assert_snapshot!(&rv);
+}
+
 #[test]
 fn test_custom_filter() {
     fn test_filter(_: &State, value: String) -> Result<String, Error> {
@@ -71,3 +98,2985 @@ fn test_single() {
     let rv = tmpl.render(context!(name => "Peter")).unwrap();
     assert_eq!(rv, "Hello Peter!");
 }
+
+#[test]
+fn test_extends_cycle() {
+    let mut env = Environment::new();
+    env.add_template("a.html", "{% extends 'b.html' %}")
+        .unwrap();
+    env.add_template("b.html", "{% extends 'c.html' %}")
+        .unwrap();
+    env.add_template("c.html", "{% extends 'a.html' %}")
+        .unwrap();
+    let err = env.get_template("a.html").unwrap().render(()).unwrap_err();
+    assert_eq!(
+        err.to_string(),
+        "impossible operation: cycle in template inheritance: \
+         a.html -> b.html -> c.html -> a.html (in c.html:1)"
+    );
+}
+
+#[test]
+fn test_include_cycle() {
+    let mut env = Environment::new();
+    env.add_template("a.html", "[{% include 'b.html' %}]")
+        .unwrap();
+    env.add_template("b.html", "{% include 'a.html' %}")
+        .unwrap();
+    let err = env.get_template("a.html").unwrap().render(()).unwrap_err();
+    assert_eq!(
+        err.to_string(),
+        "impossible operation: cycle in template includes: \
+         b.html -> a.html -> b.html (exceeded maximum include depth of 20) (in a.html:1)"
+    );
+}
+
+#[test]
+fn test_recursive_include() {
+    let mut env = Environment::new();
+    env.add_template(
+        "tree.html",
+        "{{ node.name }}{% for child in node.children %}\
+         {% with node=child %}({% include 'tree.html' %}){% endwith %}\
+         {% endfor %}",
+    )
+    .unwrap();
+    let rv = env
+        .get_template("tree.html")
+        .unwrap()
+        .render(context!(node => context!(
+            name => "a",
+            children => vec![context!(name => "b", children => vec![context!(name => "c")])],
+        )))
+        .unwrap();
+    assert_eq!(rv, "a(b(c))");
+}
+
+#[test]
+fn test_max_include_depth() {
+    let mut env = Environment::new();
+    env.add_template(
+        "count.txt",
+        "{{ n }}{% if n > 0 %}{% with n=n - 1 %}{% include 'count.txt' %}{% endwith %}{% endif %}",
+    )
+    .unwrap();
+    let tmpl = env.get_template("count.txt").unwrap();
+    assert_eq!(tmpl.render(context!(n => 3)).unwrap(), "3210");
+
+    env.set_max_include_depth(2);
+    let tmpl = env.get_template("count.txt").unwrap();
+    assert_eq!(tmpl.render(context!(n => 2)).unwrap(), "210");
+    assert_eq!(
+        tmpl.render(context!(n => 3)).unwrap_err().to_string(),
+        "impossible operation: cycle in template includes: count.txt -> count.txt \
+         (exceeded maximum include depth of 2) (in count.txt:1)"
+    );
+}
+
+#[test]
+fn test_max_expression_depth() {
+    let nested = |depth: usize| format!("{{{{ {}1{} }}}}", "(".repeat(depth), ")".repeat(depth));
+    let ok = nested(25);
+    let too_deep = [nested(200), format!("{{{{ {}x }}}}", "not ".repeat(200))];
+
+    let mut env = Environment::new();
+    env.add_template("ok.txt", &ok).unwrap();
+    assert_eq!(env.get_template("ok.txt").unwrap().render(()).unwrap(), "1");
+
+    for source in too_deep.iter() {
+        let err = env.add_template("deep.txt", source).unwrap_err();
+        assert_eq!(err.kind(), ErrorKind::SyntaxError);
+        assert_eq!(
+            err.to_string(),
+            "syntax error: exceeded maximum expression nesting depth of 30 (in deep.txt:1)"
+        );
+    }
+}
+
+#[test]
+fn test_custom_max_expression_depth() {
+    let nested = |depth: usize| format!("{}1{}", "(".repeat(depth), ")".repeat(depth));
+    let deep = format!("{{{{ {} }}}}", nested(30));
+    let shallow = format!("{{{{ {} }}}}", nested(20));
+
+    let mut env = Environment::new();
+    assert!(env.add_template("deep.txt", &deep).is_err());
+    env.set_max_expression_depth(40);
+    env.add_template("deep.txt", &deep).unwrap();
+    assert_eq!(
+        env.get_template("deep.txt").unwrap().render(()).unwrap(),
+        "1"
+    );
+    let expr = nested(30);
+    assert_eq!(
+        env.compile_expression(&expr).unwrap().eval(()).unwrap(),
+        Value::from(1)
+    );
+
+    env.set_max_expression_depth(10);
+    let err = env.add_template("shallow.txt", &shallow).unwrap_err();
+    assert_eq!(
+        err.to_string(),
+        "syntax error: exceeded maximum expression nesting depth of 10 (in shallow.txt:1)"
+    );
+    let expr = nested(20);
+    let err = env.compile_expression(&expr).unwrap_err();
+    assert_eq!(err.kind(), ErrorKind::SyntaxError);
+}
+
+#[test]
+fn test_custom_syntax() {
+    let mut env = Environment::new();
+    env.set_syntax(Syntax {
+        block_start: "<%".into(),
+        block_end: "%>".into(),
+        variable_start: "${".into(),
+        variable_end: "}".into(),
+        comment_start: "<#".into(),
+        comment_end: "#>".into(),
+        ..Syntax::default()
+    })
+    .unwrap();
+    env.add_template(
+        "custom.txt",
+        "<# comment #><% for x in seq -%>${ x }{{ x }}<% endfor %>",
+    )
+    .unwrap();
+    env.add_template_with_syntax(
+        "default.txt",
+        "{% include 'custom.txt' %}|{{ seq|length }}",
+        Syntax::default(),
+    )
+    .unwrap();
+    let rv = env
+        .get_template("default.txt")
+        .unwrap()
+        .render(context!(seq => vec![1, 2]))
+        .unwrap();
+    assert_eq!(rv, "1{{ x }}2{{ x }}|2");
+}
+
+#[test]
+fn test_invalid_syntax() {
+    let mut env = Environment::new();
+    let err = env
+        .set_syntax(Syntax {
+            variable_end: "".into(),
+            ..Syntax::default()
+        })
+        .unwrap_err();
+    assert_eq!(err.kind(), ErrorKind::InvalidSyntax);
+    assert_eq!(
+        err.to_string(),
+        "invalid syntax: delimiter variable_end must not be empty"
+    );
+
+    let err = env
+        .add_template_with_syntax(
+            "x",
+            "",
+            Syntax {
+                block_start: "{{".into(),
+                ..Syntax::default()
+            },
+        )
+        .unwrap_err();
+    assert_eq!(err.kind(), ErrorKind::InvalidSyntax);
+    assert_eq!(env.syntax(), &Syntax::default());
+}
+
+#[test]
+fn test_line_statements() {
+    let mut env = Environment::new();
+    env.set_syntax(Syntax {
+        line_statement_prefix: Some("#".into()),
+        line_comment_prefix: Some("##".into()),
+        ..Syntax::default()
+    })
+    .unwrap();
+    env.add_template(
+        "config.ini",
+        "## generated file\n\
+         # for section in sections:\n\
+         [{{ section.name }}]\n\
+         \x20 # for key in section.keys if key not in (\n\
+         \x20     'secret', 'password'):\n\
+         {{ key }} = 1 ## default\n\
+         \x20 # endfor\n\
+         # endfor\n",
+    )
+    .unwrap();
+    let rv = env
+        .get_template("config.ini")
+        .unwrap()
+        .render(context!(sections => vec![
+            context!(name => "a", keys => vec!["x", "secret"]),
+            context!(name => "b", keys => vec!["y", "z"]),
+        ]))
+        .unwrap();
+    assert_eq!(rv, "\n[a]\nx = 1\n[b]\ny = 1\nz = 1\n");
+}
+
+#[test]
+fn test_render_to_bytes() {
+    let mut env = Environment::new();
+    env.add_template("a.txt", "name={{ name }};").unwrap();
+    env.add_template("a.html", "<p>{{ name }}</p>").unwrap();
+    let name = Value::from_bytes(b"M\xfcller & S\xf6hne".to_vec());
+
+    let tmpl = env.get_template("a.txt").unwrap();
+    let rv = tmpl
+        .render_to_bytes(context!(name => name.clone()))
+        .unwrap();
+    assert_eq!(rv, b"name=M\xfcller & S\xf6hne;".to_vec());
+    let mut buf = Vec::new();
+    tmpl.render_to_write(context!(name => name.clone()), &mut buf)
+        .unwrap();
+    assert_eq!(buf, rv);
+    assert_eq!(
+        tmpl.render(context!(name => name.clone())).unwrap(),
+        "name=M\u{fffd}ller & S\u{fffd}hne;"
+    );
+
+    let tmpl = env.get_template("a.html").unwrap();
+    let rv = tmpl.render_to_bytes(context!(name => name)).unwrap();
+    assert_eq!(rv, b"<p>M\xfcller &amp; S\xf6hne</p>".to_vec());
+}
+
+#[test]
+fn test_prepared_template() {
+    let mut env = Environment::new();
+    env.add_global("greeting", Value::from("Hello"));
+    env.add_template(
+        "row.txt",
+        "{{ greeting }} {{ name }} from {{ site }}{% include 'footer.txt' %}",
+    )
+    .unwrap();
+    env.add_template("footer.txt", " ({{ site }})").unwrap();
+    let tmpl = env.get_template("row.txt").unwrap();
+    let prepared = tmpl.prepare(context!(site => "Example", name => "default"));
+    assert_eq!(
+        prepared.render(context!(name => "John")).unwrap(),
+        "Hello John from Example (Example)"
+    );
+    assert_eq!(
+        prepared.render(()).unwrap(),
+        "Hello default from Example (Example)"
+    );
+    assert_eq!(
+        prepared.render(context!(site => "Other")).unwrap(),
+        "Hello default from Other (Other)"
+    );
+}
+
+#[test]
+#[cfg(feature = "threads")]
+fn test_render_blocks_concurrently() {
+    let mut env = Environment::new();
+    env.add_template(
+        "dash.html",
+        "{% set y = 42 %}\
+         {% block a %}[{{ x }}{% for i in range(3) %}{{ i }}{% endfor %}]{% endblock %}\
+         {% block b %}({{ x }} {{ y }}){% endblock %}\
+         {% block c %}{{ 1 + none }}{% endblock %}",
+    )
+    .unwrap();
+    let tmpl = env.get_template("dash.html").unwrap();
+    assert_eq!(
+        tmpl.render_blocks_concurrently(context!(x => "x"), &["b", "a", "b"])
+            .unwrap(),
+        vec!["(x )", "[x012]", "(x )"]
+    );
+
+    let err = tmpl
+        .render_blocks_concurrently(context!(x => "x"), &["a", "c"])
+        .unwrap_err();
+    assert_eq!(err.kind(), ErrorKind::ImpossibleOperation);
+    assert_eq!(err.name(), Some("dash.html"));
+
+    let err = tmpl
+        .render_blocks_concurrently(context!(x => "x"), &["a", "missing"])
+        .unwrap_err();
+    assert_eq!(err.kind(), ErrorKind::InvalidOperation);
+    assert_eq!(
+        err.to_string(),
+        "invalid operation: block missing does not exist"
+    );
+
+    let options = RenderOptions {
+        cancel: Some(std::sync::Arc::new(true.into())),
+        ..Default::default()
+    };
+    let err = tmpl
+        .render_blocks_concurrently_with_options(context!(x => "x"), &["a", "b"], &options)
+        .unwrap_err();
+    assert!(err.to_string().contains("render was cancelled"));
+}
+
+#[test]
+fn test_components() {
+    let mut env = Environment::new();
+    env.add_template(
+        "card.html",
+        "{% props title, level=1 %}\
+         <h{{ level }}>{{ title }}</h{{ level }}>{{ slots.default }}\
+         {% if slots.footer %}<footer>{{ slots.footer }}</footer>{% endif %}\
+         {{ outer is defined }}",
+    )
+    .unwrap();
+    env.add_template("loose.html", "{{ a }}/{{ b }}/{{ slots.default }}")
+        .unwrap();
+    env.add_template(
+        "page.html",
+        "{% component 'card.html' with title=\"<Hi>\" %}\
+         {% slot footer %}by {{ outer }}{% endslot %}[{{ outer }}]\
+         {% endcomponent %}|\
+         {% component 'card.html' with title='Plain', level=2 %}{% endcomponent %}|\
+         {% component 'loose.html' with a=1, b=outer %}x{% endcomponent %}",
+    )
+    .unwrap();
+    let tmpl = env.get_template("page.html").unwrap();
+    assert_eq!(
+        tmpl.render(context!(outer => "me")).unwrap(),
+        "<h1>&lt;Hi&gt;</h1>[me]<footer>by me</footer>false|\
+         <h2>Plain</h2>false|\
+         1/me/x"
+    );
+
+    env.add_template(
+        "missing.html",
+        "{% component 'card.html' %}{% endcomponent %}",
+    )
+    .unwrap();
+    let err = env
+        .get_template("missing.html")
+        .unwrap()
+        .render(())
+        .unwrap_err();
+    assert_eq!(err.kind(), ErrorKind::InvalidArguments);
+    assert_eq!(
+        err.to_string(),
+        "invalid arguments: missing required prop title for component card.html \
+         (in card.html:1)"
+    );
+
+    env.add_template(
+        "unknown.html",
+        "{% component 'card.html' with title='x', size=2 %}{% endcomponent %}",
+    )
+    .unwrap();
+    let err = env
+        .get_template("unknown.html")
+        .unwrap()
+        .render(())
+        .unwrap_err();
+    assert_eq!(err.kind(), ErrorKind::InvalidArguments);
+    assert_eq!(
+        err.to_string(),
+        "invalid arguments: unknown prop size for component card.html \
+         (in unknown.html:1)"
+    );
+
+    let err = env
+        .add_template(
+            "bad.html",
+            "{% component 'card.html' %}{% slot a %}{% endslot %}{% slot a %}{% endslot %}{% endcomponent %}",
+        )
+        .unwrap_err();
+    assert_eq!(
+        err.to_string(),
+        "syntax error: duplicate slot a (in bad.html:1)"
+    );
+}
+
+#[test]
+fn test_component_prop_types() {
+    let mut env = Environment::new();
+    env.add_template(
+        "badge.html",
+        "{% props label: string, count: number = none, tags: sequence = [] %}\
+         {{ label }}{% if count %} ({{ count }}){% endif %}{{ tags|join(',') }}",
+    )
+    .unwrap();
+    env.add_template(
+        "ok.html",
+        "{% component 'badge.html' with label='new', count=2, tags=['a', 'b'] %}{% endcomponent %}\
+         |{% component 'badge.html' with label=label %}{% endcomponent %}",
+    )
+    .unwrap();
+    assert_eq!(
+        env.get_template("ok.html")
+            .unwrap()
+            .render(context!(label => 'x'))
+            .unwrap(),
+        "new (2)a,b|x"
+    );
+
+    env.add_template(
+        "bad.html",
+        "{% component 'badge.html' with label='x', count='many' %}{% endcomponent %}",
+    )
+    .unwrap();
+    let err = env
+        .get_template("bad.html")
+        .unwrap()
+        .render(())
+        .unwrap_err();
+    assert_eq!(err.kind(), ErrorKind::InvalidArguments);
+    assert_eq!(
+        err.to_string(),
+        "invalid arguments: prop count for component badge.html must be number, \
+         got string (in badge.html:1)"
+    );
+
+    // globals are never picked up as props
+    env.add_template("range.html", "{% props range %}{{ range }}")
+        .unwrap();
+    env.add_template(
+        "globals.html",
+        "{% component 'range.html' %}{% endcomponent %}",
+    )
+    .unwrap();
+    let err = env
+        .get_template("globals.html")
+        .unwrap()
+        .render(())
+        .unwrap_err();
+    assert_eq!(
+        err.to_string(),
+        "invalid arguments: missing required prop range for component range.html \
+         (in range.html:1)"
+    );
+
+    let err = env
+        .add_template("syntax.html", "{% props label: text %}")
+        .unwrap_err();
+    assert_eq!(
+        err.to_string(),
+        "syntax error: unknown type text for prop label (in syntax.html:1)"
+    );
+}
+
+#[test]
+fn test_markdown_filter() {
+    let mut env = Environment::new();
+    env.add_template("post.html", "{{ body|markdown }}|{{ body }}")
+        .unwrap();
+    let err = env
+        .get_template("post.html")
+        .unwrap()
+        .render(context!(body => "*hi*"))
+        .unwrap_err();
+    assert_eq!(
+        err.to_string(),
+        "invalid operation: no markdown renderer configured (in post.html:1)"
+    );
+
+    env.set_markdown_renderer(|source| {
+        if source.is_empty() {
+            return Err(Error::new(ErrorKind::InvalidArguments, "empty markdown"));
+        }
+        Ok(format!("<em>{}</em>", source.trim_matches('*')))
+    });
+    let tmpl = env.get_template("post.html").unwrap();
+    assert_eq!(
+        tmpl.render(context!(body => "*hi*")).unwrap(),
+        "<em>hi</em>|*hi*"
+    );
+    let err = tmpl.render(context!(body => "")).unwrap_err();
+    assert_eq!(err.kind(), ErrorKind::InvalidArguments);
+}
+
+#[test]
+fn test_keep_html_entities() {
+    let mut env = Environment::new();
+    env.set_keep_html_entities(true);
+    env.add_template(
+        "entities.html",
+        "{{ value }}|{{ value|e }}|{{ value|forceescape }}",
+    )
+    .unwrap();
+    env.add_template("entities.txt", "{{ value }}|{{ value|e }}")
+        .unwrap();
+    let ctx = context!(value => "&lt;b&gt; &#39;x&#x27; &copy; & <i> &nope");
+    assert_eq!(
+        env.get_template("entities.html")
+            .unwrap()
+            .render(&ctx)
+            .unwrap(),
+        "&lt;b&gt; &#39;x&#x27; &copy; &amp; &lt;i&gt; &amp;nope|\
+         &lt;b&gt; &#39;x&#x27; &copy; &amp; &lt;i&gt; &amp;nope|\
+         &amp;lt;b&amp;gt; &amp;#39;x&amp;#x27; &amp;copy; &amp; &lt;i&gt; &amp;nope"
+    );
+    assert_eq!(
+        env.get_template("entities.txt")
+            .unwrap()
+            .render(&ctx)
+            .unwrap(),
+        "&lt;b&gt; &#39;x&#x27; &copy; & <i> &nope|\
+         &lt;b&gt; &#39;x&#x27; &copy; &amp; &lt;i&gt; &amp;nope"
+    );
+}
+
+#[test]
+fn test_cycle_errors() {
+    let env = Environment::new();
+    let err = env
+        .compile_expression("cycler()")
+        .unwrap()
+        .eval(())
+        .unwrap_err();
+    assert_eq!(err.kind(), ErrorKind::InvalidArguments);
+
+    let mut env = Environment::new();
+    env.add_template(
+        "cycle.txt",
+        "{% for x in [1] %}{{ loop.cycle() }}{% endfor %}",
+    )
+    .unwrap();
+    let err = env
+        .get_template("cycle.txt")
+        .unwrap()
+        .render(())
+        .unwrap_err();
+    assert_eq!(
+        err.to_string(),
+        "invalid arguments: no items for cycling given (in cycle.txt:1)"
+    );
+}
+
+#[test]
+fn test_undefined_behavior() {
+    let mut env = Environment::new();
+    env.add_template("print.txt", "[{{ missing }}]").unwrap();
+    env.add_template("if.txt", "{% if missing %}yes{% else %}no{% endif %}")
+        .unwrap();
+    env.add_template("loop.txt", "{% for x in missing %}{{ x }}{% endfor %}!")
+        .unwrap();
+    env.add_template(
+        "defined.txt",
+        "{{ missing is defined }}|{{ missing|default('x') }}",
+    )
+    .unwrap();
+    env.add_template("compare.txt", "{{ 'a' < 1 }}|{{ 1 < 2.5 }}")
+        .unwrap();
+    env.add_template(
+        "chain.txt",
+        "{{ missing.a.b is defined }}|{{ missing['a'][0] is undefined }}",
+    )
+    .unwrap();
+    env.add_template("attr.txt", "{{ missing.a }}").unwrap();
+    env.add_template(
+        "default.txt",
+        "{{ missing.a.b|default('x') }}|{{ missing['a']|d('y') }}",
+    )
+    .unwrap();
+
+    let render = |env: &Environment, name: &str, behavior| {
+        env.get_template(name)
+            .unwrap()
+            .render_with_options(
+                (),
+                &RenderOptions {
+                    undefined_behavior: Some(behavior),
+                    ..Default::default()
+                },
+            )
+            .map_err(|err| err.kind())
+    };
+
+    for &(name, lenient, semi_strict, strict) in &[
+        (
+            "print.txt",
+            Ok("[]"),
+            Err(ErrorKind::UndefinedError),
+            Err(ErrorKind::UndefinedError),
+        ),
+        ("if.txt", Ok("no"), Ok("no"), Err(ErrorKind::UndefinedError)),
+        (
+            "loop.txt",
+            Ok("!"),
+            Err(ErrorKind::UndefinedError),
+            Err(ErrorKind::UndefinedError),
+        ),
+        ("defined.txt", Ok("false|x"), Ok("false|x"), Ok("false|x")),
+        (
+            "compare.txt",
+            Ok("false|true"),
+            Ok("false|true"),
+            Err(ErrorKind::ImpossibleOperation),
+        ),
+        (
+            "chain.txt",
+            Ok("false|true"),
+            Ok("false|true"),
+            Ok("false|true"),
+        ),
+        ("default.txt", Ok("x|y"), Ok("x|y"), Ok("x|y")),
+        (
+            "attr.txt",
+            Err(ErrorKind::UndefinedError),
+            Err(ErrorKind::UndefinedError),
+            Err(ErrorKind::UndefinedError),
+        ),
+    ] {
+        let as_owned = |x: Result<&str, ErrorKind>| x.map(|x| x.to_string());
+        assert_eq!(
+            render(&env, name, UndefinedBehavior::Lenient),
+            as_owned(lenient)
+        );
+        assert_eq!(
+            render(&env, name, UndefinedBehavior::SemiStrict),
+            as_owned(semi_strict)
+        );
+        assert_eq!(
+            render(&env, name, UndefinedBehavior::Strict),
+            as_owned(strict)
+        );
+    }
+
+    // the environment default is used unless overridden
+    env.set_undefined_behavior(UndefinedBehavior::Strict);
+    let tmpl = env.get_template("print.txt").unwrap();
+    assert_eq!(
+        tmpl.render(()).unwrap_err().kind(),
+        ErrorKind::UndefinedError
+    );
+    assert_eq!(
+        render(&env, "print.txt", UndefinedBehavior::Lenient),
+        Ok("[]".into())
+    );
+}
+
+#[test]
+fn test_sort_strict() {
+    let mut env = Environment::new();
+    env.add_template("sort.txt", "{{ items|sort(strict=strict) }}")
+        .unwrap();
+    let tmpl = env.get_template("sort.txt").unwrap();
+    let items = vec![Value::from(2), Value::from("a"), Value::from(1)];
+    assert_eq!(
+        tmpl.render(context!(items => items.clone(), strict => false))
+            .unwrap(),
+        "[1, 2, \"a\"]"
+    );
+    let mixed = vec![
+        Value::from(vec![Value::from(1), Value::from("a")]),
+        Value::from("b"),
+        Value::from(2),
+        Value::from(()),
+        Value::from(f64::NAN),
+        Value::from(vec![1, 2]),
+        Value::from_serializable(&context!(a => 1)),
+        Value::from(true),
+    ];
+    let mut reversed = mixed.clone();
+    reversed.reverse();
+    for items in &[mixed, reversed] {
+        assert_eq!(
+            tmpl.render(context!(items, strict => false)).unwrap(),
+            "[None, true, 2, NaN, \"b\", [1, 2], [1, \"a\"], {\"a\": 1}]"
+        );
+    }
+    let err = tmpl
+        .render(context!(items => items, strict => true))
+        .unwrap_err();
+    assert_eq!(err.kind(), ErrorKind::ImpossibleOperation);
+    assert_eq!(
+        err.to_string(),
+        "impossible operation: cannot compare string with number (in sort.txt:1)"
+    );
+}
+
+#[test]
+fn test_render_options() {
+    let mut env = Environment::new();
+    env.add_template("hello.html", "{{ value }}").unwrap();
+    env.add_template("loop.txt", "{% for x in range(100) %}{{ x }}{% endfor %}")
+        .unwrap();
+
+    let tmpl = env.get_template("hello.html").unwrap();
+    let ctx = context!(value => "<>");
+    assert_eq!(tmpl.render(&ctx).unwrap(), "&lt;&gt;");
+    let options = RenderOptions {
+        auto_escape: Some(AutoEscape::None),
+        ..Default::default()
+    };
+    assert_eq!(tmpl.render_with_options(&ctx, &options).unwrap(), "<>");
+
+    let tmpl = env.get_template("loop.txt").unwrap();
+    let mut options = RenderOptions {
+        fuel: Some(50),
+        ..Default::default()
+    };
+    let err = tmpl.render_with_options((), &options).unwrap_err();
+    assert_eq!(err.kind(), ErrorKind::InvalidOperation);
+    assert_eq!(
+        err.to_string(),
+        "invalid operation: engine ran out of fuel (in loop.txt:1)"
+    );
+    options.fuel = Some(10_000);
+    assert!(tmpl.render_with_options((), &options).is_ok());
+}
+
+#[test]
+fn test_error_sources_are_preserved() {
+    #[derive(Debug)]
+    struct AppError(&'static str);
+
+    impl std::fmt::Display for AppError {
+        fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+            write!(f, "app error from {}", self.0)
+        }
+    }
+
+    impl std::error::Error for AppError {}
+
+    fn fail(origin: &'static str) -> Error {
+        Error::new(ErrorKind::InvalidOperation, "failed").with_source(AppError(origin))
+    }
+
+    let mut env = Environment::new();
+    env.add_filter(
+        "fail_filter",
+        |_: &State, _: Value| -> Result<Value, Error> { Err(fail("filter")) },
+    );
+    env.add_test("fail_test", |_: &State, _: Value| -> Result<bool, Error> {
+        Err(fail("test"))
+    });
+    env.add_function("fail_function", |_: &State| -> Result<Value, Error> {
+        Err(fail("function"))
+    });
+    env.add_function("wrapped", |_: &State| -> Result<Value, Error> {
+        Err(Error::new(ErrorKind::InvalidOperation, "outer").with_source(fail("wrapped")))
+    });
+    env.add_template("filter.txt", "{{ 1|fail_filter }}")
+        .unwrap();
+    env.add_template("test.txt", "{{ 1 is fail_test }}")
+        .unwrap();
+    env.add_template("function.txt", "{{ fail_function() }}")
+        .unwrap();
+    env.add_template("include.txt", "{% include 'function.txt' %}")
+        .unwrap();
+    env.add_template("wrapped.txt", "{{ wrapped() }}").unwrap();
+
+    for &(name, origin) in &[
+        ("filter.txt", "filter"),
+        ("test.txt", "test"),
+        ("function.txt", "function"),
+        ("include.txt", "function"),
+        ("wrapped.txt", "wrapped"),
+    ] {
+        let err = env.get_template(name).unwrap().render(()).unwrap_err();
+        assert_eq!(err.kind(), ErrorKind::InvalidOperation);
+        assert_eq!(err.find_source::<AppError>().map(|x| x.0), Some(origin));
+    }
+
+    let err = env
+        .get_template("filter.txt")
+        .unwrap()
+        .render(())
+        .unwrap_err();
+    assert!(err.find_source::<std::fmt::Error>().is_none());
+}
+
+#[test]
+fn test_custom_tags() {
+    use minijinja::tags::Tag;
+
+    struct Wrap;
+
+    impl Tag for Wrap {
+        fn enter(&self, _state: &State, args: &[Value]) -> Result<Option<Value>, Error> {
+            Ok(args.get(0).filter(|x| x.is_true()).cloned())
+        }
+
+        fn render(
+            &self,
+            _state: &State,
+            _args: &[Value],
+            body: Option<Value>,
+        ) -> Result<Value, Error> {
+            let body = body.unwrap();
+            let rv = format!("[{}]", body);
+            Ok(if body.is_safe() {
+                Value::from_safe_string(rv)
+            } else {
+                Value::from(rv)
+            })
+        }
+    }
+
+    struct Now;
+
+    impl Tag for Now {
+        fn has_body(&self) -> bool {
+            false
+        }
+
+        fn render(
+            &self,
+            _state: &State,
+            args: &[Value],
+            body: Option<Value>,
+        ) -> Result<Value, Error> {
+            assert!(body.is_none());
+            Ok(Value::from(format!("<now {}>", args.len())))
+        }
+    }
+
+    let mut env = Environment::new();
+    env.add_tag("wrap", Wrap);
+    env.add_tag("now", Now);
+    env.add_template(
+        "tags.html",
+        "{% wrap %}<{{ x }}>{% endwrap %}|{% wrap '<b>' %}{{ fail() }}{% endwrap %}|\
+         {% now %}|{% now 1, x ~ 2 %}|{% for y in [1] %}{% wrap %}{{ y }}a{% endwrap %}{% endfor %}",
+    )
+    .unwrap();
+    let rv = env
+        .get_template("tags.html")
+        .unwrap()
+        .render(context!(x => "a&b"))
+        .unwrap();
+    assert_eq!(rv, "[<a&amp;b>]|&lt;b&gt;|&lt;now 0&gt;|&lt;now 2&gt;|[1a]");
+
+    let err = env
+        .add_template("unknown.txt", "{% shout %}{% endshout %}")
+        .unwrap_err();
+    assert_eq!(err.kind(), ErrorKind::SyntaxError);
+    let err = env
+        .add_template("unclosed.txt", "{% wrap %}foo")
+        .unwrap_err();
+    assert_eq!(err.kind(), ErrorKind::SyntaxError);
+    let err = env
+        .add_template("badend.txt", "{% wrap %}foo{% endfor %}")
+        .unwrap_err();
+    assert_eq!(err.kind(), ErrorKind::SyntaxError);
+}
+
+#[test]
+fn test_cache_tag() {
+    use std::sync::atomic::{AtomicUsize, Ordering};
+    use std::sync::Arc;
+
+    use minijinja::tags::{Cache, CacheTag, MemoryCache};
+
+    let calls = Arc::new(AtomicUsize::new(0));
+    let mut env = Environment::new();
+    env.add_tag("cache", CacheTag::new(MemoryCache::new()));
+    let counter = calls.clone();
+    env.add_function("expensive", move |_: &State| -> Result<Value, Error> {
+        Ok(Value::from(counter.fetch_add(1, Ordering::SeqCst)))
+    });
+    env.add_template(
+        "page.html",
+        "{% cache 'nav-' ~ user, 60 %}<{{ user }}>{{ expensive() }}{% endcache %}",
+    )
+    .unwrap();
+    env.add_template("nokey.html", "{% cache %}{% endcache %}")
+        .unwrap();
+    env.add_template("ttl.html", "{% cache 'x', ttl %}{% endcache %}")
+        .unwrap();
+
+    let tmpl = env.get_template("page.html").unwrap();
+    assert_eq!(tmpl.render(context!(user => "a&b")).unwrap(), "<a&amp;b>0");
+    assert_eq!(tmpl.render(context!(user => "a&b")).unwrap(), "<a&amp;b>0");
+    assert_eq!(tmpl.render(context!(user => "c")).unwrap(), "<c>1");
+    assert_eq!(calls.load(Ordering::SeqCst), 2);
+
+    let err = env
+        .get_template("nokey.html")
+        .unwrap()
+        .render(())
+        .unwrap_err();
+    assert_eq!(err.kind(), ErrorKind::InvalidArguments);
+
+    let tmpl = env.get_template("ttl.html").unwrap();
+    assert_eq!(tmpl.render(context!(ttl => 0)).unwrap(), "");
+    for ttl in &[-1.0, 1e300, f64::INFINITY] {
+        let err = tmpl.render(context!(ttl)).unwrap_err();
+        assert_eq!(
+            err.to_string(),
+            "invalid arguments: cache ttl must be between 0 and 4294967295 seconds \
+             (in ttl.html:1)"
+        );
+    }
+
+    // unsafe fragments are escaped when they are emitted from the cache
+    let cache = MemoryCache::new();
+    cache.set(
+        "raw",
+        minijinja::tags::Fragment {
+            content: "<b>".into(),
+            safe: false,
+        },
+        None,
+    );
+    let mut env = Environment::new();
+    env.add_tag("cache", CacheTag::new(cache));
+    env.add_template("raw.html", "{% cache 'raw' %}body{% endcache %}")
+        .unwrap();
+    let tmpl = env.get_template("raw.html").unwrap();
+    assert_eq!(tmpl.render(()).unwrap(), "&lt;b&gt;");
+}
+
+#[test]
+fn test_relative_template_names() {
+    let mut env = Environment::new();
+    env.add_template(
+        "layouts/base.html",
+        "[{% block body %}{% endblock %}]{% include './footer.html' %}",
+    )
+    .unwrap();
+    env.add_template("layouts/footer.html", "(footer {{ title }})")
+        .unwrap();
+    env.add_template(
+        "pages/index.html",
+        "{% extends '../layouts/base.html' %}{% block body %}\
+         {% include './partials/nav.html' %}\
+         {% component './partials/card.html' with title=title %}{% endcomponent %}\
+         {% endblock %}",
+    )
+    .unwrap();
+    env.add_template(
+        "pages/partials/nav.html",
+        "<nav>{% include ['./missing.html', './item.html'] %}</nav>",
+    )
+    .unwrap();
+    env.add_template("pages/partials/item.html", "{{ title }}")
+        .unwrap();
+    env.add_template("pages/partials/card.html", "<card {{ title }}>")
+        .unwrap();
+    env.add_template("pages/bad.html", "{% include '../../secret.html' %}")
+        .unwrap();
+
+    let rv = env
+        .get_template("pages/index.html")
+        .unwrap()
+        .render(context!(title => "Hi"))
+        .unwrap();
+    assert_eq!(rv, "[<nav>Hi</nav><card Hi>](footer Hi)");
+
+    let err = env
+        .get_template("pages/bad.html")
+        .unwrap()
+        .render(())
+        .unwrap_err();
+    assert_eq!(err.kind(), ErrorKind::InvalidOperation);
+}
+
+#[test]
+fn test_block_recursion() {
+    let mut env = Environment::new();
+    env.add_template(
+        "self.txt",
+        "{% block body %}[{{ self.body() }}]{% endblock %}",
+    )
+    .unwrap();
+    env.add_template(
+        "mutual.txt",
+        "{% block a %}{{ self.b() }}{% endblock %}{% block b %}{{ self.a() }}{% endblock %}",
+    )
+    .unwrap();
+    env.add_template("layout.txt", "<{% block body %}{% endblock %}>")
+        .unwrap();
+    env.add_template(
+        "child.txt",
+        "{% extends 'layout.txt' %}{% block body %}{{ self.title() }}{% endblock %}\
+         {% block title %}{{ self.body() }}{% endblock %}",
+    )
+    .unwrap();
+    env.add_template(
+        "tree.txt",
+        "{% block node %}{{ node.name }}{% for child in node.children %}\
+         ({% with node = child %}{% include 'tree.txt' %}{% endwith %})\
+         {% endfor %}{% endblock %}",
+    )
+    .unwrap();
+
+    for &(name, chain) in &[
+        ("self.txt", "body -> body"),
+        ("mutual.txt", "a -> b -> a"),
+        ("child.txt", "body -> title -> body"),
+    ] {
+        let err = env.get_template(name).unwrap().render(()).unwrap_err();
+        assert_eq!(err.kind(), ErrorKind::ImpossibleOperation);
+        assert_eq!(
+            err.to_string(),
+            format!(
+                "impossible operation: cycle in block rendering: {} (in {}:1)",
+                chain, name
+            )
+        );
+    }
+
+    let tree = context!(node => context!(name => "a", children => vec![
+        context!(name => "b", children => vec![context!(name => "c", children => ())]),
+    ]));
+    let rv = env.get_template("tree.txt").unwrap().render(tree).unwrap();
+    assert_eq!(rv, "a(b(c))");
+
+    // a failed block is no longer considered rendering
+    env.add_function("try_render", |state: &State, fail: bool| {
+        Ok(state
+            .render_template("fails.txt", context!(fail))
+            .unwrap_or_else(|_| Value::from("failed")))
+    });
+    env.add_template(
+        "fails.txt",
+        "{% block body %}{% if fail %}{{ missing() }}{% endif %}ok{% endblock %}",
+    )
+    .unwrap();
+    env.add_template(
+        "retry.txt",
+        "{{ try_render(true) }} {{ try_render(false) }}",
+    )
+    .unwrap();
+    let rv = env.get_template("retry.txt").unwrap().render(()).unwrap();
+    assert_eq!(rv, "failed ok");
+}
+
+#[test]
+fn test_html_aware_whitespace() {
+    let source = "<ul>\n  {%- for x in items %}\n  <li>{{ x }}</li>\n  {%- endfor %}\n</ul>\n\
+                  <PRE class=\"code\">\n  {%- for x in items %}\n  {{ x }}\n  {%- endfor %}\n</pre>\n\
+                  <textarea>\n  {{- items|join -}}\n</textarea>\n  {{- items|join }}\n\
+                  <script>\n  {%- if true %} x {% endif -%}\n</script>";
+    let mut env = Environment::new();
+    env.add_template("default.html", source).unwrap();
+    env.add_template_with_syntax(
+        "aware.html",
+        source,
+        Syntax {
+            html_aware_whitespace: true,
+            ..Syntax::default()
+        },
+    )
+    .unwrap();
+    let ctx = context!(items => vec!["a", "b"]);
+    assert_eq!(
+        env.get_template("default.html")
+            .unwrap()
+            .render(&ctx)
+            .unwrap(),
+        "<ul>\n  <li>a</li>\n  <li>b</li>\n</ul>\n\
+         <PRE class=\"code\">\n  a\n  b\n</pre>\n\
+         <textarea>ab</textarea>ab\n\
+         <script> x </script>"
+    );
+    assert_eq!(
+        env.get_template("aware.html")
+            .unwrap()
+            .render(&ctx)
+            .unwrap(),
+        "<ul>\n  <li>a</li>\n  <li>b</li>\n</ul>\n\
+         <PRE class=\"code\">\n  \n  a\n  \n  b\n  \n</pre>\n\
+         <textarea>\n  ab\n</textarea>ab\n\
+         <script>\n   x \n</script>"
+    );
+}
+
+#[test]
+fn test_state_render_template() {
+    let mut env = Environment::new();
+    env.add_function("render", |state: &State, name: String| {
+        state.render_template(&name, context!(title => "A & B"))
+    });
+    env.add_template("cards/card.html", "<h2>{{ title }}{{ secret }}</h2>")
+        .unwrap();
+    env.add_template("cards/list.html", "{{ render('./card.html') }}")
+        .unwrap();
+    env.add_template("self.html", "{{ render('self.html') }}")
+        .unwrap();
+    env.add_template("loop.html", "{% for x in range(100) %}{{ x }}{% endfor %}")
+        .unwrap();
+    env.add_template("page.html", "{{ render('loop.html') }}")
+        .unwrap();
+
+    let tmpl = env.get_template("cards/list.html").unwrap();
+    assert_eq!(
+        tmpl.render(context!(secret => "!")).unwrap(),
+        "<h2>A &amp; B</h2>"
+    );
+
+    let err = env
+        .get_template("self.html")
+        .unwrap()
+        .render(())
+        .unwrap_err();
+    assert_eq!(err.kind(), ErrorKind::ImpossibleOperation);
+    assert!(err
+        .to_string()
+        .contains("cycle in template includes: self.html -> self.html"));
+
+    let tmpl = env.get_template("page.html").unwrap();
+    let mut options = RenderOptions {
+        fuel: Some(50),
+        ..Default::default()
+    };
+    let err = tmpl.render_with_options((), &options).unwrap_err();
+    assert!(err.to_string().contains("engine ran out of fuel"));
+    options.fuel = Some(10_000);
+    assert!(tmpl.render_with_options((), &options).is_ok());
+}
+
+#[test]
+fn test_nested_super() {
+    let mut env = Environment::new();
+    env.add_template("a.txt", "{% block body %}a{% endblock %}")
+        .unwrap();
+    env.add_template(
+        "b.txt",
+        "{% extends 'a.txt' %}{% block body %}b{{ super() }}{% endblock %}",
+    )
+    .unwrap();
+    env.add_template(
+        "c.txt",
+        "{% extends 'b.txt' %}{% block body %}c{{ super() }}{% endblock %}",
+    )
+    .unwrap();
+    env.add_template("d.txt", "{% block body %}{{ super() }}{% endblock %}")
+        .unwrap();
+    let tmpl = env.get_template("c.txt").unwrap();
+    assert_eq!(tmpl.render(()).unwrap(), "cba");
+    let err = env.get_template("d.txt").unwrap().render(()).unwrap_err();
+    assert_eq!(err.kind(), ErrorKind::ImpossibleOperation);
+    assert!(err.to_string().contains("no parent block exists"));
+}
+
+#[test]
+fn test_state_render_template_to() {
+    let mut env = Environment::new();
+    env.add_function("byte_count", |state: &State, name: String| {
+        let mut buf = Vec::new();
+        state.render_template_to(&name, context!(title => "A & B"), &mut buf)?;
+        Ok(buf.len())
+    });
+    env.add_template("card.html", "<h2>{{ title }}</h2>")
+        .unwrap();
+    env.add_template("page.html", "{{ byte_count('card.html') }}")
+        .unwrap();
+    let tmpl = env.get_template("page.html").unwrap();
+    assert_eq!(tmpl.render(()).unwrap(), "18");
+    env.add_template("broken.html", "{{ byte_count('missing.html') }}")
+        .unwrap();
+    let tmpl = env.get_template("broken.html").unwrap();
+    assert_eq!(
+        tmpl.render(()).unwrap_err().kind(),
+        ErrorKind::TemplateNotFound
+    );
+}
+
+#[test]
+fn test_object_comparisons() {
+    use std::cmp::Ordering;
+    use std::fmt;
+
+    use minijinja::value::Object;
+
+    #[derive(Debug)]
+    struct Version(u32, u32);
+
+    impl fmt::Display for Version {
+        fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+            write!(f, "{}.{}", self.0, self.1)
+        }
+    }
+
+    impl Object for Version {
+        fn eq_value(&self, other: &Value) -> Option<bool> {
+            self.cmp_value(other).map(|x| x == Ordering::Equal)
+        }
+
+        fn cmp_value(&self, other: &Value) -> Option<Ordering> {
+            let other = other.to_string();
+            let mut parts = other.splitn(2, '.').map(|x| x.parse::<u32>().ok());
+            let major = parts.next()??;
+            let minor = parts.next().unwrap_or(Some(0))?;
+            Some((self.0, self.1).cmp(&(major, minor)))
+        }
+    }
+
+    let mut env = Environment::new();
+    env.add_function("v", |_: &State, major: u32, minor: u32| {
+        Ok(Value::from_object(Version(major, minor)))
+    });
+    env.add_template(
+        "versions.txt",
+        "{{ v(1, 2) == v(1, 2) }}|{{ v(1, 2) == '1.2' }}|{{ '1.3' != v(1, 2) }}|\
+         {{ v(1, 2) < v(1, 10) }}|{{ '2.0' > v(1, 10) }}|{{ v(1, 0) in ['1', '2'] }}|\
+         {{ [v(2, 0), v(1, 10), v(1, 2)]|sort|join(',') }}|\
+         {{ [v(1, 2), '1.2', v(2, 0)]|unique|join(',') }}",
+    )
+    .unwrap();
+    assert_eq!(
+        env.get_template("versions.txt")
+            .unwrap()
+            .render(())
+            .unwrap(),
+        "true|true|true|true|true|true|1.2,1.10,2.0|1.2,2.0"
+    );
+}
+
+#[test]
+fn test_kwargs() {
+    use minijinja::value::Kwargs;
+
+    let mut env = Environment::new();
+    env.add_function("greet", |_: &State, kwargs: Kwargs| {
+        let name: String = kwargs.get("name")?;
+        let punctuation = kwargs
+            .get::<Option<String>>("punctuation")?
+            .unwrap_or_else(|| "!".into());
+        let times = kwargs.get::<Option<usize>>("times")?.unwrap_or(1);
+        kwargs.assert_all_used()?;
+        Ok(format!("Hello {}{}", name, punctuation.repeat(times)))
+    });
+    let render = |source: &str| {
+        let mut env = env.clone();
+        env.add_template("x", source).unwrap();
+        let rv = env.get_template("x").unwrap().render(());
+        rv.map_err(|err| err.to_string())
+    };
+
+    assert_eq!(render("{{ greet(name='World') }}").unwrap(), "Hello World!");
+    assert_eq!(
+        render("{{ greet(name='World', punctuation='?', times=2) }}").unwrap(),
+        "Hello World??"
+    );
+    assert_eq!(
+        render("{{ greet() }}").unwrap_err(),
+        "invalid arguments: missing keyword argument name (in x:1)"
+    );
+    assert_eq!(
+        render("{{ greet(name='World', times='x') }}").unwrap_err(),
+        "invalid arguments: invalid value for keyword argument times (in x:1)"
+    );
+    assert_eq!(
+        render("{{ greet(name='World', color='red') }}").unwrap_err(),
+        "invalid arguments: unknown keyword argument color (in x:1)"
+    );
+    assert_eq!(
+        render("{{ greet(42) }}").unwrap_err(),
+        "invalid arguments: expected keyword arguments (in x:1)"
+    );
+}
+
+#[test]
+fn test_kwargs_duplicates_and_order() {
+    use minijinja::value::Kwargs;
+
+    let mut env = Environment::new();
+    env.add_function("names", |_: &State, kwargs: Kwargs| {
+        Ok(kwargs.args().collect::<Vec<_>>().join(","))
+    });
+
+    let err = env
+        .add_template("dup.txt", "{{ names(\n  a=1,\n  a=2) }}")
+        .unwrap_err();
+    assert_eq!(err.kind(), ErrorKind::SyntaxError);
+    assert_eq!(
+        err.to_string(),
+        "syntax error: duplicate keyword argument a (in dup.txt:3)"
+    );
+
+    env.add_template("map.txt", "{{ {'a': 1, 'b': 2, 'a': 3}.a }}")
+        .unwrap();
+    assert_eq!(
+        env.get_template("map.txt").unwrap().render(()).unwrap(),
+        "3"
+    );
+
+    env.add_template("order.txt", "{{ names(z=1, a=2, m=3) }}")
+        .unwrap();
+    let rv = env.get_template("order.txt").unwrap().render(()).unwrap();
+    if cfg!(feature = "preserve_order") {
+        assert_eq!(rv, "z,a,m");
+    } else {
+        assert_eq!(rv, "a,m,z");
+    }
+}
+
+#[test]
+fn test_splat_args() {
+    use minijinja::value::{Kwargs, Object};
+    use std::fmt;
+
+    #[derive(Debug)]
+    struct Point;
+
+    impl fmt::Display for Point {
+        fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+            write!(f, "point")
+        }
+    }
+
+    impl Object for Point {
+        fn get_attr(&self, name: &str) -> Option<Value> {
+            match name {
+                "x" => Some(Value::from(1)),
+                "y" => Some(Value::from(2)),
+                _ => None,
+            }
+        }
+
+        fn attributes(&self) -> &[&str] {
+            &["x", "y"]
+        }
+
+        fn call_method(&self, _: &State, _: &str, args: Vec<Value>) -> Result<Value, Error> {
+            Ok(Value::from(args.len()))
+        }
+    }
+
+    let mut env = Environment::new();
+    env.add_function(
+        "show",
+        |_: &State, a: Value, b: Option<Value>, c: Option<Value>, d: Option<Value>| {
+            Ok(Some(a)
+                .into_iter()
+                .chain(b)
+                .chain(c)
+                .chain(d)
+                .map(|x| x.to_string())
+                .collect::<Vec<_>>()
+                .join(","))
+        },
+    );
+    env.add_filter(
+        "show",
+        |_: &State, value: String, a: Option<Value>, b: Option<Value>| {
+            Ok(format!(
+                "{}:{:?}",
+                value,
+                a.into_iter().chain(b).collect::<Vec<_>>()
+            ))
+        },
+    );
+    env.add_filter("kw", |_: &State, value: String, kwargs: Kwargs| {
+        Ok(format!(
+            "{}:{}",
+            value,
+            kwargs
+                .args()
+                .map(|x| format!("{}={}", x, kwargs.get::<Value>(x).unwrap()))
+                .collect::<Vec<_>>()
+                .join(",")
+        ))
+    });
+    env.add_test("between", |_: &State, value: i64, a: i64, b: i64| {
+        Ok(value >= a && value <= b)
+    });
+    env.add_global("point", Value::from_object(Point));
+
+    let render = |source: &str| {
+        let mut env = env.clone();
+        env.add_template("splat.txt", source).unwrap();
+        env.get_template("splat.txt").unwrap().render(())
+    };
+
+    assert_eq!(render("{{ show(1, *[2, 3], 4, *[]) }}").unwrap(), "1,2,3,4");
+    assert_eq!(
+        render("{{ show(**{'a': 1}) }}|{{ show(1, **{}) }}").unwrap(),
+        "{\"a\": 1}|1"
+    );
+    assert_eq!(render("{{ 'x'|show(*[1, 2]) }}").unwrap(), "x:[1, 2]");
+    assert_eq!(
+        render("{{ 'x'|kw(a=1, **{'b': 2}, c=3) }}").unwrap(),
+        "x:a=1,b=2,c=3"
+    );
+    assert_eq!(render("{{ 'x'|kw(**point) }}").unwrap(), "x:x=1,y=2");
+    assert_eq!(
+        render("{{ 2 is between(*[1, 3]) }}|{{ 5 is between(*[1, 3]) }}").unwrap(),
+        "true|false"
+    );
+    assert_eq!(render("{{ point.count(*[1, 2, 3]) }}").unwrap(), "3");
+
+    let err = render("{{ show(\n  *42) }}").unwrap_err();
+    assert_eq!(err.kind(), ErrorKind::ImpossibleOperation);
+    assert_eq!(
+        err.to_string(),
+        "impossible operation: cannot splat value of type number as arguments (in splat.txt:2)"
+    );
+
+    let err = render("{{ 'x'|kw(\n  **[1, 2]) }}").unwrap_err();
+    assert_eq!(
+        err.to_string(),
+        "impossible operation: cannot splat value of type sequence as keyword \
+         arguments (in splat.txt:2)"
+    );
+
+    let err = render("{{ 'x'|kw(a=1, **{'a': 2}) }}").unwrap_err();
+    assert_eq!(
+        err.to_string(),
+        "impossible operation: duplicate keyword argument a (in splat.txt:1)"
+    );
+
+    let mut env = Environment::new();
+    let err = env
+        .add_template("splat.txt", "{{ range(a=1, *[2]) }}")
+        .unwrap_err();
+    assert_eq!(
+        err.to_string(),
+        "syntax error: non-keyword arg after keyword arg (in splat.txt:1)"
+    );
+}
+
+#[test]
+fn test_sequence_objects() {
+    use minijinja::value::Object;
+    use std::fmt;
+    use std::sync::atomic::{AtomicUsize, Ordering};
+    use std::sync::Arc;
+
+    #[derive(Debug)]
+    struct Squares(Arc<AtomicUsize>);
+
+    impl fmt::Display for Squares {
+        fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+            write!(f, "squares")
+        }
+    }
+
+    impl Object for Squares {
+        fn len(&self) -> Option<usize> {
+            Some(1000)
+        }
+
+        fn get_index(&self, idx: usize) -> Option<Value> {
+            self.0.fetch_add(1, Ordering::Relaxed);
+            Some(Value::from(idx * idx))
+        }
+    }
+
+    let lookups = Arc::new(AtomicUsize::new(0));
+    let mut env = Environment::new();
+    env.add_global("squares", Value::from_object(Squares(lookups.clone())));
+    env.add_template(
+        "squares.txt",
+        "{{ squares[3] }}|{{ squares[-1] }}|{{ squares[-1001] is undefined }}|\
+         {{ squares[2:8:2] }}|{{ squares[:-5:-2] }}|{{ squares|length }}",
+    )
+    .unwrap();
+    let rv = env.get_template("squares.txt").unwrap().render(()).unwrap();
+    assert_eq!(rv, "9|998001|true|[4, 16, 36]|[998001, 994009]|1000");
+    assert_eq!(lookups.load(Ordering::Relaxed), 7);
+
+    for (source, err) in [
+        (
+            "{{ squares[::0] }}",
+            "impossible operation: cannot slice by step size of 0 (in slice.txt:1)",
+        ),
+        (
+            "{{ squares['a':] }}",
+            "impossible operation: slice indexes must be integers (in slice.txt:1)",
+        ),
+        (
+            "{{ 42[1:] }}",
+            "impossible operation: value of type number cannot be sliced (in slice.txt:1)",
+        ),
+    ]
+    .iter()
+    {
+        env.add_template("slice.txt", source).unwrap();
+        let tmpl = env.get_template("slice.txt").unwrap();
+        assert_eq!(tmpl.render(()).unwrap_err().to_string(), *err);
+    }
+}
+
+#[test]
+fn test_secrets() {
+    use minijinja::value::{Object, Secret};
+    use std::fmt;
+
+    #[derive(Debug)]
+    struct Token;
+
+    impl fmt::Display for Token {
+        fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+            write!(f, "tok_123")
+        }
+    }
+
+    impl Object for Token {
+        fn is_secret(&self) -> bool {
+            true
+        }
+    }
+
+    let mut env = Environment::new();
+    env.add_template(
+        "config.txt",
+        "{{ password }}|{{ token }}|{{ password|upper }}|{{ 'pw=' ~ password }}|\
+         {{ [password, token] }}|{{ password == 'hunter2' }}|{{ password == 'hunter3' }}|\
+         {{ password == other }}",
+    )
+    .unwrap();
+    let ctx = context!(
+        password => Value::from_object(Secret::new("hunter2")),
+        other => Value::from_object(Secret::new("hunter2")),
+        token => Value::from_object(Token),
+    );
+    let rv = env
+        .get_template("config.txt")
+        .unwrap()
+        .render(&ctx)
+        .unwrap();
+    assert_eq!(
+        rv,
+        "*****|*****|*****|pw=*****|[\"*****\", \"*****\"]|true|false|true"
+    );
+    assert!(!format!("{:?}", ctx).contains("hunter2"));
+
+    let secret = Value::from_object(Secret::new("hunter2"));
+    assert_eq!(
+        secret.downcast_object_ref::<Secret>().unwrap().expose(),
+        "hunter2"
+    );
+}
+
+#[test]
+#[cfg(feature = "regex")]
+fn test_regex_filters_invalid_pattern() {
+    let mut env = Environment::new();
+    env.add_template("re.txt", "{{ 'x'|regex_search('(') }}")
+        .unwrap();
+    let err = env.get_template("re.txt").unwrap().render(()).unwrap_err();
+    assert_eq!(err.kind(), ErrorKind::InvalidArguments);
+    assert_eq!(
+        err.to_string(),
+        "invalid arguments: invalid regular expression \"(\" (in re.txt:1)"
+    );
+    assert!(std::error::Error::source(&err).is_some());
+}
+
+#[test]
+#[cfg(feature = "builtins")]
+fn test_indent_width_limit() {
+    let mut env = Environment::new();
+    env.add_template("indent.txt", "{{ value|indent(width) }}")
+        .unwrap();
+    let tmpl = env.get_template("indent.txt").unwrap();
+    let rv = tmpl.render(context!(value => "a\nb", width => 1024));
+    assert_eq!(rv.unwrap().len(), 1027);
+    for &width in [1025, i64::MAX].iter() {
+        let err = tmpl
+            .render(context!(value => "a\nb", width => width))
+            .unwrap_err();
+        assert_eq!(err.kind(), ErrorKind::InvalidArguments);
+    }
+}
+
+#[test]
+#[cfg(feature = "encoding")]
+fn test_b64decode() {
+    let mut env = Environment::new();
+    env.add_template("b64.txt", "{{ value|b64decode(urlsafe=urlsafe) }}")
+        .unwrap();
+    let tmpl = env.get_template("b64.txt").unwrap();
+    let render =
+        |value: &str, urlsafe: bool| tmpl.render(context!(value => value, urlsafe => urlsafe));
+    assert_eq!(render("Zm9vYg==", false).unwrap(), "foob");
+    assert_eq!(render("Zm9vYg", false).unwrap(), "foob");
+    assert_eq!(render("aGVsbG8_", true).unwrap(), "hello?");
+    for &(value, urlsafe) in [
+        ("Zm9vYg=", false),
+        ("Zm9vYg===", false),
+        ("Zm9v=Yg==", false),
+        ("Zm9v!", false),
+        ("Zm9vY", false),
+        ("aGVsbG8_", false),
+        ("+/8", true),
+    ]
+    .iter()
+    {
+        let err = render(value, urlsafe).unwrap_err();
+        assert_eq!(err.kind(), ErrorKind::InvalidArguments, "{}", value);
+        assert!(std::error::Error::source(&err).is_some());
+    }
+}
+
+#[test]
+fn test_string_filters_keep_safe() {
+    let mut env = Environment::new();
+    env.add_template(
+        "t.html",
+        "{{ s|upper }}|{{ s|trim(' <>b/') }}|{{ s|replace('b>', '<i>') }}|\
+         {{ s|replace('x', 'y&'|safe) }}|{{ u|replace('x', '<i>'|safe) }}|\
+         {{ u|replace('x', 'y') }}|{{ s|indent('> ', first=true) }}|\
+         {{ s|truncate(5, end='&', leeway=0) }}",
+    )
+    .unwrap();
+    let rv = env
+        .get_template("t.html")
+        .unwrap()
+        .render(context!(s => Value::from_safe_string(" <b>x</b> ".into()), u => "<x>"))
+        .unwrap();
+    assert_eq!(
+        rv,
+        " <B>X</B> |x| <b>x</b> | <b>y&</b> |&lt;<i>&gt;|&lt;y&gt;|&gt;  <b>x</b> |&amp;"
+    );
+}
+
+#[test]
+fn test_join_markup() {
+    let mut env = Environment::new();
+    env.add_template(
+        "t.html",
+        "{{ items|join('<br>'|safe) }}|{{ [safe, '<i>']|join(' & ') }}|{{ items|join('&') }}",
+    )
+    .unwrap();
+    env.add_template("t.txt", "{{ items|join('<br>'|safe) }}")
+        .unwrap();
+    let ctx = context!(items => vec!["a<", "", "b"], safe => Value::from_safe_string("<b>".into()));
+    assert_eq!(
+        env.get_template("t.html").unwrap().render(&ctx).unwrap(),
+        "a&lt;<br><br>b|<b> &amp; &lt;i&gt;|a&lt;&amp;&amp;b"
+    );
+    assert_eq!(
+        env.get_template("t.txt").unwrap().render(&ctx).unwrap(),
+        "a<<br><br>b"
+    );
+
+    // only html escaping produces markup
+    #[cfg(feature = "json")]
+    {
+        env.set_auto_escape_callback(|_| AutoEscape::Js);
+        env.add_template("t.js", "{{ items|join('<br>'|safe) }}")
+            .unwrap();
+        assert_eq!(
+            env.get_template("t.js").unwrap().render(&ctx).unwrap(),
+            r#""a\u003c\u003cbr\u003e\u003cbr\u003eb""#
+        );
+    }
+}
+
+#[test]
+fn test_truncate_end_too_long() {
+    let mut env = Environment::new();
+    env.add_template("t.txt", "{{ 'abcdefghij'|truncate(2, leeway=0) }}")
+        .unwrap();
+    let err = env.get_template("t.txt").unwrap().render(()).unwrap_err();
+    assert_eq!(err.kind(), ErrorKind::InvalidArguments);
+}
+
+#[test]
+#[cfg(feature = "unicode")]
+fn test_unicode_graphemes() {
+    let mut env = Environment::new();
+    env.add_template(
+        "t.txt",
+        "{{ s|truncate(4, killwords=true, end='.', leeway=0) }}|{{ s|graphemes|length }}|\
+         {{ (s|graphemes)[1:2]|join }}|{{ s[1:2] }}",
+    )
+    .unwrap();
+    let rv = env
+        .get_template("t.txt")
+        .unwrap()
+        .render(context!(s => "a\u{1f44d}\u{1f3fd}b\u{1f44d}\u{1f3fd}c\u{1f44d}\u{1f3fd}d"))
+        .unwrap();
+    assert_eq!(rv, "a\u{1f44d}\u{1f3fd}b.|7|\u{1f44d}\u{1f3fd}|\u{1f44d}");
+}
+
+#[test]
+fn test_random_globals() {
+    let mut env = Environment::new();
+    let counter = std::sync::atomic::AtomicU8::new(0);
+    env.set_random_source(move |buf| {
+        for b in buf.iter_mut() {
+            *b = counter.fetch_add(1, std::sync::atomic::Ordering::Relaxed);
+        }
+    });
+    env.add_template("id.txt", "{{ uuid4() }}|{{ random_token(10) }}")
+        .unwrap();
+    env.add_template("long.txt", "{{ random_token(2000) }}")
+        .unwrap();
+    let rv = env.get_template("id.txt").unwrap().render(()).unwrap();
+    assert_eq!(rv, "00010203-0405-4607-8809-0a0b0c0d0e0f|QRSTUVWXYZ");
+    let err = env
+        .get_template("long.txt")
+        .unwrap()
+        .render(())
+        .unwrap_err();
+    assert_eq!(err.kind(), ErrorKind::InvalidArguments);
+
+    // a source that never yields usable bytes must not hang
+    let mut env = Environment::new();
+    env.set_random_source(|buf| buf.iter_mut().for_each(|b| *b = 0xff));
+    env.add_template("token.txt", "{{ random_token() }}")
+        .unwrap();
+    let err = env
+        .get_template("token.txt")
+        .unwrap()
+        .render(())
+        .unwrap_err();
+    assert_eq!(err.kind(), ErrorKind::InvalidOperation);
+
+    // the default source is only good enough for identifiers
+    let mut env = Environment::new();
+    env.add_template("id.txt", "{{ uuid4() }}|{{ uuid4() }}")
+        .unwrap();
+    let rv = env.get_template("id.txt").unwrap().render(()).unwrap();
+    let parts = rv.split('|').collect::<Vec<_>>();
+    assert_ne!(parts[0], parts[1]);
+    assert_eq!(parts[0].len(), 36);
+    assert_eq!(&parts[0][14..15], "4");
+    env.add_template("token.txt", "{{ random_token() }}")
+        .unwrap();
+    let err = env
+        .get_template("token.txt")
+        .unwrap()
+        .render(())
+        .unwrap_err();
+    assert_eq!(err.kind(), ErrorKind::InvalidOperation);
+    assert!(err.to_string().contains("no random source configured"));
+}
+
+#[test]
+fn test_datetimes() {
+    use minijinja::value::DateTime;
+
+    let mut env = Environment::new();
+    env.add_template(
+        "dt.txt",
+        "{{ dt }}|{{ dt.year }}-{{ dt.month }}-{{ dt.day }}|{{ dt.astimezone('-05:00') }}|\
+         {{ dt|datetimeformat }}|{{ dt|datetimeformat('%H:%M %Z', tz='+01:00') }}|\
+         {{ 86400|datetimeformat('%F') }}|{{ '2022-03-04T10:00:00Z'|datetimeformat('%A') }}|\
+         {{ dt + 3600 }}|{{ dt - '2022-03-04T10:00:00+01:00' }}|{{ dt - 60.5 }}|\
+         {{ dt == '2022-03-04T12:00:00+02:00' }}|{{ dt < '2022-03-05' }}|{{ dt > dt + 1 }}",
+    )
+    .unwrap();
+    env.add_template(
+        "now.txt",
+        "{{ now() < now() + 1 }}|{{ now(tz='+03:00').offset }}",
+    )
+    .unwrap();
+    env.add_template("bad.txt", "{{ now(tz='Europe/Vienna') }}")
+        .unwrap();
+    env.add_template(
+        "far.txt",
+        "{{ (now() + 1000000000000000000000.0)|datetimeformat }}",
+    )
+    .unwrap();
+    env.add_template(
+        "far_ts.txt",
+        "{{ 1000000000000000000000.0|datetimeformat }}",
+    )
+    .unwrap();
+    let dt = DateTime::parse("2022-03-04T10:00:00Z").unwrap();
+    let rv = env
+        .get_template("dt.txt")
+        .unwrap()
+        .render(context!(dt => Value::from_object(dt)))
+        .unwrap();
+    assert_eq!(
+        rv,
+        "2022-03-04T10:00:00+00:00|2022-3-4|2022-03-04T05:00:00-05:00|\
+         2022-03-04 10:00:00|11:00 +01:00|\
+         1970-01-02|Friday|\
+         2022-03-04T11:00:00+00:00|1 hour|2022-03-04T09:58:59.500000+00:00|\
+         true|true|false"
+    );
+    let rv = env.get_template("now.txt").unwrap().render(()).unwrap();
+    assert_eq!(rv, "true|10800");
+    let err = env.get_template("bad.txt").unwrap().render(()).unwrap_err();
+    assert_eq!(err.kind(), ErrorKind::InvalidArguments);
+    for name in ["far.txt", "far_ts.txt"].iter() {
+        assert!(env.get_template(name).unwrap().render(()).is_err());
+    }
+}
+
+#[test]
+fn test_durations() {
+    use std::time::Duration;
+
+    let mut env = Environment::new();
+    env.add_template(
+        "d.txt",
+        "{{ d }}|{{ d.days }}/{{ d.seconds }}/{{ d.total_seconds }}|{{ d|duration(2) }}|\
+         {{ 90|duration }}|{{ 0.25|duration }}|{{ d * 2 }}|{{ d - 93784 }}|{{ short - d }}|\
+         {{ d > 3600 }}|{{ d == short }}|{{ [short, d]|sort|first }}|\
+         {{ ('2022-03-04T10:00:00Z'|to_dt + d)|datetimeformat }}|\
+         {{ (now() + d) - now() > 93783 }}",
+    )
+    .unwrap();
+    env.add_filter("to_dt", |_: &State, s: String| {
+        Ok(Value::from_object(
+            minijinja::value::DateTime::parse(&s).unwrap(),
+        ))
+    });
+    let rv = env
+        .get_template("d.txt")
+        .unwrap()
+        .render(context!(
+            d => Value::from(Duration::from_secs(93_784)),
+            short => Value::from(Duration::from_millis(1500)),
+        ))
+        .unwrap();
+    assert_eq!(
+        rv,
+        "1 day 2 hours 3 minutes 4 seconds|1/7384/93784.0|1 day 2 hours|\
+         1 minute 30 seconds|250 milliseconds|2 days 4 hours 6 minutes 8 seconds|0 seconds|\
+         -1 day 2 hours 3 minutes 2 seconds 500 milliseconds|\
+         true|false|1 second 500 milliseconds|\
+         2022-03-05 12:03:04|true"
+    );
+}
+
+#[test]
+fn test_bytes() {
+    let mut env = Environment::new();
+    env.add_template(
+        "b.txt",
+        "{{ data|length }}|{{ data[0] }}|{{ data[-1] }}|{{ data[1:3]|length }}|\
+         {{ data[::-1] == data }}|{{ data == other }}|{{ data == 'abc' }}|{{ data|filesizeformat }}",
+    )
+    .unwrap();
+    let ctx = context!(
+        data => Value::from_bytes(vec![0, 255, 254, 1]),
+        other => Value::from_bytes(vec![0, 255, 254, 1]),
+    );
+    let rv = env.get_template("b.txt").unwrap().render(&ctx).unwrap();
+    assert_eq!(rv, "4|0|1|2|false|true|false|4 Bytes");
+
+    #[cfg(feature = "encoding")]
+    {
+        env.add_template("b64.txt", "{{ data[1:3]|b64encode }}")
+            .unwrap();
+        let rv = env.get_template("b64.txt").unwrap().render(&ctx).unwrap();
+        assert_eq!(rv, "//4=");
+    }
+}
+
+#[test]
+fn test_front_matter() {
+    fn parse_front_matter(fence: &str, content: &str) -> Result<Value, Error> {
+        if fence != "---" {
+            return Err(Error::new(
+                ErrorKind::InvalidSyntax,
+                "only YAML is supported",
+            ));
+        }
+        let mut rv = BTreeMap::new();
+        for line in content.lines() {
+            let mut parts = line.splitn(2, ": ");
+            match (parts.next(), parts.next()) {
+                (Some(key), Some(value)) => rv.insert(key.to_string(), value.to_string()),
+                _ => return Err(Error::new(ErrorKind::InvalidSyntax, "bad front matter")),
+            };
+        }
+        Ok(Value::from_serializable(&rv))
+    }
+
+    let mut env = Environment::new();
+    env.set_front_matter_parser(parse_front_matter);
+    env.add_template(
+        "post.txt",
+        "---\ntitle: Hello\nauthor: Jane\n---\n{{ title }} by {{ author }}",
+    )
+    .unwrap();
+    env.add_template("plain.txt", "--- {{ title }}").unwrap();
+
+    let tmpl = env.get_template("post.txt").unwrap();
+    assert_eq!(
+        tmpl.metadata().get_attr("title").unwrap().as_str(),
+        Some("Hello")
+    );
+    assert_eq!(tmpl.render(()).unwrap(), "Hello by Jane");
+    assert_eq!(
+        tmpl.render(context!(author => "John")).unwrap(),
+        "Hello by John"
+    );
+    assert_eq!(
+        tmpl.prepare(context!(title => "Hi")).render(()).unwrap(),
+        "Hi by Jane"
+    );
+    let tmpl = env.get_template("plain.txt").unwrap();
+    assert!(tmpl.metadata().is_undefined());
+    assert_eq!(tmpl.render(context!(title => "x")).unwrap(), "--- x");
+
+    let err = env
+        .add_template("broken.txt", "---\ntitle: Hello\n---\n\n{{ title }\n")
+        .unwrap_err();
+    assert_eq!(err.line(), Some(5));
+    let err = env
+        .add_template("toml.txt", "+++\ntitle = 1\n+++\n")
+        .unwrap_err();
+    assert_eq!(err.kind(), ErrorKind::InvalidSyntax);
+    assert_eq!(err.line(), Some(1));
+}
+
+#[test]
+fn test_render_directory() {
+    use minijinja::RenderDirectoryOptions;
+
+    let out_dir = std::env::temp_dir().join(format!("minijinja-render-dir-{}", std::process::id()));
+    let mut env = Environment::new();
+    env.add_template(
+        "_layout.html",
+        "<title>{{ title }}</title>{% block body %}{% endblock %}",
+    )
+    .unwrap();
+    env.add_template(
+        "index.html",
+        "{% extends '_layout.html' %}{% block body %}index{% endblock %}",
+    )
+    .unwrap();
+    env.add_template(
+        "blog/post.html",
+        "{% extends '_layout.html' %}{% block body %}post{% endblock %}",
+    )
+    .unwrap();
+    env.add_template("_partials/nav.html", "nav").unwrap();
+    let rendered = env
+        .render_directory(
+            &out_dir,
+            &RenderDirectoryOptions::default(),
+            |name| context!(title => name),
+        )
+        .unwrap();
+    assert_eq!(rendered, vec!["blog/post.html", "index.html"]);
+    assert_eq!(
+        fs::read_to_string(out_dir.join("blog/post.html")).unwrap(),
+        "<title>blog&#x2f;post.html</title>post"
+    );
+    assert!(!out_dir.join("_layout.html").exists());
+
+    env.add_template("broken.html", "{{ 1 / none }}").unwrap();
+    env.add_template("missing.html", "{% include 'missing' %}")
+        .unwrap();
+    let err = env
+        .render_directory(
+            &out_dir,
+            &RenderDirectoryOptions {
+                threads: 1,
+                ..Default::default()
+            },
+            |_| (),
+        )
+        .unwrap_err();
+    assert!(err
+        .to_string()
+        .starts_with("invalid operation: failed to render 2 of 4 templates\n  broken.html: "));
+    fs::remove_dir_all(&out_dir).unwrap();
+}
+
+#[test]
+fn test_render_changed_blocks() {
+    let mut env = Environment::new();
+    env.add_template(
+        "page.txt",
+        "{% block title %}{{ title }}{% endblock %}\
+         {% block body %}{% for item in items %}{{ item }}{% endfor %}\
+         {% block footer %}{{ footer }}{% endblock %}{% endblock %}\
+         {% block nav %}{% set title = 'x' %}{{ title }}{% endblock %}\
+         {% block dyn %}{% include 'other.txt' %}{% endblock %}",
+    )
+    .unwrap();
+    env.add_template("other.txt", "other").unwrap();
+    let tmpl = env.get_template("page.txt").unwrap();
+
+    let old = context!(title => "A", items => vec![1, 2], footer => "F");
+    let changed = tmpl
+        .render_changed_blocks(
+            &old,
+            context!(title => "A", items => vec![1, 2], footer => "F"),
+        )
+        .unwrap();
+    assert_eq!(changed.keys().collect::<Vec<_>>(), vec!["dyn"]);
+
+    let changed = tmpl
+        .render_changed_blocks(
+            &old,
+            context!(title => "B", items => vec![1, 2], footer => "G"),
+        )
+        .unwrap();
+    assert_eq!(
+        changed.keys().collect::<Vec<_>>(),
+        vec!["body", "dyn", "footer", "title"]
+    );
+    assert_eq!(changed["title"], "B");
+    assert_eq!(changed["body"], "12G");
+    assert_eq!(changed["footer"], "G");
+    assert_eq!(changed["dyn"], "other");
+}
+
+#[test]
+fn test_block_dependencies() {
+    let mut env = Environment::new();
+    env.add_template(
+        "page.txt",
+        "{% block body %}{{ title|upper }}{% for x in items|sort %}{{ x }}{% endfor %}\
+         {% block footer %}{% include 'footer.txt' %}{{ year }}{% endblock %}{% endblock %}\
+         {% block side %}{% filter indent(width) %}{% include name %}{% endfilter %}{% endblock %}\
+         {% block plain %}{% set x = 1 %}{{ x }}{% endblock %}",
+    )
+    .unwrap();
+    let tmpl = env.get_template("page.txt").unwrap();
+    let deps = tmpl.block_dependencies();
+    assert_eq!(
+        deps.keys().collect::<Vec<_>>(),
+        vec!["body", "footer", "plain", "side"]
+    );
+
+    let to_vec = |set: &std::collections::BTreeSet<String>| set.iter().cloned().collect::<Vec<_>>();
+    assert_eq!(
+        to_vec(deps["body"].variables()),
+        vec!["items", "title", "year"]
+    );
+    assert_eq!(to_vec(deps["body"].filters()), vec!["sort", "upper"]);
+    assert_eq!(to_vec(deps["body"].includes()), vec!["footer.txt"]);
+    assert!(deps["body"].is_dynamic());
+    assert_eq!(to_vec(deps["footer"].variables()), vec!["year"]);
+    assert_eq!(to_vec(deps["side"].variables()), vec!["name", "width"]);
+    assert_eq!(to_vec(deps["side"].filters()), vec!["indent"]);
+    assert_eq!(to_vec(deps["side"].includes()), vec!["*"]);
+    assert!(deps["plain"].variables().is_empty());
+    assert!(!deps["plain"].is_dynamic());
+
+    env.add_template(
+        "alias.txt",
+        "{% set title = page.title|title %}{% set heading = title ~ suffix %}\
+         {% for item in items %}{% block item %}{{ item }}{{ loop.index }}{% endblock %}{% endfor %}\
+         {% block head %}{{ heading }}{% endblock %}\
+         {% block shadow %}{% set title = 'x' %}{{ title }}{% endblock %}",
+    )
+    .unwrap();
+    let tmpl = env.get_template("alias.txt").unwrap();
+    let deps = tmpl.block_dependencies();
+    assert_eq!(to_vec(deps["head"].variables()), vec!["page", "suffix"]);
+    assert_eq!(to_vec(deps["head"].filters()), vec!["title"]);
+    assert_eq!(to_vec(deps["item"].variables()), vec!["items"]);
+    assert!(deps["shadow"].variables().is_empty());
+    assert_eq!(
+        tmpl.undeclared_paths().iter().collect::<Vec<_>>(),
+        vec!["items", "page.title", "suffix"]
+    );
+}
+
+#[test]
+fn test_prefetch_callback() {
+    let mut env = Environment::new();
+    env.add_template(
+        "page.txt",
+        "{{ user.name }} {{ user['email'] }} {{ site.pages[0].title }} {{ site.nav[key].url }}\
+         {% for item in items %}{{ item.title }}{% endfor %}{% set x = {} %}{{ x.y }}\
+         {% block body %}{{ user.id }}{% endblock %}",
+    )
+    .unwrap();
+    let tmpl = env.get_template("page.txt").unwrap();
+    assert_eq!(
+        tmpl.undeclared_paths().iter().collect::<Vec<_>>(),
+        vec![
+            "items",
+            "key",
+            "site.nav",
+            "site.pages.0.title",
+            "user.email",
+            "user.id",
+            "user.name"
+        ]
+    );
+
+    let seen = std::sync::Arc::new(std::sync::Mutex::new(Vec::new()));
+    let seen_in_callback = seen.clone();
+    env.set_prefetch_callback(move |name, paths| {
+        if paths.contains("fail") {
+            return Err(Error::new(ErrorKind::InvalidOperation, "cannot prefetch"));
+        }
+        seen_in_callback
+            .lock()
+            .unwrap()
+            .push((name.to_string(), paths.len()));
+        Ok(())
+    });
+    env.add_template("fail.txt", "{{ fail }}").unwrap();
+    let ctx = context!(
+        user => context!(id => 1),
+        site => context!(
+            pages => vec![context!(title => "Home")],
+            nav => context!(home => context!(url => "/"))
+        ),
+        key => "home"
+    );
+    env.get_template("page.txt").unwrap().render(ctx).unwrap();
+    let err = env
+        .get_template("fail.txt")
+        .unwrap()
+        .render(())
+        .unwrap_err();
+    assert_eq!(err.kind(), ErrorKind::InvalidOperation);
+    assert_eq!(*seen.lock().unwrap(), vec![("page.txt".to_string(), 7)]);
+}
+
+#[test]
+fn test_repr_limits() {
+    let mut env = Environment::new();
+    env.set_repr_limits(ReprLimits {
+        max_depth: Some(1),
+        max_items: Some(2),
+        max_string_len: Some(4),
+    });
+    env.add_template(
+        "pprint.txt",
+        "{{ value|pprint }}|{{ value|pprint(max_items=3) }}",
+    )
+    .unwrap();
+    env.add_template("debug.txt", "{{ debug() }}").unwrap();
+    let ctx =
+        context!(value => vec![Value::from("abcdefgh"), Value::from(vec![1]), Value::from(3)]);
+    insta::assert_snapshot!(
+        env.get_template("pprint.txt").unwrap().render(&ctx).unwrap(),
+        @r###"
+    [
+        "abcd"... (4 more),
+        [...],
+        ... (1 more)
+    ]|[
+        "abcd"... (4 more),
+        [...],
+        3,
+    ]
+    "###
+    );
+    let rv = env.get_template("debug.txt").unwrap().render(&ctx).unwrap();
+    assert!(rv.contains("\"abcd\"... (4 more)"));
+    assert!(!rv.contains("abcdefgh"));
+}
+
+#[test]
+fn test_render_block() {
+    let mut env = Environment::new();
+    env.add_template(
+        "layout.html",
+        "<title>{% block title %}{% endblock %}</title>\
+         {% block footer %}by {% block author %}{% endblock %}{% endblock %}",
+    )
+    .unwrap();
+    env.add_template(
+        "page.html",
+        "{% extends 'layout.html' %}{% set x = fail() %}\
+         {% block title %}{{ title }} <{{ x is undefined }}>{% endblock %}\
+         {% block author %}{{ author }}{% endblock %}",
+    )
+    .unwrap();
+    let rv = env
+        .render_block("page.html", "title", context!(title => "A&B"))
+        .unwrap();
+    assert_eq!(rv, "A&amp;B <true>");
+
+    // blocks are resolved through the inheritance chain
+    let rv = env
+        .render_block("page.html", "footer", context!(author => "Jane"))
+        .unwrap();
+    assert_eq!(rv, "by Jane");
+    env.add_template(
+        "sub.html",
+        "{% extends 'page.html' %}{% block title %}[{{ super() }}]{% endblock %}",
+    )
+    .unwrap();
+    let rv = env
+        .render_block("sub.html", "title", context!(title => "T"))
+        .unwrap();
+    assert_eq!(rv, "[T <true>]");
+    env.add_template("a.html", "{% extends 'b.html' %}")
+        .unwrap();
+    env.add_template("b.html", "{% extends 'a.html' %}")
+        .unwrap();
+    let err = env.render_block("a.html", "title", ()).unwrap_err();
+    assert_eq!(
+        err.to_string(),
+        "impossible operation: cycle in template inheritance: a.html -> b.html -> a.html"
+    );
+
+    let err = env.render_block("page.html", "body", ()).unwrap_err();
+    assert_eq!(err.kind(), ErrorKind::InvalidOperation);
+    assert_eq!(
+        err.to_string(),
+        "invalid operation: block body does not exist"
+    );
+    let err = env.render_block("missing.html", "title", ()).unwrap_err();
+    assert_eq!(err.kind(), ErrorKind::TemplateNotFound);
+}
+
+#[test]
+fn test_render_with_exports() {
+    let mut env = Environment::new();
+    env.add_template(
+        "layout.html",
+        "{% set layout = true %}<title>{% block title %}{% endblock %}</title>",
+    )
+    .unwrap();
+    env.add_template(
+        "page.html",
+        "{% set title = name|title %}{% set tags = ['a', 'b'] %}\
+         {% for x in tags %}{% set inner = x %}{% endfor %}\
+         {% extends 'layout.html' %}{% block title %}{{ title }}{% endblock %}",
+    )
+    .unwrap();
+    let tmpl = env.get_template("page.html").unwrap();
+    let (output, exports) = tmpl.render_with_exports(context!(name => "hello")).unwrap();
+    assert_eq!(output, "<title>Hello</title>");
+    insta::assert_snapshot!(format!("{:?}", exports), @r###"{"layout": true, "tags": ["a", "b"], "title": "Hello"}"###);
+}
+
+#[test]
+fn test_map_iteration() {
+    let mut env = Environment::new();
+    env.add_template(
+        "keys.txt",
+        "{% for k in m %}{{ k }}:{{ k is number }}:{{ m[k] }},{% endfor %}\
+         {{ m|first }}|{{ m|last }}|{{ {}|first is undefined }}",
+    )
+    .unwrap();
+    let mut m = BTreeMap::new();
+    m.insert(10, "ten");
+    m.insert(2, "two");
+    m.insert(1, "one");
+    let rv = env
+        .get_template("keys.txt")
+        .unwrap()
+        .render(context!(m))
+        .unwrap();
+    assert_eq!(rv, "1:true:one,2:true:two,10:true:ten,1|10|true");
+}
+
+#[test]
+fn test_map_object_iteration() {
+    use minijinja::value::Object;
+    use std::fmt;
+
+    #[derive(Debug)]
+    struct Headers;
+
+    impl fmt::Display for Headers {
+        fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+            write!(f, "headers")
+        }
+    }
+
+    impl Object for Headers {
+        fn get_attr(&self, name: &str) -> Option<Value> {
+            match name {
+                "host" => Some(Value::from("example.com")),
+                "accept" => Some(Value::from("*/*")),
+                _ => None,
+            }
+        }
+
+        fn attributes(&self) -> &[&str] {
+            &["host", "accept"]
+        }
+    }
+
+    let mut env = Environment::new();
+    env.add_template(
+        "headers.txt",
+        "{% for key in headers %}{{ key }},{% endfor %}\
+         {% for key, value in headers %}[{{ key }}={{ value }}]{% endfor %}\
+         {% for key, value in headers if key != 'host' %}[{{ key }}={{ value }}]{% endfor %}\
+         {% for key, value in headers|items %}[{{ key }}={{ value }}]{% endfor %}",
+    )
+    .unwrap();
+    let rv = env
+        .get_template("headers.txt")
+        .unwrap()
+        .render(context!(headers => Value::from_object(Headers)))
+        .unwrap();
+    assert_eq!(
+        rv,
+        "host,accept,[host=example.com][accept=*/*][accept=*/*]\
+         [host=example.com][accept=*/*]"
+    );
+}
+
+#[test]
+fn test_starred_unpacking() {
+    let render = |source: &str| {
+        let mut env = Environment::new();
+        env.add_template("test.txt", source)?;
+        env.get_template("test.txt")?
+            .render(context!(seq => vec![1, 2, 3, 4]))
+    };
+    assert_eq!(
+        render("{% for a, *rest in [seq] %}{{ a }}|{{ rest }}{% endfor %}").unwrap(),
+        "1|[2, 3, 4]"
+    );
+    assert_eq!(
+        render("{% set (a, *b, c) = seq %}{{ a }}|{{ b }}|{{ c }}").unwrap(),
+        "1|[2, 3]|4"
+    );
+    assert_eq!(
+        render("{% set (*a, b, c, d, e) = seq %}{{ a }}|{{ e }}").unwrap(),
+        "[]|4"
+    );
+
+    let err = render("{% set (a, *b, c) = [1] %}").unwrap_err();
+    assert_eq!(err.kind(), ErrorKind::ImpossibleOperation);
+    assert!(err
+        .to_string()
+        .contains("cannot unpack: sequence of wrong length (expected at least 2, got 1: [1])"));
+    let err = render("{% set (a, b) = 42 %}").unwrap_err();
+    assert!(err
+        .to_string()
+        .contains("cannot unpack: not a sequence (got 42)"));
+
+    let err = render("{% set (*a, *b) = seq %}").unwrap_err();
+    assert_eq!(err.kind(), ErrorKind::SyntaxError);
+    assert!(err
+        .to_string()
+        .contains("multiple starred names in assignment"));
+    let err = render("{% set (*a) = seq %}").unwrap_err();
+    assert_eq!(err.kind(), ErrorKind::SyntaxError);
+    assert!(err
+        .to_string()
+        .contains("starred assignment target must be in a tuple"));
+}
+
+#[test]
+fn test_usage_stats() {
+    let mut env = Environment::new();
+    env.add_function("sep", |_: &State| Ok(", "));
+    env.add_template("item.txt", "{{ item|title }}").unwrap();
+    env.add_template(
+        "list.txt",
+        "{% for item in items %}{% if item is string %}{% include 'item.txt' %}{% endif %}\
+         {% if not loop.last %}{{ sep() }}{% endif %}{% endfor %}\
+         {{ range(2)|length }}",
+    )
+    .unwrap();
+    assert_eq!(env.usage_stats(), Default::default());
+    env.set_usage_tracking(true);
+
+    let tmpl = env.get_template("list.txt").unwrap();
+    let rv = tmpl.render(context!(items => vec!["a", "b"])).unwrap();
+    assert_eq!(rv, "A, B2");
+    let stats = env.usage_stats();
+    let counts = |map: &std::collections::BTreeMap<String, u64>| {
+        map.iter()
+            .map(|(k, v)| format!("{}={}", k, v))
+            .collect::<Vec<_>>()
+            .join(" ")
+    };
+    assert_eq!(counts(&stats.filters), "length=1 title=2");
+    assert_eq!(counts(&stats.tests), "string=2");
+    assert_eq!(counts(&stats.functions), "range=1 sep=1");
+    assert_eq!(counts(&stats.templates), "item.txt=2 list.txt=1");
+
+    env.reset_usage_stats();
+    assert_eq!(env.usage_stats(), Default::default());
+    env.set_usage_tracking(false);
+    let tmpl = env.get_template("list.txt").unwrap();
+    tmpl.render(context!(items => vec!["a"])).unwrap();
+    assert_eq!(env.usage_stats(), Default::default());
+}
+
+#[test]
+fn test_float_format() {
+    use minijinja::FloatFormat;
+
+    let mut env = Environment::new();
+    env.add_template(
+        "floats.html",
+        "{{ x }}|{{ x * 10.0 ** 20 }}|{{ [x] }}|{{ x ~ '' }}",
+    )
+    .unwrap();
+    let render = |env: &Environment| {
+        env.get_template("floats.html")
+            .unwrap()
+            .render(context!(x => 1.5))
+            .unwrap()
+    };
+    assert_eq!(render(&env), "1.5|150000000000000000000.0|[1.5]|1.5");
+    env.set_float_format(FloatFormat::Python);
+    assert_eq!(render(&env), "1.5|1.5e+20|[1.5]|1.5");
+    env.set_float_format(FloatFormat::Fixed(2));
+    assert_eq!(render(&env), "1.50|150000000000000000000.00|[1.5]|1.5");
+}
+
+#[test]
+fn test_eval_expr() {
+    let mut env = Environment::new();
+    env.add_global("site", Value::from("example.com"));
+    env.add_template(
+        "mail.txt",
+        "{% set name = name|title %}{% set subject = 'Hi ' ~ name %}{{ subject }}",
+    )
+    .unwrap();
+    let tmpl = env.get_template("mail.txt").unwrap();
+    let ctx = context!(name => "jane", count => 2);
+    let rv = tmpl
+        .eval_expr(&ctx, "subject ~ ' from ' ~ site ~ ' ' ~ count")
+        .unwrap();
+    assert_eq!(rv.as_str(), Some("Hi Jane from example.com 2"));
+    assert!(tmpl.eval_expr(&ctx, "missing").unwrap().is_undefined());
+
+    let err = tmpl.eval_expr(&ctx, "name|").unwrap_err();
+    assert_eq!(err.kind(), ErrorKind::SyntaxError);
+}
+
+#[test]
+fn test_formatter() {
+    use std::fmt::Write;
+
+    let mut env = Environment::new();
+    env.set_formatter(|out, state, value| {
+        if value.is_undefined() {
+            return Err(Error::new(
+                ErrorKind::UndefinedError,
+                "undefined value in output",
+            ));
+        }
+        if value.kind() == minijinja::value::ValueKind::Bytes {
+            write!(out, "<{} bytes>", value.len().unwrap_or(0)).unwrap();
+            return Ok(());
+        }
+        minijinja::escape_formatter(out, state, value)
+    });
+    env.add_template(
+        "hello.html",
+        "{{ name }} {{ data }}{% if x %}{{ x }}{% endif %}",
+    )
+    .unwrap();
+    env.add_template("missing.html", "\n{{ missing }}").unwrap();
+    let rv = env
+        .get_template("hello.html")
+        .unwrap()
+        .render(context!(name => "<x>", data => Value::from_bytes(b"abc".to_vec())))
+        .unwrap();
+    assert_eq!(rv, "&lt;x&gt; <3 bytes>");
+    let err = env
+        .get_template("missing.html")
+        .unwrap()
+        .render(())
+        .unwrap_err();
+    assert_eq!(err.kind(), ErrorKind::UndefinedError);
+    assert_eq!(err.line(), Some(2));
+}
+
+#[test]
+#[cfg(feature = "json")]
+fn test_js_auto_escape() {
+    let mut env = Environment::new();
+    env.add_template(
+        "page.html",
+        "<script>{% autoescape 'js' %}const config = {{ config }};\
+         const name = {{ name }};{{ raw|safe }}{% endautoescape %}</script>\
+         <p>{{ name }}</p>",
+    )
+    .unwrap();
+    let rv = env
+        .get_template("page.html")
+        .unwrap()
+        .render(context!(
+            config => context!(title => "</script>", n => 1),
+            name => "A & B\u{2028}",
+            raw => "// raw"
+        ))
+        .unwrap();
+    assert_eq!(
+        rv,
+        "<script>const config = {\"n\":1,\"title\":\"\\u003c/script\\u003e\"};\
+         const name = \"A \\u0026 B\\u2028\";// raw</script><p>A &amp; B\u{2028}</p>"
+    );
+}
+
+#[test]
+fn test_check_template() {
+    let mut env = Environment::new();
+    env.add_template("layout.html", "{% block body %}{% endblock %}")
+        .unwrap();
+    env.add_template(
+        "page.html",
+        "{% extends 'layout.html' %}{% block body %}\n\
+         {{ x|upper }}{% include 'partial.html' %}\n\
+         {% include 'optional.html' ignore missing %}{% include name %}\n\
+         {% if x is nope %}{% endif %}{% include 'missing.html' %}\n\
+         {% endblock %}",
+    )
+    .unwrap();
+    env.add_template("partial.html", "{% filter shout %}{% endfilter %}")
+        .unwrap();
+    env.add_template("broken.html", "{% if %}").unwrap_err();
+    env.add_template("ok.html", "{{ x|default(1) }}{% include 'partial.html' %}")
+        .unwrap();
+    env.add_template("self.html", "{% include 'self.html' %}")
+        .unwrap();
+
+    let errors = env
+        .check_template("page.html")
+        .iter()
+        .map(|x| x.to_string())
+        .collect::<Vec<_>>();
+    assert_eq!(
+        errors,
+        vec![
+            "unknown test: test nope is unknown (in page.html:4)",
+            "unknown filter: filter shout is unknown (in partial.html:1)",
+            "template not found: template \"missing.html\" does not exist (in page.html:4)",
+        ]
+    );
+    assert_eq!(env.check_template("ok.html").len(), 1);
+    assert!(env.check_template("self.html").is_empty());
+    assert_eq!(
+        env.check_template("unknown.html")[0].kind(),
+        ErrorKind::TemplateNotFound
+    );
+}
+
+#[test]
+fn test_check_syntax() {
+    let env = Environment::new();
+    let errors = env.check_syntax(
+        "page.html",
+        "{{ 1 + }}\n\
+         {% for item in %}{{ item }}{% endfor %}\n\
+         {% if x %}{{ x| }}{% else %}{{ y. }}{% endif %}\n\
+         {{ ok }}{% nope %}",
+    );
+    let errors = errors
+        .iter()
+        .map(|x| (x.to_string(), x.span().unwrap().start_col))
+        .collect::<Vec<_>>();
+    assert_eq!(
+        errors,
+        vec![
+            (
+                "syntax error: unexpected end of variable block (in page.html:1)".to_string(),
+                7
+            ),
+            (
+                "syntax error: unexpected end of block (in page.html:2)".to_string(),
+                15
+            ),
+            (
+                "syntax error: unknown statement endfor (in page.html:2)".to_string(),
+                30
+            ),
+            (
+                "syntax error: unexpected end of variable block, expected identifier (in page.html:3)"
+                    .to_string(),
+                16
+            ),
+            (
+                "syntax error: unexpected end of variable block, expected identifier (in page.html:3)"
+                    .to_string(),
+                34
+            ),
+            (
+                "syntax error: unknown statement nope (in page.html:4)".to_string(),
+                11
+            ),
+        ]
+    );
+
+    assert!(env
+        .check_syntax("ok.html", "{{ x }}{% if y %}{% endif %}")
+        .is_empty());
+    let errors = env.check_syntax("lexer.html", "{{ 'unterminated }}\n{{ 1 + }}");
+    assert_eq!(errors.len(), 1);
+}
+
+#[test]
+fn test_format_template() {
+    let syntax = Syntax::default();
+    for &(source, expected) in &[
+        (
+            "{%if x>1%}{{x|join( ',' )}}{%endif%}",
+            "{% if x > 1 %}{{ x|join(',') }}{% endif %}",
+        ),
+        ("{{-x.y[1:2]-}}", "{{- x.y[1:2] -}}"),
+        ("{{ dict(a = 1,b=-2) }}", "{{ dict(a=1, b=-2) }}"),
+        (
+            "{% set (a,*b)=[1,2,3] %}{{a}}",
+            "{% set (a, *b) = [1, 2, 3] %}{{ a }}",
+        ),
+        ("{{ {'a':1}['a'] }}", "{{ {'a': 1}['a'] }}"),
+        ("{{not(x) and -y**2 }}", "{{ not (x) and -y ** 2 }}"),
+        (
+            "{% for a,b in items if a is not none %}{{loop.index0}}{% endfor %}",
+            "{% for a, b in items if a is not none %}{{ loop.index0 }}{% endfor %}",
+        ),
+        ("{{ 1 - -1 }}{{ x[:2] }}", "{{ 1 - -1 }}{{ x[:2] }}"),
+        (
+            "{# keep   this #}{% raw %}{{  x }}{% endraw %}",
+            "{# keep   this #}{% raw %}{{  x }}{% endraw %}",
+        ),
+        ("text\n  {{x}}  \n", "text\n  {{ x }}  \n"),
+    ] {
+        let formatted = format_template(source, &syntax).unwrap();
+        assert_eq!(formatted, expected);
+        assert_eq!(format_template(&formatted, &syntax).unwrap(), formatted);
+
+        let ctx = context!(x => [1, 2, 3], y => 2, items => vec![(1, 2)]);
+        let render = |source: &str| {
+            let mut env = Environment::new();
+            env.add_template("x", source).unwrap();
+            env.get_template("x").unwrap().render(&ctx).ok()
+        };
+        assert_eq!(render(source), render(&formatted), "{}", source);
+    }
+
+    assert_eq!(
+        format_template("{{ x + }}", &syntax).unwrap_err().kind(),
+        ErrorKind::SyntaxError
+    );
+
+    let mut env = Environment::new();
+    env.set_syntax(Syntax {
+        line_statement_prefix: Some("#".into()),
+        line_comment_prefix: Some("##".into()),
+        ..Syntax::default()
+    })
+    .unwrap();
+    assert_eq!(
+        env.format_template("# for x in seq|reverse\n  {{x}} ## note\n# endfor")
+            .unwrap(),
+        "# for x in seq|reverse\n  {{ x }} ## note\n# endfor"
+    );
+}
+
+#[test]
+fn test_new_state() {
+    fn wrap(state: &State, value: String) -> Result<String, Error> {
+        let tag = state
+            .lookup("tag")
+            .and_then(|x| x.as_str().map(|x| x.to_string()));
+        let tag = tag.unwrap_or_else(|| "span".into());
+        if let AutoEscape::Html = state.auto_escape() {
+            Ok(format!("<{}>{}</{}>", tag, value, tag))
+        } else {
+            Ok(value)
+        }
+    }
+
+    let mut env = Environment::new();
+    env.add_global("tag", Value::from("b"));
+    let state = env.new_state(());
+    assert_eq!(state.name(), "<unknown>");
+    assert_eq!(wrap(&state, "x".into()).unwrap(), "x");
+    let state = env
+        .new_state(context!(tag => "i"))
+        .with_auto_escape(AutoEscape::Html);
+    assert_eq!(wrap(&state, "x".into()).unwrap(), "<i>x</i>");
+    let state = env.new_state(()).with_auto_escape(AutoEscape::Html);
+    assert_eq!(wrap(&state, "x".into()).unwrap(), "<b>x</b>");
+}
+
+#[test]
+fn test_temps() {
+    fn counter(state: &State) -> Result<usize, Error> {
+        let rv = state.get_temp::<usize>("counter").unwrap_or(0) + 1;
+        state.set_temp("counter", rv);
+        Ok(rv)
+    }
+
+    fn other(state: &State) -> Result<String, Error> {
+        Ok(state.get_or_set_temp("counter", || "other".to_string()))
+    }
+
+    let mut env = Environment::new();
+    env.add_function("counter", counter);
+    env.add_function("other", other);
+    env.add_template(
+        "layout.txt",
+        "{{ counter() }}{% block body %}{% endblock %}",
+    )
+    .unwrap();
+    env.add_template(
+        "page.txt",
+        "{% extends 'layout.txt' %}{% block body %}{{ counter() }}[{% include 'inc.txt' %}]{{ counter() }}{{ other() }}{% endblock %}",
+    )
+    .unwrap();
+    env.add_template("inc.txt", "{{ counter() }}{{ counter() }}")
+        .unwrap();
+    let tmpl = env.get_template("page.txt").unwrap();
+    assert_eq!(tmpl.render(()).unwrap(), "12[12]3other");
+    assert_eq!(tmpl.render(()).unwrap(), "12[12]3other");
+
+    // a failed render of another template does not leave its temps behind
+    env.add_function("try_render", |state: &State| {
+        Ok(state
+            .render_template("broken.txt", ())
+            .unwrap_or_else(|_| Value::from("failed")))
+    });
+    env.add_template("broken.txt", "{{ counter() }}{{ missing() }}")
+        .unwrap();
+    env.add_template(
+        "retry.txt",
+        "{{ counter() }}{{ try_render() }}{{ counter() }}",
+    )
+    .unwrap();
+    let tmpl = env.get_template("retry.txt").unwrap();
+    assert_eq!(tmpl.render(()).unwrap(), "1failed2");
+
+    let state = env.new_state(());
+    assert_eq!(counter(&state).unwrap(), 1);
+    assert_eq!(counter(&state).unwrap(), 2);
+    assert_eq!(state.remove_temp::<usize>("counter"), Some(2));
+    assert_eq!(state.remove_temp::<String>("counter"), None);
+    assert_eq!(counter(&state).unwrap(), 1);
+}
+
+#[test]
+fn test_memory_budget() {
+    let mut env = Environment::new();
+    env.add_template("join.txt", "{{ range(100000)|join(',') }}")
+        .unwrap();
+    env.add_template("small.txt", "{% for x in range(10) %}{{ x }}{% endfor %}")
+        .unwrap();
+    env.add_template(
+        "loop.txt",
+        "{% for x in range(1000) %}{{ range(x)|length }}{% endfor %}",
+    )
+    .unwrap();
+    env.add_template("inc.txt", "{% include 'join.txt' %}")
+        .unwrap();
+
+    let render = |env: &Environment, name: &str| env.get_template(name).unwrap().render(());
+    assert_eq!(render(&env, "join.txt").unwrap().len(), 588889);
+
+    env.set_memory_budget(Some(64 * 1024));
+    assert_eq!(env.memory_budget(), Some(64 * 1024));
+    let err = render(&env, "join.txt").unwrap_err();
+    assert_eq!(err.kind(), ErrorKind::MemoryBudgetExceeded);
+    assert_eq!(err.to_string(), "memory budget exceeded (in join.txt:1)");
+    assert_eq!(
+        render(&env, "inc.txt").unwrap_err().kind(),
+        ErrorKind::MemoryBudgetExceeded
+    );
+    assert_eq!(render(&env, "small.txt").unwrap(), "0123456789");
+    assert_eq!(
+        render(&env, "loop.txt").unwrap_err().kind(),
+        ErrorKind::MemoryBudgetExceeded
+    );
+
+    let options = RenderOptions {
+        memory_budget: Some(1024 * 1024 * 1024),
+        ..Default::default()
+    };
+    let tmpl = env.get_template("join.txt").unwrap();
+    assert!(tmpl.render_with_options((), &options).is_ok());
+
+    // these fail before the large value is allocated
+    env.set_memory_budget(Some(1024));
+    for source in [
+        "{{ s|indent(1000, first=true) }}",
+        "{{ range(4000000000)|length }}",
+        "{{ [s, s, s, s]|join }}",
+        "{% set x = s ~ s ~ s %}",
+    ]
+    .iter()
+    {
+        env.add_template("budget.txt", source).unwrap();
+        let tmpl = env.get_template("budget.txt").unwrap();
+        let err = tmpl.render(context!(s => "x".repeat(512))).unwrap_err();
+        assert_eq!(err.kind(), ErrorKind::MemoryBudgetExceeded, "{}", source);
+    }
+}
+
+#[test]
+fn test_lazy_iterators() {
+    let mut env = Environment::new();
+    env.add_template(
+        "loop.txt",
+        "{% for x in items %}{{ loop.index }}:{{ x }}{{ loop.length is undefined }} {% endfor %}|\
+         {% for x in items %}{{ x }}{% else %}consumed{% endfor %}",
+    )
+    .unwrap();
+    env.add_template("batch.txt", "{{ (items|batch(3))|first }}")
+        .unwrap();
+    env.add_template(
+        "fill.txt",
+        "{% for row in items|batch(2, 'x') %}{{ row|join }} {% endfor %}",
+    )
+    .unwrap();
+    env.add_template("list.txt", "{{ items|list }} {{ items|list }}")
+        .unwrap();
+
+    let render = |name: &str, items: Value| {
+        env.get_template(name)
+            .unwrap()
+            .render(context!(items))
+            .unwrap()
+    };
+    assert_eq!(
+        render("loop.txt", Value::from_iterator(vec!["a", "b"])),
+        "1:atrue 2:btrue |consumed"
+    );
+    // an infinite stream is only read as far as needed
+    assert_eq!(render("batch.txt", Value::from_iterator(0..)), "[0, 1, 2]");
+    assert_eq!(render("fill.txt", Value::from_iterator(1..6)), "12 34 5x ");
+    assert_eq!(
+        render("list.txt", Value::from_iterator(0..3)),
+        "[0, 1, 2] []"
+    );
+}
+
+#[test]
+fn test_receiver_values() {
+    use std::sync::mpsc;
+
+    let mut env = Environment::new();
+    env.add_template("all.txt", "{% for x in items %}{{ x }},{% endfor %}")
+        .unwrap();
+    env.add_template("first.txt", "{{ items|first }}").unwrap();
+
+    let (tx, rx) = mpsc::channel();
+    let producer = std::thread::spawn(move || {
+        for idx in 0..5 {
+            tx.send(idx).unwrap();
+        }
+    });
+    let rv = env
+        .get_template("all.txt")
+        .unwrap()
+        .render(context!(items => Value::from_receiver(rx)))
+        .unwrap();
+    assert_eq!(rv, "0,1,2,3,4,");
+    producer.join().unwrap();
+
+    // the producer notices that the template stopped reading
+    let (tx, rx) = mpsc::sync_channel(1);
+    let producer = std::thread::spawn(move || {
+        let mut sent = 0;
+        while tx.send(sent).is_ok() {
+            sent += 1;
+        }
+        sent
+    });
+    let rv = env
+        .get_template("first.txt")
+        .unwrap()
+        .render(context!(items => Value::from_receiver(rx)))
+        .unwrap();
+    assert_eq!(rv, "0");
+    assert!(producer.join().unwrap() >= 1);
+}
+
+#[test]
+fn test_lazy_values() {
+    use std::sync::atomic::{AtomicUsize, Ordering};
+    use std::sync::Arc;
+
+    let mut env = Environment::new();
+    env.add_template(
+        "page.txt",
+        "{% if show %}{{ user.name }} {{ user.name }} {{ items[1] }}{% endif %}\
+         {% for x in list %}{{ x }}{% endfor %}",
+    )
+    .unwrap();
+    env.add_template("broken.txt", "ok\n{{ data }}").unwrap();
+
+    let calls = Arc::new(AtomicUsize::new(0));
+    let make_user = || {
+        let calls = calls.clone();
+        Value::from_lazy(move || {
+            calls.fetch_add(1, Ordering::Relaxed);
+            Ok(context!(name => "Peter"))
+        })
+    };
+    let tmpl = env.get_template("page.txt").unwrap();
+    let ctx = context!(
+        show => true,
+        user => make_user(),
+        items => vec![Value::from(1), Value::from_lazy(|| Ok(42))],
+        list => vec![Value::from_lazy(|| Ok("a")), Value::from("b")],
+    );
+    assert_eq!(tmpl.render(&ctx).unwrap(), "Peter Peter 42ab");
+    assert_eq!(tmpl.render(&ctx).unwrap(), "Peter Peter 42ab");
+    assert_eq!(calls.load(Ordering::Relaxed), 1);
+
+    let rv = tmpl
+        .render(context!(show => false, user => make_user()))
+        .unwrap();
+    assert_eq!(rv, "");
+    assert_eq!(calls.load(Ordering::Relaxed), 1);
+
+    let data = Value::from_lazy(|| -> Result<Value, Error> {
+        Err(Error::new(ErrorKind::InvalidOperation, "query failed").with_source(std::fmt::Error))
+    });
+    let tmpl = env.get_template("broken.txt").unwrap();
+    for _ in 0..2 {
+        let err = tmpl.render(context!(data => data.clone())).unwrap_err();
+        assert_eq!(
+            err.to_string(),
+            "invalid operation: query failed (in broken.txt:2)"
+        );
+        assert!(err.find_source::<std::fmt::Error>().is_some());
+    }
+}
+
+#[test]
+#[cfg(feature = "builtins")]
+fn test_lazy_values_in_filters() {
+    let mut env = Environment::new();
+    env.add_template(
+        "filters.txt",
+        "{{ scores|dictsort }}|{{ users|map(attribute='name')|join(',') }}|\
+         {{ names|map('upper')|join(',') }}|{{ scores|pprint }}|{{ names }}",
+    )
+    .unwrap();
+    let ctx = context!(
+        scores => context!(a => Value::from_lazy(|| Ok(2)), b => Value::from_lazy(|| Ok(1))),
+        users => vec![Value::from_lazy(|| Ok(context!(name => "Peter")))],
+        names => vec![Value::from_lazy(|| Ok("x")), Value::from("y")],
+    );
+    let rv = env
+        .get_template("filters.txt")
+        .unwrap()
+        .render(&ctx)
+        .unwrap();
+    assert_eq!(
+        rv,
+        "[[\"a\", 2], [\"b\", 1]]|Peter|X,Y|{\n    \"a\": 2,\n    \"b\": 1,\n}|[\"x\", \"y\"]"
+    );
+
+    #[cfg(feature = "json")]
+    {
+        env.add_template("json.txt", "{{ scores|tojson }}").unwrap();
+        let rv = env.get_template("json.txt").unwrap().render(&ctx).unwrap();
+        assert_eq!(rv, r#"{"a":2,"b":1}"#);
+    }
+}
+
+#[test]
+#[cfg(feature = "builtins")]
+fn test_list_templates() {
+    let mut env = Environment::new();
+    env.add_template("missing.txt", "{{ list_templates() }}")
+        .unwrap();
+    let err = env
+        .get_template("missing.txt")
+        .unwrap()
+        .render(())
+        .unwrap_err();
+    assert_eq!(err.kind(), ErrorKind::ImpossibleOperation);
+    env.remove_template("missing.txt");
+
+    env.add_function("list_templates", minijinja::functions::list_templates);
+    env.add_template("partials/nav.html", "[nav]").unwrap();
+    env.add_template("partials/footer.html", "[footer]")
+        .unwrap();
+    env.add_template("partials/sub/item.html", "[item]")
+        .unwrap();
+    env.add_template(
+        "index.html",
+        "{% for name in list_templates('partials/*.html') %}{% include name %}{% endfor %}",
+    )
+    .unwrap();
+    let rv = env.get_template("index.html").unwrap().render(()).unwrap();
+    assert_eq!(rv, "[footer][nav]");
+
+    env.add_template(
+        "all.txt",
+        "{{ list_templates('partials/**') }}|{{ list_templates()|length }}",
+    )
+    .unwrap();
+    let rv = env.get_template("all.txt").unwrap().render(()).unwrap();
+    assert_eq!(
+        rv,
+        r#"["partials/footer.html", "partials/nav.html", "partials/sub/item.html"]|5"#
+    );
+}
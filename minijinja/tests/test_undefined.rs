@@ -0,0 +1,330 @@
+//! Behavior of undefined values for every [`UndefinedBehavior`].
+//!
+//! Every case renders a template with the context below and lists the
+//! expected result for the lenient, semi strict and strict behavior.  A
+//! result of `Err(kind)` means that rendering fails with that error kind.
+use minijinja::value::Value;
+use minijinja::{context, Environment, ErrorKind, RenderOptions, State, UndefinedBehavior};
+
+fn render(source: &str, behavior: UndefinedBehavior) -> Result<String, ErrorKind> {
+    let mut env = Environment::new();
+    env.add_filter("or_else", |_: &State, value: Value, other: Value| {
+        Ok(if value.is_undefined() { other } else { value })
+    });
+    env.add_template("test.txt", source).unwrap();
+    env.get_template("test.txt")
+        .unwrap()
+        .render_with_options(
+            context!(obj => context!(a => 1), seq => vec![1, 2]),
+            &RenderOptions {
+                undefined_behavior: Some(behavior),
+                ..Default::default()
+            },
+        )
+        .map_err(|err| err.kind())
+}
+
+macro_rules! undefined_test {
+    ($name:ident, $source:expr, $lenient:expr, $semi_strict:expr, $strict:expr) => {
+        #[test]
+        fn $name() {
+            let expected: [Result<&str, ErrorKind>; 3] = [$lenient, $semi_strict, $strict];
+            for (&behavior, expected) in [
+                UndefinedBehavior::Lenient,
+                UndefinedBehavior::SemiStrict,
+                UndefinedBehavior::Strict,
+            ]
+            .iter()
+            .zip(expected.iter())
+            {
+                assert_eq!(
+                    render($source, behavior),
+                    expected.clone().map(|x| x.to_string()),
+                    "{:?} with {:?}",
+                    $source,
+                    behavior
+                );
+            }
+        }
+    };
+}
+
+const UNDEFINED: ErrorKind = ErrorKind::UndefinedError;
+const IMPOSSIBLE: ErrorKind = ErrorKind::ImpossibleOperation;
+
+// access
+undefined_test!(
+    access_attr_of_undefined,
+    "{{ missing.attr }}",
+    Err(UNDEFINED),
+    Err(UNDEFINED),
+    Err(UNDEFINED)
+);
+undefined_test!(
+    access_item_of_undefined,
+    "{{ missing[0] }}",
+    Err(UNDEFINED),
+    Err(UNDEFINED),
+    Err(UNDEFINED)
+);
+undefined_test!(
+    access_slice_of_undefined,
+    "{{ missing[1:2] }}",
+    Err(UNDEFINED),
+    Err(UNDEFINED),
+    Err(UNDEFINED)
+);
+undefined_test!(
+    access_missing_attr,
+    "{{ obj.missing is undefined }}",
+    Ok("true"),
+    Ok("true"),
+    Ok("true")
+);
+undefined_test!(
+    access_call,
+    "{{ missing() }}",
+    Err(IMPOSSIBLE),
+    Err(IMPOSSIBLE),
+    Err(IMPOSSIBLE)
+);
+
+// printing
+undefined_test!(
+    print_variable,
+    "[{{ missing }}]",
+    Ok("[]"),
+    Err(UNDEFINED),
+    Err(UNDEFINED)
+);
+undefined_test!(
+    print_missing_attr,
+    "[{{ obj.missing }}]",
+    Ok("[]"),
+    Err(UNDEFINED),
+    Err(UNDEFINED)
+);
+undefined_test!(
+    print_missing_item,
+    "[{{ obj['missing'] }}]",
+    Ok("[]"),
+    Err(UNDEFINED),
+    Err(UNDEFINED)
+);
+undefined_test!(
+    print_concat,
+    "{{ missing ~ 'x' }}",
+    Ok("x"),
+    Err(UNDEFINED),
+    Err(UNDEFINED)
+);
+undefined_test!(
+    print_nested,
+    "{{ [missing] }}",
+    Ok("[Undefined]"),
+    Ok("[Undefined]"),
+    Ok("[Undefined]")
+);
+
+// boolean checks
+undefined_test!(
+    bool_if,
+    "{% if missing %}y{% else %}n{% endif %}",
+    Ok("n"),
+    Ok("n"),
+    Err(UNDEFINED)
+);
+undefined_test!(
+    bool_not,
+    "{{ not missing }}",
+    Ok("true"),
+    Ok("true"),
+    Err(UNDEFINED)
+);
+undefined_test!(
+    bool_if_expr,
+    "{{ 'y' if missing else 'n' }}",
+    Ok("n"),
+    Ok("n"),
+    Err(UNDEFINED)
+);
+undefined_test!(
+    bool_or,
+    "{{ missing or 'x' }}",
+    Ok("x"),
+    Ok("x"),
+    Err(UNDEFINED)
+);
+undefined_test!(
+    bool_loop_filter,
+    "{% for x in seq if missing %}{{ x }}{% endfor %}!",
+    Ok("!"),
+    Ok("!"),
+    Err(UNDEFINED)
+);
+
+// iteration
+undefined_test!(
+    iter_loop,
+    "{% for x in missing %}{{ x }}{% else %}empty{% endfor %}",
+    Ok("empty"),
+    Err(UNDEFINED),
+    Err(UNDEFINED)
+);
+undefined_test!(
+    iter_in,
+    "{{ 1 in missing }}",
+    Ok("false"),
+    Err(UNDEFINED),
+    Err(UNDEFINED)
+);
+
+// comparisons
+undefined_test!(
+    compare_eq,
+    "{{ missing == none }}|{{ missing != 1 }}",
+    Ok("false|true"),
+    Ok("false|true"),
+    Ok("false|true")
+);
+undefined_test!(
+    compare_in,
+    "{{ missing in [1] }}",
+    Ok("false"),
+    Ok("false"),
+    Ok("false")
+);
+undefined_test!(
+    compare_order,
+    "{{ missing < 1 }}",
+    Ok("false"),
+    Ok("false"),
+    Err(IMPOSSIBLE)
+);
+
+// math
+undefined_test!(
+    math_add,
+    "{{ missing + 1 }}",
+    Err(IMPOSSIBLE),
+    Err(IMPOSSIBLE),
+    Err(IMPOSSIBLE)
+);
+
+// filters
+undefined_test!(
+    filter_upper,
+    "[{{ missing|upper }}]",
+    Ok("[]"),
+    Err(UNDEFINED),
+    Err(UNDEFINED)
+);
+undefined_test!(
+    filter_length,
+    "{{ missing|length }}",
+    Ok("0"),
+    Ok("0"),
+    Err(UNDEFINED)
+);
+undefined_test!(
+    filter_length_in_if,
+    "{% if missing|length %}y{% else %}n{% endif %}",
+    Ok("n"),
+    Ok("n"),
+    Err(UNDEFINED)
+);
+undefined_test!(
+    filter_bool,
+    "{{ missing|bool }}",
+    Ok("false"),
+    Ok("false"),
+    Err(UNDEFINED)
+);
+undefined_test!(
+    filter_custom,
+    "{{ missing|or_else('x') }}|{{ 'y'|or_else('x') }}",
+    Ok("x|y"),
+    Ok("x|y"),
+    Ok("x|y")
+);
+undefined_test!(
+    filter_list,
+    "{{ missing|list }}",
+    Ok("[]"),
+    Err(UNDEFINED),
+    Err(UNDEFINED)
+);
+undefined_test!(
+    filter_first,
+    "{{ missing|first is undefined }}",
+    Ok("true"),
+    Err(UNDEFINED),
+    Err(UNDEFINED)
+);
+undefined_test!(
+    filter_default,
+    "{{ missing|default('x') }}|{{ missing|d('y') }}",
+    Ok("x|y"),
+    Ok("x|y"),
+    Ok("x|y")
+);
+undefined_test!(
+    filter_default_attr_chain,
+    "{{ missing.a['b']|default('x') }}",
+    Ok("x"),
+    Ok("x"),
+    Ok("x")
+);
+undefined_test!(
+    filter_undefined_argument,
+    "{{ 'x'|default(missing) }}",
+    Ok("x"),
+    Ok("x"),
+    Ok("x")
+);
+undefined_test!(
+    filter_map_attribute,
+    "{{ seq|map(attribute='missing')|list|length }}",
+    Ok("2"),
+    Ok("2"),
+    Ok("2")
+);
+
+// tests
+undefined_test!(
+    test_defined,
+    "{{ missing is defined }}|{{ missing is undefined }}",
+    Ok("false|true"),
+    Ok("false|true"),
+    Ok("false|true")
+);
+undefined_test!(
+    test_other,
+    "{{ missing is string }}|{{ missing is number }}",
+    Ok("false|false"),
+    Ok("false|false"),
+    Ok("false|false")
+);
+undefined_test!(
+    test_attr_chain,
+    "{{ missing.a.b is defined }}|{{ missing['a'] is undefined }}",
+    Ok("false|true"),
+    Ok("false|true"),
+    Ok("false|true")
+);
+
+// assignments
+undefined_test!(
+    assign_set,
+    "{% set x = missing %}{{ x is defined }}",
+    Ok("false"),
+    Ok("false"),
+    Ok("false")
+);
+undefined_test!(
+    assign_with,
+    "{% with x = missing %}{{ x is undefined }}{% endwith %}",
+    Ok("true"),
+    Ok("true"),
+    Ok("true")
+);